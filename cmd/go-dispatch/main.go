@@ -5,6 +5,7 @@ import (
 	"log/slog"
 	"os"
 	"os/signal"
+	"syscall"
 
 	"github.com/a-essam23/go-dispatch/internal/engine"
 	"github.com/a-essam23/go-dispatch/internal/server"
@@ -21,9 +22,33 @@ func main() {
 		logger.Error("Failed to load configuration", slog.Any("error", err))
 		os.Exit(1)
 	}
+	// SIGTERM (rolling deploys) and interrupts both drain connections before exiting.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// a sync webhook holds up the connection's reads, so it must give up well
+	// before the client misses a pong.
+	pongTimeout := cfg.Transport.PongTimeout
+	if pongTimeout <= 0 {
+		pongTimeout = cfg.Transport.PingInterval
+	}
+
 	eng.RegisterCore(&engine.RegisterCoreOptions{
-		JWTsecret: cfg.Server.Auth.JWTSecret,
+		JWTsecret:           cfg.Server.Auth.JWTSecret,
+		CompilePermissions:  config.CompilePermissions,
+		BroadcastPermission: cfg.Broadcast.Required,
+		BroadcastBatchSize:  cfg.Broadcast.BatchSize,
+		ReceiptRetention:    cfg.Receipts.Retention,
+		Webhooks:            cfg.WebhookEndpoints,
+		MaxSyncWebhookWait:  pongTimeout / 2,
+		Authorizers:         cfg.AuthorizerEndpoints,
+		Upstreams:           cfg.UpstreamEndpoints,
+		MaxJobsPerUser:      cfg.Scheduler.MaxJobsPerUser,
 	})
+	if err := eng.RegisterScripts(cfg.CompiledScripts); err != nil {
+		logger.Error("Failed to register scripts", slog.Any("error", err))
+		os.Exit(1)
+	}
 	err = config.CompilePipelines(cfg, eng)
 	if err != nil {
 		logger.Error("Failed to compile pipelines", slog.Any("error", err))
@@ -31,9 +56,6 @@ func main() {
 	}
 	logger.Info("Event pipelines compiled", "total_pipelines", len(cfg.Pipelines))
 
-	ctx, stop := signal.NotifyContext(context.Background())
-	defer stop()
-
 	app := server.NewApp(logger, ctx, cfg, eng)
 	if err := app.Run(); err != nil {
 		logger.Error("Application run failed", slog.Any("error", err))
@@ -5,8 +5,12 @@ import (
 	"errors"
 	"fmt"
 	"log/slog"
+	"strings"
 
 	"github.com/a-essam23/go-dispatch/pkg/pipeline"
+	"github.com/a-essam23/go-dispatch/pkg/state"
+	"github.com/a-essam23/go-dispatch/pkg/transport"
+	"github.com/google/uuid"
 )
 
 type NotifyOriginAction struct {
@@ -14,7 +18,11 @@ type NotifyOriginAction struct {
 	Payload   json.RawMessage
 }
 type ClientResponse struct {
-	Event   string          `json:"event"`
+	Event string `json:"event"`
+	// set on notifications whose receipts are tracked.
+	ID string `json:"id,omitempty"`
+	// the id of the client message this answers, on replies such as _proxy's.
+	ReplyTo string          `json:"replyTo,omitempty"`
 	Payload json.RawMessage `json:"payload"`
 }
 
@@ -25,69 +33,200 @@ func actionJoinRoom(pctx *pipeline.Cargo, params ...string) error {
 	}
 	userID := params[0]
 	roomID := params[1]
-	_, err := pctx.StateManager.Join(userID, roomID, nil)
+	_, err := pctx.StateManager.Join(userID, roomID, joinAuth(pctx, roomID))
 	if err != nil {
 		return fmt.Errorf("failed to join user '%s' to room '%s': %w", userID, roomID, err)
 	}
 	pctx.Logger.Info("User joined room", slog.Any("userID", userID), slog.Any("roomID", roomID))
 	return nil
 }
-func actionLeaveRoom(pctx *pipeline.Cargo, params ...string) error {
-	if len(params) != 2 {
-		return errors.New("_leave requires 2 parameters: [userid, roomid]")
-	}
-	userID := params[0]
-	roomID := params[1]
-	err := pctx.StateManager.Leave(userID, roomID)
-	if err != nil {
-		return fmt.Errorf("failed to leave user '%s' from room '%s': %w", userID, roomID, err)
+
+// a token validated by the secure modifier authorizes joining the room named
+// by its room_id claim.
+func joinAuth(pctx *pipeline.Cargo, roomID string) *state.JoinAuth {
+	if pctx.TokenClaims == nil {
+		return nil
 	}
-	pctx.Logger.Info("User left room", slog.Any("userID", userID), slog.Any("roomID", roomID))
-	return nil
+	claim, _ := pctx.TokenClaims["room_id"].(string)
+	return &state.JoinAuth{Token: claim == roomID}
+}
 
+func newLeaveRoomAction(typing *typingTracker) pipeline.ActionFunc {
+	return func(pctx *pipeline.Cargo, params ...string) error {
+		if len(params) != 2 {
+			return errors.New("_leave requires 2 parameters: [userid, roomid]")
+		}
+		userID := params[0]
+		roomID := params[1]
+		// while still a member, so the room hears the indicator stop.
+		typing.clear(pctx, userID, roomID)
+		err := pctx.StateManager.Leave(userID, roomID)
+		if err != nil {
+			return fmt.Errorf("failed to leave user '%s' from room '%s': %w", userID, roomID, err)
+		}
+		pctx.Logger.Info("User left room", slog.Any("userID", userID), slog.Any("roomID", roomID))
+		return nil
+	}
 }
 
 func actionLog(pctx *pipeline.Cargo, params ...string) error {
 	if len(params) != 1 {
 		return errors.New("_log requires exactly 1 parameter: [message]")
 	}
-	pctx.Logger.Info(params[0], slog.Any("component", "action_log"), slog.Any("userID", pctx.User.ID))
+	logger := pctx.Logger.With(slog.Any("component", "action_log"))
+	if pctx.User != nil {
+		logger = logger.With(slog.Any("userID", pctx.User.ID))
+	}
+	logger.Info(params[0])
 	return nil
 }
 
-func actionNotifyOrigin(pctx *pipeline.Cargo, params ...string) error {
-	if len(params) != 2 {
-		return errors.New("_notify_origin requires exactly 2 parameters: [eventName, payload]")
-	}
+func newNotifyOriginAction(throttle *notifyThrottle) pipeline.ActionFunc {
+	return func(pctx *pipeline.Cargo, params ...string) error {
+		if len(params) != 2 && len(params) != 3 {
+			return errors.New("_notify_origin requires 2 or 3 parameters: [eventName, payload, priority?]")
+		}
+		if pctx.User == nil {
+			return errors.New("_notify_origin requires a user")
+		}
+		priority, err := priorityParam(params)
+		if err != nil {
+			return fmt.Errorf("_notify_origin: %w", err)
+		}
 
-	eventName := params[0]
-	payload := params[1]
+		eventName := params[0]
+		payload := params[1]
 
-	userRoomID := "user:" + pctx.User.ID
-	return notifyRoom(pctx, userRoomID, eventName, payload)
+		userRoomID := "user:" + pctx.User.ID
+		return notifyRoom(throttle, pctx, userRoomID, eventName, payload, priority)
+	}
 }
 
-func actionNotifyRoom(pctx *pipeline.Cargo, params ...string) error {
-	if len(params) != 2 { // We only need eventName and payload now.
-		return errors.New("_notify_room requires 2 parameters: [eventName, payload]")
+func newNotifyRoomAction(throttle *notifyThrottle) pipeline.ActionFunc {
+	return func(pctx *pipeline.Cargo, params ...string) error {
+		if len(params) != 2 && len(params) != 3 {
+			return errors.New("_notify_room requires 2 or 3 parameters: [eventName, payload, priority?]")
+		}
+		priority, err := priorityParam(params)
+		if err != nil {
+			return fmt.Errorf("_notify_room: %w", err)
+		}
+		eventName := params[0]
+		payload := params[1]
+
+		return notifyRoom(throttle, pctx, pctx.TargetID, eventName, payload, priority)
 	}
-	eventName := params[0]
-	payload := params[1]
+}
+
+// params: [targets, eventName, payload, exclude?, priority?]. targets and
+// exclude are comma separated lists; see audience.addTarget and
+// audience.exclude for their entries. A connection reached by several targets
+// gets the message once.
+func newNotifyAction(throttle *notifyThrottle) pipeline.ActionFunc {
+	return func(pctx *pipeline.Cargo, params ...string) error {
+		if len(params) < 3 || len(params) > 5 {
+			return errors.New("_notify requires 3 to 5 parameters: [targets, eventName, payload, exclude?, priority?]")
+		}
+		targets := splitList(params[0])
+		var exclude []string
+		if len(params) > 3 {
+			exclude = splitList(params[3])
+			if err := validateExclusions(exclude); err != nil {
+				return fmt.Errorf("_notify: %w", err)
+			}
+		}
+		priority := transport.PriorityNormal
+		if len(params) > 4 {
+			var err error
+			if priority, err = transport.ParsePriority(params[4]); err != nil {
+				return fmt.Errorf("_notify: %w", err)
+			}
+		}
+		if len(targets) == 0 {
+			pctx.Logger.Debug("_notify has no targets")
+			return nil
+		}
 
-	return notifyRoom(pctx, pctx.TargetID, eventName, payload)
+		scope := strings.Join(targets, ",") + "\x00" + strings.Join(exclude, ",")
+		return notify(throttle, pctx, scope, params[1], params[2], priority, func() []transport.Conn {
+			a := newAudience()
+			a.exclude(pctx, exclude)
+			for _, target := range targets {
+				a.addTarget(pctx, target)
+			}
+			return a.conns
+		})
+	}
 }
 
-func notifyRoom(pctx *pipeline.Cargo, roomID, eventName, payload string) error {
-	response := ClientResponse{
-		Event:   eventName,
-		Payload: json.RawMessage(payload),
+// reads the optional outbound priority given as the third notify parameter.
+func priorityParam(params []string) (transport.Priority, error) {
+	if len(params) < 3 {
+		return transport.PriorityNormal, nil
 	}
+	return transport.ParsePriority(params[2])
+}
 
-	msgBytes, err := json.Marshal(response)
+func notifyRoom(throttle *notifyThrottle, pctx *pipeline.Cargo, roomID, eventName, payload string, priority transport.Priority) error {
+	return notify(throttle, pctx, roomID, eventName, payload, priority, func() []transport.Conn {
+		return targetAudience(pctx, roomID)
+	})
+}
+
+// notify builds the message and sends it to the connections resolve returns,
+// applying the pipeline's coalescing and receipt tracking. scope identifies
+// who resolve reaches, so that only messages to the same audience are
+// coalesced or throttled together.
+func notify(throttle *notifyThrottle, pctx *pipeline.Cargo, scope, eventName, payload string, priority transport.Priority, resolve func() []transport.Conn) error {
+	var messageID string
+	if pctx.Receipts != nil {
+		messageID = uuid.NewString()
+	}
+	msgBytes, err := json.Marshal(ClientResponse{Event: eventName, ID: messageID, Payload: json.RawMessage(payload)})
 	if err != nil {
 		return fmt.Errorf("failed to marshal notification: %w", err)
 	}
+	deliver := func(msg []byte, key string) error {
+		conns := resolve()
+		if err := sendAll(conns, msg, priority, key); err != nil {
+			return err
+		}
+		if messageID != "" {
+			trackReceipts(pctx, messageID, eventName, conns)
+		}
+		pctx.Logger.Debug("Notified", slog.String("scope", scope), slog.Int("connection_count", len(conns)))
+		return nil
+	}
+
+	c := pctx.Coalesce
+	if c == nil {
+		return deliver(msgBytes, "")
+	}
+	key := eventName + "\x00" + scope + "\x00" + c.Key
+	if c.Throttle <= 0 {
+		return deliver(msgBytes, key)
+	}
+	// a deferred flush runs after the pipeline has finished, so it resolves the
+	// audience afresh and can only log failures.
+	throttle.send(scope, eventName+"\x00"+c.Key, c.Throttle, func() {
+		if err := deliver(msgBytes, key); err != nil {
+			pctx.Logger.Error("Failed to flush throttled notification", slog.Any("scope", scope), slog.Any("error", err))
+		}
+	})
+	return nil
+}
 
+func marshalNotification(eventName, payload string) ([]byte, error) {
+	msg, err := json.Marshal(ClientResponse{Event: eventName, Payload: json.RawMessage(payload)})
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal notification: %w", err)
+	}
+	return msg, nil
+}
+
+// fanOut sends msg to every connection in the room. A non-empty key
+// coalesces it with undelivered messages of the same key.
+func fanOut(pctx *pipeline.Cargo, roomID string, msg []byte, priority transport.Priority, key string) error {
 	// Use our new helper to get the list of target connections.
 	targetConns, err := getConnectionsForRoom(pctx, roomID)
 	if err != nil {
@@ -97,11 +236,29 @@ func notifyRoom(pctx *pipeline.Cargo, roomID, eventName, payload string) error {
 		return nil
 	}
 
-	// Fan out the message to all resolved connections.
-	for _, conn := range targetConns {
-		conn.Send(msgBytes)
+	if err := sendAll(targetConns, msg, priority, key); err != nil {
+		return err
 	}
-
 	pctx.Logger.Debug("Notified room", slog.Any("roomID", roomID), slog.Any("connection_count", len(targetConns)))
 	return nil
 }
+
+// sendAll sends msg to every connection, encoding it once per wire format
+// rather than once per connection.
+func sendAll(conns []transport.Conn, msg []byte, priority transport.Priority, key string) error {
+	encoded := make(map[string][]byte)
+	for _, conn := range conns {
+		cd := conn.Codec()
+		wire, ok := encoded[cd.Name()]
+		if !ok {
+			var err error
+			wire, err = cd.Encode(msg)
+			if err != nil {
+				return fmt.Errorf("failed to encode notification as %s: %w", cd.Name(), err)
+			}
+			encoded[cd.Name()] = wire
+		}
+		conn.SendCoalesced(wire, priority, key)
+	}
+	return nil
+}
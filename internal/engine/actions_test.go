@@ -0,0 +1,117 @@
+package engine_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/a-essam23/go-dispatch/pkg/codec"
+	"github.com/a-essam23/go-dispatch/pkg/state"
+	"github.com/a-essam23/go-dispatch/pkg/transport"
+	"github.com/a-essam23/go-dispatch/pkg/transport/transporttest"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func TestNotifyRoomFansOutToEveryMemberConnection(t *testing.T) {
+	env := newTestEnv(t, nil)
+	env.target = "lobby"
+	alicePhone := env.connect("alice", 0)
+	aliceLaptop := env.connect("alice", 0)
+	aliceLaptop.SetCodec(codec.MessagePack)
+	env.joinAll("lobby", "alice", "bob")
+	env.connectAll("carol")
+
+	env.run("", "_notify_room", "greeting", `{"text":"hi"}`)
+
+	want := `{"event":"greeting","payload":{"text":"hi"}}`
+	for name, conn := range map[string]*transporttest.Conn{"alice phone": alicePhone, "bob": env.conns["bob"]} {
+		if sent := conn.Sent(); len(sent) != 1 || string(sent[0]) != want {
+			t.Errorf("%s: expected one %s, got %q", name, want, sent)
+		}
+	}
+
+	sent := aliceLaptop.Sent()
+	if len(sent) != 1 {
+		t.Fatalf("alice laptop: expected one message, got %d", len(sent))
+	}
+	decoded, err := codec.MessagePack.Decode(sent[0])
+	if err != nil {
+		t.Fatalf("alice laptop: message is not msgpack: %v", err)
+	}
+	if string(decoded) != want {
+		t.Errorf("alice laptop: expected %s, got %s", want, decoded)
+	}
+
+	if sent := env.conns["carol"].Sent(); len(sent) != 0 {
+		t.Errorf("non-member received %q", sent)
+	}
+}
+
+func TestNotifyOriginReachesOnlyTheUsersConnections(t *testing.T) {
+	env := newTestEnv(t, nil)
+	first := env.connect("alice", 0)
+	second := env.connect("alice", 0)
+	other := env.connect("bob", 0)
+
+	env.run("alice", "_notify_origin", "ack", `{}`)
+
+	if len(first.Sent()) != 1 || len(second.Sent()) != 1 {
+		t.Errorf("expected both of alice's connections to be notified")
+	}
+	if len(other.Sent()) != 0 {
+		t.Errorf("another user's connection was notified")
+	}
+}
+
+func TestLeaveStopsNotifications(t *testing.T) {
+	env := newTestEnv(t, nil)
+	env.target = "lobby"
+	env.joinAll("lobby", "alice", "bob")
+
+	env.run("", "_leave", "bob", "lobby")
+	env.run("", "_notify_room", "greeting", `{}`)
+
+	if len(env.conns["alice"].Sent()) != 1 {
+		t.Errorf("expected the remaining member to be notified")
+	}
+	if len(env.conns["bob"].Sent()) != 0 {
+		t.Errorf("a member who left was still notified")
+	}
+}
+
+func TestNotifyRoomTagsPriority(t *testing.T) {
+	env := newTestEnv(t, nil)
+	env.target = "lobby"
+	env.joinAll("lobby", "alice")
+
+	env.run("", "_notify_room", "typing", `{}`, "system")
+	env.run("", "_notify_room", "message", `{}`)
+
+	got := env.conns["alice"].Priorities()
+	if len(got) != 2 || got[0] != transport.PrioritySystem || got[1] != transport.PriorityNormal {
+		t.Errorf("unexpected priorities %v", got)
+	}
+
+	if err := env.action("_notify_room")(env.cargo(""), "message", `{}`, "urgent"); err == nil {
+		t.Error("expected an unknown priority to be rejected")
+	}
+}
+
+func TestJoinPresentsTheSecureToken(t *testing.T) {
+	env := newTestEnv(t, nil)
+	env.sm.SetRoomClasses([]state.RoomClass{{Name: "paid", Pattern: "paid:*", Join: state.JoinTokenRequired}})
+	env.connect("alice", 0)
+
+	join := env.action("_join")
+	cargo := env.cargo("alice")
+	if err := join(cargo, "alice", "paid:1"); !errors.Is(err, state.ErrJoinDenied) {
+		t.Errorf("expected a join without a token to be denied, got %v", err)
+	}
+	cargo.TokenClaims = jwt.MapClaims{"room_id": "paid:2"}
+	if err := join(cargo, "alice", "paid:1"); !errors.Is(err, state.ErrJoinDenied) {
+		t.Errorf("expected a token for another room to be denied, got %v", err)
+	}
+	cargo.TokenClaims = jwt.MapClaims{"room_id": "paid:1"}
+	if err := join(cargo, "alice", "paid:1"); err != nil {
+		t.Errorf("expected the token to authorize the join, got %v", err)
+	}
+}
@@ -0,0 +1,180 @@
+package engine
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/a-essam23/go-dispatch/pkg/pipeline"
+)
+
+// cached decisions kept before expired ones are swept.
+const maxAuthorizeCache = 10000
+
+// Authorizer is a backend endpoint the authorize modifier asks whether an event
+// may run.
+type Authorizer struct {
+	URL string
+	// signs requests when set, as for webhooks.
+	Secret  string
+	Timeout time.Duration
+	// how long a decision is cached under the modifier's cache key.
+	TTL time.Duration
+	// allow events when the endpoint cannot be reached, times out or answers
+	// 408, 429 or 5xx, rather than deny them. Other 4xx answers are denials.
+	FailOpen bool
+}
+
+type authorizeRequest struct {
+	UserID  string          `json:"userId"`
+	Event   string          `json:"event"`
+	Target  string          `json:"target"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+// the endpoint's answer, from a 2xx response, or a denial from a 4xx one.
+type authorizeDecision struct {
+	Allow  bool   `json:"allow"`
+	Reason string `json:"reason,omitempty"`
+}
+
+type cachedDecision struct {
+	authorizeDecision
+	expires time.Time
+}
+
+type authorizeClient struct {
+	authorizers map[string]Authorizer
+	http        *http.Client
+
+	mu    sync.Mutex
+	cache map[string]cachedDecision // keyed by authorizer and cache key
+}
+
+func newAuthorizeClient(authorizers map[string]Authorizer) *authorizeClient {
+	return &authorizeClient{authorizers: authorizers, http: &http.Client{}, cache: make(map[string]cachedDecision)}
+}
+
+func (c *authorizeClient) cached(key string, now time.Time) (authorizeDecision, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	d, ok := c.cache[key]
+	if !ok || now.After(d.expires) {
+		return authorizeDecision{}, false
+	}
+	return d.authorizeDecision, true
+}
+
+func (c *authorizeClient) store(key string, d authorizeDecision, expires time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.cache) >= maxAuthorizeCache {
+		now := time.Now()
+		for k, cd := range c.cache {
+			if now.After(cd.expires) {
+				delete(c.cache, k)
+			}
+		}
+		if len(c.cache) >= maxAuthorizeCache {
+			clear(c.cache)
+		}
+	}
+	c.cache[key] = cachedDecision{authorizeDecision: d, expires: expires}
+}
+
+func (c *authorizeClient) ask(ctx context.Context, a Authorizer, pctx *pipeline.Cargo) (authorizeDecision, error) {
+	body, _ := json.Marshal(authorizeRequest{UserID: pctx.User.ID, Event: pctx.EventName, Target: pctx.TargetID, Payload: pctx.Payload})
+	ctx, cancel := context.WithTimeout(ctx, a.Timeout)
+	defer cancel()
+	req, err := newSignedRequest(ctx, http.MethodPost, a.URL, a.Secret, pctx.EventName, body)
+	if err != nil {
+		return authorizeDecision{}, err
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return authorizeDecision{}, err
+	}
+	defer resp.Body.Close()
+	var d authorizeDecision
+	switch status := resp.StatusCode; {
+	case status >= 200 && status <= 299:
+		if err := json.NewDecoder(io.LimitReader(resp.Body, maxWebhookResponse)).Decode(&d); err != nil {
+			return authorizeDecision{}, fmt.Errorf("invalid response: %w", err)
+		}
+		return d, nil
+	case status >= 400 && status <= 499 && status != http.StatusRequestTimeout && status != http.StatusTooManyRequests:
+		// the endpoint refused the request, such as with 401 or 403: a denial,
+		// which failing open must not turn into an allow. A JSON body may
+		// still give the reason.
+		json.NewDecoder(io.LimitReader(resp.Body, maxWebhookResponse)).Decode(&d)
+		d.Allow = false
+		if d.Reason == "" {
+			d.Reason = fmt.Sprintf("authorizer answered %d", status)
+		}
+		return d, nil
+	default:
+		return authorizeDecision{}, fmt.Errorf("endpoint returned %d", status)
+	}
+}
+
+// params: [authorizer, cacheKey?]. Asks the named authorizer whether the user
+// may run the event, posting {userId, event, target, payload}, and halts the
+// pipeline unless it answers {"allow": true}. With a cache key, typically
+// templated such as "{$user.id}:{$target.id}", the decision is reused for the
+// authorizer's TTL. A 4xx answer other than 408 or 429 denies the event. When
+// the authorizer fails, the event is denied unless it fails open.
+func newAuthorizeModifier(c *authorizeClient) pipeline.ModifierFunc {
+	return func(pctx *pipeline.Cargo, params ...string) error {
+		if len(params) != 1 && len(params) != 2 {
+			return errors.New("'authorize' modifier requires 1 or 2 parameters: [authorizer, cacheKey?]")
+		}
+		if pctx.User == nil {
+			return errors.New("'authorize' modifier requires a user")
+		}
+		a, ok := c.authorizers[params[0]]
+		if !ok {
+			return fmt.Errorf("'authorize' modifier: unknown authorizer '%s'", params[0])
+		}
+		cacheKey := ""
+		if len(params) == 2 && params[1] != "" && a.TTL > 0 {
+			cacheKey = params[0] + "\x00" + params[1]
+		}
+
+		d, hit := authorizeDecision{}, false
+		if cacheKey != "" {
+			d, hit = c.cached(cacheKey, time.Now())
+		}
+		if !hit {
+			ctx := pctx.Ctx
+			if ctx == nil {
+				ctx = context.Background()
+			}
+			var err error
+			if d, err = c.ask(ctx, a, pctx); err != nil {
+				if a.FailOpen {
+					pctx.Logger.Warn("Authorizer failed, allowing event", slog.String("authorizer", params[0]), slog.Any("error", err))
+					return nil
+				}
+				return fmt.Errorf("authorizer '%s' failed: %w", params[0], err)
+			}
+			if cacheKey != "" {
+				c.store(cacheKey, d, time.Now().Add(a.TTL))
+			}
+		}
+
+		if !d.Allow {
+			if d.Reason != "" {
+				return fmt.Errorf("authorization denied: %s", d.Reason)
+			}
+			return errors.New("authorization denied")
+		}
+		pctx.Logger.Debug("Authorize modifier check passed", slog.String("authorizer", params[0]), slog.Bool("cached", hit))
+		return nil
+	}
+}
@@ -0,0 +1,196 @@
+package engine_test
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/a-essam23/go-dispatch/internal/engine"
+	"github.com/a-essam23/go-dispatch/pkg/pipeline"
+	"github.com/a-essam23/go-dispatch/pkg/state"
+)
+
+// starts a backend allowing alice and denying everyone else with a reason,
+// and returns its URL and a count of the requests it got.
+func newAuthorizeBackend(t *testing.T) (string, *atomic.Int32) {
+	t.Helper()
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		var req struct {
+			UserID string `json:"userId"`
+			Target string `json:"target"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		if req.UserID == "alice" {
+			io.WriteString(w, `{"allow":true}`)
+			return
+		}
+		io.WriteString(w, `{"allow":false,"reason":"muted in `+req.Target+`"}`)
+	}))
+	t.Cleanup(srv.Close)
+	return srv.URL, &calls
+}
+
+// starts a backend answering every request with status and body.
+func newAuthorizeAnswer(t *testing.T, status int, body string) string {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+		io.WriteString(w, body)
+	}))
+	t.Cleanup(srv.Close)
+	return srv.URL
+}
+
+// returns the authorize modifier asking the given authorizers and a func making
+// cargos acting as a user.
+func newAuthorize(t *testing.T, authorizers map[string]engine.Authorizer) (pipeline.ModifierFunc, func(userID string) *pipeline.Cargo) {
+	t.Helper()
+	env := newTestEnv(t, &engine.RegisterCoreOptions{Authorizers: authorizers})
+	env.target = "lobby"
+	return env.modifier("authorize"), func(userID string) *pipeline.Cargo {
+		cargo := env.cargo(userID)
+		cargo.EventName = "send_message"
+		if userID != "" {
+			// decisions are the backend's, so users need not be connected.
+			cargo.User = &state.User{ID: userID}
+		}
+		return cargo
+	}
+}
+
+func TestAuthorizeAllowsAndDeniesWithTheReason(t *testing.T) {
+	url, _ := newAuthorizeBackend(t)
+	authorize, cargoFor := newAuthorize(t, map[string]engine.Authorizer{"backend": {URL: url, Timeout: time.Second}})
+
+	if err := authorize(cargoFor("alice"), "backend"); err != nil {
+		t.Errorf("expected alice to be allowed, got %v", err)
+	}
+	if err := authorize(cargoFor("bob"), "backend"); err == nil || !strings.Contains(err.Error(), "muted in lobby") {
+		t.Errorf("expected bob to be denied with the reason, got %v", err)
+	}
+}
+
+func TestAuthorizeCachesDecisionsUnderTheKey(t *testing.T) {
+	url, calls := newAuthorizeBackend(t)
+	authorize, cargoFor := newAuthorize(t, map[string]engine.Authorizer{
+		"backend":  {URL: url, Timeout: time.Second, TTL: time.Minute},
+		"no-cache": {URL: url, Timeout: time.Second},
+	})
+
+	for range 2 {
+		if err := authorize(cargoFor("alice"), "backend", "alice:lobby"); err != nil {
+			t.Fatalf("expected alice to be allowed, got %v", err)
+		}
+	}
+	if n := calls.Load(); n != 1 {
+		t.Errorf("expected the cached decision to be reused, got %d calls", n)
+	}
+	// the key, not the user, names the decision.
+	if err := authorize(cargoFor("bob"), "backend", "alice:lobby"); err != nil {
+		t.Errorf("expected the decision cached under the key, got %v", err)
+	}
+
+	calls.Store(0)
+	authorize(cargoFor("alice"), "backend")
+	authorize(cargoFor("alice"), "backend")
+	authorize(cargoFor("alice"), "no-cache", "alice:lobby")
+	authorize(cargoFor("alice"), "no-cache", "alice:lobby")
+	if n := calls.Load(); n != 4 {
+		t.Errorf("expected no caching without a key or a TTL, got %d calls for 4", n)
+	}
+}
+
+func TestAuthorizeCachedDecisionsExpire(t *testing.T) {
+	url, calls := newAuthorizeBackend(t)
+	authorize, cargoFor := newAuthorize(t, map[string]engine.Authorizer{"backend": {URL: url, Timeout: time.Second, TTL: 20 * time.Millisecond}})
+
+	authorize(cargoFor("alice"), "backend", "alice:lobby")
+	authorize(cargoFor("alice"), "backend", "alice:lobby")
+	time.Sleep(40 * time.Millisecond)
+	authorize(cargoFor("alice"), "backend", "alice:lobby")
+	if n := calls.Load(); n != 2 {
+		t.Errorf("expected the endpoint to be asked again once the decision expired, got %d calls", n)
+	}
+}
+
+func TestAuthorizeTreatsClientErrorsAsDenials(t *testing.T) {
+	tests := []struct {
+		name       string
+		status     int
+		body       string
+		wantReason string
+	}{
+		{"unauthorized", http.StatusUnauthorized, "", "answered 401"},
+		{"forbidden", http.StatusForbidden, `{"reason":"banned"}`, "banned"},
+		{"not found", http.StatusNotFound, "not json", "answered 404"},
+	}
+	for _, tt := range tests {
+		authorize, cargoFor := newAuthorize(t, map[string]engine.Authorizer{"open": {URL: newAuthorizeAnswer(t, tt.status, tt.body), Timeout: time.Second, FailOpen: true}})
+		if err := authorize(cargoFor("alice"), "open"); err == nil || !strings.Contains(err.Error(), tt.wantReason) {
+			t.Errorf("%s: expected a denial with %q even when failing open, got %v", tt.name, tt.wantReason, err)
+		}
+	}
+}
+
+func TestAuthorizeFailsClosedUnlessFailingOpen(t *testing.T) {
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(100 * time.Millisecond)
+	}))
+	defer slow.Close()
+	gone := httptest.NewServer(http.NotFoundHandler())
+	gone.Close()
+
+	tests := []struct {
+		name string
+		url  string
+	}{
+		{"server error", newAuthorizeAnswer(t, http.StatusBadGateway, "")},
+		{"rate limited", newAuthorizeAnswer(t, http.StatusTooManyRequests, "")},
+		{"invalid decision", newAuthorizeAnswer(t, http.StatusOK, "allow")},
+		{"timeout", slow.URL},
+		{"unreachable", gone.URL},
+	}
+	for _, tt := range tests {
+		authorize, cargoFor := newAuthorize(t, map[string]engine.Authorizer{
+			"closed": {URL: tt.url, Timeout: 20 * time.Millisecond},
+			"open":   {URL: tt.url, Timeout: 20 * time.Millisecond, FailOpen: true},
+		})
+		if err := authorize(cargoFor("alice"), "closed"); err == nil {
+			t.Errorf("%s: expected a failing authorizer to deny by default", tt.name)
+		}
+		if err := authorize(cargoFor("alice"), "open"); err != nil {
+			t.Errorf("%s: expected a failing authorizer to allow when it fails open, got %v", tt.name, err)
+		}
+	}
+}
+
+func TestAuthorizeRejectsBadParams(t *testing.T) {
+	url, calls := newAuthorizeBackend(t)
+	authorize, cargoFor := newAuthorize(t, map[string]engine.Authorizer{"backend": {URL: url, Timeout: time.Second}})
+
+	tests := []struct {
+		name   string
+		cargo  *pipeline.Cargo
+		params []string
+	}{
+		{"no authorizer", cargoFor("alice"), nil},
+		{"too many params", cargoFor("alice"), []string{"backend", "key", "x"}},
+		{"unknown authorizer", cargoFor("alice"), []string{"channels"}},
+		{"no user", cargoFor(""), []string{"backend"}},
+	}
+	for _, tt := range tests {
+		if err := authorize(tt.cargo, tt.params...); err == nil {
+			t.Errorf("%s: expected an error", tt.name)
+		}
+	}
+	if n := calls.Load(); n != 0 {
+		t.Errorf("a rejected check asked the endpoint %d times", n)
+	}
+}
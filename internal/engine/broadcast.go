@@ -0,0 +1,144 @@
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"github.com/a-essam23/go-dispatch/pkg/pipeline"
+	"github.com/a-essam23/go-dispatch/pkg/state"
+	"github.com/a-essam23/go-dispatch/pkg/transport"
+)
+
+const defaultBroadcastBatchSize = 256
+
+// broadcast filter prefixes; a user must match every filter given.
+const (
+	permFilterPrefix = "perm:" // users holding a global permission
+	roomFilterPrefix = "room:" // members of any room matching an ID or pattern
+)
+
+// broadcastFilter decides which connected users a broadcast reaches.
+type broadcastFilter struct {
+	perms   state.Permission
+	members map[string]bool // nil when not filtering by room
+}
+
+func (f *broadcastFilter) matches(u *state.ConnectedUser) bool {
+	if !u.GlobalPermissions.Has(f.perms) {
+		return false
+	}
+	return f.members == nil || f.members[u.ID]
+}
+
+// parseBroadcastFilter compiles a comma separated list of filters. Room
+// filters are resolved to their members once, up front.
+func parseBroadcastFilter(pctx *pipeline.Cargo, compile PermissionCompiler, param string) (*broadcastFilter, error) {
+	f := &broadcastFilter{}
+	for _, item := range splitList(param) {
+		switch {
+		case strings.HasPrefix(item, permFilterPrefix):
+			if compile == nil {
+				return nil, errors.New("permission filters are not available")
+			}
+			perm, err := compile([]string{strings.TrimPrefix(item, permFilterPrefix)})
+			if err != nil {
+				return nil, err
+			}
+			f.perms |= perm
+		case strings.HasPrefix(item, roomFilterPrefix):
+			pattern := strings.TrimPrefix(item, roomFilterPrefix)
+			if err := state.ValidateRoomPattern(pattern); err != nil {
+				return nil, err
+			}
+			members := make(map[string]bool)
+			for _, roomID := range pctx.StateManager.MatchRooms(pattern) {
+				users, _ := pctx.StateManager.GetRoomMembers(roomID)
+				for _, u := range users {
+					members[u.ID] = true
+				}
+			}
+			if f.members != nil {
+				// every room filter must hold.
+				for id := range f.members {
+					if !members[id] {
+						delete(f.members, id)
+					}
+				}
+			} else {
+				f.members = members
+			}
+		default:
+			return nil, fmt.Errorf("unknown filter '%s' (want perm:<name> or room:<pattern>)", item)
+		}
+	}
+	return f, nil
+}
+
+// params: [eventName, payload, filter?, priority?]. Sends to every connected
+// user, or those matching filter, batchSize users at a time. The triggering
+// user must hold the required global permission; only the server itself, a
+// system pipeline run without a user, may always broadcast.
+func newBroadcastAction(required state.Permission, batchSize int, compile PermissionCompiler) pipeline.ActionFunc {
+	if required == 0 {
+		required = state.PermBroadcast
+	}
+	if batchSize <= 0 {
+		batchSize = defaultBroadcastBatchSize
+	}
+	return func(pctx *pipeline.Cargo, params ...string) error {
+		if len(params) < 2 || len(params) > 4 {
+			return errors.New("_broadcast requires 2 to 4 parameters: [eventName, payload, filter?, priority?]")
+		}
+		if !isSystemCall(pctx) {
+			if pctx.User == nil {
+				return errors.New("_broadcast requires a user or a system event")
+			}
+			if !pctx.User.GlobalPermissions.Has(required) {
+				return fmt.Errorf("_broadcast: user '%s' lacks the broadcast permission", pctx.User.ID)
+			}
+		}
+		filter := &broadcastFilter{}
+		if len(params) > 2 {
+			var err error
+			if filter, err = parseBroadcastFilter(pctx, compile, params[2]); err != nil {
+				return fmt.Errorf("_broadcast: %w", err)
+			}
+		}
+		priority := transport.PriorityNormal
+		if len(params) > 3 {
+			var err error
+			if priority, err = transport.ParsePriority(params[3]); err != nil {
+				return fmt.Errorf("_broadcast: %w", err)
+			}
+		}
+		msg, err := marshalNotification(params[0], params[1])
+		if err != nil {
+			return err
+		}
+
+		var users, sent int
+		var sendErr error
+		var conns []transport.Conn
+		pctx.StateManager.ForEachConnectedUser(batchSize, func(batch []state.ConnectedUser) {
+			if sendErr != nil {
+				return
+			}
+			conns = conns[:0]
+			for i := range batch {
+				if filter.matches(&batch[i]) {
+					users++
+					conns = append(conns, batch[i].Conns...)
+				}
+			}
+			sendErr = sendAll(conns, msg, priority, "")
+			sent += len(conns)
+		})
+		if sendErr != nil {
+			return sendErr
+		}
+		pctx.Logger.Info("Broadcast sent", slog.String("event", params[0]), slog.Int("users", users), slog.Int("connection_count", sent))
+		return nil
+	}
+}
@@ -0,0 +1,153 @@
+package engine_test
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/a-essam23/go-dispatch/internal/engine"
+	"github.com/a-essam23/go-dispatch/pkg/state"
+	"github.com/a-essam23/go-dispatch/pkg/transport"
+	"github.com/a-essam23/go-dispatch/pkg/transport/transporttest"
+)
+
+const permVIP state.Permission = 1 << 5
+
+// a small batch, so broadcasts to a handful of connections span batches.
+var broadcastOptions = engine.RegisterCoreOptions{
+	BroadcastBatchSize: 2,
+	CompilePermissions: knownPermissions(map[string]state.Permission{"vip": permVIP}),
+}
+
+// returns how many messages each connection was sent, resetting them.
+func sentCounts(conns []*transporttest.Conn) []int {
+	got := make([]int, len(conns))
+	for i, c := range conns {
+		got[i] = len(c.Sent())
+		c.Reset()
+	}
+	return got
+}
+
+func TestBroadcastReachesEveryConnectionAcrossBatches(t *testing.T) {
+	env := newTestEnv(t, &broadcastOptions)
+	conns := []*transporttest.Conn{
+		env.connect("admin", state.PermBroadcast),
+		env.connect("alice", permVIP),
+		env.connect("alice", permVIP),
+		env.connect("bob", 0),
+		env.connect("carol", permVIP),
+	}
+	env.join("org:1/lobby", "alice")
+	env.join("org:1/dev", "bob")
+
+	env.run("admin", "_broadcast", "banner", `{"text":"maintenance at noon"}`, "", "system")
+	want := `{"event":"banner","payload":{"text":"maintenance at noon"}}`
+	for i, conn := range conns {
+		sent, priorities := conn.Sent(), conn.Priorities()
+		if len(sent) != 1 || string(sent[0]) != want {
+			t.Errorf("connection %d: expected one %s, got %q", i, want, sent)
+		} else if priorities[0] != transport.PrioritySystem {
+			t.Errorf("connection %d: sent at priority %v, want system", i, priorities[0])
+		}
+	}
+}
+
+func TestBroadcastAppliesFilters(t *testing.T) {
+	tests := []struct {
+		filter string
+		want   []int
+	}{
+		{"perm:vip", []int{0, 1, 1, 0, 1}},
+		{"room:org:1/**", []int{0, 1, 1, 1, 0}},
+		{"room:org:1/lobby", []int{0, 1, 1, 0, 0}},
+		{"perm:vip,room:org:1/**", []int{0, 1, 1, 0, 0}},
+		{"room:org:1/lobby,room:org:1/dev", []int{0, 0, 0, 0, 0}},
+		{"room:org:2/**", []int{0, 0, 0, 0, 0}},
+	}
+	for _, tt := range tests {
+		env := newTestEnv(t, &broadcastOptions)
+		conns := []*transporttest.Conn{
+			env.connect("admin", state.PermBroadcast),
+			env.connect("alice", permVIP),
+			env.connect("alice", permVIP),
+			env.connect("bob", 0),
+			env.connect("carol", permVIP),
+		}
+		env.join("org:1/lobby", "alice")
+		env.join("org:1/dev", "bob")
+		env.run("admin", "_broadcast", "banner", `{}`, tt.filter)
+		if got := sentCounts(conns); !slices.Equal(got, tt.want) {
+			t.Errorf("%s: deliveries = %v, want %v", tt.filter, got, tt.want)
+		}
+	}
+}
+
+func TestBroadcastRequiresThePermission(t *testing.T) {
+	env := newTestEnv(t, &broadcastOptions)
+	conns := []*transporttest.Conn{
+		env.connect("admin", state.PermBroadcast),
+		env.connect("alice", permVIP),
+		env.connect("alice", permVIP),
+		env.connect("bob", 0),
+		env.connect("carol", permVIP),
+	}
+	env.join("org:1/lobby", "alice")
+	env.join("org:1/dev", "bob")
+	broadcast := env.action("_broadcast")
+
+	if err := broadcast(env.cargo("bob"), "banner", `{}`); err == nil {
+		t.Error("a user without the broadcast permission broadcast")
+	}
+	if err := broadcast(env.cargo("alice"), "banner", `{}`, "perm:vip"); err == nil {
+		t.Error("holding the filtered permission let alice broadcast")
+	}
+	if got, want := sentCounts(conns), []int{0, 0, 0, 0, 0}; !slices.Equal(got, want) {
+		t.Errorf("a denied broadcast was sent: %v", got)
+	}
+
+	// another required permission replaces the built-in one.
+	custom := engine.New(env.logger)
+	custom.RegisterCore(&engine.RegisterCoreOptions{BroadcastPermission: permVIP})
+	broadcast, _ = custom.GetActionFunc("_broadcast")
+	if err := broadcast(env.cargo("admin"), "banner", `{}`); err == nil {
+		t.Error("the built-in permission was accepted in place of the configured one")
+	}
+	if err := broadcast(env.cargo("carol"), "banner", `{}`); err != nil {
+		t.Errorf("the configured permission was refused: %v", err)
+	}
+}
+
+func TestBroadcastRejectsBadParams(t *testing.T) {
+	env := newTestEnv(t, &broadcastOptions)
+	conns := []*transporttest.Conn{
+		env.connect("admin", state.PermBroadcast),
+		env.connect("alice", permVIP),
+		env.connect("alice", permVIP),
+		env.connect("bob", 0),
+		env.connect("carol", permVIP),
+	}
+	env.join("org:1/lobby", "alice")
+	env.join("org:1/dev", "bob")
+	broadcast := env.action("_broadcast")
+
+	tests := []struct {
+		name   string
+		params []string
+	}{
+		{"too few params", []string{"banner"}},
+		{"too many params", []string{"banner", `{}`, "", "normal", "x"}},
+		{"unknown filter", []string{"banner", `{}`, "everyone"}},
+		{"unknown permission", []string{"banner", `{}`, "perm:unknown"}},
+		{"malformed pattern", []string{"banner", `{}`, "room:org:1/**x"}},
+		{"unknown priority", []string{"banner", `{}`, "", "urgent"}},
+		{"invalid payload", []string{"banner", `{`}},
+	}
+	for _, tt := range tests {
+		if err := broadcast(env.cargo("admin"), tt.params...); err == nil {
+			t.Errorf("%s: expected an error", tt.name)
+		}
+	}
+	if got, want := sentCounts(conns), []int{0, 0, 0, 0, 0}; !slices.Equal(got, want) {
+		t.Errorf("a rejected broadcast was sent: %v", got)
+	}
+}
@@ -0,0 +1,89 @@
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/a-essam23/go-dispatch/pkg/pipeline"
+)
+
+const coalesceModifier = "coalesce"
+
+// the coalesce modifier marks every notification of the pipeline as
+// latest-value-only: params are [key] or [key, throttle interval].
+func newCoalesceModifier() pipeline.ModifierFunc {
+	return func(pctx *pipeline.Cargo, params ...string) error {
+		if len(params) != 1 && len(params) != 2 {
+			return errors.New("'coalesce' modifier requires 1 or 2 parameters: [key, throttle?]")
+		}
+		if params[0] == "" {
+			return errors.New("'coalesce' key cannot be empty")
+		}
+		c := &pipeline.Coalescing{Key: params[0]}
+		if len(params) == 2 {
+			throttle, err := time.ParseDuration(params[1])
+			if err != nil || throttle < 0 {
+				return fmt.Errorf("invalid coalesce throttle: %s", params[1])
+			}
+			c.Throttle = throttle
+		}
+		pctx.Coalesce = c
+		return nil
+	}
+}
+
+// throttleWindow is an open throttle interval of one key in one scope.
+type throttleWindow struct {
+	timer   *time.Timer
+	pending func() // latest deferred flush, nil if none
+}
+
+// notifyThrottle flushes a coalesced key to a scope, a room or user, at most
+// once per interval. The first value goes out at once; later values wait for
+// the interval to end and only the latest of them is flushed. A window closes
+// after an interval in which nothing arrived.
+type notifyThrottle struct {
+	mu      sync.Mutex
+	windows map[string]*throttleWindow // keyed by scope and key
+}
+
+func newNotifyThrottle() *notifyThrottle {
+	return &notifyThrottle{windows: make(map[string]*throttleWindow)}
+}
+
+func (t *notifyThrottle) send(scope, key string, interval time.Duration, flush func()) {
+	id := scope + "\x00" + key
+	t.mu.Lock()
+	if window, found := t.windows[id]; found {
+		window.pending = flush
+		t.mu.Unlock()
+		return
+	}
+	window := &throttleWindow{}
+	// the timer cannot run before window.timer is set: it needs t.mu first.
+	window.timer = time.AfterFunc(interval, func() { t.tick(id, window, interval) })
+	t.windows[id] = window
+	t.mu.Unlock()
+
+	flush()
+}
+
+// tick ends an interval of window, flushing its latest value into a new one
+// or closing it when nothing arrived.
+func (t *notifyThrottle) tick(id string, window *throttleWindow, interval time.Duration) {
+	t.mu.Lock()
+	pending := window.pending
+	window.pending = nil
+	if pending == nil {
+		delete(t.windows, id)
+	} else {
+		window.timer.Reset(interval)
+	}
+	t.mu.Unlock()
+
+	if pending != nil {
+		pending()
+	}
+}
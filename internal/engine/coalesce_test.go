@@ -0,0 +1,118 @@
+package engine_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/a-essam23/go-dispatch/pkg/pipeline"
+)
+
+// returns a cargo from the server coalescing its notifications under key,
+// given with the rest of the modifier's params.
+func coalescedCargo(env *testEnv, params ...string) *pipeline.Cargo {
+	env.t.Helper()
+	cargo := env.cargo("")
+	if err := env.modifier("coalesce")(cargo, params...); err != nil {
+		env.t.Fatalf("coalesce failed: %v", err)
+	}
+	return cargo
+}
+
+// notifies the cargo's room of a cursor at x.
+func notifyCursor(env *testEnv, cargo *pipeline.Cargo, x string) {
+	env.t.Helper()
+	runAction(env.t, env.reg, cargo, "_notify_room", "cursor", `{"x":`+x+`}`)
+}
+
+func TestCoalesceRejectsBadParams(t *testing.T) {
+	coalesce := newTestEnv(t, nil).modifier("coalesce")
+	for name, params := range map[string][]string{
+		"no key":            {},
+		"empty key":         {""},
+		"invalid throttle":  {"k", "not-a-duration"},
+		"negative throttle": {"k", "-1s"},
+		"extra params":      {"k", "1s", "x"},
+	} {
+		if err := coalesce(&pipeline.Cargo{}, params...); err == nil {
+			t.Errorf("%s: expected %q to be rejected", name, params)
+		}
+	}
+}
+
+func TestCoalesceWithoutThrottleTagsEveryValue(t *testing.T) {
+	env := newTestEnv(t, nil)
+	env.target = "board"
+	env.joinAll("board", "alice")
+	alice := env.conns["alice"]
+	cargo := coalescedCargo(env, "alice")
+	notifyCursor(env, cargo, "1")
+	notifyCursor(env, cargo, "2")
+
+	if sent := alice.Sent(); len(sent) != 2 {
+		t.Fatalf("expected every value to be queued, got %q", sent)
+	}
+	if keys := alice.Keys(); keys[0] == "" || keys[0] != keys[1] {
+		t.Errorf("expected both values to share a coalescing key, got %q", keys)
+	}
+}
+
+func TestCoalesceThrottleFlushesTheLatestValue(t *testing.T) {
+	env := newTestEnv(t, nil)
+	env.target = "board"
+	env.joinAll("board", "alice")
+	alice := env.conns["alice"]
+	cargo := coalescedCargo(env, "alice", "40ms")
+	for _, x := range []string{"1", "2", "3"} {
+		notifyCursor(env, cargo, x)
+	}
+	if sent := alice.Sent(); len(sent) != 1 || string(sent[0]) != `{"event":"cursor","payload":{"x":1}}` {
+		t.Fatalf("expected only the first value before the interval ends, got %q", sent)
+	}
+
+	sent := waitForSent(t, alice, 2)
+	if len(sent) != 2 || string(sent[1]) != `{"event":"cursor","payload":{"x":3}}` {
+		t.Fatalf("expected the latest value to be flushed after the interval, got %q", sent)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if n := len(alice.Sent()); n != 2 {
+		t.Errorf("expected nothing more once the window is idle, got %d messages", n)
+	}
+}
+
+func TestCoalesceThrottleReopensAfterAnIdleInterval(t *testing.T) {
+	env := newTestEnv(t, nil)
+	env.target = "board"
+	env.joinAll("board", "alice")
+	alice := env.conns["alice"]
+	cargo := coalescedCargo(env, "alice", "20ms")
+	notifyCursor(env, cargo, "1")
+	// an interval passes with nothing to flush, closing the window.
+	time.Sleep(60 * time.Millisecond)
+	notifyCursor(env, cargo, "2")
+
+	if sent := alice.Sent(); len(sent) != 2 || string(sent[1]) != `{"event":"cursor","payload":{"x":2}}` {
+		t.Errorf("expected a value after an idle interval to go out at once, got %q", sent)
+	}
+}
+
+func TestCoalesceThrottlesEachRoomSeparately(t *testing.T) {
+	env := newTestEnv(t, nil)
+	env.target = "board"
+	env.joinAll("board", "alice")
+	alice := env.conns["alice"]
+	cargo := coalescedCargo(env, "alice", "1h")
+	if _, err := env.sm.Join("alice", "wall", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	notifyCursor(env, cargo, "1")
+	cargo.TargetID = "wall"
+	notifyCursor(env, cargo, "2")
+	cargo.TargetID = "board"
+	notifyCursor(env, cargo, "3")
+
+	sent := alice.Sent()
+	if len(sent) != 2 || string(sent[1]) != `{"event":"cursor","payload":{"x":2}}` {
+		t.Errorf("expected the first value of each room at once and the rest held, got %q", sent)
+	}
+}
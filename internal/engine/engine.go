@@ -1,10 +1,14 @@
 package engine
 
 import (
+	"context"
 	"log/slog"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/a-essam23/go-dispatch/pkg/pipeline"
+	"github.com/a-essam23/go-dispatch/pkg/state"
 )
 
 /*
@@ -19,42 +23,119 @@ type Registry struct {
 	modifiers  map[string]pipeline.ModifierFunc
 	modifierMu sync.RWMutex
 
-	params   map[string]ResolverFunc
-	paramsMu sync.RWMutex
+	params map[string]ResolverFunc
+	// resolvers of params named by a prefix and a path, e.g. "webhook.id".
+	paramPrefixes map[string]func(path string) ResolverFunc
+	paramsMu      sync.RWMutex
+
+	// actions, modifiers and params that cannot run without a user, keyed by
+	// kind and name; see requireUser.
+	needsUser map[string]bool
+	// how values resolved into params of actions are encoded, by action and
+	// index; see encodeParam.
+	encodings map[string]map[int]pipeline.Encoding
+
+	throttle  *notifyThrottle
+	typing    *typingTracker
+	scheduler *Scheduler
+	webhooks  *webhookClient
 }
 type RegisterCoreOptions struct {
 	JWTsecret string
+	// resolves permission names given to actions such as _invite.
+	CompilePermissions PermissionCompiler
+	// the global permission _broadcast requires; state.PermBroadcast if zero.
+	BroadcastPermission state.Permission
+	// users _broadcast sends to per batch; 256 if zero.
+	BroadcastBatchSize int
+	// how long the receipts modifier keeps receipts by default; 24h if zero.
+	ReceiptRetention time.Duration
+	// the endpoints _webhook posts to, by name.
+	Webhooks map[string]Webhook
+	// the most a synchronous _webhook may take, retries included, as it holds
+	// up the connection's reads; no limit if zero.
+	MaxSyncWebhookWait time.Duration
+	// the endpoints the authorize modifier asks, by name.
+	Authorizers map[string]Authorizer
+	// the backends _proxy forwards to, by name.
+	Upstreams map[string]Upstream
+	// how many _schedule jobs a user may have pending at once; 100 if zero.
+	MaxJobsPerUser int
 }
 
 func (e *Registry) RegisterCore(opts *RegisterCoreOptions) {
 	e.registerCoreParams()
-	e.registerCoreActions()
-	e.registerCoreModifiers(opts.JWTsecret)
+	e.registerCoreActions(opts)
+	e.registerCoreModifiers(opts)
 }
 
 // New creates and initializes a new Engine instance.
 func New(logger *slog.Logger) *Registry {
 	return &Registry{
-		actions:   make(map[string]pipeline.ActionFunc),
-		modifiers: make(map[string]pipeline.ModifierFunc),
-		params:    make(map[string]ResolverFunc),
-		logger:    logger.With(slog.String("component", "engine")),
+		actions:       make(map[string]pipeline.ActionFunc),
+		modifiers:     make(map[string]pipeline.ModifierFunc),
+		params:        make(map[string]ResolverFunc),
+		paramPrefixes: make(map[string]func(path string) ResolverFunc),
+		needsUser:     make(map[string]bool),
+		encodings:     make(map[string]map[int]pipeline.Encoding),
+		throttle:      newNotifyThrottle(),
+		typing:        &typingTracker{},
+		scheduler:     newScheduler(logger),
+		logger:        logger.With(slog.String("component", "engine")),
 	}
 }
 
-func (e *Registry) registerCoreActions() {
+func (e *Registry) registerCoreActions(opts *RegisterCoreOptions) {
 	e.RegisterAction("_log", actionLog)
 	e.RegisterAction("_join", actionJoinRoom)
-	e.RegisterAction("_leave", actionLeaveRoom)
+	e.RegisterAction("_leave", newLeaveRoomAction(e.typing))
+
+	e.RegisterAction("_notify_origin", newNotifyOriginAction(e.throttle))
+	e.RegisterAction("_notify_room", newNotifyRoomAction(e.throttle))
+	e.RegisterAction("_notify", newNotifyAction(e.throttle))
+	e.RegisterAction("_broadcast", newBroadcastAction(opts.BroadcastPermission, opts.BroadcastBatchSize, opts.CompilePermissions))
 
-	e.RegisterAction("_notify_origin", actionNotifyOrigin)
-	e.RegisterAction("_notify_room", actionNotifyRoom)
+	e.RegisterAction("_set_presence", actionSetPresence)
+	e.RegisterAction("_presence_list", actionPresenceList)
+	e.RegisterAction("_typing", newTypingAction(e.typing))
+	e.RegisterAction("_room_set", actionRoomSet)
+	e.RegisterAction("_room_patch", actionRoomPatch)
+	e.RegisterAction("_room_snapshot", actionRoomSnapshot)
+	e.RegisterAction("_invite", newInviteAction(opts.CompilePermissions))
+	e.RegisterAction("_accept_invite", actionAcceptInvite)
+	e.RegisterAction("_request_join", actionRequestJoin)
+	e.RegisterAction("_approve_join", actionApproveJoin)
+	e.RegisterAction("_subscribe", actionSubscribe)
+	e.RegisterAction("_unsubscribe", actionUnsubscribe)
+	e.RegisterAction("_delivered", newAckAction("_delivered", state.ReceiptDelivered))
+	e.RegisterAction("_read", newAckAction("_read", state.ReceiptRead))
+	if opts.MaxJobsPerUser > 0 {
+		e.scheduler.SetMaxJobsPerUser(opts.MaxJobsPerUser)
+	}
+	e.RegisterAction("_schedule", newScheduleAction(e.scheduler))
+	e.RegisterAction("_cancel_schedule", newCancelScheduleAction(e.scheduler))
+	e.webhooks = newWebhookClient(opts.Webhooks, opts.MaxSyncWebhookWait, e.logger)
+	e.RegisterAction("_webhook", newWebhookAction(e.webhooks))
+	e.RegisterAction("_proxy", newProxyAction(newProxyClient(opts.Upstreams)))
+	e.requireUser(actionKind, "_notify_origin", "_set_presence", "_presence_list", "_typing",
+		"_room_set", "_room_patch", "_room_snapshot", "_invite", "_accept_invite", "_request_join",
+		"_approve_join", "_subscribe", "_unsubscribe", "_delivered", "_read", "_proxy")
+	e.encodeParam("_schedule", 2, pipeline.EncodeJSON)
+	e.encodeParam("_webhook", 1, pipeline.EncodeJSON)
+	e.encodeParam("_proxy", 2, pipeline.EncodePath)
+	for _, index := range []int{4, 5, 6} { // mapping, headers and body
+		e.encodeParam("_proxy", index, pipeline.EncodeJSON)
+	}
 	e.logger.Info("Resgisted core actions", slog.Any("count", len(e.actions)))
 }
 
-func (e *Registry) registerCoreModifiers(jwtSecret string) {
-	e.RegisterModifier("secure", newSecureModifier(jwtSecret))
+func (e *Registry) registerCoreModifiers(opts *RegisterCoreOptions) {
+	e.RegisterModifier("secure", newSecureModifier(opts.JWTsecret))
 	e.RegisterModifier("rate_limit", newRateLimitModifier(e.logger))
+	e.RegisterModifier(coalesceModifier, newCoalesceModifier())
+	e.RegisterModifier(receiptsModifier, newReceiptsModifier(opts.ReceiptRetention))
+	e.RegisterModifier("authorize", newAuthorizeModifier(newAuthorizeClient(opts.Authorizers)))
+	e.requireUser(modifierKind, "secure", "rate_limit", "authorize")
 	e.logger.Info("Resgisted core modifiers", slog.Any("count", len(e.modifiers)))
 }
 
@@ -62,9 +143,69 @@ func (e *Registry) registerCoreParams() {
 	e.RegisterParams("target.id", _target)
 	e.RegisterParams("conn.id", _connID)
 	e.RegisterParams("user.id", _userID)
+	e.RegisterParamPrefix("webhook.", webhookResolver)
+	// system pipelines never have a connection either.
+	e.requireUser(paramKind, "user.id", "conn.id")
 	e.logger.Info("Resgisted core params", slog.Any("count", len(e.params)))
 }
 
+const (
+	actionKind   = "action:"
+	modifierKind = "modifier:"
+	paramKind    = "param:"
+)
+
+// requireUser marks registered names of a kind as unusable in system pipelines.
+func (e *Registry) requireUser(kind string, names ...string) {
+	for _, name := range names {
+		e.needsUser[kind+name] = true
+	}
+}
+
+// encodeParam sets how values resolved into a param of a registered action
+// are encoded, so client input cannot change the param's structure.
+func (e *Registry) encodeParam(action string, index int, enc pipeline.Encoding) {
+	if e.encodings[action] == nil {
+		e.encodings[action] = make(map[int]pipeline.Encoding)
+	}
+	e.encodings[action][index] = enc
+}
+
+// ActionParamEncodings returns how values resolved into the action's params
+// are encoded, by index.
+func (e *Registry) ActionParamEncodings(name string) map[int]pipeline.Encoding {
+	return e.encodings[name]
+}
+
+// ActionNeedsUser reports whether the action fails without a user, so system
+// pipelines may not use it. Likewise ModifierNeedsUser and ParamNeedsUser.
+func (e *Registry) ActionNeedsUser(name string) bool {
+	return e.needsUser[actionKind+name]
+}
+
+func (e *Registry) ModifierNeedsUser(name string) bool {
+	return e.needsUser[modifierKind+name]
+}
+
+func (e *Registry) ParamNeedsUser(name string) bool {
+	return e.needsUser[paramKind+name]
+}
+
+// Scheduler runs the jobs of _schedule and the configured cron schedules.
+func (e *Registry) Scheduler() *Scheduler {
+	return e.scheduler
+}
+
+// Close waits for the asynchronous webhook deliveries in flight until ctx is
+// done, then cancels the rest; none start afterwards. It returns ctx's error
+// if any had to be cancelled.
+func (e *Registry) Close(ctx context.Context) error {
+	if e.webhooks == nil {
+		return nil
+	}
+	return e.webhooks.close(ctx)
+}
+
 // --- Action Methods ---
 func (e *Registry) RegisterAction(name string, fn pipeline.ActionFunc) {
 	e.actionMu.Lock()
@@ -111,11 +252,29 @@ func (e *Registry) RegisterParams(name string, resolver ResolverFunc) {
 	e.params[name] = resolver
 }
 
+// RegisterParamPrefix registers the params whose names start with prefix;
+// resolver is given the rest of the name.
+func (e *Registry) RegisterParamPrefix(prefix string, resolver func(path string) ResolverFunc) {
+	e.paramsMu.Lock()
+	defer e.paramsMu.Unlock()
+	if _, exists := e.paramPrefixes[prefix]; exists {
+		panic("Param prefix already registered: " + prefix)
+	}
+	e.paramPrefixes[prefix] = resolver
+}
+
 func (e *Registry) GetParamResolver(name string) (ResolverFunc, bool) {
 	e.paramsMu.RLock()
 	defer e.paramsMu.RUnlock()
-	resolver, ok := e.params[name]
-	return resolver, ok
+	if resolver, ok := e.params[name]; ok {
+		return resolver, true
+	}
+	for prefix, resolver := range e.paramPrefixes {
+		if path, ok := strings.CutPrefix(name, prefix); ok && path != "" {
+			return resolver(path), true
+		}
+	}
+	return nil, false
 }
 
 // GetAllRegisteredParams returns all registered variable names for validation.
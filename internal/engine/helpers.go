@@ -1,17 +1,20 @@
 package engine
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
 	"log/slog"
 	"strings"
 
 	"github.com/a-essam23/go-dispatch/pkg/pipeline"
+	"github.com/a-essam23/go-dispatch/pkg/state"
 	"github.com/a-essam23/go-dispatch/pkg/transport"
 	"github.com/google/uuid"
 )
 
-func getConnectionsForRoom(pctx *pipeline.Cargo, roomID string) ([]*transport.Connection, error) {
-	conns := make(map[uuid.UUID]*transport.Connection)
+func getConnectionsForRoom(pctx *pipeline.Cargo, roomID string) ([]transport.Conn, error) {
+	conns := make(map[uuid.UUID]transport.Conn)
 
 	switch {
 	case strings.HasPrefix(roomID, "user:"):
@@ -38,9 +41,31 @@ func getConnectionsForRoom(pctx *pipeline.Cargo, roomID string) ([]*transport.Co
 			}
 		}
 	}
-	connList := make([]*transport.Connection, 0, len(conns))
+	connList := make([]transport.Conn, 0, len(conns))
 	for _, conn := range conns {
 		connList = append(connList, conn)
 	}
 	return connList, nil
 }
+
+// builds the cargo for engine work that no client message triggered.
+func newSystemCargo(logger *slog.Logger, sm state.Manager) *pipeline.Cargo {
+	return &pipeline.Cargo{Origin: pipeline.OriginSystem, Logger: logger, Ctx: context.Background(), StateManager: sm}
+}
+
+// isSystemCall reports whether the server itself runs the pipeline: a system
+// origin and no user to act as. Only then are the checks made of a sender
+// skipped; a pipeline that lost its user is not trusted.
+func isSystemCall(pctx *pipeline.Cargo) bool {
+	return pctx.Origin == pipeline.OriginSystem && pctx.User == nil
+}
+
+// sends the reserved event with payload v to every connection of roomID.
+func fanOutEvent(pctx *pipeline.Cargo, roomID, event string, v any, priority transport.Priority) error {
+	payload, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("failed to marshal %s payload: %w", event, err)
+	}
+	msg, _ := json.Marshal(ClientResponse{Event: event, Payload: payload})
+	return fanOut(pctx, roomID, msg, priority, "")
+}
@@ -0,0 +1,178 @@
+package engine_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/a-essam23/go-dispatch/internal/engine"
+	"github.com/a-essam23/go-dispatch/pkg/pipeline"
+	"github.com/a-essam23/go-dispatch/pkg/state"
+	"github.com/a-essam23/go-dispatch/pkg/state/statemanager"
+	"github.com/a-essam23/go-dispatch/pkg/transport/transporttest"
+)
+
+// testEnv is a registry with its own in-memory state and the fake connections
+// of the users connected to it.
+type testEnv struct {
+	t      *testing.T
+	logger *slog.Logger
+	reg    *engine.Registry
+	sm     *statemanager.InMemoryManager
+	// the first connection of each user.
+	conns map[string]*transporttest.Conn
+	// the TargetID of the cargos made by cargo.
+	target string
+}
+
+// newTestEnv registers the core with opts, the defaults if nil.
+func newTestEnv(t *testing.T, opts *engine.RegisterCoreOptions) *testEnv {
+	t.Helper()
+	if opts == nil {
+		opts = &engine.RegisterCoreOptions{}
+	}
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	reg := engine.New(logger)
+	reg.RegisterCore(opts)
+	return &testEnv{
+		t:      t,
+		logger: logger,
+		reg:    reg,
+		sm:     statemanager.NewInMemoryManager(logger),
+		conns:  make(map[string]*transporttest.Conn),
+	}
+}
+
+// connect connects userID with the given global permissions and returns the
+// connection, kept in conns if it is their first.
+func (e *testEnv) connect(userID string, perms state.Permission) *transporttest.Conn {
+	e.t.Helper()
+	conn := transporttest.NewConn()
+	if _, err := e.sm.RegisterConnection(conn, "127.0.0.1"); err != nil {
+		e.t.Fatalf("RegisterConnection failed: %v", err)
+	}
+	if _, err := e.sm.AssociateUser(conn.ID(), userID, perms); err != nil {
+		e.t.Fatalf("AssociateUser failed: %v", err)
+	}
+	if _, ok := e.conns[userID]; !ok {
+		e.conns[userID] = conn
+	}
+	return conn
+}
+
+// cargo returns a cargo acting as userID, or as the server for "".
+func (e *testEnv) cargo(userID string) *pipeline.Cargo {
+	cargo := &pipeline.Cargo{Logger: e.logger, Ctx: context.Background(), StateManager: e.sm, TargetID: e.target}
+	if userID == "" {
+		cargo.Origin = pipeline.OriginSystem
+	}
+	cargo.User, _ = e.sm.FindUser(userID)
+	return cargo
+}
+
+// cargoOn returns a cargo acting as the user of conn, from conn.
+func (e *testEnv) cargoOn(conn *transporttest.Conn) *pipeline.Cargo {
+	e.t.Helper()
+	origin, ok := e.sm.GetConnection(conn.ID())
+	if !ok {
+		e.t.Fatal("connection is not registered")
+	}
+	cargo := e.cargo(origin.User.ID)
+	cargo.Connection = origin
+	return cargo
+}
+
+// join joins each user to room as the server.
+func (e *testEnv) join(room string, userIDs ...string) {
+	e.t.Helper()
+	for _, userID := range userIDs {
+		runAction(e.t, e.reg, e.cargo(""), "_join", userID, room)
+	}
+}
+
+// joinAll connects each user not connected yet, without permissions, and joins
+// them all to room as the server.
+func (e *testEnv) joinAll(room string, userIDs ...string) {
+	e.t.Helper()
+	e.connectAll(userIDs...)
+	e.join(room, userIDs...)
+}
+
+// connectAll connects each user not connected yet, without permissions.
+func (e *testEnv) connectAll(userIDs ...string) {
+	e.t.Helper()
+	for _, userID := range userIDs {
+		if _, ok := e.conns[userID]; !ok {
+			e.connect(userID, 0)
+		}
+	}
+}
+
+// run runs the action as userID, failing the test if it fails.
+func (e *testEnv) run(userID, name string, params ...string) {
+	e.t.Helper()
+	runAction(e.t, e.reg, e.cargo(userID), name, params...)
+}
+
+// action returns the registered action, failing the test if there is none.
+func (e *testEnv) action(name string) pipeline.ActionFunc {
+	e.t.Helper()
+	fn, ok := e.reg.GetActionFunc(name)
+	if !ok {
+		e.t.Fatalf("action %s is not registered", name)
+	}
+	return fn
+}
+
+// modifier returns the registered modifier, failing the test if there is none.
+func (e *testEnv) modifier(name string) pipeline.ModifierFunc {
+	e.t.Helper()
+	fn, ok := e.reg.GetModifierFunc(name)
+	if !ok {
+		e.t.Fatalf("modifier %s is not registered", name)
+	}
+	return fn
+}
+
+// resetSent forgets what every kept connection was sent.
+func (e *testEnv) resetSent() {
+	for _, conn := range e.conns {
+		conn.Reset()
+	}
+}
+
+// knownPermissions compiles permission lists of a single name found in perms.
+func knownPermissions(perms map[string]state.Permission) func(names []string) (state.Permission, error) {
+	return func(names []string) (state.Permission, error) {
+		if len(names) == 1 {
+			if perm, ok := perms[names[0]]; ok {
+				return perm, nil
+			}
+		}
+		return 0, errors.New("unknown permission")
+	}
+}
+
+func runAction(t *testing.T, reg *engine.Registry, cargo *pipeline.Cargo, name string, params ...string) {
+	t.Helper()
+	fn, ok := reg.GetActionFunc(name)
+	if !ok {
+		t.Fatalf("action %s is not registered", name)
+	}
+	if err := fn(cargo, params...); err != nil {
+		t.Fatalf("%s failed: %v", name, err)
+	}
+}
+
+// waits up to a second for conn to have been sent n messages and returns them.
+func waitForSent(t *testing.T, conn *transporttest.Conn, n int) [][]byte {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for len(conn.Sent()) < n && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	return conn.Sent()
+}
@@ -0,0 +1,208 @@
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/a-essam23/go-dispatch/pkg/pipeline"
+	"github.com/a-essam23/go-dispatch/pkg/state"
+	"github.com/a-essam23/go-dispatch/pkg/transport"
+)
+
+// reserved events of the invitation subsystem.
+const (
+	// InviteEvent tells a user they were invited to a room.
+	InviteEvent = "invite"
+	// JoinRequestEvent tells a room's moderators a user asks to join.
+	JoinRequestEvent = "join_request"
+	// JoinApprovedEvent tells a user their join request was approved.
+	JoinApprovedEvent = "join_approved"
+
+	defaultInviteTTL = 24 * time.Hour
+)
+
+// PermissionCompiler turns permission names into a bitmap.
+type PermissionCompiler func(names []string) (state.Permission, error)
+
+type joinApprovedPayload struct {
+	Room string `json:"room"`
+	By   string `json:"by"`
+}
+
+// a moderator of a room is its owner, or a user holding the moderate
+// permission in the room or globally.
+func isModerator(sm state.Manager, roomID, userID string) bool {
+	if user, ok := sm.FindUser(userID); ok && user.GlobalPermissions.Has(state.PermModerate) {
+		return true
+	}
+	if grant, member := sm.GetGrant(userID, roomID); member && grant.Permissions.Has(state.PermModerate) {
+		return true
+	}
+	room, err := sm.GetRoomState(roomID)
+	return err == nil && room.Meta.Owner == userID
+}
+
+// reads an optional ttl parameter; an empty one means def.
+func ttlParam(params []string, i int, def time.Duration) (time.Duration, error) {
+	if len(params) <= i || params[i] == "" {
+		return def, nil
+	}
+	ttl, err := time.ParseDuration(params[i])
+	if err != nil || ttl <= 0 {
+		return 0, fmt.Errorf("invalid ttl: %s", params[i])
+	}
+	return ttl, nil
+}
+
+// params: [userID, ttl?, permissions?]. Invites the user to the target room
+// until ttl (24h by default) passes. permissions is a comma separated list of
+// the permissions the user is granted in the room on accepting.
+func newInviteAction(compile PermissionCompiler) pipeline.ActionFunc {
+	return func(pctx *pipeline.Cargo, params ...string) error {
+		if len(params) < 1 || len(params) > 3 {
+			return errors.New("_invite requires 1 to 3 parameters: [userID, ttl?, permissions?]")
+		}
+		if pctx.User == nil {
+			return errors.New("_invite requires a user")
+		}
+		roomID, inviteeID := pctx.TargetID, params[0]
+		if !isModerator(pctx.StateManager, roomID, pctx.User.ID) {
+			return fmt.Errorf("_invite: user '%s' cannot invite to room '%s'", pctx.User.ID, roomID)
+		}
+		if _, member := pctx.StateManager.GetGrant(inviteeID, roomID); member {
+			return fmt.Errorf("_invite: user '%s' is already a member of room '%s'", inviteeID, roomID)
+		}
+		ttl, err := ttlParam(params, 1, defaultInviteTTL)
+		if err != nil {
+			return fmt.Errorf("_invite: %w", err)
+		}
+		var perms state.Permission
+		if len(params) == 3 && params[2] != "" {
+			if compile == nil {
+				return errors.New("_invite: permissions are not available")
+			}
+			if perms, err = compile(strings.Split(params[2], ",")); err != nil {
+				return fmt.Errorf("_invite: %w", err)
+			}
+		}
+
+		now := time.Now()
+		invite := state.Invite{
+			Kind:        state.InviteKindInvite,
+			Room:        roomID,
+			UserID:      inviteeID,
+			By:          pctx.User.ID,
+			Permissions: perms,
+			CreatedAt:   now,
+			ExpiresAt:   now.Add(ttl),
+		}
+		if err := pctx.StateManager.PutInvite(invite); err != nil {
+			return fmt.Errorf("_invite: %w", err)
+		}
+		pctx.Logger.Info("User invited to room", slog.String("userID", inviteeID), slog.String("roomID", roomID), slog.String("by", pctx.User.ID))
+		return fanOutEvent(pctx, "user:"+inviteeID, InviteEvent, invite, transport.PriorityNormal)
+	}
+}
+
+// params: [roomID?], defaulting to the event's target. Joins the triggering
+// user to the room they were invited to, with the invite's permissions.
+func actionAcceptInvite(pctx *pipeline.Cargo, params ...string) error {
+	if len(params) > 1 {
+		return errors.New("_accept_invite accepts at most 1 parameter: [roomID?]")
+	}
+	if pctx.User == nil {
+		return errors.New("_accept_invite requires a user")
+	}
+	roomID := pctx.TargetID
+	if len(params) == 1 {
+		roomID = params[0]
+	}
+	userID := pctx.User.ID
+	invite, ok := pctx.StateManager.GetInvite(state.InviteKindInvite, roomID, userID)
+	if !ok {
+		return fmt.Errorf("_accept_invite: user '%s' has no pending invite to room '%s'", userID, roomID)
+	}
+	if _, err := pctx.StateManager.Join(userID, roomID, &state.JoinAuth{Invite: &invite}); err != nil {
+		return fmt.Errorf("_accept_invite: %w", err)
+	}
+	pctx.StateManager.DeleteInvite(state.InviteKindInvite, roomID, userID)
+	pctx.StateManager.DeleteInvite(state.InviteKindRequest, roomID, userID)
+	pctx.Logger.Info("User accepted invite", slog.String("userID", userID), slog.String("roomID", roomID))
+	return nil
+}
+
+// params: [message?, ttl?]. Asks the moderators of the target room to let the
+// triggering user in, until ttl (24h by default) passes.
+func actionRequestJoin(pctx *pipeline.Cargo, params ...string) error {
+	if len(params) > 2 {
+		return errors.New("_request_join accepts at most 2 parameters: [message?, ttl?]")
+	}
+	if pctx.User == nil {
+		return errors.New("_request_join requires a user")
+	}
+	roomID, userID := pctx.TargetID, pctx.User.ID
+	if _, member := pctx.StateManager.GetGrant(userID, roomID); member {
+		return fmt.Errorf("_request_join: user '%s' is already a member of room '%s'", userID, roomID)
+	}
+	ttl, err := ttlParam(params, 1, defaultInviteTTL)
+	if err != nil {
+		return fmt.Errorf("_request_join: %w", err)
+	}
+	now := time.Now()
+	request := state.Invite{
+		Kind:      state.InviteKindRequest,
+		Room:      roomID,
+		UserID:    userID,
+		By:        userID,
+		CreatedAt: now,
+		ExpiresAt: now.Add(ttl),
+	}
+	if len(params) > 0 {
+		request.Message = params[0]
+	}
+	if err := pctx.StateManager.PutInvite(request); err != nil {
+		return fmt.Errorf("_request_join: %w", err)
+	}
+
+	members, err := pctx.StateManager.GetRoomMembers(roomID)
+	if err != nil {
+		return fmt.Errorf("_request_join: %w", err)
+	}
+	for _, member := range members {
+		if isModerator(pctx.StateManager, roomID, member.ID) {
+			if err := fanOutEvent(pctx, "user:"+member.ID, JoinRequestEvent, request, transport.PriorityNormal); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// params: [userID]. Approves the user's request to join the target room, and
+// joins them.
+func actionApproveJoin(pctx *pipeline.Cargo, params ...string) error {
+	if len(params) != 1 {
+		return errors.New("_approve_join requires 1 parameter: [userID]")
+	}
+	if pctx.User == nil {
+		return errors.New("_approve_join requires a user")
+	}
+	roomID, userID := pctx.TargetID, params[0]
+	if !isModerator(pctx.StateManager, roomID, pctx.User.ID) {
+		return fmt.Errorf("_approve_join: user '%s' cannot approve joins to room '%s'", pctx.User.ID, roomID)
+	}
+	request, ok := pctx.StateManager.GetInvite(state.InviteKindRequest, roomID, userID)
+	if !ok {
+		return fmt.Errorf("_approve_join: user '%s' has no pending request to join room '%s'", userID, roomID)
+	}
+	if _, err := pctx.StateManager.Join(userID, roomID, &state.JoinAuth{Invite: &request}); err != nil {
+		return fmt.Errorf("_approve_join: %w", err)
+	}
+	pctx.StateManager.DeleteInvite(state.InviteKindRequest, roomID, userID)
+	pctx.StateManager.DeleteInvite(state.InviteKindInvite, roomID, userID)
+	pctx.Logger.Info("Join request approved", slog.String("userID", userID), slog.String("roomID", roomID), slog.String("by", pctx.User.ID))
+	return fanOutEvent(pctx, "user:"+userID, JoinApprovedEvent, joinApprovedPayload{Room: roomID, By: pctx.User.ID}, transport.PriorityNormal)
+}
@@ -0,0 +1,160 @@
+package engine_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/a-essam23/go-dispatch/internal/engine"
+	"github.com/a-essam23/go-dispatch/pkg/pipeline"
+	"github.com/a-essam23/go-dispatch/pkg/state"
+)
+
+// the invite-only rooms private:*, with a create permission of their own, so
+// their owner moderates them as such rather than globally.
+const createPrivate state.Permission = 1 << 5
+
+var privateRooms = []state.RoomClass{{Name: "private", Pattern: "private:*", Join: state.JoinInviteOnly, Permission: createPrivate}}
+
+func TestInviteIsSentAndAcceptingJoinsWithItsPermissions(t *testing.T) {
+	env := newTestEnv(t, &engine.RegisterCoreOptions{CompilePermissions: knownPermissions(map[string]state.Permission{"moderate": state.PermModerate})})
+	env.sm.SetRoomClasses(privateRooms)
+	env.connect("alice", createPrivate)
+	env.connectAll("bob", "carol")
+	env.target = "private:1"
+	env.run("alice", "_join", "alice", "private:1")
+
+	env.run("alice", "_invite", "bob", "1h", "moderate")
+	if sent := env.conns["bob"].Sent(); len(sent) != 1 || !strings.Contains(string(sent[0]), `"event":"invite"`) || !strings.Contains(string(sent[0]), `"by":"alice"`) {
+		t.Errorf("expected bob to be told about the invite, got %q", sent)
+	}
+	env.run("bob", "_accept_invite")
+	sm := env.sm
+	if grant, member := sm.GetGrant("bob", "private:1"); !member || !grant.Permissions.Has(state.PermModerate) {
+		t.Fatal("accepting did not join bob with the invite's permissions")
+	}
+	if pending := sm.ListInvites("private:1"); len(pending) != 0 {
+		t.Errorf("the accepted invite is still pending: %+v", pending)
+	}
+
+	// bob moderates the room through the invite's grant.
+	env.run("bob", "_invite", "carol")
+	if len(env.conns["carol"].Sent()) != 1 {
+		t.Error("a moderator by grant could not invite")
+	}
+}
+
+func TestInviteRejectsBadParamsAndNonModerators(t *testing.T) {
+	env := newTestEnv(t, &engine.RegisterCoreOptions{CompilePermissions: knownPermissions(map[string]state.Permission{"moderate": state.PermModerate})})
+	env.sm.SetRoomClasses(privateRooms)
+	env.connect("alice", createPrivate)
+	env.connectAll("bob", "carol")
+	env.target = "private:1"
+	env.run("alice", "_join", "alice", "private:1")
+	invite := env.action("_invite")
+
+	tests := []struct {
+		name   string
+		cargo  *pipeline.Cargo
+		params []string
+	}{
+		{"no invitee", env.cargo("alice"), nil},
+		{"too many params", env.cargo("alice"), []string{"bob", "1h", "moderate", "x"}},
+		{"no user", env.cargo("nobody"), []string{"bob"}},
+		{"invited by a non-member", env.cargo("bob"), []string{"carol"}},
+		{"invitee already a member", env.cargo("alice"), []string{"alice"}},
+		{"malformed ttl", env.cargo("alice"), []string{"bob", "soon"}},
+		{"negative ttl", env.cargo("alice"), []string{"bob", "-1h"}},
+		{"unknown permission", env.cargo("alice"), []string{"bob", "", "admin"}},
+	}
+	for _, tt := range tests {
+		if err := invite(tt.cargo, tt.params...); err == nil {
+			t.Errorf("%s: expected an error", tt.name)
+		}
+	}
+	if sent := env.conns["bob"].Sent(); len(sent) != 0 {
+		t.Errorf("a rejected invite was sent: %q", sent)
+	}
+}
+
+func TestAcceptInviteRequiresALiveInvite(t *testing.T) {
+	env := newTestEnv(t, nil)
+	env.sm.SetRoomClasses(privateRooms)
+	env.connect("alice", createPrivate)
+	env.connectAll("bob", "carol")
+	env.target = "private:1"
+	env.run("alice", "_join", "alice", "private:1")
+	accept := env.action("_accept_invite")
+
+	if err := accept(env.cargo("carol")); err == nil {
+		t.Error("accepting without an invite succeeded")
+	}
+	if err := accept(env.cargo("carol"), "private:1", "x"); err == nil {
+		t.Error("expected too many params to be rejected")
+	}
+	env.run("alice", "_invite", "carol", "10ms")
+	time.Sleep(30 * time.Millisecond)
+	if err := accept(env.cargo("carol")); err == nil {
+		t.Error("accepting an expired invite succeeded")
+	}
+	if _, member := env.sm.GetGrant("carol", "private:1"); member {
+		t.Error("an expired invite joined carol")
+	}
+}
+
+func TestJoinRequestIsSentToModeratorsAndApprovalJoins(t *testing.T) {
+	env := newTestEnv(t, nil)
+	env.sm.SetRoomClasses(privateRooms)
+	env.connect("alice", createPrivate)
+	env.connectAll("bob", "carol")
+	env.target = "private:1"
+	env.run("alice", "_join", "alice", "private:1")
+
+	env.run("carol", "_request_join", "let me in")
+	if sent := env.conns["alice"].Sent(); len(sent) != 1 || !strings.Contains(string(sent[0]), `"event":"join_request"`) || !strings.Contains(string(sent[0]), `"message":"let me in"`) {
+		t.Errorf("expected owner alice to be told about the request, got %q", sent)
+	}
+	env.run("alice", "_approve_join", "carol")
+	if _, member := env.sm.GetGrant("carol", "private:1"); !member {
+		t.Fatal("approving did not join carol")
+	}
+	want := `{"event":"join_approved","payload":{"room":"private:1","by":"alice"}}`
+	if sent := env.conns["carol"].Sent(); len(sent) != 1 || string(sent[0]) != want {
+		t.Errorf("expected carol to be told about the approval, got %q", sent)
+	}
+}
+
+func TestJoinRequestsRejectMembersAndNonModerators(t *testing.T) {
+	env := newTestEnv(t, nil)
+	env.sm.SetRoomClasses(privateRooms)
+	env.connect("alice", createPrivate)
+	env.connectAll("bob", "carol")
+	env.target = "private:1"
+	env.run("alice", "_join", "alice", "private:1")
+	request := env.action("_request_join")
+	approve := env.action("_approve_join")
+
+	if err := request(env.cargo("alice")); err == nil {
+		t.Error("a member was allowed to request joining")
+	}
+	if err := request(env.cargo("carol"), "hi", "1h", "x"); err == nil {
+		t.Error("expected too many params to be rejected")
+	}
+	if err := request(env.cargo("carol"), "hi", "never"); err == nil {
+		t.Error("expected a malformed ttl to be rejected")
+	}
+	env.run("carol", "_request_join", "hi")
+
+	if err := approve(env.cargo("bob"), "carol"); err == nil {
+		t.Error("a non-moderator approved a join request")
+	}
+	if err := approve(env.cargo("alice"), "bob"); err == nil {
+		t.Error("approving a user who did not ask succeeded")
+	}
+	if err := approve(env.cargo("alice")); err == nil {
+		t.Error("expected a missing user to be rejected")
+	}
+	if _, member := env.sm.GetGrant("bob", "private:1"); member {
+		t.Error("bob was joined without a request")
+	}
+}
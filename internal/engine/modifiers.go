@@ -82,6 +82,9 @@ func newRateLimitModifier(logger *slog.Logger) pipeline.ModifierFunc {
 			return fmt.Errorf("invalid rate_limit duration unit: %s", parts[1])
 		}
 
+		if pctx.User == nil {
+			return errors.New("'rate_limit' modifier requires a user")
+		}
 		modifierName := "rate_limit"
 		userID := pctx.User.ID
 		eventName := pctx.EventName
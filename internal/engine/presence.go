@@ -0,0 +1,118 @@
+package engine
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/a-essam23/go-dispatch/pkg/pipeline"
+	"github.com/a-essam23/go-dispatch/pkg/state"
+	"github.com/a-essam23/go-dispatch/pkg/transport"
+)
+
+// reserved events of the presence subsystem.
+const (
+	// PresenceEvent carries one user's presence change to their rooms.
+	PresenceEvent = "presence"
+	// PresenceListEvent answers _presence_list.
+	PresenceListEvent = "presence_list"
+)
+
+type presenceEntry struct {
+	UserID   string               `json:"userId"`
+	Status   state.PresenceStatus `json:"status"`
+	Text     string               `json:"text,omitempty"`
+	LastSeen *time.Time           `json:"lastSeen,omitempty"`
+}
+
+type presenceListPayload struct {
+	Room    string          `json:"room"`
+	Members []presenceEntry `json:"members"`
+}
+
+func newPresenceEntry(userID string, p state.Presence) presenceEntry {
+	entry := presenceEntry{UserID: userID, Status: p.Status, Text: p.Text}
+	if !p.LastSeen.IsZero() {
+		entry.LastSeen = &p.LastSeen
+	}
+	return entry
+}
+
+// NewPresenceBroadcaster returns a state.PresenceHandler that sends every
+// presence change to each connection sharing a room with the user, once.
+func NewPresenceBroadcaster(logger *slog.Logger, sm state.Manager) state.PresenceHandler {
+	pctx := newSystemCargo(logger, sm)
+	return func(userID string, p state.Presence) {
+		rooms, err := sm.GetUserRooms(userID)
+		if err != nil || len(rooms) == 0 {
+			return
+		}
+		payload, _ := json.Marshal(newPresenceEntry(userID, p))
+		msg, _ := json.Marshal(ClientResponse{Event: PresenceEvent, Payload: payload})
+
+		a := newAudience()
+		for _, roomID := range rooms {
+			if roomConns, err := getConnectionsForRoom(pctx, roomID); err == nil {
+				a.add(roomConns)
+			}
+		}
+		if err := sendAll(a.conns, msg, transport.PrioritySystem, ""); err != nil {
+			logger.Error("Failed to broadcast presence", slog.String("userID", userID), slog.Any("error", err))
+		}
+	}
+}
+
+// params: [status, text?]. status is "online" or "away".
+func actionSetPresence(pctx *pipeline.Cargo, params ...string) error {
+	if len(params) != 1 && len(params) != 2 {
+		return errors.New("_set_presence requires 1 or 2 parameters: [status, text?]")
+	}
+	if pctx.User == nil {
+		return errors.New("_set_presence requires a user")
+	}
+	text := ""
+	if len(params) == 2 {
+		text = params[1]
+	}
+	if _, err := pctx.StateManager.SetPresence(pctx.User.ID, state.PresenceStatus(params[0]), text); err != nil {
+		return fmt.Errorf("_set_presence: %w", err)
+	}
+	return nil
+}
+
+// params: [roomID?], defaulting to the event's target. Replies to the origin
+// with the presence of every member of the room.
+func actionPresenceList(pctx *pipeline.Cargo, params ...string) error {
+	if len(params) > 1 {
+		return errors.New("_presence_list accepts at most 1 parameter: [roomID?]")
+	}
+	if pctx.User == nil {
+		return errors.New("_presence_list requires a user")
+	}
+	roomID := pctx.TargetID
+	if len(params) == 1 {
+		roomID = params[0]
+	}
+	if _, member := pctx.StateManager.GetGrant(pctx.User.ID, roomID); !member {
+		return fmt.Errorf("_presence_list: user '%s' is not a member of room '%s'", pctx.User.ID, roomID)
+	}
+
+	members, err := pctx.StateManager.GetRoomMembers(roomID)
+	if err != nil {
+		return fmt.Errorf("_presence_list: %w", err)
+	}
+	list := presenceListPayload{Room: roomID, Members: make([]presenceEntry, 0, len(members))}
+	for _, member := range members {
+		p, _ := pctx.StateManager.GetPresence(member.ID)
+		list.Members = append(list.Members, newPresenceEntry(member.ID, p))
+	}
+	slices.SortFunc(list.Members, func(a, b presenceEntry) int {
+		return strings.Compare(a.UserID, b.UserID)
+	})
+
+	return fanOutEvent(pctx, "user:"+pctx.User.ID, PresenceListEvent, list, transport.PriorityNormal)
+}
@@ -0,0 +1,74 @@
+package engine_test
+
+import (
+	"testing"
+
+	"github.com/a-essam23/go-dispatch/internal/engine"
+	"github.com/a-essam23/go-dispatch/pkg/pipeline"
+	"github.com/a-essam23/go-dispatch/pkg/transport"
+)
+
+func TestPresenceIsBroadcastOnceToSharedRooms(t *testing.T) {
+	env := newTestEnv(t, nil)
+	env.sm.SetPresenceHandler(engine.NewPresenceBroadcaster(env.logger, env.sm))
+	env.joinAll("lobby", "alice", "bob")
+	env.joinAll("games", "alice", "bob")
+	env.connectAll("carol")
+
+	env.run("alice", "_set_presence", "away", "lunch")
+	want := `{"event":"presence","payload":{"userId":"alice","status":"away","text":"lunch"}}`
+	if sent := env.conns["bob"].Sent(); len(sent) != 1 || string(sent[0]) != want {
+		t.Errorf("expected one presence change across both shared rooms, got %q", sent)
+	}
+	if got := env.conns["bob"].Priorities(); len(got) == 1 && got[0] != transport.PrioritySystem {
+		t.Errorf("presence should be sent as system priority, got %v", got[0])
+	}
+	if len(env.conns["carol"].Sent()) != 0 {
+		t.Error("a user sharing no room received the presence change")
+	}
+}
+
+func TestSetPresenceRejectsBadParams(t *testing.T) {
+	env := newTestEnv(t, nil)
+	env.connectAll("alice")
+	cargo := env.cargo("alice")
+	setPresence := env.action("_set_presence")
+
+	if err := setPresence(cargo, "asleep"); err == nil {
+		t.Error("expected an unknown status to be rejected")
+	}
+	if err := setPresence(cargo); err == nil {
+		t.Error("expected a missing status to be rejected")
+	}
+	if err := setPresence(&pipeline.Cargo{StateManager: env.sm}, "away"); err == nil {
+		t.Error("expected _set_presence without a user to be rejected")
+	}
+}
+
+func TestPresenceListRepliesWithTheRoomsMembers(t *testing.T) {
+	env := newTestEnv(t, nil)
+	env.target = "lobby"
+	env.joinAll("lobby", "alice", "bob")
+	env.run("alice", "_set_presence", "away", "lunch")
+	env.conns["alice"].Reset()
+
+	env.run("alice", "_presence_list")
+	want := `{"event":"presence_list","payload":{"room":"lobby","members":[{"userId":"alice","status":"away","text":"lunch"},{"userId":"bob","status":"online"}]}}`
+	if sent := env.conns["alice"].Sent(); len(sent) != 1 || string(sent[0]) != want {
+		t.Errorf("unexpected presence list %q", sent)
+	}
+}
+
+func TestPresenceListRequiresMembership(t *testing.T) {
+	env := newTestEnv(t, nil)
+	env.target = "lobby"
+	env.joinAll("lobby", "alice")
+	list := env.action("_presence_list")
+
+	if err := list(env.cargo("alice"), "vault"); err == nil {
+		t.Error("expected listing a room the user is not in to be rejected")
+	}
+	if len(env.conns["alice"].Sent()) != 0 {
+		t.Error("a rejected list was answered")
+	}
+}
@@ -0,0 +1,353 @@
+package engine
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/a-essam23/go-dispatch/pkg/pipeline"
+	"github.com/a-essam23/go-dispatch/pkg/transport"
+	"github.com/tidwall/gjson"
+	"golang.org/x/net/http/httpguts"
+)
+
+// ProxyErrorEvent answers a _proxy request that failed, in place of its reply.
+const ProxyErrorEvent = "proxy_error"
+
+// the prefix of the headers the server sets on requests, such as
+// WebhookSignatureHeader, which _proxy callers may not set.
+const reservedHeaderPrefix = "X-Dispatch-"
+
+var (
+	// returned while an upstream's circuit is open.
+	ErrCircuitOpen = errors.New("upstream circuit is open")
+	// returned when an upstream already has its limit of requests in flight.
+	ErrUpstreamBusy = errors.New("upstream is busy")
+)
+
+// Upstream is a backend _proxy forwards events to.
+type Upstream struct {
+	// the base URL request paths are appended to.
+	URL string
+	// signs requests when set, as for webhooks.
+	Secret  string
+	Timeout time.Duration
+	// requests in flight at once; further ones fail at once.
+	MaxConcurrent int
+	// consecutive failures, errors or 5xx answers, that open the circuit.
+	FailureThreshold int
+	// how long an open circuit rejects requests before letting one through to
+	// probe the upstream.
+	Cooldown time.Duration
+}
+
+type proxyErrorPayload struct {
+	Error  string `json:"error"`
+	Status int    `json:"status,omitempty"`
+}
+
+// proxyFailure is what the client is told of a failed request: the status of
+// an upstream answer, or why it was not sent, but never the error itself,
+// which may name internal hosts.
+func proxyFailure(err error) proxyErrorPayload {
+	var statusErr *upstreamStatusError
+	switch {
+	case errors.As(err, &statusErr):
+		return proxyErrorPayload{Error: "upstream request failed", Status: statusErr.status}
+	case errors.Is(err, ErrCircuitOpen), errors.Is(err, ErrUpstreamBusy):
+		return proxyErrorPayload{Error: "upstream unavailable", Status: http.StatusServiceUnavailable}
+	default:
+		return proxyErrorPayload{Error: "upstream request failed", Status: http.StatusBadGateway}
+	}
+}
+
+// circuit states.
+const (
+	circuitClosed = iota
+	circuitOpen
+	circuitHalfOpen
+)
+
+// upstreamClient guards one upstream with a concurrency limit and a circuit
+// breaker.
+type upstreamClient struct {
+	Upstream
+	slots chan struct{}
+
+	mu       sync.Mutex
+	state    int
+	failures int
+	openedAt time.Time
+}
+
+// acquire reserves a request slot, reporting why the request may not be sent.
+func (u *upstreamClient) acquire(now time.Time) error {
+	select {
+	case u.slots <- struct{}{}:
+	default:
+		return ErrUpstreamBusy
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	switch u.state {
+	case circuitOpen:
+		if now.Sub(u.openedAt) >= u.Cooldown {
+			// this request probes the upstream; others are rejected until it ends.
+			u.state = circuitHalfOpen
+			return nil
+		}
+	case circuitHalfOpen:
+	default:
+		return nil
+	}
+	<-u.slots
+	return ErrCircuitOpen
+}
+
+// release frees the request's slot and records its outcome.
+func (u *upstreamClient) release(ok bool) {
+	<-u.slots
+	u.record(ok, time.Now())
+}
+
+// abandon frees the request's slot without counting it: it failed through no
+// fault of the upstream. An abandoned probe leaves the circuit open, so the
+// next request probes again.
+func (u *upstreamClient) abandon() {
+	<-u.slots
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.state == circuitHalfOpen {
+		u.state = circuitOpen
+	}
+}
+
+// record counts the outcome of a request against the circuit.
+func (u *upstreamClient) record(ok bool, now time.Time) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if ok {
+		u.state = circuitClosed
+		u.failures = 0
+		return
+	}
+	u.failures++
+	if u.state == circuitHalfOpen || u.failures >= u.FailureThreshold {
+		u.state = circuitOpen
+		u.openedAt = now
+	}
+}
+
+type proxyClient struct {
+	upstreams map[string]*upstreamClient
+	http      *http.Client
+}
+
+func newProxyClient(upstreams map[string]Upstream) *proxyClient {
+	c := &proxyClient{upstreams: make(map[string]*upstreamClient, len(upstreams)), http: &http.Client{}}
+	for name, u := range upstreams {
+		c.upstreams[name] = &upstreamClient{Upstream: u, slots: make(chan struct{}, u.MaxConcurrent)}
+	}
+	return c
+}
+
+// the status of an upstream answer that is not 2xx; only 5xx count against
+// the circuit.
+type upstreamStatusError struct {
+	status int
+}
+
+func (e *upstreamStatusError) Error() string {
+	return fmt.Sprintf("upstream returned %d", e.status)
+}
+
+// upstreamFault reports whether err, from sending a request or reading its
+// answer, is the upstream's doing: it could not be reached or read, or did not
+// answer within its timeout. A request the caller gave up on, or one net/http
+// refused to send, is not.
+func upstreamFault(parent context.Context, err error) bool {
+	if parent.Err() != nil {
+		return false
+	}
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		err = urlErr.Err
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) || errors.Is(err, context.DeadlineExceeded) ||
+		errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// do sends the request through the upstream's limit and breaker, and returns
+// the JSON body of a 2xx answer. Only the upstream's failures, errors reaching
+// or reading it, its timeout and 5xx answers, count against the breaker.
+func (c *proxyClient) do(parent context.Context, u *upstreamClient, method, path string, header http.Header, event string, body []byte) ([]byte, error) {
+	if err := u.acquire(time.Now()); err != nil {
+		return nil, err
+	}
+	ok, counted := false, true
+	defer func() {
+		if counted {
+			u.release(ok)
+		} else {
+			u.abandon()
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(parent, u.Timeout)
+	defer cancel()
+	req, err := newSignedRequest(ctx, method, strings.TrimSuffix(u.URL, "/")+path, u.Secret, event, body)
+	if err != nil {
+		counted = false
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		counted = upstreamFault(parent, err)
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxWebhookResponse))
+	if err != nil {
+		counted = upstreamFault(parent, err)
+		return nil, err
+	}
+	ok = resp.StatusCode < 500
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, &upstreamStatusError{status: resp.StatusCode}
+	}
+	if len(bytes.TrimSpace(data)) == 0 {
+		return []byte("null"), nil
+	}
+	if !json.Valid(data) {
+		return nil, errors.New("upstream response is not valid JSON")
+	}
+	return data, nil
+}
+
+// mapResponse builds the reply payload from the fields of mapping, each a GJSON
+// path into the response, or returns the response whole without a mapping.
+func mapResponse(data []byte, mapping string) (json.RawMessage, error) {
+	if mapping == "" {
+		return data, nil
+	}
+	var paths map[string]string
+	if err := json.Unmarshal([]byte(mapping), &paths); err != nil {
+		return nil, errors.New("mapping must be a JSON object of field names to paths")
+	}
+	fields := make(map[string]json.RawMessage, len(paths))
+	for field, path := range paths {
+		value := gjson.GetBytes(data, path)
+		if !value.Exists() {
+			fields[field] = json.RawMessage("null")
+			continue
+		}
+		fields[field] = json.RawMessage(value.Raw)
+	}
+	return json.Marshal(fields)
+}
+
+// params: [upstream, method, path, replyEvent?, mapping?, headers?, body?].
+// Forwards the event to path, e.g. "/users/{$user.id}", on the named upstream,
+// and replies to the origin connection with replyEvent, the triggering event by
+// default, carrying the request's id as replyTo. mapping is a JSON object of
+// reply fields to GJSON paths into the response, headers a JSON object of
+// valid header values, none of them X-Dispatch-*, and body defaults to the
+// event's payload except for GET, HEAD and DELETE. Values resolved into path are
+// escaped, and those resolved into mapping, headers and body JSON-encoded. A
+// failed request is answered with ProxyErrorEvent, giving only a status, and
+// halts the pipeline.
+func newProxyAction(c *proxyClient) pipeline.ActionFunc {
+	return func(pctx *pipeline.Cargo, params ...string) error {
+		if len(params) < 3 || len(params) > 7 {
+			return errors.New("_proxy requires 3 to 7 parameters: [upstream, method, path, replyEvent?, mapping?, headers?, body?]")
+		}
+		if pctx.Connection == nil {
+			return errors.New("_proxy requires a connection")
+		}
+		u, ok := c.upstreams[params[0]]
+		if !ok {
+			return fmt.Errorf("_proxy: unknown upstream '%s'", params[0])
+		}
+		param := func(i int) string {
+			if len(params) > i {
+				return params[i]
+			}
+			return ""
+		}
+
+		method := strings.ToUpper(params[1])
+		if !slices.Contains([]string{http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete}, method) {
+			return fmt.Errorf("_proxy: unsupported method '%s'", params[1])
+		}
+		path := params[2]
+		if !strings.HasPrefix(path, "/") || strings.Contains(path, "#") || slices.Contains(strings.Split(strings.SplitN(path, "?", 2)[0], "/"), "..") {
+			return fmt.Errorf("_proxy: path '%s' must start with '/' and not contain '..' or '#'", path)
+		}
+		replyEvent := param(3)
+		if replyEvent == "" {
+			replyEvent = pctx.EventName
+		}
+		header := http.Header{}
+		if h := param(5); h != "" {
+			var values map[string]string
+			if err := json.Unmarshal([]byte(h), &values); err != nil {
+				return errors.New("_proxy: headers must be a JSON object of strings")
+			}
+			for k, v := range values {
+				if strings.HasPrefix(http.CanonicalHeaderKey(k), reservedHeaderPrefix) {
+					return fmt.Errorf("_proxy: header '%s' is reserved", k)
+				}
+				if !httpguts.ValidHeaderFieldName(k) || !httpguts.ValidHeaderFieldValue(v) {
+					return fmt.Errorf("_proxy: header %q has an invalid name or value", k)
+				}
+				header.Set(k, v)
+			}
+		}
+		var body []byte
+		if b := param(6); b != "" {
+			if body = []byte(b); !json.Valid(body) {
+				return errors.New("_proxy: body is not valid JSON")
+			}
+		} else if method != http.MethodGet && method != http.MethodHead && method != http.MethodDelete {
+			body = pctx.Payload
+		}
+
+		ctx := pctx.Ctx
+		if ctx == nil {
+			ctx = context.Background()
+		}
+		data, err := c.do(ctx, u, method, path, header, pctx.EventName, body)
+		var payload json.RawMessage
+		if err == nil {
+			payload, err = mapResponse(data, param(4))
+		}
+		if err != nil {
+			pctx.Logger.Warn("Proxy request failed", slog.String("upstream", params[0]), slog.String("path", path), slog.Any("error", err))
+			payload, _ := json.Marshal(proxyFailure(err))
+			msg, _ := json.Marshal(ClientResponse{Event: ProxyErrorEvent, ReplyTo: pctx.RequestID, Payload: payload})
+			if sendErr := sendAll([]transport.Conn{pctx.Connection.Transport}, msg, transport.PriorityNormal, ""); sendErr != nil {
+				pctx.Logger.Warn("Failed to send proxy error", slog.Any("error", sendErr))
+			}
+			return fmt.Errorf("_proxy '%s': %w", params[0], err)
+		}
+
+		msg, _ := json.Marshal(ClientResponse{Event: replyEvent, ReplyTo: pctx.RequestID, Payload: payload})
+		return sendAll([]transport.Conn{pctx.Connection.Transport}, msg, transport.PriorityNormal, "")
+	}
+}
@@ -0,0 +1,296 @@
+package engine_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/a-essam23/go-dispatch/internal/engine"
+	"github.com/a-essam23/go-dispatch/pkg/pipeline"
+	"github.com/a-essam23/go-dispatch/pkg/transport/transporttest"
+)
+
+// starts an upstream serving handler and returns _proxy forwarding to it, or
+// to upstream's URL if set, as "api", with a cargo from alice's connection and
+// that connection.
+func newProxy(t *testing.T, handler http.HandlerFunc, upstream engine.Upstream) (pipeline.ActionFunc, *pipeline.Cargo, *transporttest.Conn) {
+	t.Helper()
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+	if upstream.URL == "" {
+		upstream.URL = srv.URL
+	}
+	if upstream.Timeout == 0 {
+		upstream.Timeout = time.Second
+	}
+	if upstream.MaxConcurrent == 0 {
+		upstream.MaxConcurrent = 4
+	}
+	if upstream.FailureThreshold == 0 {
+		upstream.FailureThreshold = 5
+	}
+	if upstream.Cooldown == 0 {
+		upstream.Cooldown = time.Minute
+	}
+
+	env := newTestEnv(t, &engine.RegisterCoreOptions{Upstreams: map[string]engine.Upstream{"api": upstream}})
+	conn := env.connect("alice", 0)
+	cargo := env.cargoOn(conn)
+	cargo.EventName, cargo.RequestID, cargo.Payload = "get_profile", "r1", []byte(`{"name":"Alice"}`)
+	proxy := env.action("_proxy")
+	return proxy, cargo, conn
+}
+
+func TestProxyRelaysTheMappedResponse(t *testing.T) {
+	proxy, cargo, conn := newProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/users/alice" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		io.WriteString(w, `{"data":{"name":"Alice","trace":"`+r.Header.Get("X-Trace")+`"}}`)
+	}, engine.Upstream{})
+
+	if err := proxy(cargo, "api", "GET", "/users/alice", "profile", `{"name":"data.name","trace":"data.trace","age":"data.age"}`, `{"X-Trace":"t-1"}`); err != nil {
+		t.Fatal(err)
+	}
+	if sent := conn.Sent(); len(sent) != 1 || string(sent[0]) != `{"event":"profile","replyTo":"r1","payload":{"age":null,"name":"Alice","trace":"t-1"}}` {
+		t.Errorf("expected the mapped profile, got %q", sent)
+	}
+}
+
+func TestProxySendsThePayloadByDefaultExceptToReads(t *testing.T) {
+	bodies := make(chan string, 4)
+	proxy, cargo, conn := newProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		bodies <- r.Method + " " + string(body)
+		io.WriteString(w, `{"ok":true}`)
+	}, engine.Upstream{})
+
+	for _, params := range [][]string{
+		{"api", "POST", "/users"},
+		{"api", "GET", "/users"},
+		{"api", "put", "/users", "", "", "", `{"name":"Bob"}`},
+	} {
+		if err := proxy(cargo, params...); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, want := range []string{`POST {"name":"Alice"}`, "GET ", `PUT {"name":"Bob"}`} {
+		if got := <-bodies; got != want {
+			t.Errorf("upstream got %s, want %s", got, want)
+		}
+	}
+	if sent := conn.Sent(); len(sent) != 3 || string(sent[0]) != `{"event":"get_profile","replyTo":"r1","payload":{"ok":true}}` {
+		t.Errorf("expected the whole response under the triggering event, got %q", sent)
+	}
+}
+
+func TestProxyAnswersFailuresWithoutTheirDetails(t *testing.T) {
+	gone := httptest.NewServer(http.NotFoundHandler())
+	gone.Close()
+
+	tests := []struct {
+		name     string
+		upstream engine.Upstream
+		path     string
+		want     string
+	}{
+		{"client error", engine.Upstream{}, "/missing", `{"error":"upstream request failed","status":404}`},
+		{"server error", engine.Upstream{}, "/broken", `{"error":"upstream request failed","status":500}`},
+		{"invalid response", engine.Upstream{}, "/text", `{"error":"upstream request failed","status":502}`},
+		{"unreachable", engine.Upstream{URL: gone.URL}, "/users", `{"error":"upstream request failed","status":502}`},
+	}
+	for _, tt := range tests {
+		proxy, cargo, conn := newProxy(t, func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/broken":
+				w.WriteHeader(http.StatusInternalServerError)
+				io.WriteString(w, `{"error":"db at 10.0.0.7 is down"}`)
+			case "/text":
+				io.WriteString(w, "not json")
+			default:
+				w.WriteHeader(http.StatusNotFound)
+			}
+		}, tt.upstream)
+		if err := proxy(cargo, "api", "GET", tt.path); err == nil {
+			t.Errorf("%s: expected the pipeline to halt", tt.name)
+		}
+		want := `{"event":"proxy_error","replyTo":"r1","payload":` + tt.want + `}`
+		if sent := conn.Sent(); len(sent) != 1 || string(sent[0]) != want {
+			t.Errorf("%s: expected %s, got %q", tt.name, want, sent)
+		}
+	}
+}
+
+func TestProxyOpensTheCircuitAfterFailures(t *testing.T) {
+	var calls atomic.Int32
+	proxy, cargo, conn := newProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		if r.URL.Path == "/missing" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+	}, engine.Upstream{FailureThreshold: 2})
+
+	// 4xx answers are the client's fault, not the upstream's.
+	for range 3 {
+		proxy(cargo, "api", "GET", "/missing")
+	}
+	for range 3 {
+		if err := proxy(cargo, "api", "GET", "/flaky"); err == nil {
+			t.Fatal("expected a failing upstream to halt the pipeline")
+		}
+	}
+	if n := calls.Load(); n != 5 {
+		t.Errorf("expected the circuit to open after 2 failures, got %d calls for 5", n)
+	}
+	sent := conn.Sent()
+	if want := `{"event":"proxy_error","replyTo":"r1","payload":{"error":"upstream unavailable","status":503}}`; len(sent) != 6 || string(sent[5]) != want {
+		t.Errorf("expected %s once the circuit opened, got %q", want, sent)
+	}
+}
+
+func TestProxyCountsOnlyUpstreamFailuresAgainstTheCircuit(t *testing.T) {
+	var calls atomic.Int32
+	proxy, cargo, _ := newProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		io.WriteString(w, `{}`)
+	}, engine.Upstream{FailureThreshold: 2})
+
+	// a newline templated into a header, JSON-encoded then decoded.
+	for range 3 {
+		if err := proxy(cargo, "api", "GET", "/profile", "", "", `{"X-Note": "hi\r\nX-Admin: 1"}`); err == nil {
+			t.Fatal("expected a header with a newline to be rejected")
+		}
+	}
+	// the client went away before the upstream answered.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	gone := *cargo
+	gone.Ctx = ctx
+	for range 3 {
+		if err := proxy(&gone, "api", "GET", "/profile"); err == nil {
+			t.Fatal("expected a cancelled request to fail")
+		}
+	}
+
+	if err := proxy(cargo, "api", "GET", "/profile"); err != nil {
+		t.Errorf("expected the circuit to stay closed, got %v", err)
+	}
+	if n := calls.Load(); n != 1 {
+		t.Errorf("expected only the last request to reach the upstream, got %d", n)
+	}
+}
+
+func TestProxyHalfOpenCircuitLetsOneProbeThrough(t *testing.T) {
+	entered, unblock := make(chan struct{}), make(chan struct{})
+	proxy, cargo, _ := newProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/slow":
+			entered <- struct{}{}
+			<-unblock
+			io.WriteString(w, `{}`)
+		case "/ok":
+			io.WriteString(w, `{}`)
+		default:
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}, engine.Upstream{FailureThreshold: 1, Cooldown: 20 * time.Millisecond})
+
+	proxy(cargo, "api", "GET", "/fail")
+	if err := proxy(cargo, "api", "GET", "/ok"); !errors.Is(err, engine.ErrCircuitOpen) {
+		t.Fatalf("expected the circuit to be open, got %v", err)
+	}
+	time.Sleep(30 * time.Millisecond)
+
+	done := make(chan error)
+	go func() { done <- proxy(cargo, "api", "GET", "/slow") }()
+	<-entered
+	if err := proxy(cargo, "api", "GET", "/ok"); !errors.Is(err, engine.ErrCircuitOpen) {
+		t.Errorf("expected requests during the probe to be rejected, got %v", err)
+	}
+	close(unblock)
+	if err := <-done; err != nil {
+		t.Fatalf("expected the probe to succeed, got %v", err)
+	}
+	if err := proxy(cargo, "api", "GET", "/ok"); err != nil {
+		t.Errorf("expected a successful probe to close the circuit, got %v", err)
+	}
+
+	// a failed probe opens it again.
+	proxy(cargo, "api", "GET", "/fail")
+	time.Sleep(30 * time.Millisecond)
+	if err := proxy(cargo, "api", "GET", "/fail"); err == nil || errors.Is(err, engine.ErrCircuitOpen) {
+		t.Fatalf("expected the probe to reach the upstream and fail, got %v", err)
+	}
+	if err := proxy(cargo, "api", "GET", "/ok"); !errors.Is(err, engine.ErrCircuitOpen) {
+		t.Errorf("expected a failed probe to reopen the circuit, got %v", err)
+	}
+}
+
+func TestProxyRejectsRequestsOverTheLimit(t *testing.T) {
+	entered, unblock := make(chan struct{}), make(chan struct{})
+	proxy, cargo, _ := newProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		entered <- struct{}{}
+		<-unblock
+		io.WriteString(w, `{}`)
+	}, engine.Upstream{MaxConcurrent: 1})
+
+	done := make(chan error)
+	go func() { done <- proxy(cargo, "api", "GET", "/slow") }()
+	<-entered
+	if err := proxy(cargo, "api", "GET", "/slow"); !errors.Is(err, engine.ErrUpstreamBusy) {
+		t.Errorf("expected a second request over the limit to be rejected, got %v", err)
+	}
+	close(unblock)
+	if err := <-done; err != nil {
+		t.Errorf("expected the first request to succeed, got %v", err)
+	}
+}
+
+func TestProxyRejectsBadParams(t *testing.T) {
+	var calls atomic.Int32
+	proxy, cargo, conn := newProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+	}, engine.Upstream{})
+	noConn := *cargo
+	noConn.Connection = nil
+
+	tests := []struct {
+		name   string
+		cargo  *pipeline.Cargo
+		params []string
+	}{
+		{"too few params", cargo, []string{"api", "GET"}},
+		{"too many params", cargo, []string{"api", "GET", "/", "", "", "", "{}", "x"}},
+		{"no connection", &noConn, []string{"api", "GET", "/users"}},
+		{"unknown upstream", cargo, []string{"profiles", "GET", "/users"}},
+		{"unknown method", cargo, []string{"api", "TRACE", "/users"}},
+		{"relative path", cargo, []string{"api", "GET", "users"}},
+		{"parent path", cargo, []string{"api", "GET", "/users/../admin"}},
+		{"fragment", cargo, []string{"api", "GET", "/users#admin"}},
+		{"invalid headers", cargo, []string{"api", "GET", "/users", "", "", `["X-Trace"]`}},
+		{"reserved header", cargo, []string{"api", "GET", "/users", "", "", `{"x-dispatch-signature": "sha256=forged"}`}},
+		{"invalid body", cargo, []string{"api", "POST", "/users", "", "", "", `{"name":`}},
+	}
+	for _, tt := range tests {
+		if err := proxy(tt.cargo, tt.params...); err == nil {
+			t.Errorf("%s: expected an error", tt.name)
+		} else if strings.Contains(err.Error(), "upstream returned") {
+			t.Errorf("%s: the request was sent: %v", tt.name, err)
+		}
+	}
+	if n := calls.Load(); n != 0 {
+		t.Errorf("rejected requests reached the upstream %d times", n)
+	}
+	if sent := conn.Sent(); len(sent) != 0 {
+		t.Errorf("rejected requests were answered: %q", sent)
+	}
+}
@@ -0,0 +1,132 @@
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"time"
+
+	"github.com/a-essam23/go-dispatch/pkg/pipeline"
+	"github.com/a-essam23/go-dispatch/pkg/state"
+	"github.com/a-essam23/go-dispatch/pkg/transport"
+	"github.com/google/uuid"
+)
+
+const (
+	// ReceiptEvent tells a sender that a recipient got or read their message.
+	ReceiptEvent = "receipt"
+
+	receiptsModifier        = "receipts"
+	defaultReceiptRetention = 24 * time.Hour
+)
+
+type receiptPayload struct {
+	MessageID  string              `json:"id"`
+	Event      string              `json:"event"`
+	UserID     string              `json:"userId"`
+	Status     state.ReceiptStatus `json:"status"`
+	Recipients int                 `json:"recipients"`
+	Delivered  int                 `json:"delivered"`
+	Read       int                 `json:"read"`
+}
+
+// the receipts modifier tracks every notification of the pipeline: params are
+// [retention?], defaulting to the configured retention.
+func newReceiptsModifier(retention time.Duration) pipeline.ModifierFunc {
+	if retention <= 0 {
+		retention = defaultReceiptRetention
+	}
+	return func(pctx *pipeline.Cargo, params ...string) error {
+		if len(params) > 1 {
+			return errors.New("'receipts' modifier accepts at most 1 parameter: [retention?]")
+		}
+		ttl, err := ttlParam(params, 0, retention)
+		if err != nil {
+			return fmt.Errorf("'receipts' modifier: %w", err)
+		}
+		pctx.Receipts = &pipeline.ReceiptTracking{Retention: ttl}
+		return nil
+	}
+}
+
+// trackReceipts starts tracking the receipts of a message sent to conns. Its
+// recipients are the users owning conns, except the sender; notifications
+// without a sender are not tracked.
+func trackReceipts(pctx *pipeline.Cargo, messageID, eventName string, conns []transport.Conn) {
+	if pctx.User == nil {
+		return
+	}
+	seen := make(map[string]bool)
+	var recipients []string
+	for _, conn := range conns {
+		c, ok := pctx.StateManager.GetConnection(conn.ID())
+		if !ok || c.User == nil || c.User.ID == pctx.User.ID || seen[c.User.ID] {
+			continue
+		}
+		seen[c.User.ID] = true
+		recipients = append(recipients, c.User.ID)
+	}
+	slices.Sort(recipients)
+
+	now := time.Now()
+	err := pctx.StateManager.TrackMessage(state.Receipt{
+		MessageID:  messageID,
+		Event:      eventName,
+		Sender:     pctx.User.ID,
+		Recipients: recipients,
+		SentAt:     now,
+		ExpiresAt:  now.Add(pctx.Receipts.Retention),
+	})
+	if err != nil {
+		pctx.Logger.Error("Failed to track message receipts", slog.String("messageID", messageID), slog.Any("error", err))
+	}
+}
+
+// params: [messageIDs]. messageIDs is a comma separated list of tracked
+// messages the triggering user got (_delivered) or read (_read). Each change is
+// sent to the message's sender as a receipt event; acknowledging an unknown,
+// expired or foreign message does nothing.
+func newAckAction(name string, status state.ReceiptStatus) pipeline.ActionFunc {
+	return func(pctx *pipeline.Cargo, params ...string) error {
+		if len(params) != 1 {
+			return fmt.Errorf("%s requires 1 parameter: [messageIDs]", name)
+		}
+		if pctx.User == nil {
+			return fmt.Errorf("%s requires a user", name)
+		}
+		messageIDs := splitList(params[0])
+		// before acknowledging any, so a bad list changes nothing.
+		for _, messageID := range messageIDs {
+			if _, err := uuid.Parse(messageID); err != nil {
+				return fmt.Errorf("%s: invalid message ID '%s'", name, messageID)
+			}
+		}
+		for _, messageID := range messageIDs {
+			r, changed, err := pctx.StateManager.AckMessage(messageID, pctx.User.ID, status, time.Now())
+			if errors.Is(err, state.ErrReceiptNotFound) || errors.Is(err, state.ErrNotRecipient) {
+				pctx.Logger.Debug("Ignoring acknowledgement", slog.String("messageID", messageID), slog.Any("error", err))
+				continue
+			}
+			if err != nil {
+				return fmt.Errorf("%s: %w", name, err)
+			}
+			if !changed {
+				continue
+			}
+			payload := receiptPayload{
+				MessageID:  r.MessageID,
+				Event:      r.Event,
+				UserID:     pctx.User.ID,
+				Status:     status,
+				Recipients: len(r.Recipients),
+				Delivered:  len(r.Delivered),
+				Read:       len(r.Read),
+			}
+			if err := fanOutEvent(pctx, "user:"+r.Sender, ReceiptEvent, payload, transport.PriorityNormal); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
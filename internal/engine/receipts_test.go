@@ -0,0 +1,141 @@
+package engine_test
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/a-essam23/go-dispatch/pkg/pipeline"
+	"github.com/google/uuid"
+)
+
+// sends a message tracked for retention from sender ("" for the server) to
+// the env's target, checked through bob, and returns the message's ID.
+func sendTracked(env *testEnv, sender, retention string) string {
+	t := env.t
+	t.Helper()
+	send := env.cargo(sender)
+	if err := env.modifier("receipts")(send, retention); err != nil {
+		t.Fatalf("receipts modifier failed: %v", err)
+	}
+	runAction(t, env.reg, send, "_notify_room", "new_message", `{"text":"hi"}`)
+
+	var msg struct {
+		ID string `json:"id"`
+	}
+	if sent := env.conns["bob"].Sent(); len(sent) != 1 || json.Unmarshal(sent[0], &msg) != nil || msg.ID == "" {
+		t.Fatalf("expected one notification with a message ID, got %q", sent)
+	}
+	env.resetSent()
+	return msg.ID
+}
+
+func TestReceiptsAreAggregatedAndSentToTheSender(t *testing.T) {
+	env := newTestEnv(t, nil)
+	env.target = "lobby"
+	env.joinAll("lobby", "alice", "bob", "carol")
+	env.connectAll("dave")
+	msgID := sendTracked(env, "alice", "1h")
+
+	env.run("bob", "_delivered", msgID)
+	env.run("bob", "_read", msgID)
+	env.run("bob", "_read", msgID) // already read: no receipt
+	env.run("carol", "_read", msgID)
+
+	want := []string{
+		`{"event":"receipt","payload":{"id":"` + msgID + `","event":"new_message","userId":"bob","status":"delivered","recipients":2,"delivered":1,"read":0}}`,
+		`{"event":"receipt","payload":{"id":"` + msgID + `","event":"new_message","userId":"bob","status":"read","recipients":2,"delivered":1,"read":1}}`,
+		`{"event":"receipt","payload":{"id":"` + msgID + `","event":"new_message","userId":"carol","status":"read","recipients":2,"delivered":2,"read":2}}`,
+	}
+	sent := env.conns["alice"].Sent()
+	if len(sent) != len(want) {
+		t.Fatalf("expected %d receipts, got %d: %q", len(want), len(sent), sent)
+	}
+	for i := range want {
+		if string(sent[i]) != want[i] {
+			t.Errorf("receipt %d = %s, want %s", i, sent[i], want[i])
+		}
+	}
+	for _, userID := range []string{"bob", "carol", "dave"} {
+		if got := len(env.conns[userID].Sent()); got != 0 {
+			t.Errorf("receipts should only reach the sender, %s got %d", userID, got)
+		}
+	}
+}
+
+func TestAcknowledgingAMessageNotTrackedForTheUserIsIgnored(t *testing.T) {
+	env := newTestEnv(t, nil)
+	env.target = "lobby"
+	env.joinAll("lobby", "alice", "bob", "carol")
+	env.connectAll("dave")
+	msgID := sendTracked(env, "alice", "1h")
+
+	env.run("dave", "_read", msgID)           // not a recipient
+	env.run("alice", "_read", msgID)          // the sender
+	env.run("bob", "_read", uuid.NewString()) // unknown
+	env.run("bob", "_read", " , ")            // blank
+	if sent := env.conns["alice"].Sent(); len(sent) != 0 {
+		t.Errorf("expected no receipts, got %q", sent)
+	}
+}
+
+func TestReceiptsExpireAfterTheirRetention(t *testing.T) {
+	env := newTestEnv(t, nil)
+	env.target = "lobby"
+	env.joinAll("lobby", "alice", "bob", "carol")
+	msgID := sendTracked(env, "alice", "10ms")
+
+	time.Sleep(30 * time.Millisecond)
+	env.run("bob", "_read", msgID)
+	if sent := env.conns["alice"].Sent(); len(sent) != 0 {
+		t.Errorf("a receipt was sent for an expired message: %q", sent)
+	}
+}
+
+func TestNotificationsWithoutASenderAreNotTracked(t *testing.T) {
+	env := newTestEnv(t, nil)
+	env.target = "lobby"
+	env.joinAll("lobby", "alice", "bob", "carol")
+	msgID := sendTracked(env, "", "1h")
+
+	env.run("bob", "_read", msgID)
+	for userID, conn := range env.conns {
+		if sent := conn.Sent(); len(sent) != 0 {
+			t.Errorf("%s was sent a receipt for a server message: %q", userID, sent)
+		}
+	}
+}
+
+func TestReceiptsRejectBadParams(t *testing.T) {
+	env := newTestEnv(t, nil)
+	env.target = "lobby"
+	env.joinAll("lobby", "alice", "bob", "carol")
+	msgID := sendTracked(env, "alice", "1h")
+	receipts := env.modifier("receipts")
+	read := env.action("_read")
+
+	for _, params := range [][]string{{"1h", "x"}, {"soon"}, {"-1h"}} {
+		if err := receipts(env.cargo("alice"), params...); err == nil {
+			t.Errorf("receipts %q: expected an error", params)
+		}
+	}
+	tests := []struct {
+		name   string
+		cargo  *pipeline.Cargo
+		params []string
+	}{
+		{"no IDs", env.cargo("bob"), nil},
+		{"too many params", env.cargo("bob"), []string{msgID, "x"}},
+		{"malformed ID", env.cargo("bob"), []string{msgID + ",abc"}},
+		{"no user", env.cargo(""), []string{msgID}},
+	}
+	for _, tt := range tests {
+		if err := read(tt.cargo, tt.params...); err == nil {
+			t.Errorf("_read %s: expected an error", tt.name)
+		}
+	}
+	// a malformed ID rejects the list before any of it is acknowledged.
+	if sent := env.conns["alice"].Sent(); len(sent) != 0 {
+		t.Errorf("a rejected acknowledgement sent receipts: %q", sent)
+	}
+}
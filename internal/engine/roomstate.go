@@ -0,0 +1,126 @@
+package engine
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/a-essam23/go-dispatch/pkg/jsonpatch"
+	"github.com/a-essam23/go-dispatch/pkg/pipeline"
+	"github.com/a-essam23/go-dispatch/pkg/transport"
+)
+
+// reserved events of the room state subsystem.
+const (
+	// RoomPatchEvent carries a patch applied to a room's state to its members.
+	RoomPatchEvent = "room_patch"
+	// RoomSnapshotEvent answers _room_snapshot with a room's full state.
+	RoomSnapshotEvent = "room_snapshot"
+)
+
+type roomPatchPayload struct {
+	Room    string          `json:"room"`
+	Version uint64          `json:"version"`
+	Patch   jsonpatch.Patch `json:"patch"`
+}
+
+// params: [path, value, version?]. Sets the value at a JSON pointer into the
+// target room's state, e.g. "/meta/title" or "/data/score". A value that is not
+// valid JSON is taken as a string.
+func actionRoomSet(pctx *pipeline.Cargo, params ...string) error {
+	if len(params) != 2 && len(params) != 3 {
+		return errors.New("_room_set requires 2 or 3 parameters: [path, value, version?]")
+	}
+	value := json.RawMessage(params[1])
+	if !json.Valid(value) {
+		value, _ = json.Marshal(params[1])
+	}
+	patch := jsonpatch.Patch{{Op: "add", Path: params[0], Value: value}}
+	return patchRoom(pctx, "_room_set", patch, params[2:])
+}
+
+// params: [patch, version?]. patch is an RFC 6902 JSON Patch against the
+// target room's state.
+func actionRoomPatch(pctx *pipeline.Cargo, params ...string) error {
+	if len(params) != 1 && len(params) != 2 {
+		return errors.New("_room_patch requires 1 or 2 parameters: [patch, version?]")
+	}
+	patch, err := jsonpatch.Decode([]byte(params[0]))
+	if err != nil {
+		return fmt.Errorf("_room_patch: %w", err)
+	}
+	return patchRoom(pctx, "_room_patch", patch, params[1:])
+}
+
+// changesMeta reports whether patch changes the room's attributes rather than
+// only its data; replacing the whole document does.
+func changesMeta(patch jsonpatch.Patch) bool {
+	isMeta := func(path string) bool {
+		return path == "/meta" || strings.HasPrefix(path, "/meta/")
+	}
+	for _, op := range patch {
+		if op.Op == "test" {
+			continue
+		}
+		if op.Path == "" || isMeta(op.Path) || (op.Op == "move" && isMeta(op.From)) {
+			return true
+		}
+	}
+	return false
+}
+
+// patchRoom applies patch as the triggering user, who must be a member and,
+// to change the room's meta, one of its moderators. The patch is broadcast to
+// the room with the version it produced.
+func patchRoom(pctx *pipeline.Cargo, action string, patch jsonpatch.Patch, version []string) error {
+	if pctx.User == nil {
+		return fmt.Errorf("%s requires a user", action)
+	}
+	roomID := pctx.TargetID
+	if _, member := pctx.StateManager.GetGrant(pctx.User.ID, roomID); !member {
+		return fmt.Errorf("%s: user '%s' is not a member of room '%s'", action, pctx.User.ID, roomID)
+	}
+	if changesMeta(patch) && !isModerator(pctx.StateManager, roomID, pctx.User.ID) {
+		return fmt.Errorf("%s: only moderators may change the meta of room '%s'", action, roomID)
+	}
+	var expected *uint64
+	if len(version) == 1 && version[0] != "" {
+		v, err := strconv.ParseUint(version[0], 10, 64)
+		if err != nil {
+			return fmt.Errorf("%s: invalid version '%s'", action, version[0])
+		}
+		expected = &v
+	}
+
+	applied, err := pctx.StateManager.PatchRoomState(roomID, patch, expected)
+	if err != nil {
+		return fmt.Errorf("%s: %w", action, err)
+	}
+	return fanOutEvent(pctx, roomID, RoomPatchEvent, roomPatchPayload{Room: roomID, Version: applied.Version, Patch: patch}, transport.PriorityNormal)
+}
+
+// params: [roomID?], defaulting to the event's target. Replies to the origin
+// with the room's full state; typically run right after _join.
+func actionRoomSnapshot(pctx *pipeline.Cargo, params ...string) error {
+	if len(params) > 1 {
+		return errors.New("_room_snapshot accepts at most 1 parameter: [roomID?]")
+	}
+	if pctx.User == nil {
+		return errors.New("_room_snapshot requires a user")
+	}
+	roomID := pctx.TargetID
+	if len(params) == 1 {
+		roomID = params[0]
+	}
+	if _, member := pctx.StateManager.GetGrant(pctx.User.ID, roomID); !member {
+		return fmt.Errorf("_room_snapshot: user '%s' is not a member of room '%s'", pctx.User.ID, roomID)
+	}
+
+	snapshot, err := pctx.StateManager.GetRoomState(roomID)
+	if err != nil {
+		return fmt.Errorf("_room_snapshot: %w", err)
+	}
+	return fanOutEvent(pctx, "user:"+pctx.User.ID, RoomSnapshotEvent, snapshot, transport.PriorityNormal)
+}
@@ -0,0 +1,128 @@
+package engine_test
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/a-essam23/go-dispatch/pkg/state"
+)
+
+func TestRoomPatchesAreBroadcastWithVersions(t *testing.T) {
+	env := newTestEnv(t, nil)
+	env.target = "board"
+	env.joinAll("board", "alice", "bob")
+
+	env.run("alice", "_room_set", "/meta/title", "Sketches")
+	env.run("bob", "_room_patch", `[{"op":"add","path":"/data/shapes","value":[{"kind":"circle"}]}]`, "1")
+	want := []string{
+		`{"event":"room_patch","payload":{"room":"board","version":1,"patch":[{"op":"add","path":"/meta/title","value":"Sketches"}]}}`,
+		`{"event":"room_patch","payload":{"room":"board","version":2,"patch":[{"op":"add","path":"/data/shapes","value":[{"kind":"circle"}]}]}}`,
+	}
+	for name, conn := range env.conns {
+		sent := conn.Sent()
+		if len(sent) != len(want) {
+			t.Fatalf("%s: expected %d patches, got %q", name, len(want), sent)
+		}
+		for i := range want {
+			if string(sent[i]) != want[i] {
+				t.Errorf("%s: want %s, got %s", name, want[i], sent[i])
+			}
+		}
+	}
+}
+
+func TestRoomPatchRejectsAStaleVersion(t *testing.T) {
+	env := newTestEnv(t, nil)
+	env.target = "board"
+	env.joinAll("board", "alice", "bob")
+	env.run("alice", "_room_set", "/data/score", "1")
+
+	patch := env.action("_room_patch")
+	if err := patch(env.cargo("alice"), `[{"op":"remove","path":"/data/score"}]`, "0"); err == nil {
+		t.Error("a patch against a stale version was applied")
+	}
+	if err := patch(env.cargo("alice"), `[{"op":"remove","path":"/data/score"}]`, "latest"); err == nil {
+		t.Error("a malformed version was accepted")
+	}
+	if n := len(env.conns["bob"].Sent()); n != 1 {
+		t.Errorf("rejected patches were broadcast: %d messages", n)
+	}
+}
+
+func TestRoomMetaChangesRequireAModerator(t *testing.T) {
+	env := newTestEnv(t, nil)
+	env.target = "board"
+	env.joinAll("board", "alice", "bob")
+	set := env.action("_room_set")
+	patch := env.action("_room_patch")
+
+	if err := set(env.cargo("bob"), "/meta/title", "Mine now"); err == nil {
+		t.Error("a member who is not a moderator changed the title")
+	}
+	for _, p := range []string{
+		`[{"op":"replace","path":"/meta/topic","value":"x"}]`,
+		`[{"op":"move","from":"/meta/custom","path":"/data/custom"}]`,
+		`[{"op":"replace","path":"","value":{}}]`,
+	} {
+		if err := patch(env.cargo("bob"), p); err == nil {
+			t.Errorf("a member who is not a moderator applied %s", p)
+		}
+	}
+	if len(env.conns["alice"].Sent()) != 0 {
+		t.Errorf("rejected meta changes were broadcast: %q", env.conns["alice"].Sent())
+	}
+
+	// testing meta while changing data is not a meta change.
+	env.run("bob", "_room_patch", `[{"op":"test","path":"/meta/owner","value":"alice"},{"op":"add","path":"/data/x","value":1}]`)
+
+	env.cargo("bob").User.GlobalPermissions = state.PermModerate
+	env.run("bob", "_room_set", "/meta/topic", "moderated")
+}
+
+func TestRoomStateRequiresMembership(t *testing.T) {
+	env := newTestEnv(t, nil)
+	env.target = "board"
+	env.joinAll("board", "alice", "bob")
+	bob := env.cargo("bob")
+	bob.TargetID = "vault"
+	for _, action := range []string{"_room_set", "_room_patch", "_room_snapshot"} {
+		fn := env.action(action)
+		params := map[string][]string{
+			"_room_set":      {"/data/x", "1"},
+			"_room_patch":    {`[{"op":"add","path":"/data/x","value":1}]`},
+			"_room_snapshot": nil,
+		}[action]
+		if err := fn(bob, params...); err == nil {
+			t.Errorf("%s: a non-member was allowed", action)
+		}
+	}
+}
+
+func TestRoomSnapshotRepliesWithTheFullState(t *testing.T) {
+	env := newTestEnv(t, nil)
+	env.target = "board"
+	env.joinAll("board", "alice", "bob")
+	env.run("alice", "_room_set", "/meta/title", "Sketches")
+	env.run("alice", "_room_set", "/data/shapes", `[{"kind":"circle"}]`)
+	env.conns["bob"].Reset()
+
+	env.run("bob", "_room_snapshot")
+	sent := env.conns["bob"].Sent()
+	if len(sent) != 1 {
+		t.Fatalf("expected one snapshot, got %q", sent)
+	}
+	var snapshot struct {
+		Event   string          `json:"event"`
+		Payload state.RoomState `json:"payload"`
+	}
+	if err := json.Unmarshal(sent[0], &snapshot); err != nil {
+		t.Fatalf("invalid snapshot %s: %v", sent[0], err)
+	}
+	p := snapshot.Payload
+	if snapshot.Event != "room_snapshot" || p.Version != 2 || p.Meta.Title != "Sketches" || p.Meta.Owner != "alice" || string(p.Data) != `{"shapes":[{"kind":"circle"}]}` {
+		t.Errorf("unexpected snapshot %s", sent[0])
+	}
+	if len(env.conns["alice"].Sent()) != 2 {
+		t.Error("the snapshot was sent to other members")
+	}
+}
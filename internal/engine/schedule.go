@@ -0,0 +1,364 @@
+package engine
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/a-essam23/go-dispatch/pkg/cron"
+	"github.com/a-essam23/go-dispatch/pkg/pipeline"
+	"github.com/google/uuid"
+)
+
+// Invocation is a run of an event's pipeline that no client message triggered.
+type Invocation struct {
+	Event   string          `json:"event"`
+	Target  string          `json:"target"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+	// the user the pipeline runs as, if they are still known; empty for none.
+	UserID string `json:"userId,omitempty"`
+}
+
+func (inv Invocation) equal(other Invocation) bool {
+	return inv.Event == other.Event && inv.Target == other.Target && inv.UserID == other.UserID && bytes.Equal(inv.Payload, other.Payload)
+}
+
+// PipelineRunner runs invocations; the router provides it.
+type PipelineRunner func(inv Invocation) error
+
+const defaultMaxJobsPerUser = 100
+
+// ErrTooManyJobs is returned when a user schedules more jobs than may be
+// pending at once.
+var ErrTooManyJobs = errors.New("too many pending jobs")
+
+// ScheduledJob is an invocation due once, at RunAt. Its key is scoped to the
+// user scheduling it, its UserID, so users can neither replace nor cancel
+// each other's jobs.
+type ScheduledJob struct {
+	Key string `json:"key"`
+	Invocation
+	RunAt     time.Time `json:"runAt"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// CronSchedule is an invocation repeated on a cron schedule.
+type CronSchedule struct {
+	Name     string        `json:"name"`
+	Spec     string        `json:"cron"`
+	Schedule cron.Schedule `json:"-"`
+	Invocation
+	// when it fires next; set by the scheduler.
+	Next time.Time `json:"next"`
+}
+
+// jobKey identifies a pending job: its key within its owner's, the user who
+// scheduled it or "" for the server.
+type jobKey struct {
+	owner, key string
+}
+
+type scheduledJob struct {
+	ScheduledJob
+	timer *time.Timer
+}
+
+func (j *scheduledJob) id() jobKey {
+	return jobKey{owner: j.UserID, key: j.Key}
+}
+
+type cronJob struct {
+	CronSchedule
+	timer *time.Timer
+}
+
+// Scheduler runs invocations later: one-shot jobs, keyed per user so they can
+// be replaced or cancelled, and named cron schedules. Jobs name their event
+// rather than hold its compiled pipeline; SetCronSchedules leaves one-shot
+// jobs, and cron schedules that did not change, untouched.
+type Scheduler struct {
+	mu      sync.Mutex
+	logger  *slog.Logger
+	run     PipelineRunner
+	jobs    map[jobKey]*scheduledJob
+	pending map[string]int // jobs per user, but not the server's
+	crons   map[string]*cronJob
+	stopped bool
+	// how many jobs a user may have pending at once.
+	maxPerUser int
+}
+
+func newScheduler(logger *slog.Logger) *Scheduler {
+	return &Scheduler{
+		logger:     logger.With(slog.String("component", "scheduler")),
+		jobs:       make(map[jobKey]*scheduledJob),
+		pending:    make(map[string]int),
+		crons:      make(map[string]*cronJob),
+		maxPerUser: defaultMaxJobsPerUser,
+	}
+}
+
+func (s *Scheduler) SetRunner(run PipelineRunner) {
+	s.mu.Lock()
+	s.run = run
+	s.mu.Unlock()
+}
+
+// SetMaxJobsPerUser sets how many jobs a user may have pending at once;
+// jobs already pending are kept.
+func (s *Scheduler) SetMaxJobsPerUser(n int) {
+	s.mu.Lock()
+	s.maxPerUser = n
+	s.mu.Unlock()
+}
+
+// Schedule runs inv at runAt, replacing the pending job of the same key
+// scheduled by the same user, inv.UserID. A user may have at most the
+// configured number of jobs pending; the server's jobs are not limited.
+func (s *Scheduler) Schedule(key string, runAt time.Time, inv Invocation) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stopped {
+		return errors.New("scheduler is stopped")
+	}
+	id := jobKey{owner: inv.UserID, key: key}
+	if old, ok := s.jobs[id]; ok {
+		old.timer.Stop()
+		s.remove(old)
+	} else if inv.UserID != "" && s.pending[inv.UserID] >= s.maxPerUser {
+		return fmt.Errorf("%w: user '%s' has %d", ErrTooManyJobs, inv.UserID, s.pending[inv.UserID])
+	}
+	job := &scheduledJob{ScheduledJob: ScheduledJob{Key: key, Invocation: inv, RunAt: runAt, CreatedAt: time.Now()}}
+	job.timer = time.AfterFunc(time.Until(runAt), func() { s.fire(job) })
+	s.jobs[id] = job
+	if inv.UserID != "" {
+		s.pending[inv.UserID]++
+	}
+	s.logger.Debug("Job scheduled", slog.String("key", key), slog.String("userID", inv.UserID), slog.String("event", inv.Event), slog.Time("runAt", runAt))
+	return nil
+}
+
+// Cancel drops the pending job of key scheduled by userID, "" for the server,
+// reporting whether there was one.
+func (s *Scheduler) Cancel(userID, key string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	job, ok := s.jobs[jobKey{owner: userID, key: key}]
+	if ok {
+		job.timer.Stop()
+		s.remove(job)
+	}
+	return ok
+}
+
+// remove forgets a pending job. Must be called with s.mu held.
+func (s *Scheduler) remove(job *scheduledJob) {
+	delete(s.jobs, job.id())
+	if job.UserID == "" {
+		return
+	}
+	if s.pending[job.UserID]--; s.pending[job.UserID] == 0 {
+		delete(s.pending, job.UserID)
+	}
+}
+
+func (s *Scheduler) fire(job *scheduledJob) {
+	s.mu.Lock()
+	if s.jobs[job.id()] != job {
+		// replaced or cancelled after the timer fired.
+		s.mu.Unlock()
+		return
+	}
+	s.remove(job)
+	run := s.run
+	s.mu.Unlock()
+	s.invoke(run, job.Invocation)
+}
+
+// SetCronSchedules replaces the cron schedules. Those whose name, expression
+// and invocation did not change keep their timers.
+func (s *Scheduler) SetCronSchedules(schedules []CronSchedule) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stopped {
+		return
+	}
+	next := make(map[string]*cronJob, len(schedules))
+	for _, cs := range schedules {
+		if old, ok := s.crons[cs.Name]; ok && old.Spec == cs.Spec && old.Invocation.equal(cs.Invocation) {
+			next[cs.Name] = old
+			delete(s.crons, cs.Name)
+			continue
+		}
+		cj := &cronJob{CronSchedule: cs}
+		s.arm(cj, time.Now())
+		next[cs.Name] = cj
+	}
+	for _, removed := range s.crons {
+		removed.timer.Stop()
+	}
+	s.crons = next
+	s.logger.Info("Cron schedules set", slog.Int("count", len(next)))
+}
+
+// arm starts the timer of the schedule's next activation after now. Must be
+// called with s.mu held.
+func (s *Scheduler) arm(cj *cronJob, now time.Time) {
+	cj.Next = cj.Schedule.Next(now)
+	if cj.Next.IsZero() {
+		s.logger.Warn("Cron schedule never fires again", slog.String("name", cj.Name))
+		return
+	}
+	cj.timer = time.AfterFunc(cj.Next.Sub(now), func() { s.fireCron(cj) })
+}
+
+func (s *Scheduler) fireCron(cj *cronJob) {
+	s.mu.Lock()
+	if s.crons[cj.Name] != cj || s.stopped {
+		s.mu.Unlock()
+		return
+	}
+	s.arm(cj, time.Now())
+	run := s.run
+	s.mu.Unlock()
+	s.invoke(run, cj.Invocation)
+}
+
+func (s *Scheduler) invoke(run PipelineRunner, inv Invocation) {
+	if run == nil {
+		s.logger.Warn("No pipeline runner; dropping scheduled invocation", slog.String("event", inv.Event))
+		return
+	}
+	if err := run(inv); err != nil {
+		s.logger.Error("Scheduled pipeline failed", slog.String("event", inv.Event), slog.Any("error", err))
+	}
+}
+
+// Jobs lists the pending one-shot jobs, the soonest first.
+func (s *Scheduler) Jobs() []ScheduledJob {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	jobs := make([]ScheduledJob, 0, len(s.jobs))
+	for _, job := range s.jobs {
+		jobs = append(jobs, job.ScheduledJob)
+	}
+	slices.SortFunc(jobs, func(a, b ScheduledJob) int {
+		if c := a.RunAt.Compare(b.RunAt); c != 0 {
+			return c
+		}
+		if c := strings.Compare(a.UserID, b.UserID); c != 0 {
+			return c
+		}
+		return strings.Compare(a.Key, b.Key)
+	})
+	return jobs
+}
+
+// CronSchedules lists the cron schedules by name.
+func (s *Scheduler) CronSchedules() []CronSchedule {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	crons := make([]CronSchedule, 0, len(s.crons))
+	for _, cj := range s.crons {
+		crons = append(crons, cj.CronSchedule)
+	}
+	slices.SortFunc(crons, func(a, b CronSchedule) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+	return crons
+}
+
+// Stop cancels every job and schedule; nothing can be scheduled afterwards.
+func (s *Scheduler) Stop() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.stopped = true
+	for _, job := range s.jobs {
+		job.timer.Stop()
+	}
+	for _, cj := range s.crons {
+		if cj.timer != nil {
+			cj.timer.Stop()
+		}
+	}
+	s.jobs = make(map[jobKey]*scheduledJob)
+	s.pending = make(map[string]int)
+	s.crons = make(map[string]*cronJob)
+}
+
+// reads when a job runs: a delay such as "5m", or an RFC 3339 time.
+func parseRunAt(when string, now time.Time) (time.Time, error) {
+	if d, err := time.ParseDuration(when); err == nil {
+		if d < 0 {
+			return time.Time{}, fmt.Errorf("negative delay '%s'", when)
+		}
+		return now.Add(d), nil
+	}
+	at, err := time.Parse(time.RFC3339, when)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid time '%s' (want a delay such as \"5m\" or an RFC 3339 time)", when)
+	}
+	return at, nil
+}
+
+// params: [event, when, payload?, target?, key?]. Runs the event's pipeline
+// as the triggering user once when, a delay or an RFC 3339 time, comes.
+// payload and target default to the triggering event's. payload is a JSON
+// template: values resolved into it are JSON-encoded. Scheduling a key the
+// user has pending replaces its job; without a key, the job cannot be
+// cancelled.
+func newScheduleAction(s *Scheduler) pipeline.ActionFunc {
+	return func(pctx *pipeline.Cargo, params ...string) error {
+		if len(params) < 2 || len(params) > 5 {
+			return errors.New("_schedule requires 2 to 5 parameters: [event, when, payload?, target?, key?]")
+		}
+		runAt, err := parseRunAt(params[1], time.Now())
+		if err != nil {
+			return fmt.Errorf("_schedule: %w", err)
+		}
+		inv := Invocation{Event: params[0], Target: pctx.TargetID, Payload: pctx.Payload}
+		if pctx.User != nil {
+			inv.UserID = pctx.User.ID
+		}
+		if len(params) > 2 && params[2] != "" {
+			if !json.Valid([]byte(params[2])) {
+				return errors.New("_schedule: payload is not valid JSON")
+			}
+			inv.Payload = json.RawMessage(params[2])
+		}
+		if len(params) > 3 && params[3] != "" {
+			inv.Target = params[3]
+		}
+		key := uuid.NewString()
+		if len(params) > 4 && params[4] != "" {
+			key = params[4]
+		}
+		if err := s.Schedule(key, runAt, inv); err != nil {
+			return fmt.Errorf("_schedule: %w", err)
+		}
+		return nil
+	}
+}
+
+// params: [key]. Cancels the triggering user's pending job of key, if any.
+func newCancelScheduleAction(s *Scheduler) pipeline.ActionFunc {
+	return func(pctx *pipeline.Cargo, params ...string) error {
+		if len(params) != 1 {
+			return errors.New("_cancel_schedule requires 1 parameter: [key]")
+		}
+		var userID string
+		if pctx.User != nil {
+			userID = pctx.User.ID
+		}
+		if !s.Cancel(userID, params[0]) {
+			pctx.Logger.Debug("No scheduled job to cancel", slog.String("key", params[0]))
+		}
+		return nil
+	}
+}
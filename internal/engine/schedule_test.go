@@ -0,0 +1,208 @@
+package engine_test
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/a-essam23/go-dispatch/internal/engine"
+	"github.com/a-essam23/go-dispatch/pkg/cron"
+	"github.com/a-essam23/go-dispatch/pkg/pipeline"
+)
+
+// makes env's scheduler report the invocations it runs, and stops it when the
+// test ends.
+func recordRuns(env *testEnv) <-chan engine.Invocation {
+	ran := make(chan engine.Invocation, 8)
+	env.reg.Scheduler().SetRunner(func(inv engine.Invocation) error {
+		ran <- inv
+		return nil
+	})
+	env.t.Cleanup(env.reg.Scheduler().Stop)
+	return ran
+}
+
+// returns a cargo of env acting as userID, or as the server for "", with the
+// payload of a poll.
+func pollCargo(env *testEnv, userID string) *pipeline.Cargo {
+	cargo := env.cargo(userID)
+	cargo.Payload = json.RawMessage(`{"poll":1}`)
+	return cargo
+}
+
+// returns the keys of the pending jobs, soonest first, as "user/key".
+func pendingJobs(reg *engine.Registry) []string {
+	var keys []string
+	for _, job := range reg.Scheduler().Jobs() {
+		keys = append(keys, job.UserID+"/"+job.Key)
+	}
+	return keys
+}
+
+func TestScheduleRunsReplacesAndCancelsJobs(t *testing.T) {
+	env := newTestEnv(t, nil)
+	env.target = "poll:1"
+	env.connectAll("alice", "bob")
+	ran := recordRuns(env)
+	alice := pollCargo(env, "alice")
+
+	runAction(t, env.reg, alice, "_schedule", "close_poll", "30ms", "", "", "poll:1")
+	runAction(t, env.reg, alice, "_schedule", "close_poll", "30ms", `{"poll":1,"final":true}`, "", "poll:1") // replaces the first
+	runAction(t, env.reg, alice, "_schedule", "remind", "30ms", "", "user:alice", "reminder")
+	runAction(t, env.reg, alice, "_cancel_schedule", "reminder")
+
+	if jobs := pendingJobs(env.reg); len(jobs) != 1 || jobs[0] != "alice/poll:1" {
+		t.Fatalf("expected only the poll job pending, got %v", jobs)
+	}
+	select {
+	case inv := <-ran:
+		want := engine.Invocation{Event: "close_poll", Target: "poll:1", Payload: json.RawMessage(`{"poll":1,"final":true}`), UserID: "alice"}
+		if inv.Event != want.Event || inv.Target != want.Target || string(inv.Payload) != string(want.Payload) || inv.UserID != want.UserID {
+			t.Errorf("ran %+v, want %+v", inv, want)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the scheduled job did not run")
+	}
+	select {
+	case inv := <-ran:
+		t.Errorf("a replaced or cancelled job ran: %+v", inv)
+	case <-time.After(60 * time.Millisecond):
+	}
+	if jobs := pendingJobs(env.reg); len(jobs) != 0 {
+		t.Errorf("a job that ran is still listed: %v", jobs)
+	}
+}
+
+// returns a cron schedule named name that fires hourly.
+func hourly(t *testing.T, name, event string) engine.CronSchedule {
+	t.Helper()
+	schedule, err := cron.Parse("@hourly")
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	return engine.CronSchedule{Name: name, Spec: "@hourly", Schedule: schedule, Invocation: engine.Invocation{Event: event}}
+}
+
+func TestSetCronSchedulesKeepsPendingJobsAndUnchangedSchedules(t *testing.T) {
+	env := newTestEnv(t, nil)
+	env.target = "poll:1"
+	env.connectAll("alice", "bob")
+	recordRuns(env)
+	runAction(t, env.reg, pollCargo(env, "alice"), "_schedule", "close_poll", "1h", "", "", "poll:1")
+	runAction(t, env.reg, pollCargo(env, ""), "_schedule", "close_poll", "1h", "", "", "poll:2")
+	scheduler := env.reg.Scheduler()
+
+	scheduler.SetCronSchedules([]engine.CronSchedule{hourly(t, "digest", "send_digest")})
+	next := scheduler.CronSchedules()[0].Next
+	time.Sleep(5 * time.Millisecond)
+	scheduler.SetCronSchedules([]engine.CronSchedule{hourly(t, "digest", "send_digest"), hourly(t, "cleanup", "clean_up")})
+
+	crons := scheduler.CronSchedules()
+	if len(crons) != 2 || crons[0].Name != "cleanup" || crons[1].Name != "digest" {
+		t.Fatalf("expected the cleanup and digest schedules, got %+v", crons)
+	}
+	if !crons[1].Next.Equal(next) {
+		t.Errorf("an unchanged schedule was re-armed: next %v, was %v", crons[1].Next, next)
+	}
+	if jobs := pendingJobs(env.reg); len(jobs) != 2 || jobs[0] != "alice/poll:1" || jobs[1] != "/poll:2" {
+		t.Errorf("setting the cron schedules touched the pending jobs: %v", jobs)
+	}
+
+	scheduler.SetCronSchedules(nil)
+	if crons := scheduler.CronSchedules(); len(crons) != 0 {
+		t.Errorf("expected no cron schedules, got %+v", crons)
+	}
+	if jobs := pendingJobs(env.reg); len(jobs) != 2 {
+		t.Errorf("removing the cron schedules touched the pending jobs: %v", jobs)
+	}
+}
+
+func TestScheduleKeysAreScopedToTheSchedulingUser(t *testing.T) {
+	env := newTestEnv(t, nil)
+	env.target = "poll:1"
+	env.connectAll("alice", "bob")
+	ran := recordRuns(env)
+
+	runAction(t, env.reg, pollCargo(env, "alice"), "_schedule", "close_poll", "1h", `{"by":"alice"}`, "", "poll:1")
+	runAction(t, env.reg, pollCargo(env, ""), "_schedule", "close_poll", "1h", `{"by":"server"}`, "", "poll:1")
+	runAction(t, env.reg, pollCargo(env, "bob"), "_schedule", "close_poll", "20ms", `{"by":"bob"}`, "", "poll:1")
+	runAction(t, env.reg, pollCargo(env, "bob"), "_cancel_schedule", "poll:1")
+	runAction(t, env.reg, pollCargo(env, "bob"), "_cancel_schedule", "poll:1") // nothing left to cancel
+
+	if jobs := pendingJobs(env.reg); len(jobs) != 2 || jobs[0] != "alice/poll:1" || jobs[1] != "/poll:1" {
+		t.Errorf("expected bob to replace and cancel only his own job, got %v", jobs)
+	}
+	runAction(t, env.reg, pollCargo(env, ""), "_cancel_schedule", "poll:1")
+	if jobs := pendingJobs(env.reg); len(jobs) != 1 || jobs[0] != "alice/poll:1" {
+		t.Errorf("expected the server to cancel only its own job, got %v", jobs)
+	}
+	select {
+	case inv := <-ran:
+		t.Errorf("a cancelled job ran: %+v", inv)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestSchedulePendingJobsAreCappedPerUser(t *testing.T) {
+	env := newTestEnv(t, &engine.RegisterCoreOptions{MaxJobsPerUser: 2})
+	env.target = "poll:1"
+	env.connectAll("alice", "bob")
+	recordRuns(env)
+	schedule := env.action("_schedule")
+	alice := pollCargo(env, "alice")
+
+	runAction(t, env.reg, alice, "_schedule", "remind", "1h", "", "", "a")
+	runAction(t, env.reg, alice, "_schedule", "remind", "1h", "", "", "b")
+	if err := schedule(alice, "remind", "1h", "", "", "c"); !errors.Is(err, engine.ErrTooManyJobs) {
+		t.Errorf("expected a third pending job to be refused, got %v", err)
+	}
+	runAction(t, env.reg, alice, "_schedule", "remind", "2h", "", "", "b") // replacing does not add a job
+	runAction(t, env.reg, pollCargo(env, "bob"), "_schedule", "remind", "1h")
+	for i := range 3 {
+		runAction(t, env.reg, pollCargo(env, ""), "_schedule", "stats", "1h", "", "", string(rune('a'+i)))
+	}
+
+	runAction(t, env.reg, alice, "_cancel_schedule", "a")
+	runAction(t, env.reg, alice, "_schedule", "remind", "1h", "", "", "c")
+	if got := len(env.reg.Scheduler().Jobs()); got != 6 {
+		t.Errorf("expected 6 pending jobs, got %v", pendingJobs(env.reg))
+	}
+}
+
+func TestScheduleRejectsBadParams(t *testing.T) {
+	env := newTestEnv(t, nil)
+	env.target = "poll:1"
+	env.connectAll("alice", "bob")
+	recordRuns(env)
+	schedule := env.action("_schedule")
+	cancel := env.action("_cancel_schedule")
+	alice := pollCargo(env, "alice")
+
+	tests := []struct {
+		name   string
+		params []string
+	}{
+		{"too few params", []string{"close_poll"}},
+		{"too many params", []string{"close_poll", "1m", "", "", "k", "x"}},
+		{"invalid time", []string{"close_poll", "soon"}},
+		{"negative delay", []string{"close_poll", "-1m"}},
+		{"invalid payload", []string{"close_poll", "1m", `{"poll":`}},
+	}
+	for _, tt := range tests {
+		if err := schedule(alice, tt.params...); err == nil {
+			t.Errorf("%s: expected an error", tt.name)
+		}
+	}
+	if err := cancel(alice); err == nil {
+		t.Error("_cancel_schedule without a key: expected an error")
+	}
+	if jobs := pendingJobs(env.reg); len(jobs) != 0 {
+		t.Errorf("a rejected job was scheduled: %v", jobs)
+	}
+
+	env.reg.Scheduler().Stop()
+	if err := schedule(alice, "close_poll", "1m"); err == nil {
+		t.Error("a stopped scheduler accepted a job")
+	}
+}
@@ -0,0 +1,437 @@
+package engine
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/a-essam23/go-dispatch/pkg/pipeline"
+	"github.com/a-essam23/go-dispatch/pkg/transport"
+	lua "github.com/yuin/gopher-lua"
+	"github.com/yuin/gopher-lua/parse"
+)
+
+// ScriptKind is what a script is registered as.
+type ScriptKind string
+
+const (
+	ScriptAction   ScriptKind = "action"
+	ScriptModifier ScriptKind = "modifier"
+)
+
+// sandbox limits of every script run.
+const (
+	scriptCallStackSize = 128
+	scriptRegistryMax   = 64 * 1024
+	// the longest string a script may build, with .. or the string and table
+	// libraries.
+	scriptMaxString = 1 << 20
+	// how deeply tables converted to and from JSON may nest.
+	scriptMaxDepth = 32
+	// the most values a table converted to JSON may hold, counting nested ones.
+	scriptMaxItems = 64 * 1024
+)
+
+// Script is a Lua script compiled at config load, run as an action or a
+// modifier with the globals "event" and "dispatch".
+type Script struct {
+	Name string
+	Kind ScriptKind
+	// how long one run may take before it is aborted.
+	Timeout time.Duration
+	proto   *lua.FunctionProto
+}
+
+// CompileScript parses and compiles source, reporting syntax errors. Every
+// a .. b is compiled to a call that bounds the string it builds.
+func CompileScript(name string, kind ScriptKind, source string, timeout time.Duration) (*Script, error) {
+	if kind != ScriptAction && kind != ScriptModifier {
+		return nil, fmt.Errorf("unknown script kind '%s' (want action or modifier)", kind)
+	}
+	if timeout <= 0 {
+		return nil, errors.New("script timeout must be positive")
+	}
+	chunk, err := parse.Parse(strings.NewReader(source), name)
+	if err != nil {
+		return nil, err
+	}
+	boundConcats(chunk)
+	proto, err := lua.Compile(chunk, name)
+	if err != nil {
+		return nil, err
+	}
+	return &Script{Name: name, Kind: kind, Timeout: timeout, proto: proto}, nil
+}
+
+// RegisterScripts registers each script as an action or modifier of its name.
+// Names starting with '_' are reserved for core actions.
+func (e *Registry) RegisterScripts(scripts []*Script) error {
+	for _, s := range scripts {
+		if strings.HasPrefix(s.Name, "_") {
+			return fmt.Errorf("script '%s': names starting with '_' are reserved", s.Name)
+		}
+		switch s.Kind {
+		case ScriptAction:
+			if _, exists := e.GetActionFunc(s.Name); exists {
+				return fmt.Errorf("script '%s': an action of that name is already registered", s.Name)
+			}
+			e.RegisterAction(s.Name, func(pctx *pipeline.Cargo, params ...string) error {
+				_, err := e.runScript(s, pctx, params)
+				return err
+			})
+		case ScriptModifier:
+			if _, exists := e.GetModifierFunc(s.Name); exists {
+				return fmt.Errorf("script '%s': a modifier of that name is already registered", s.Name)
+			}
+			e.RegisterModifier(s.Name, func(pctx *pipeline.Cargo, params ...string) error {
+				results, err := e.runScript(s, pctx, params)
+				if err != nil {
+					return err
+				}
+				if len(results) > 0 && results[0] == lua.LFalse {
+					if len(results) > 1 && results[1] != lua.LNil {
+						return fmt.Errorf("script '%s' denied the event: %s", s.Name, results[1].String())
+					}
+					return fmt.Errorf("script '%s' denied the event", s.Name)
+				}
+				return nil
+			})
+		}
+	}
+	if len(scripts) > 0 {
+		e.logger.Info("Registered scripts", slog.Int("count", len(scripts)))
+	}
+	return nil
+}
+
+// runScript runs s in a fresh sandbox, with the params as its arguments, and
+// returns what it returned.
+func (e *Registry) runScript(s *Script, pctx *pipeline.Cargo, params []string) ([]lua.LValue, error) {
+	L := newSandbox()
+	defer L.Close()
+	parent := pctx.Ctx
+	if parent == nil {
+		parent = context.Background()
+	}
+	ctx, cancel := context.WithTimeout(parent, s.Timeout)
+	defer cancel()
+	L.SetContext(ctx)
+
+	event, err := scriptEvent(L, pctx, params)
+	if err != nil {
+		return nil, fmt.Errorf("script '%s': %w", s.Name, err)
+	}
+	L.SetGlobal("event", event)
+	L.SetGlobal("dispatch", e.scriptAPI(L, pctx))
+
+	L.Push(L.NewFunctionFromProto(s.proto))
+	for _, p := range params {
+		L.Push(lua.LString(p))
+	}
+	if err := L.PCall(len(params), lua.MultRet, nil); err != nil {
+		if ctx.Err() != nil {
+			return nil, fmt.Errorf("script '%s' exceeded its %s timeout", s.Name, s.Timeout)
+		}
+		return nil, fmt.Errorf("script '%s': %w", s.Name, err)
+	}
+	results := make([]lua.LValue, L.GetTop())
+	for i := range results {
+		results[i] = L.Get(i + 1)
+	}
+	return results, nil
+}
+
+// newSandbox opens the base, table, string and math libraries, without the
+// functions that reach outside the script, such as loading files or printing,
+// and with the string builders bounded.
+func newSandbox() *lua.LState {
+	L := lua.NewState(lua.Options{
+		SkipOpenLibs:        true,
+		CallStackSize:       scriptCallStackSize,
+		RegistryMaxSize:     scriptRegistryMax,
+		MinimizeStackMemory: true,
+	})
+	for _, lib := range []struct {
+		name string
+		open lua.LGFunction
+	}{
+		{lua.BaseLibName, lua.OpenBase},
+		{lua.TabLibName, lua.OpenTable},
+		{lua.StringLibName, lua.OpenString},
+		{lua.MathLibName, lua.OpenMath},
+	} {
+		L.Push(L.NewFunction(lib.open))
+		L.Push(lua.LString(lib.name))
+		L.Call(1, 0)
+	}
+	for _, name := range []string{"dofile", "loadfile", "load", "loadstring", "require", "module", "print", "collectgarbage", "getfenv", "setfenv", "newproxy", "_printregs"} {
+		L.SetGlobal(name, lua.LNil)
+	}
+	openBoundedStrings(L)
+	return L
+}
+
+// the "event" global: the triggering event's fields, read-only by convention.
+func scriptEvent(L *lua.LState, pctx *pipeline.Cargo, params []string) (*lua.LTable, error) {
+	event := L.NewTable()
+	event.RawSetString("name", lua.LString(pctx.EventName))
+	event.RawSetString("target", lua.LString(pctx.TargetID))
+	event.RawSetString("origin", lua.LString(pctx.Origin.String()))
+	if pctx.RequestID != "" {
+		event.RawSetString("id", lua.LString(pctx.RequestID))
+	}
+	if pctx.User != nil {
+		event.RawSetString("user", lua.LString(pctx.User.ID))
+	}
+	if pctx.Connection != nil {
+		event.RawSetString("conn", lua.LString(pctx.Connection.ID.String()))
+	}
+	if len(pctx.Payload) > 0 {
+		payload, err := jsonToLua(L, pctx.Payload)
+		if err != nil {
+			return nil, fmt.Errorf("payload: %w", err)
+		}
+		event.RawSetString("payload", payload)
+	}
+	list := L.NewTable()
+	for _, p := range params {
+		list.Append(lua.LString(p))
+	}
+	event.RawSetString("params", list)
+	return event, nil
+}
+
+// the "dispatch" global: notify helpers and whitelisted state reads.
+func (e *Registry) scriptAPI(L *lua.LState, pctx *pipeline.Cargo) *lua.LTable {
+	sm := pctx.StateManager
+	notifyTo := func(L *lua.LState, roomID, event string, value lua.LValue) {
+		payload, err := luaToJSON(value)
+		if err != nil {
+			L.RaiseError("payload: %s", err.Error())
+		}
+		if err := notifyRoom(e.throttle, pctx, roomID, event, string(payload), transport.PriorityNormal); err != nil {
+			L.RaiseError("%s", err.Error())
+		}
+	}
+	stringList := func(L *lua.LState, values []string) *lua.LTable {
+		t := L.NewTable()
+		for _, v := range values {
+			t.Append(lua.LString(v))
+		}
+		return t
+	}
+
+	return L.SetFuncs(L.NewTable(), map[string]lua.LGFunction{
+		// log(message)
+		"log": func(L *lua.LState) int {
+			pctx.Logger.Info(L.CheckString(1), slog.String("event", pctx.EventName))
+			return 0
+		},
+		// notify_room(room, event, payload), where room may also be "user:<id>".
+		"notify_room": func(L *lua.LState) int {
+			notifyTo(L, L.CheckString(1), L.CheckString(2), L.Get(3))
+			return 0
+		},
+		// notify_origin(event, payload) sends to the triggering user.
+		"notify_origin": func(L *lua.LState) int {
+			if pctx.User == nil {
+				L.RaiseError("notify_origin requires a user")
+			}
+			notifyTo(L, "user:"+pctx.User.ID, L.CheckString(1), L.Get(2))
+			return 0
+		},
+		// set_payload(value) replaces the payload later steps read as {.payload}.
+		"set_payload": func(L *lua.LState) int {
+			payload, err := luaToJSON(L.Get(1))
+			if err != nil {
+				L.RaiseError("payload: %s", err.Error())
+			}
+			pctx.Payload = payload
+			return 0
+		},
+		// room_members(room) lists the IDs of the room's members.
+		"room_members": func(L *lua.LState) int {
+			members, err := sm.GetRoomMembers(L.CheckString(1))
+			if err != nil {
+				L.Push(L.NewTable())
+				return 1
+			}
+			ids := make([]string, 0, len(members))
+			for _, m := range members {
+				ids = append(ids, m.ID)
+			}
+			slices.Sort(ids)
+			L.Push(stringList(L, ids))
+			return 1
+		},
+		// user_rooms(user) lists the rooms the user is a member of.
+		"user_rooms": func(L *lua.LState) int {
+			rooms, _ := sm.GetUserRooms(L.CheckString(1))
+			slices.Sort(rooms)
+			L.Push(stringList(L, rooms))
+			return 1
+		},
+		// is_member(user, room)
+		"is_member": func(L *lua.LState) int {
+			_, member := sm.GetGrant(L.CheckString(1), L.CheckString(2))
+			L.Push(lua.LBool(member))
+			return 1
+		},
+		// presence(user) returns the user's status and status text.
+		"presence": func(L *lua.LState) int {
+			p, _ := sm.GetPresence(L.CheckString(1))
+			L.Push(lua.LString(p.Status))
+			L.Push(lua.LString(p.Text))
+			return 2
+		},
+		// room_state(room) returns {room, version, meta, data}, or nil.
+		"room_state": func(L *lua.LState) int {
+			st, err := sm.GetRoomState(L.CheckString(1))
+			if err != nil {
+				L.Push(lua.LNil)
+				return 1
+			}
+			data, _ := json.Marshal(st)
+			value, err := jsonToLua(L, data)
+			if err != nil {
+				L.RaiseError("%s", err.Error())
+			}
+			L.Push(value)
+			return 1
+		},
+		"json_encode": func(L *lua.LState) int {
+			data, err := luaToJSON(L.Get(1))
+			if err != nil {
+				L.RaiseError("%s", err.Error())
+			}
+			L.Push(lua.LString(data))
+			return 1
+		},
+		"json_decode": func(L *lua.LState) int {
+			value, err := jsonToLua(L, []byte(L.CheckString(1)))
+			if err != nil {
+				L.RaiseError("%s", err.Error())
+			}
+			L.Push(value)
+			return 1
+		},
+	})
+}
+
+func jsonToLua(L *lua.LState, data []byte) (lua.LValue, error) {
+	var v any
+	if err := json.Unmarshal(data, &v); err != nil {
+		return nil, err
+	}
+	return goToLua(L, v, 0)
+}
+
+func goToLua(L *lua.LState, v any, depth int) (lua.LValue, error) {
+	if depth > scriptMaxDepth {
+		return nil, errors.New("value is nested too deeply")
+	}
+	switch v := v.(type) {
+	case nil:
+		return lua.LNil, nil
+	case bool:
+		return lua.LBool(v), nil
+	case float64:
+		return lua.LNumber(v), nil
+	case string:
+		return lua.LString(v), nil
+	case []any:
+		t := L.CreateTable(len(v), 0)
+		for _, e := range v {
+			lv, err := goToLua(L, e, depth+1)
+			if err != nil {
+				return nil, err
+			}
+			t.Append(lv)
+		}
+		return t, nil
+	case map[string]any:
+		t := L.CreateTable(0, len(v))
+		for k, e := range v {
+			lv, err := goToLua(L, e, depth+1)
+			if err != nil {
+				return nil, err
+			}
+			t.RawSetString(k, lv)
+		}
+		return t, nil
+	default:
+		return nil, fmt.Errorf("unsupported value %T", v)
+	}
+}
+
+func luaToJSON(v lua.LValue) (json.RawMessage, error) {
+	items := 0
+	goValue, err := luaToGo(v, 0, &items)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(goValue)
+}
+
+// luaToGo converts a Lua value to its JSON form. A table whose keys are
+// exactly 1..n becomes an array; any other table, including an empty one, an
+// object. items counts the values converted so far.
+func luaToGo(v lua.LValue, depth int, items *int) (any, error) {
+	if depth > scriptMaxDepth {
+		return nil, errors.New("value is nested too deeply")
+	}
+	if *items++; *items > scriptMaxItems {
+		return nil, fmt.Errorf("value holds more than %d items", scriptMaxItems)
+	}
+	switch v := v.(type) {
+	case *lua.LNilType:
+		return nil, nil
+	case lua.LBool:
+		return bool(v), nil
+	case lua.LNumber:
+		return float64(v), nil
+	case lua.LString:
+		return string(v), nil
+	case *lua.LTable:
+		keys := 0
+		v.ForEach(func(lua.LValue, lua.LValue) { keys++ })
+		if n := v.MaxN(); n > 0 && n == keys {
+			list := make([]any, 0, n)
+			for i := 1; i <= n; i++ {
+				e, err := luaToGo(v.RawGetInt(i), depth+1, items)
+				if err != nil {
+					return nil, err
+				}
+				list = append(list, e)
+			}
+			return list, nil
+		}
+		obj := make(map[string]any, keys)
+		var err error
+		v.ForEach(func(k, e lua.LValue) {
+			if err != nil {
+				return
+			}
+			var key string
+			switch k := k.(type) {
+			case lua.LString:
+				key = string(k)
+			case lua.LNumber:
+				key = strconv.FormatFloat(float64(k), 'f', -1, 64)
+			default:
+				err = fmt.Errorf("unsupported table key of type %s", k.Type())
+				return
+			}
+			obj[key], err = luaToGo(e, depth+1, items)
+		})
+		return obj, err
+	default:
+		return nil, fmt.Errorf("unsupported value of type %s", v.Type())
+	}
+}
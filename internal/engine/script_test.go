@@ -0,0 +1,220 @@
+package engine_test
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/a-essam23/go-dispatch/internal/engine"
+	"github.com/a-essam23/go-dispatch/pkg/pipeline"
+)
+
+// registers source as a script named "test" of kind.
+func registerScript(env *testEnv, kind engine.ScriptKind, source string) {
+	env.t.Helper()
+	s, err := engine.CompileScript("test", kind, source, time.Second)
+	if err != nil {
+		env.t.Fatalf("CompileScript failed: %v", err)
+	}
+	if err := env.reg.RegisterScripts([]*engine.Script{s}); err != nil {
+		env.t.Fatalf("RegisterScripts failed: %v", err)
+	}
+}
+
+// returns a cargo from alice for a play event.
+func playCargo(env *testEnv) *pipeline.Cargo {
+	cargo := env.cargo("alice")
+	cargo.EventName = "play"
+	cargo.Payload = json.RawMessage(`{"words":["a","b","c"],"text":"hello!"}`)
+	return cargo
+}
+
+// runs the "test" action, returning its error.
+func runScript(env *testEnv, cargo *pipeline.Cargo, params ...string) error {
+	env.t.Helper()
+	return env.action("test")(cargo, params...)
+}
+
+func TestCompileScriptRejectsBadScripts(t *testing.T) {
+	tests := []struct {
+		name    string
+		kind    engine.ScriptKind
+		source  string
+		timeout time.Duration
+	}{
+		{"syntax error", engine.ScriptAction, "if then", time.Second},
+		{"unknown kind", "filter", "", time.Second},
+		{"no timeout", engine.ScriptAction, "", 0},
+	}
+	for _, tt := range tests {
+		if _, err := engine.CompileScript(tt.name, tt.kind, tt.source, tt.timeout); err == nil {
+			t.Errorf("%s: expected an error", tt.name)
+		}
+	}
+}
+
+func TestScriptNamesStartingWithAnUnderscoreAreReserved(t *testing.T) {
+	s, err := engine.CompileScript("_log", engine.ScriptAction, "", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := newTestEnv(t, nil).reg.RegisterScripts([]*engine.Script{s}); err == nil {
+		t.Error("expected reserved script names to be rejected")
+	}
+}
+
+func TestScriptActionNotifiesAndSetsThePayload(t *testing.T) {
+	env := newTestEnv(t, nil)
+	env.target = "lobby"
+	env.joinAll("lobby", "alice")
+	registerScript(env, engine.ScriptAction, `
+		local bonus = tonumber(...) or 0
+		local score = #event.payload.words * 10 + bonus
+		dispatch.set_payload({user = event.user, score = score})
+		dispatch.notify_room(event.target, "scored", {score = score, members = dispatch.room_members(event.target)})
+	`)
+
+	cargo := playCargo(env)
+	if err := runScript(env, cargo, "5"); err != nil {
+		t.Fatal(err)
+	}
+	if sent := env.conns["alice"].Sent(); len(sent) != 1 || string(sent[0]) != `{"event":"scored","payload":{"members":["alice"],"score":35}}` {
+		t.Errorf("expected the score in the lobby, got %q", sent)
+	}
+	if string(cargo.Payload) != `{"score":35,"user":"alice"}` {
+		t.Errorf("expected the payload to be replaced, got %s", cargo.Payload)
+	}
+}
+
+func TestScriptModifierDeniesWithItsReason(t *testing.T) {
+	env := newTestEnv(t, nil)
+	env.connectAll("alice")
+	registerScript(env, engine.ScriptModifier, `
+		if #event.payload.text > 5 then return false, "text is too long" end
+	`)
+	shortText := env.modifier("test")
+	cargo := playCargo(env)
+
+	if err := shortText(cargo); err == nil || !strings.Contains(err.Error(), "text is too long") {
+		t.Errorf("expected the modifier to deny with its reason, got %v", err)
+	}
+	cargo.Payload = json.RawMessage(`{"text":"hi"}`)
+	if err := shortText(cargo); err != nil {
+		t.Errorf("expected the modifier to allow short text, got %v", err)
+	}
+}
+
+func TestScriptSandboxHidesOutsideAccess(t *testing.T) {
+	env := newTestEnv(t, nil)
+	env.connectAll("alice")
+	registerScript(env, engine.ScriptAction, `
+		for _, name in ipairs({"os", "io", "load", "loadstring", "dofile", "require", "print", "setfenv"}) do
+			if _G[name] ~= nil then error(name .. " is reachable") end
+		end
+	`)
+
+	if err := runScript(env, playCargo(env)); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestScriptConcatDoublingFailsFast(t *testing.T) {
+	env := newTestEnv(t, nil)
+	env.connectAll("alice")
+	registerScript(env, engine.ScriptAction, `
+		local s = "x"
+		for i = 1, 40 do s = s .. s end
+	`)
+
+	start := time.Now()
+	if err := runScript(env, playCargo(env)); err == nil || !strings.Contains(err.Error(), "too large") {
+		t.Errorf("expected the doubling string to be refused, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("expected the size limit, not the timeout, to stop the script, took %s", elapsed)
+	}
+}
+
+func TestScriptStringBuildersAreBounded(t *testing.T) {
+	tests := []struct {
+		name, source string
+	}{
+		{"string.rep", `string.rep("x", 1e9)`},
+		{"concat with a number", `local s = string.rep("x", 2^20) .. 1`},
+		{"table.concat", `local t = {} for i = 1, 2^11 do t[i] = string.rep("x", 2^10) end table.concat(t)`},
+		{"table.concat separators", `table.concat({1, 2}, string.rep("x", 2^20))`},
+		{"string.gsub", `string.gsub(string.rep("x", 2^10), "x", string.rep("y", 2^11))`},
+		{"string.gsub with a function", `local y = string.rep("y", 2^10) string.gsub(string.rep("x", 2^11), "x", function() return y end)`},
+		{"string.format arguments", `local s = string.rep("x", 2^19) string.format("%s%s", s, s)`},
+		{"string.format width", `string.format("%999999999d", 1)`},
+	}
+	for _, tt := range tests {
+		env := newTestEnv(t, nil)
+		env.connectAll("alice")
+		registerScript(env, engine.ScriptAction, tt.source)
+		if err := runScript(env, playCargo(env)); err == nil || !strings.Contains(err.Error(), "too large") && !strings.Contains(err.Error(), "too long") {
+			t.Errorf("%s: expected the string to be refused, got %v", tt.name, err)
+		}
+	}
+}
+
+func TestScriptStringBuildersBehaveAsInLua(t *testing.T) {
+	env := newTestEnv(t, nil)
+	env.connectAll("alice")
+	registerScript(env, engine.ScriptAction, `
+		local function check(got, want)
+			if got ~= want then error(string.format("got %q, want %q", tostring(got), tostring(want)), 2) end
+		end
+		check("a" .. "b" .. 1 .. 2.5, "ab12.5")
+		local greeting = setmetatable({}, {__concat = function(a, b) return "hi " .. b end})
+		check(greeting .. "bob", "hi bob")
+		check(pcall(function() return "a" .. {} end), false)
+		check(table.concat({1, "b", 3}, ", "), "1, b, 3")
+		check(table.concat({1, 2, 3}, "", 2), "23")
+		check(string.rep("ab", 3), "ababab")
+		check(string.format("%5.2f|%-3s|%%", 1.5, "x"), " 1.50|x  |%")
+		check((string.gsub("hello world", "(o)", "[%1]")), "hell[o] w[o]rld")
+		check((string.gsub("hello world", "%w+", "<%0>", 1)), "<hello> world")
+		check((string.gsub("$name is $age", "%$(%w+)", {name = "bob"})), "bob is $age")
+		check((string.gsub("a b", "%w", function(c) return c:upper() end)), "A B")
+		check(select(2, string.gsub("aaa", "a", "b")), 3)
+		check((string.gsub("abc", "()b", "%1")), "a2c")
+	`)
+
+	if err := runScript(env, playCargo(env)); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestScriptPayloadsOverTheItemLimitFail(t *testing.T) {
+	env := newTestEnv(t, nil)
+	env.connectAll("alice")
+	registerScript(env, engine.ScriptAction, `
+		local t = {}
+		for i = 1, 70000 do t[i] = i end
+		dispatch.set_payload(t)
+	`)
+
+	if err := runScript(env, playCargo(env)); err == nil || !strings.Contains(err.Error(), "items") {
+		t.Errorf("expected the payload to be refused, got %v", err)
+	}
+}
+
+func TestScriptsTimeOut(t *testing.T) {
+	s, err := engine.CompileScript("spin", engine.ScriptAction, `while true do end`, 50*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	env := newTestEnv(t, nil)
+	env.reg.RegisterScripts([]*engine.Script{s})
+	spin := env.action("spin")
+
+	start := time.Now()
+	if err := spin(env.cargo("")); err == nil || !strings.Contains(err.Error(), "timeout") {
+		t.Errorf("expected a runaway script to time out, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("expected the timeout to stop the script promptly, took %s", elapsed)
+	}
+}
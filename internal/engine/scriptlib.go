@@ -0,0 +1,335 @@
+package engine
+
+import (
+	"strings"
+
+	lua "github.com/yuin/gopher-lua"
+	"github.com/yuin/gopher-lua/ast"
+	"github.com/yuin/gopher-lua/pm"
+)
+
+// the global every a .. b in a script is compiled to a call of. It is not a
+// valid name, so scripts cannot call it by accident.
+const scriptConcatGlobal = "(concat)"
+
+// Lua has no allocation hooks, so the ways a script can build a string, which
+// may double in size each time, are bounded to scriptMaxString instead. Tables
+// grow one value at a time, within the script's timeout.
+
+// boundConcats rewrites every a .. b in stmts into a call of scriptConcat.
+func boundConcats(stmts []ast.Stmt) {
+	for _, s := range stmts {
+		boundConcatsIn(s)
+	}
+}
+
+func boundConcatsIn(s ast.Stmt) {
+	switch s := s.(type) {
+	case *ast.AssignStmt:
+		boundExprs(s.Lhs)
+		boundExprs(s.Rhs)
+	case *ast.LocalAssignStmt:
+		boundExprs(s.Exprs)
+	case *ast.FuncCallStmt:
+		s.Expr = boundExpr(s.Expr)
+	case *ast.DoBlockStmt:
+		boundConcats(s.Stmts)
+	case *ast.WhileStmt:
+		s.Condition = boundExpr(s.Condition)
+		boundConcats(s.Stmts)
+	case *ast.RepeatStmt:
+		s.Condition = boundExpr(s.Condition)
+		boundConcats(s.Stmts)
+	case *ast.IfStmt:
+		s.Condition = boundExpr(s.Condition)
+		boundConcats(s.Then)
+		boundConcats(s.Else)
+	case *ast.NumberForStmt:
+		s.Init, s.Limit, s.Step = boundExpr(s.Init), boundExpr(s.Limit), boundExpr(s.Step)
+		boundConcats(s.Stmts)
+	case *ast.GenericForStmt:
+		boundExprs(s.Exprs)
+		boundConcats(s.Stmts)
+	case *ast.FuncDefStmt:
+		s.Name.Func, s.Name.Receiver = boundExpr(s.Name.Func), boundExpr(s.Name.Receiver)
+		boundConcats(s.Func.Stmts)
+	case *ast.ReturnStmt:
+		boundExprs(s.Exprs)
+	}
+}
+
+func boundExprs(exprs []ast.Expr) {
+	for i, e := range exprs {
+		exprs[i] = boundExpr(e)
+	}
+}
+
+func boundExpr(e ast.Expr) ast.Expr {
+	switch e := e.(type) {
+	case *ast.StringConcatOpExpr:
+		fn := &ast.IdentExpr{Value: scriptConcatGlobal}
+		call := &ast.FuncCallExpr{Func: fn, Args: []ast.Expr{boundExpr(e.Lhs), boundExpr(e.Rhs)}, AdjustRet: true}
+		for _, n := range []ast.PositionHolder{fn, call} {
+			n.SetLine(e.Line())
+			n.SetLastLine(e.LastLine())
+		}
+		return call
+	case *ast.AttrGetExpr:
+		e.Object, e.Key = boundExpr(e.Object), boundExpr(e.Key)
+	case *ast.TableExpr:
+		for _, f := range e.Fields {
+			f.Key, f.Value = boundExpr(f.Key), boundExpr(f.Value)
+		}
+	case *ast.FuncCallExpr:
+		e.Func, e.Receiver = boundExpr(e.Func), boundExpr(e.Receiver)
+		boundExprs(e.Args)
+	case *ast.LogicalOpExpr:
+		e.Lhs, e.Rhs = boundExpr(e.Lhs), boundExpr(e.Rhs)
+	case *ast.RelationalOpExpr:
+		e.Lhs, e.Rhs = boundExpr(e.Lhs), boundExpr(e.Rhs)
+	case *ast.ArithmeticOpExpr:
+		e.Lhs, e.Rhs = boundExpr(e.Lhs), boundExpr(e.Rhs)
+	case *ast.UnaryMinusOpExpr:
+		e.Expr = boundExpr(e.Expr)
+	case *ast.UnaryNotOpExpr:
+		e.Expr = boundExpr(e.Expr)
+	case *ast.UnaryLenOpExpr:
+		e.Expr = boundExpr(e.Expr)
+	case *ast.FunctionExpr:
+		boundConcats(e.Stmts)
+	}
+	return e
+}
+
+// openBoundedStrings replaces the library functions that build strings of any
+// size with bounded ones, and defines the concat operator.
+func openBoundedStrings(L *lua.LState) {
+	L.SetGlobal(scriptConcatGlobal, L.NewFunction(scriptConcat))
+	if str, ok := L.GetGlobal(lua.StringLibName).(*lua.LTable); ok {
+		str.RawSetString("rep", L.NewFunction(scriptStringRep))
+		str.RawSetString("gsub", L.NewFunction(scriptStringGsub))
+		if format, ok := str.RawGetString("format").(*lua.LFunction); ok {
+			str.RawSetString("format", L.NewFunction(scriptStringFormat(format.GFunction)))
+		}
+	}
+	if tab, ok := L.GetGlobal(lua.TabLibName).(*lua.LTable); ok {
+		tab.RawSetString("concat", L.NewFunction(scriptTableConcat))
+	}
+}
+
+// the text a string or number concatenates as.
+func concatOperand(v lua.LValue) (string, bool) {
+	switch v := v.(type) {
+	case lua.LString:
+		return string(v), true
+	case lua.LNumber:
+		return v.String(), true
+	}
+	return "", false
+}
+
+// a .. b, falling back to a __concat metamethod like the operator.
+func scriptConcat(L *lua.LState) int {
+	a, b := L.Get(1), L.Get(2)
+	as, aok := concatOperand(a)
+	bs, bok := concatOperand(b)
+	if !aok || !bok {
+		op := L.GetMetaField(a, "__concat")
+		if op == lua.LNil {
+			op = L.GetMetaField(b, "__concat")
+		}
+		if op == lua.LNil {
+			bad := a
+			if aok {
+				bad = b
+			}
+			L.RaiseError("attempt to concatenate a %s value", bad.Type())
+		}
+		L.Push(op)
+		L.Push(a)
+		L.Push(b)
+		L.Call(2, 1)
+		return 1
+	}
+	if len(as)+len(bs) > scriptMaxString {
+		L.RaiseError("string concatenation result is too large")
+	}
+	L.Push(lua.LString(as + bs))
+	return 1
+}
+
+// string.rep, refusing to build strings longer than scriptMaxString.
+func scriptStringRep(L *lua.LState) int {
+	s, n := L.CheckString(1), L.CheckInt(2)
+	if n <= 0 {
+		L.Push(lua.LString(""))
+		return 1
+	}
+	if len(s)*n > scriptMaxString || (len(s) > 0 && n > scriptMaxString) {
+		L.RaiseError("string.rep result is too large")
+	}
+	L.Push(lua.LString(strings.Repeat(s, n)))
+	return 1
+}
+
+// table.concat, refusing to build strings longer than scriptMaxString.
+func scriptTableConcat(L *lua.LState) int {
+	t := L.CheckTable(1)
+	sep := L.OptString(2, "")
+	i, j := L.OptInt(3, 1), L.OptInt(4, t.Len())
+	var b strings.Builder
+	for k := i; k <= j; k++ {
+		s, ok := concatOperand(t.RawGetInt(k))
+		if !ok {
+			L.RaiseError("invalid value (at index %d) in table for 'concat'", k)
+		}
+		if k > i {
+			s = sep + s
+		}
+		if b.Len()+len(s) > scriptMaxString {
+			L.RaiseError("table.concat result is too large")
+		}
+		b.WriteString(s)
+	}
+	L.Push(lua.LString(b.String()))
+	return 1
+}
+
+// string.format, refusing widths and precisions over 99, as Lua does, and
+// arguments that could format longer than scriptMaxString.
+func scriptStringFormat(format lua.LGFunction) lua.LGFunction {
+	return func(L *lua.LState) int {
+		f := L.CheckString(1)
+		for i := 0; i < len(f); i++ {
+			if f[i] != '%' {
+				continue
+			}
+			i++
+			for i < len(f) && strings.IndexByte("-+ #0", f[i]) >= 0 {
+				i++
+			}
+			width := leadingDigits(f[i:])
+			if i += width; i < len(f) && f[i] == '.' {
+				i++
+				precision := leadingDigits(f[i:])
+				i += precision
+				width = max(width, precision)
+			}
+			if width > 2 {
+				L.RaiseError("invalid format (width or precision too long)")
+			}
+		}
+		// %q at most doubles a string; anything else formats within a few
+		// hundred bytes.
+		size := len(f)
+		for i := 2; i <= L.GetTop(); i++ {
+			if s, ok := L.Get(i).(lua.LString); ok {
+				size += 2*len(s) + 100
+			} else {
+				size += 512
+			}
+		}
+		if size > scriptMaxString {
+			L.RaiseError("string.format result may be too large")
+		}
+		return format(L)
+	}
+}
+
+func leadingDigits(s string) int {
+	n := 0
+	for n < len(s) && s[n] >= '0' && s[n] <= '9' {
+		n++
+	}
+	return n
+}
+
+// string.gsub, building its result in one pass and refusing to build strings
+// longer than scriptMaxString.
+func scriptStringGsub(L *lua.LState) int {
+	s, pattern := L.CheckString(1), L.CheckString(2)
+	L.CheckTypes(3, lua.LTString, lua.LTTable, lua.LTFunction)
+	repl := L.Get(3)
+	matches, err := pm.Find(pattern, []byte(s), 0, L.OptInt(4, -1))
+	if err != nil {
+		L.RaiseError("%s", err.Error())
+	}
+
+	// capture returns the idx'th capture of m, its whole match without captures.
+	capture := func(m *pm.MatchData, idx int) lua.LValue {
+		if idx == 0 || (idx == 1 && m.CaptureLength() == 2) {
+			return lua.LString(s[m.Capture(0):m.Capture(1)])
+		}
+		if 2*idx >= m.CaptureLength() {
+			L.RaiseError("invalid capture index")
+		}
+		if m.IsPosCapture(2 * idx) {
+			return lua.LNumber(m.Capture(2 * idx))
+		}
+		return lua.LString(s[m.Capture(2*idx):m.Capture(2*idx+1)])
+	}
+	var b strings.Builder
+	write := func(text string) {
+		if b.Len()+len(text) > scriptMaxString {
+			L.RaiseError("string.gsub result is too large")
+		}
+		b.WriteString(text)
+	}
+
+	last := 0
+	for _, m := range matches {
+		start, end := m.Capture(0), m.Capture(1)
+		write(s[last:start])
+		last = end
+		switch repl := repl.(type) {
+		case lua.LString:
+			r := string(repl)
+			for {
+				i := strings.IndexByte(r, '%')
+				if i < 0 || i+1 == len(r) {
+					write(r)
+					break
+				}
+				write(r[:i])
+				if c := r[i+1]; c >= '0' && c <= '9' {
+					text, _ := concatOperand(capture(m, int(c-'0')))
+					write(text)
+				} else {
+					write(r[i+1 : i+2])
+				}
+				r = r[i+2:]
+			}
+		case *lua.LTable:
+			value := L.GetTable(repl, capture(m, 1))
+			writeReplacement(L, write, value, s[start:end])
+		case *lua.LFunction:
+			L.Push(repl)
+			n := max(1, m.CaptureLength()/2-1)
+			for i := 1; i <= n; i++ {
+				L.Push(capture(m, i))
+			}
+			L.Call(n, 1)
+			value := L.Get(-1)
+			L.Pop(1)
+			writeReplacement(L, write, value, s[start:end])
+		}
+	}
+	write(s[last:])
+	L.Push(lua.LString(b.String()))
+	L.Push(lua.LNumber(len(matches)))
+	return 2
+}
+
+// writes the value a table or function replaced a match with, keeping the
+// match for false or nil.
+func writeReplacement(L *lua.LState, write func(string), value lua.LValue, match string) {
+	if lua.LVIsFalse(value) {
+		write(match)
+		return
+	}
+	text, ok := concatOperand(value)
+	if !ok {
+		L.RaiseError("invalid replacement value (a %s)", value.Type())
+	}
+	write(text)
+}
@@ -0,0 +1,221 @@
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"github.com/a-essam23/go-dispatch/pkg/pipeline"
+	"github.com/a-essam23/go-dispatch/pkg/state"
+	"github.com/a-essam23/go-dispatch/pkg/transport"
+	"github.com/google/uuid"
+)
+
+// targetAudience resolves a notify target to its connections, see
+// audience.addTarget. Every room reached also reaches the users subscribed to
+// it; a connection reached through several rooms is listed once.
+func targetAudience(pctx *pipeline.Cargo, target string) []transport.Conn {
+	a := newAudience()
+	a.addTarget(pctx, target)
+	return a.conns
+}
+
+// notify target prefixes, besides plain room IDs and room patterns.
+const (
+	userTargetPrefix    = "user:"
+	roomsOfTargetPrefix = "rooms_of:"
+)
+
+// notify exclusions, besides "user:<id>".
+const (
+	excludeOrigin = "origin" // the connection that triggered the event
+	excludeSender = "sender" // every connection of the triggering user
+)
+
+// splitList splits a comma separated parameter, dropping blank entries.
+func splitList(param string) []string {
+	var items []string
+	for _, item := range strings.Split(param, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// validateExclusions rejects exclusions other than origin, sender and user:<id>.
+func validateExclusions(exclude []string) error {
+	for _, e := range exclude {
+		if e != excludeOrigin && e != excludeSender && !strings.HasPrefix(e, userTargetPrefix) {
+			return fmt.Errorf("unknown exclusion '%s' (want origin, sender or user:<id>)", e)
+		}
+	}
+	return nil
+}
+
+// resolvePattern returns the rooms matching pattern that the triggering user
+// may send to.
+func resolvePattern(pctx *pipeline.Cargo, pattern string) []string {
+	return allowedRooms(pctx, pctx.StateManager.MatchRooms(pattern))
+}
+
+// allowedRooms filters rooms down to those the triggering user is a member or
+// a moderator of. The server may send to every room; a client pipeline
+// without a user to none.
+func allowedRooms(pctx *pipeline.Cargo, rooms []string) []string {
+	if isSystemCall(pctx) {
+		return rooms
+	}
+	if pctx.User == nil {
+		return nil
+	}
+	allowed := make([]string, 0, len(rooms))
+	for _, roomID := range rooms {
+		_, member := pctx.StateManager.GetGrant(pctx.User.ID, roomID)
+		if member || isModerator(pctx.StateManager, roomID, pctx.User.ID) {
+			allowed = append(allowed, roomID)
+		} else {
+			pctx.Logger.Debug("Skipping room the sender may not notify", slog.String("roomID", roomID))
+		}
+	}
+	return allowed
+}
+
+// audience collects the connections a notification goes to, each once.
+type audience struct {
+	seen  map[uuid.UUID]bool
+	conns []transport.Conn
+}
+
+func newAudience() *audience {
+	return &audience{seen: make(map[uuid.UUID]bool)}
+}
+
+// exclude keeps the connections named by exclusions out of the audience,
+// even if added later.
+func (a *audience) exclude(pctx *pipeline.Cargo, exclusions []string) {
+	for _, e := range exclusions {
+		switch {
+		case e == excludeOrigin:
+			if pctx.Connection != nil {
+				a.seen[pctx.Connection.ID] = true
+			}
+		case e == excludeSender:
+			if pctx.User != nil {
+				a.excludeUser(pctx, pctx.User.ID)
+			}
+		default:
+			a.excludeUser(pctx, strings.TrimPrefix(e, userTargetPrefix))
+		}
+	}
+}
+
+func (a *audience) excludeUser(pctx *pipeline.Cargo, userID string) {
+	conns, _ := pctx.StateManager.GetUserConnections(userID)
+	for _, conn := range conns {
+		a.seen[conn.ID()] = true
+	}
+}
+
+func (a *audience) add(conns []transport.Conn) {
+	for _, conn := range conns {
+		if !a.seen[conn.ID()] {
+			a.seen[conn.ID()] = true
+			a.conns = append(a.conns, conn)
+		}
+	}
+}
+
+// addTarget adds the connections a notify target reaches: a user
+// ("user:<id>"), the rooms of a user ("rooms_of:<id>"), a room or a room
+// pattern. Rooms reached through a pattern or another user are limited to
+// those the triggering user may notify; a user or room named directly is
+// reached as named.
+func (a *audience) addTarget(pctx *pipeline.Cargo, target string) {
+	switch {
+	case strings.HasPrefix(target, userTargetPrefix):
+		conns, err := getConnectionsForRoom(pctx, target)
+		if err != nil {
+			pctx.Logger.Debug("Could not resolve user to connections", slog.String("target", target), slog.Any("error", err))
+			return
+		}
+		a.add(conns)
+	case strings.HasPrefix(target, roomsOfTargetPrefix):
+		userID := strings.TrimPrefix(target, roomsOfTargetPrefix)
+		rooms, err := pctx.StateManager.GetUserRooms(userID)
+		if err != nil {
+			pctx.Logger.Debug("Could not resolve user to rooms", slog.String("target", target), slog.Any("error", err))
+			return
+		}
+		if pctx.User == nil || pctx.User.ID != userID {
+			rooms = allowedRooms(pctx, rooms)
+		}
+		a.addRooms(pctx, rooms)
+	case state.IsRoomPattern(target):
+		a.addRooms(pctx, resolvePattern(pctx, target))
+	default:
+		a.addRooms(pctx, []string{target})
+	}
+}
+
+// addRooms adds the connections of the members of rooms, and of the users
+// subscribed to them who may see them (see state.Manager.CanJoin).
+func (a *audience) addRooms(pctx *pipeline.Cargo, rooms []string) {
+	sm := pctx.StateManager
+	for _, roomID := range rooms {
+		members, err := getConnectionsForRoom(pctx, roomID)
+		if err != nil {
+			// the room does not exist; neither does anything to subscribe to.
+			pctx.Logger.Debug("Could not resolve room to connections", slog.String("roomID", roomID), slog.Any("error", err))
+			continue
+		}
+		a.add(members)
+		for _, userID := range sm.GetSubscribers(roomID) {
+			if !sm.CanJoin(userID, roomID) {
+				continue
+			}
+			if userConns, err := sm.GetUserConnections(userID); err == nil {
+				a.add(userConns)
+			}
+		}
+	}
+}
+
+// params: [pattern?], defaulting to the event's target. Subscribes the
+// triggering user to the notifications of every room matching the pattern.
+func actionSubscribe(pctx *pipeline.Cargo, params ...string) error {
+	pattern, err := subscriptionParam(pctx, "_subscribe", params)
+	if err != nil {
+		return err
+	}
+	if err := pctx.StateManager.Subscribe(pctx.User.ID, pattern); err != nil {
+		return fmt.Errorf("_subscribe: %w", err)
+	}
+	return nil
+}
+
+// params: [pattern?], defaulting to the event's target.
+func actionUnsubscribe(pctx *pipeline.Cargo, params ...string) error {
+	pattern, err := subscriptionParam(pctx, "_unsubscribe", params)
+	if err != nil {
+		return err
+	}
+	if err := pctx.StateManager.Unsubscribe(pctx.User.ID, pattern); err != nil {
+		return fmt.Errorf("_unsubscribe: %w", err)
+	}
+	return nil
+}
+
+func subscriptionParam(pctx *pipeline.Cargo, action string, params []string) (string, error) {
+	if len(params) > 1 {
+		return "", fmt.Errorf("%s accepts at most 1 parameter: [pattern?]", action)
+	}
+	if pctx.User == nil {
+		return "", errors.New(action + " requires a user")
+	}
+	if len(params) == 1 {
+		return params[0], nil
+	}
+	return pctx.TargetID, nil
+}
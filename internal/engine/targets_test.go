@@ -0,0 +1,154 @@
+package engine_test
+
+import (
+	"testing"
+
+	"github.com/a-essam23/go-dispatch/pkg/state"
+	"github.com/a-essam23/go-dispatch/pkg/transport/transporttest"
+)
+
+func TestNotifyReachesNamedRoomsAndUsersAsNamed(t *testing.T) {
+	env := newTestEnv(t, nil)
+	env.connect("mod", state.PermModerate)
+	env.joinAll("lobby", "alice", "bob")
+	env.joinAll("attic", "carol")
+
+	env.target = "attic"
+	env.run("alice", "_notify_room", "knock", `{}`)
+	env.run("alice", "_notify", "user:carol", "ping", `{}`)
+	if got := len(env.conns["carol"].Sent()); got != 2 {
+		t.Errorf("a room and a user named directly should be reached, carol got %d messages", got)
+	}
+
+	// a room the sender just left, as leave_room does.
+	env.target = "lobby"
+	env.run("alice", "_leave", "alice", "lobby")
+	env.run("alice", "_notify_room", "user_left", `{}`)
+	if got := len(env.conns["bob"].Sent()); got != 1 {
+		t.Errorf("bob should hear that alice left, got %d messages", got)
+	}
+}
+
+func TestNotifyRoomsOfAnotherUserReachesOnlyRoomsTheSenderMayNotify(t *testing.T) {
+	env := newTestEnv(t, nil)
+	env.connect("mod", state.PermModerate)
+	env.joinAll("lobby", "alice", "bob")
+	env.joinAll("attic", "carol")
+
+	tests := []struct {
+		name   string
+		sender string
+		want   int
+	}{
+		{"a member of another room", "alice", 0},
+		{"the user themselves", "carol", 1},
+		{"a moderator outside the room", "mod", 1},
+		{"the server", "", 1},
+	}
+	for _, tt := range tests {
+		env.resetSent()
+		env.run(tt.sender, "_notify", "rooms_of:carol", "ping", `{}`)
+		if got := len(env.conns["carol"].Sent()); got != tt.want {
+			t.Errorf("%s: carol got %d messages, want %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestNotifyRoomPatternReachesSubtreeAndSubscribers(t *testing.T) {
+	env := newTestEnv(t, nil)
+	// a create permission of its own, as moderating everywhere would let alice
+	// notify every room.
+	env.sm.SetRoomClasses([]state.RoomClass{{Name: "private", Pattern: "org:42/private", Join: state.JoinInviteOnly, Permission: createPrivate}})
+	alice := env.connect("alice", createPrivate)
+	bob := env.connect("bob", 0)
+	carol := env.connect("carol", 0)
+	watcher := env.connect("dave", 0)
+
+	env.run("alice", "_join", "alice", "org:42/private")
+	env.join("org:42/team:7", "alice", "bob")
+	env.join("org:42/team:8", "alice", "bob")
+	env.join("org:42/team:9", "carol")
+	env.target = "org:42/**"
+	env.run("dave", "_subscribe")
+
+	cargo := env.cargo("alice")
+	cargo.TargetID = "org:42/**"
+	runAction(t, env.reg, cargo, "_notify_room", "announcement", `{}`)
+
+	if got := len(alice.Sent()); got != 1 {
+		t.Errorf("alice should get the announcement once across her rooms, got %d", got)
+	}
+	if got := len(bob.Sent()); got != 1 {
+		t.Errorf("bob should get the announcement once across his rooms, got %d", got)
+	}
+	if got := len(carol.Sent()); got != 0 {
+		t.Errorf("carol's room is not one alice may notify, yet she got %d messages", got)
+	}
+	if got := len(watcher.Sent()); got != 1 {
+		t.Errorf("the subscriber should get the announcement once, got %d", got)
+	}
+
+	watcher.Reset()
+	cargo.TargetID = "org:42/private"
+	runAction(t, env.reg, cargo, "_notify_room", "secret", `{}`)
+	if got := len(watcher.Sent()); got != 0 {
+		t.Errorf("a subscriber who may not join the room received %d messages from it", got)
+	}
+}
+
+func TestNotifySendsOncePerConnectionAndAppliesExclusions(t *testing.T) {
+	tests := []struct {
+		name    string
+		targets string
+		exclude string
+		want    map[string]int
+	}{
+		{"overlapping rooms and users", "lobby, game, user:dave, user:bob", "origin", map[string]int{"origin": 0, "otherTab": 1, "bob": 1, "carol": 1, "dave": 1}},
+		{"exclude sender", "lobby,game", "sender", map[string]int{"origin": 0, "otherTab": 0, "bob": 1, "carol": 1, "dave": 0}},
+		{"exclude a user", "game", "user:carol", map[string]int{"origin": 1, "otherTab": 1, "bob": 1, "carol": 0, "dave": 0}},
+		{"rooms of the sender", "rooms_of:alice", "sender,user:carol", map[string]int{"origin": 0, "otherTab": 0, "bob": 1, "carol": 0, "dave": 0}},
+		{"user list", "user:bob,user:carol,user:dave", "", map[string]int{"origin": 0, "otherTab": 0, "bob": 1, "carol": 1, "dave": 1}},
+		{"the sender's other tabs", "user:alice", "origin", map[string]int{"origin": 0, "otherTab": 1, "bob": 0, "carol": 0, "dave": 0}},
+		{"blank targets", " , ", "", map[string]int{"origin": 0, "otherTab": 0, "bob": 0, "carol": 0, "dave": 0}},
+	}
+	for _, tt := range tests {
+		env := newTestEnv(t, nil)
+		origin, otherTab := env.connect("alice", 0), env.connect("alice", 0)
+		env.joinAll("lobby", "alice", "bob")
+		env.joinAll("game", "alice", "bob", "carol")
+		env.connectAll("dave")
+		conns := map[string]*transporttest.Conn{"origin": origin, "otherTab": otherTab, "bob": env.conns["bob"], "carol": env.conns["carol"], "dave": env.conns["dave"]}
+
+		runAction(t, env.reg, env.cargoOn(origin), "_notify", tt.targets, "move", `{}`, tt.exclude)
+		for name, want := range tt.want {
+			if got := len(conns[name].Sent()); got != want {
+				t.Errorf("%s: %s got %d messages, want %d", tt.name, name, got, want)
+			}
+		}
+	}
+}
+
+func TestNotifyRejectsBadParams(t *testing.T) {
+	env := newTestEnv(t, nil)
+	env.joinAll("lobby", "alice", "bob")
+	notify := env.action("_notify")
+	cargo := env.cargo("alice")
+
+	tests := []struct {
+		name   string
+		params []string
+	}{
+		{"too few params", []string{"lobby", "move"}},
+		{"too many params", []string{"lobby", "move", `{}`, "", "normal", "x"}},
+		{"unknown exclusion", []string{"lobby", "move", `{}`, "everyone"}},
+		{"unknown priority", []string{"lobby", "move", `{}`, "", "urgent"}},
+	}
+	for _, tt := range tests {
+		if err := notify(cargo, tt.params...); err == nil {
+			t.Errorf("%s: expected an error", tt.name)
+		}
+	}
+	if sent := env.conns["bob"].Sent(); len(sent) != 0 {
+		t.Errorf("a rejected notification was sent: %q", sent)
+	}
+}
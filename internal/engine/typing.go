@@ -0,0 +1,152 @@
+package engine
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/a-essam23/go-dispatch/pkg/pipeline"
+	"github.com/a-essam23/go-dispatch/pkg/state"
+	"github.com/a-essam23/go-dispatch/pkg/transport"
+)
+
+const (
+	// TypingEvent tells a room that a member started or stopped typing.
+	TypingEvent = "typing"
+
+	typingModifier   = "typing"
+	defaultTypingTTL = 5 * time.Second
+)
+
+type typingPayload struct {
+	UserID string `json:"userId"`
+	Room   string `json:"room"`
+	Typing bool   `json:"typing"`
+}
+
+// typingTracker keeps who is typing where as "typing" modifier state, keyed by
+// user and room, whose timer stops the indicator once its TTL passes. Only
+// transitions are broadcast: refreshing an indicator is silent. mu serializes
+// every read and write of that state.
+type typingTracker struct {
+	mu sync.Mutex
+}
+
+// start marks the user as typing in roomID until ttl passes. It reports
+// whether the user was not typing there before.
+func (t *typingTracker) start(pctx *pipeline.Cargo, userID, roomID string, ttl time.Duration) bool {
+	sm := pctx.StateManager
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if st, found := sm.GetModifierState(typingModifier, userID, roomID); found {
+		st.Timer.Reset(ttl)
+		return false
+	}
+	st := &state.ModifierState{}
+	st.Timer = time.AfterFunc(ttl, func() {
+		if t.stop(sm, userID, roomID, st) {
+			broadcastTyping(pctx, userID, roomID, false)
+		}
+	})
+	sm.SetModifierState(typingModifier, userID, roomID, st)
+	return true
+}
+
+// stop clears the user's indicator in roomID, if it is still the one given
+// (any, when nil). It reports whether there was one to clear.
+func (t *typingTracker) stop(sm state.Manager, userID, roomID string, only *state.ModifierState) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	st, found := sm.GetModifierState(typingModifier, userID, roomID)
+	if !found || (only != nil && st != only) {
+		return false
+	}
+	sm.DeleteModifierState(typingModifier, userID, roomID)
+	return true
+}
+
+// clear stops the user's indicator in roomID, telling the room if there was one.
+func (t *typingTracker) clear(pctx *pipeline.Cargo, userID, roomID string) {
+	if t.stop(pctx.StateManager, userID, roomID, nil) {
+		broadcastTyping(pctx, userID, roomID, false)
+	}
+}
+
+// tells every member of the room but the typist.
+func broadcastTyping(pctx *pipeline.Cargo, userID, roomID string, typing bool) {
+	payload, _ := json.Marshal(typingPayload{UserID: userID, Room: roomID, Typing: typing})
+	msg, _ := json.Marshal(ClientResponse{Event: TypingEvent, Payload: payload})
+
+	members, err := pctx.StateManager.GetRoomMembers(roomID)
+	if err != nil {
+		return
+	}
+	var conns []transport.Conn
+	for _, member := range members {
+		if member.ID == userID {
+			continue
+		}
+		memberConns, err := pctx.StateManager.GetUserConnections(member.ID)
+		if err != nil {
+			continue
+		}
+		conns = append(conns, memberConns...)
+	}
+	if err := sendAll(conns, msg, transport.PrioritySystem, ""); err != nil {
+		pctx.Logger.Error("Failed to broadcast typing", slog.String("roomID", roomID), slog.Any("error", err))
+	}
+}
+
+// params: [state, ttl?]. state is "start" or "stop"; ttl defaults to 5s. The
+// room is the event's target.
+func newTypingAction(typing *typingTracker) pipeline.ActionFunc {
+	return func(pctx *pipeline.Cargo, params ...string) error {
+		if len(params) != 1 && len(params) != 2 {
+			return errors.New("_typing requires 1 or 2 parameters: [start|stop, ttl?]")
+		}
+		if pctx.User == nil {
+			return errors.New("_typing requires a user")
+		}
+		ttl := defaultTypingTTL
+		if len(params) == 2 {
+			var err error
+			if ttl, err = time.ParseDuration(params[1]); err != nil || ttl <= 0 {
+				return fmt.Errorf("invalid _typing ttl: %s", params[1])
+			}
+		}
+		userID, roomID := pctx.User.ID, pctx.TargetID
+		if _, member := pctx.StateManager.GetGrant(userID, roomID); !member {
+			return fmt.Errorf("_typing: user '%s' is not a member of room '%s'", userID, roomID)
+		}
+
+		switch params[0] {
+		case "start":
+			if typing.start(pctx, userID, roomID, ttl) {
+				broadcastTyping(pctx, userID, roomID, true)
+			}
+		case "stop":
+			typing.clear(pctx, userID, roomID)
+		default:
+			return fmt.Errorf("_typing: unknown state '%s' (want start or stop)", params[0])
+		}
+		return nil
+	}
+}
+
+// HandleDisconnect cleans up after a user whose last connection closed:
+// typing indicators in every room they belong to are stopped.
+func (e *Registry) HandleDisconnect(logger *slog.Logger, sm state.Manager, userID string) {
+	rooms, err := sm.GetUserRooms(userID)
+	if err != nil {
+		return
+	}
+	pctx := newSystemCargo(logger, sm)
+	for _, roomID := range rooms {
+		e.typing.clear(pctx, userID, roomID)
+	}
+}
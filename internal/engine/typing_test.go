@@ -0,0 +1,86 @@
+package engine_test
+
+import "testing"
+
+const (
+	typingStart = `{"event":"typing","payload":{"userId":"alice","room":"lobby","typing":true}}`
+	typingStop  = `{"event":"typing","payload":{"userId":"alice","room":"lobby","typing":false}}`
+)
+
+func TestTypingBroadcastsOnlyTransitions(t *testing.T) {
+	env := newTestEnv(t, nil)
+	env.target = "lobby"
+	env.joinAll("lobby", "alice", "bob")
+
+	env.run("alice", "_typing", "start")
+	env.run("alice", "_typing", "start")
+	env.run("alice", "_typing", "stop")
+	env.run("alice", "_typing", "stop")
+	if sent := env.conns["bob"].Sent(); len(sent) != 2 || string(sent[0]) != typingStart || string(sent[1]) != typingStop {
+		t.Errorf("expected a single start then a single stop, got %q", sent)
+	}
+	if len(env.conns["alice"].Sent()) != 0 {
+		t.Error("the typist was told about their own typing")
+	}
+}
+
+func TestTypingExpiresAfterItsTTL(t *testing.T) {
+	env := newTestEnv(t, nil)
+	env.target = "lobby"
+	env.joinAll("lobby", "alice", "bob")
+
+	env.run("alice", "_typing", "start", "30ms")
+	if sent := waitForSent(t, env.conns["bob"], 2); len(sent) != 2 || string(sent[1]) != typingStop {
+		t.Errorf("expected the indicator to expire, got %q", sent)
+	}
+}
+
+func TestTypingRejectsBadParams(t *testing.T) {
+	env := newTestEnv(t, nil)
+	env.target = "lobby"
+	env.joinAll("lobby", "alice", "bob")
+	typing := env.action("_typing")
+	cargo := env.cargo("alice")
+
+	for name, params := range map[string][]string{
+		"unknown state": {"pause"},
+		"invalid ttl":   {"start", "soon"},
+		"zero ttl":      {"start", "0s"},
+		"no params":     {},
+	} {
+		if err := typing(cargo, params...); err == nil {
+			t.Errorf("%s: expected %q to be rejected", name, params)
+		}
+	}
+	cargo.TargetID = "vault"
+	if err := typing(cargo, "start"); err == nil {
+		t.Error("expected typing in a room the user is not in to be rejected")
+	}
+	if sent := env.conns["bob"].Sent(); len(sent) != 0 {
+		t.Errorf("rejected calls were broadcast: %q", sent)
+	}
+}
+
+func TestTypingIsClearedOnLeave(t *testing.T) {
+	env := newTestEnv(t, nil)
+	env.target = "lobby"
+	env.joinAll("lobby", "alice", "bob")
+
+	env.run("alice", "_typing", "start")
+	env.run("alice", "_leave", "alice", "lobby")
+	if sent := env.conns["bob"].Sent(); len(sent) != 2 || string(sent[1]) != typingStop {
+		t.Errorf("leaving should stop the indicator, got %q", sent)
+	}
+}
+
+func TestTypingIsClearedOnDisconnect(t *testing.T) {
+	env := newTestEnv(t, nil)
+	env.target = "lobby"
+	env.joinAll("lobby", "alice", "bob")
+
+	env.run("alice", "_typing", "start")
+	env.reg.HandleDisconnect(env.logger, env.sm, "alice")
+	if sent := env.conns["bob"].Sent(); len(sent) != 2 || string(sent[1]) != typingStop {
+		t.Errorf("disconnecting should stop the indicator, got %q", sent)
+	}
+}
@@ -0,0 +1,321 @@
+package engine
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/a-essam23/go-dispatch/pkg/pipeline"
+	"github.com/google/uuid"
+	"github.com/tidwall/gjson"
+)
+
+// headers of a webhook or authorizer request. The signature, sent when the
+// endpoint has a secret, is "sha256=" and the hex HMAC-SHA256 of
+// "<timestamp>.<body>".
+const (
+	WebhookEventHeader     = "X-Dispatch-Event"
+	WebhookDeliveryHeader  = "X-Dispatch-Delivery"
+	WebhookTimestampHeader = "X-Dispatch-Timestamp"
+	WebhookSignatureHeader = "X-Dispatch-Signature"
+)
+
+// the most of a synchronous webhook's response that is read.
+const maxWebhookResponse = 1 << 20
+
+// asynchronous deliveries a webhook may have in flight if it sets no limit.
+const defaultWebhookInFlight = 64
+
+// Webhook is a backend endpoint _webhook posts to.
+type Webhook struct {
+	URL string
+	// signs requests when set.
+	Secret string
+	// how long each attempt may take.
+	Timeout time.Duration
+	// attempts after the first when the endpoint fails or answers 429 or 5xx.
+	Retries int
+	// the wait before the first retry, doubled before each further one.
+	Backoff time.Duration
+	// asynchronous deliveries in flight at once; further ones are dropped.
+	// 64 if zero.
+	MaxInFlight int
+}
+
+// Sign returns the signature header value of a request with the given
+// timestamp and body.
+func (w Webhook) Sign(timestamp string, body []byte) string {
+	return sign(w.Secret, timestamp, body)
+}
+
+func sign(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// newSignedRequest builds a request with a JSON body, if body is not nil,
+// signed when secret is set.
+func newSignedRequest(ctx context.Context, method, url, secret, event string, body []byte) (*http.Request, error) {
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, url, reader)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	req.Header.Set(WebhookEventHeader, event)
+	if secret != "" {
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		req.Header.Set(WebhookTimestampHeader, timestamp)
+		req.Header.Set(WebhookSignatureHeader, sign(secret, timestamp, body))
+	}
+	return req, nil
+}
+
+type webhookEnvelope struct {
+	Event   string          `json:"event"`
+	Target  string          `json:"target"`
+	UserID  string          `json:"userId,omitempty"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+// an error the endpoint answered with; retried only for 429 and 5xx.
+type webhookStatusError struct {
+	status int
+}
+
+func (e *webhookStatusError) Error() string {
+	return fmt.Sprintf("endpoint returned %d", e.status)
+}
+
+func (e *webhookStatusError) retryable() bool {
+	return e.status == http.StatusTooManyRequests || e.status >= 500
+}
+
+type webhookClient struct {
+	hooks  map[string]Webhook
+	http   *http.Client
+	logger *slog.Logger
+	// the most a synchronous call may take, retries included; no limit if zero.
+	maxSyncWait time.Duration
+	// asynchronous deliveries run on ctx, cancelled by close.
+	ctx    context.Context
+	cancel context.CancelFunc
+	// the asynchronous deliveries in flight; none start once closed.
+	mu     sync.Mutex
+	closed bool
+	async  sync.WaitGroup
+	// a slot per asynchronous delivery in flight, by webhook.
+	inFlight map[string]chan struct{}
+}
+
+func newWebhookClient(hooks map[string]Webhook, maxSyncWait time.Duration, logger *slog.Logger) *webhookClient {
+	ctx, cancel := context.WithCancel(context.Background())
+	c := &webhookClient{hooks: hooks, http: &http.Client{}, logger: logger, maxSyncWait: maxSyncWait, ctx: ctx, cancel: cancel, inFlight: make(map[string]chan struct{}, len(hooks))}
+	for name, hook := range hooks {
+		limit := hook.MaxInFlight
+		if limit <= 0 {
+			limit = defaultWebhookInFlight
+		}
+		c.inFlight[name] = make(chan struct{}, limit)
+	}
+	return c
+}
+
+// goAsync runs deliver in the background unless the client is closed, and
+// reports whether it did.
+func (c *webhookClient) goAsync(deliver func(ctx context.Context)) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return false
+	}
+	c.async.Add(1)
+	go func() {
+		defer c.async.Done()
+		deliver(c.ctx)
+	}()
+	return true
+}
+
+// close stops asynchronous deliveries from starting and waits for those in
+// flight until ctx is done, then cancels the rest and waits for them to
+// return. It returns ctx's error if any had to be cancelled.
+func (c *webhookClient) close(ctx context.Context) error {
+	c.mu.Lock()
+	c.closed = true
+	c.mu.Unlock()
+	done := make(chan struct{})
+	go func() {
+		c.async.Wait()
+		close(done)
+	}()
+	defer c.cancel()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		c.cancel()
+		<-done
+		return ctx.Err()
+	}
+}
+
+// post delivers body to the webhook, retrying failed attempts, and returns the
+// response body of the one that succeeded. Every attempt carries the same
+// delivery ID, so the endpoint can drop duplicates.
+func (c *webhookClient) post(ctx context.Context, hook Webhook, event string, body []byte) ([]byte, error) {
+	delivery := uuid.NewString()
+	backoff := hook.Backoff
+	for attempt := 0; ; attempt++ {
+		resp, err := c.attempt(ctx, hook, event, delivery, body)
+		if err == nil {
+			return resp, nil
+		}
+		var statusErr *webhookStatusError
+		if attempt >= hook.Retries || (errors.As(err, &statusErr) && !statusErr.retryable()) {
+			return nil, err
+		}
+		c.logger.Debug("Webhook attempt failed, retrying", slog.String("url", hook.URL), slog.Int("attempt", attempt+1), slog.Any("error", err))
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		backoff *= 2
+	}
+}
+
+func (c *webhookClient) attempt(ctx context.Context, hook Webhook, event, delivery string, body []byte) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, hook.Timeout)
+	defer cancel()
+	req, err := newSignedRequest(ctx, http.MethodPost, hook.URL, hook.Secret, event, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set(WebhookDeliveryHeader, delivery)
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		io.Copy(io.Discard, io.LimitReader(resp.Body, maxWebhookResponse))
+		return nil, &webhookStatusError{status: resp.StatusCode}
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, maxWebhookResponse))
+}
+
+// params: [webhook, body?, mode?]. POSTs body, by default the triggering event
+// as {event, target, userId, payload}, to the named webhook. mode is "async",
+// the default, which returns at once and only logs a failure, or "sync", which
+// waits, at most the client's maxSyncWait, and halts the pipeline if the
+// webhook fails. An asynchronous delivery past the webhook's MaxInFlight, or
+// once the client is closed, is dropped. body is a JSON template: values
+// resolved into it are JSON-encoded. The JSON response of a synchronous call
+// is read by later steps as {$webhook.<path>}.
+func newWebhookAction(c *webhookClient) pipeline.ActionFunc {
+	return func(pctx *pipeline.Cargo, params ...string) error {
+		if len(params) < 1 || len(params) > 3 {
+			return errors.New("_webhook requires 1 to 3 parameters: [webhook, body?, mode?]")
+		}
+		hook, ok := c.hooks[params[0]]
+		if !ok {
+			return fmt.Errorf("_webhook: unknown webhook '%s'", params[0])
+		}
+		sync := false
+		if len(params) == 3 {
+			switch params[2] {
+			case "", "async":
+			case "sync":
+				sync = true
+			default:
+				return fmt.Errorf("_webhook: unknown mode '%s' (want async or sync)", params[2])
+			}
+		}
+
+		var body []byte
+		if len(params) > 1 && params[1] != "" {
+			body = []byte(params[1])
+			if !json.Valid(body) {
+				return errors.New("_webhook: body is not valid JSON")
+			}
+		} else {
+			envelope := webhookEnvelope{Event: pctx.EventName, Target: pctx.TargetID, Payload: pctx.Payload}
+			if pctx.User != nil {
+				envelope.UserID = pctx.User.ID
+			}
+			body, _ = json.Marshal(envelope)
+		}
+
+		if !sync {
+			slots := c.inFlight[params[0]]
+			select {
+			case slots <- struct{}{}:
+			default:
+				pctx.Logger.Warn("Webhook has too many deliveries in flight, dropping one", slog.String("webhook", params[0]))
+				return nil
+			}
+			started := c.goAsync(func(ctx context.Context) {
+				defer func() { <-slots }()
+				if _, err := c.post(ctx, hook, pctx.EventName, body); err != nil {
+					pctx.Logger.Error("Webhook failed", slog.String("webhook", params[0]), slog.Any("error", err))
+				}
+			})
+			if !started {
+				<-slots
+				pctx.Logger.Warn("Server is shutting down, dropping a webhook delivery", slog.String("webhook", params[0]))
+			}
+			return nil
+		}
+
+		ctx := pctx.Ctx
+		if ctx == nil {
+			ctx = context.Background()
+		}
+		if c.maxSyncWait > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, c.maxSyncWait)
+			defer cancel()
+		}
+		resp, err := c.post(ctx, hook, pctx.EventName, body)
+		if err != nil {
+			return fmt.Errorf("_webhook '%s': %w", params[0], err)
+		}
+		if len(bytes.TrimSpace(resp)) > 0 && !json.Valid(resp) {
+			return fmt.Errorf("_webhook '%s': response is not valid JSON", params[0])
+		}
+		pctx.Webhook = resp
+		return nil
+	}
+}
+
+// resolves "{$webhook.<path>}" from the last synchronous webhook response.
+func webhookResolver(path string) ResolverFunc {
+	return func(pctx *pipeline.Cargo) (string, error) {
+		value := gjson.GetBytes(pctx.Webhook, path)
+		if !value.Exists() {
+			return "", fmt.Errorf("path '%.*s' not found in webhook response", 40, path)
+		}
+		return value.String(), nil
+	}
+}
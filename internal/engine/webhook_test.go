@@ -0,0 +1,306 @@
+package engine_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/a-essam23/go-dispatch/internal/engine"
+	"github.com/a-essam23/go-dispatch/pkg/pipeline"
+)
+
+type webhookRequest struct {
+	body                string
+	delivery, signature string
+	timestamp           string
+}
+
+// starts a backend answering with statuses in turn, then 200 and a JSON
+// verdict, and returns the webhook posting to it with the requests it got.
+func newWebhookBackend(t *testing.T, statuses ...int) (engine.Webhook, chan webhookRequest) {
+	t.Helper()
+	requests := make(chan webhookRequest, 8)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		requests <- webhookRequest{
+			body:      string(body),
+			delivery:  r.Header.Get(engine.WebhookDeliveryHeader),
+			signature: r.Header.Get(engine.WebhookSignatureHeader),
+			timestamp: r.Header.Get(engine.WebhookTimestampHeader),
+		}
+		if len(statuses) > 0 {
+			w.WriteHeader(statuses[0])
+			statuses = statuses[1:]
+			return
+		}
+		io.WriteString(w, `{"verdict":{"allowed":true}}`)
+	}))
+	t.Cleanup(srv.Close)
+	return engine.Webhook{URL: srv.URL, Secret: "s3cret", Timeout: time.Second, Retries: 2, Backoff: time.Millisecond}, requests
+}
+
+// returns a registry with the webhooks and a cargo from the server for the
+// lobby.
+func newWebhookRegistry(t *testing.T, hooks map[string]engine.Webhook) (*engine.Registry, *pipeline.Cargo) {
+	t.Helper()
+	return newWebhookRegistryWith(t, &engine.RegisterCoreOptions{Webhooks: hooks})
+}
+
+func newWebhookRegistryWith(t *testing.T, opts *engine.RegisterCoreOptions) (*engine.Registry, *pipeline.Cargo) {
+	t.Helper()
+	env := newTestEnv(t, opts)
+	env.target = "lobby"
+	cargo := env.cargo("")
+	cargo.EventName, cargo.Payload = "send_message", json.RawMessage(`{"text":"hi"}`)
+	return env.reg, cargo
+}
+
+// returns the next request, failing if none comes.
+func nextWebhookRequest(t *testing.T, requests chan webhookRequest) webhookRequest {
+	t.Helper()
+	select {
+	case r := <-requests:
+		return r
+	case <-time.After(time.Second):
+		t.Fatal("expected a webhook request")
+		return webhookRequest{}
+	}
+}
+
+// fails if another request comes soon.
+func expectNoWebhookRequest(t *testing.T, requests chan webhookRequest, why string) {
+	t.Helper()
+	select {
+	case r := <-requests:
+		t.Errorf("%s, got %+v", why, r)
+	case <-time.After(20 * time.Millisecond):
+	}
+}
+
+func TestWebhookRetriesWithTheSameDeliveryAndSignsEachAttempt(t *testing.T) {
+	hook, requests := newWebhookBackend(t, http.StatusServiceUnavailable)
+	reg, cargo := newWebhookRegistry(t, map[string]engine.Webhook{"backend": hook})
+
+	runAction(t, reg, cargo, "_webhook", "backend", `{"text":"hi"}`, "sync")
+	first, second := nextWebhookRequest(t, requests), nextWebhookRequest(t, requests)
+	if first.delivery == "" || first.delivery != second.delivery {
+		t.Errorf("expected the retry to keep the delivery ID, got %q and %q", first.delivery, second.delivery)
+	}
+	for i, r := range []webhookRequest{first, second} {
+		if r.body != `{"text":"hi"}` || r.signature != hook.Sign(r.timestamp, []byte(r.body)) {
+			t.Errorf("attempt %d: expected the signed body, got %+v", i+1, r)
+		}
+	}
+}
+
+func TestWebhookExposesASyncResponse(t *testing.T) {
+	hook, _ := newWebhookBackend(t)
+	reg, cargo := newWebhookRegistry(t, map[string]engine.Webhook{"backend": hook})
+
+	runAction(t, reg, cargo, "_webhook", "backend", "", "sync")
+	resolve, ok := reg.GetParamResolver("webhook.verdict.allowed")
+	if !ok {
+		t.Fatal("expected {$webhook.*} to resolve")
+	}
+	if allowed, err := resolve(cargo); err != nil || allowed != "true" {
+		t.Errorf("expected the response to be exposed, got %q, %v", allowed, err)
+	}
+	if _, err := mustResolver(t, reg, "webhook.verdict.missing")(cargo); err == nil {
+		t.Error("expected a missing response path to fail")
+	}
+}
+
+func TestWebhookFailsOnceRetriesAreExhausted(t *testing.T) {
+	hook, requests := newWebhookBackend(t, http.StatusBadGateway, http.StatusTooManyRequests, http.StatusServiceUnavailable)
+	reg, cargo := newWebhookRegistry(t, map[string]engine.Webhook{"backend": hook})
+	webhook, _ := reg.GetActionFunc("_webhook")
+
+	if err := webhook(cargo, "backend", "", "sync"); err == nil {
+		t.Error("expected the pipeline to halt once retries are exhausted")
+	}
+	for range hook.Retries + 1 {
+		nextWebhookRequest(t, requests)
+	}
+	expectNoWebhookRequest(t, requests, "expected no attempt past the retries")
+	if cargo.Webhook != nil {
+		t.Errorf("a failed webhook exposed a response: %s", cargo.Webhook)
+	}
+}
+
+func TestWebhookDoesNotRetryOtherStatuses(t *testing.T) {
+	hook, requests := newWebhookBackend(t, http.StatusBadRequest)
+	reg, cargo := newWebhookRegistry(t, map[string]engine.Webhook{"backend": hook})
+	webhook, _ := reg.GetActionFunc("_webhook")
+
+	if err := webhook(cargo, "backend", "", "sync"); err == nil {
+		t.Error("expected a 400 to halt the pipeline")
+	}
+	nextWebhookRequest(t, requests)
+	expectNoWebhookRequest(t, requests, "expected a 400 not to be retried")
+}
+
+func TestWebhookSendsTheEventByDefaultWithoutWaiting(t *testing.T) {
+	hook, requests := newWebhookBackend(t)
+	reg, cargo := newWebhookRegistry(t, map[string]engine.Webhook{"backend": hook})
+
+	runAction(t, reg, cargo, "_webhook", "backend")
+	if r := nextWebhookRequest(t, requests); r.body != `{"event":"send_message","target":"lobby","payload":{"text":"hi"}}` {
+		t.Errorf("expected the event as the default body, got %s", r.body)
+	}
+	if cargo.Webhook != nil {
+		t.Errorf("an async webhook exposed a response: %s", cargo.Webhook)
+	}
+}
+
+func TestWebhookDropsAsyncDeliveriesPastTheLimit(t *testing.T) {
+	started, release := make(chan struct{}, 1), make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case started <- struct{}{}:
+		default:
+		}
+		<-release
+	}))
+	defer srv.Close()
+	reg, cargo := newWebhookRegistry(t, map[string]engine.Webhook{"backend": {URL: srv.URL, Timeout: time.Second, MaxInFlight: 1}})
+
+	runAction(t, reg, cargo, "_webhook", "backend")
+	<-started
+	runAction(t, reg, cargo, "_webhook", "backend")
+	select {
+	case <-started:
+		t.Error("a delivery past the limit was sent")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	// the slot is free again once the first delivery finishes.
+	close(release)
+	deadline := time.Now().Add(time.Second)
+	for len(started) == 0 && time.Now().Before(deadline) {
+		runAction(t, reg, cargo, "_webhook", "backend")
+		time.Sleep(5 * time.Millisecond)
+	}
+	if len(started) == 0 {
+		t.Error("expected a delivery once the first finished")
+	}
+}
+
+func TestWebhookCloseWaitsForDeliveriesInFlight(t *testing.T) {
+	started, release := make(chan struct{}, 1), make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		<-release
+	}))
+	defer srv.Close()
+	reg, cargo := newWebhookRegistry(t, map[string]engine.Webhook{"backend": {URL: srv.URL, Timeout: time.Minute}})
+
+	runAction(t, reg, cargo, "_webhook", "backend")
+	<-started
+	closed := make(chan error, 1)
+	go func() { closed <- reg.Close(context.Background()) }()
+	select {
+	case err := <-closed:
+		t.Fatalf("Close returned with a delivery in flight: %v", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+	close(release)
+	select {
+	case err := <-closed:
+		if err != nil {
+			t.Errorf("Close failed: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Close did not return once the delivery finished")
+	}
+
+	// nothing is delivered once closed.
+	runAction(t, reg, cargo, "_webhook", "backend")
+	select {
+	case <-started:
+		t.Error("a delivery started after Close")
+	case <-time.After(20 * time.Millisecond):
+	}
+}
+
+func TestWebhookCloseCancelsDeliveriesLeftWhenItTimesOut(t *testing.T) {
+	started, aborted := make(chan struct{}, 1), make(chan struct{}, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// the server only notices the client go once the body is read.
+		io.ReadAll(r.Body)
+		started <- struct{}{}
+		<-r.Context().Done()
+		aborted <- struct{}{}
+	}))
+	defer srv.Close()
+	reg, cargo := newWebhookRegistry(t, map[string]engine.Webhook{"backend": {URL: srv.URL, Timeout: time.Minute}})
+
+	runAction(t, reg, cargo, "_webhook", "backend")
+	<-started
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := reg.Close(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected Close to time out, got %v", err)
+	}
+	select {
+	case <-aborted:
+	case <-time.After(time.Second):
+		t.Error("the delivery went on after Close")
+	}
+}
+
+func TestWebhookSyncCallsGiveUpAfterTheMaxWait(t *testing.T) {
+	hook, requests := newWebhookBackend(t, 500, 500, 500, 500)
+	hook.Retries, hook.Backoff = 3, 200*time.Millisecond
+	reg, cargo := newWebhookRegistryWith(t, &engine.RegisterCoreOptions{
+		Webhooks:           map[string]engine.Webhook{"backend": hook},
+		MaxSyncWebhookWait: 50 * time.Millisecond,
+	})
+	webhook, _ := reg.GetActionFunc("_webhook")
+
+	began := time.Now()
+	if err := webhook(cargo, "backend", "", "sync"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected the call to time out, got %v", err)
+	}
+	if took := time.Since(began); took > 150*time.Millisecond {
+		t.Errorf("the call took %v, past its max wait", took)
+	}
+	nextWebhookRequest(t, requests)
+	expectNoWebhookRequest(t, requests, "expected no retry past the max wait")
+}
+
+func TestWebhookRejectsBadParams(t *testing.T) {
+	hook, requests := newWebhookBackend(t)
+	reg, cargo := newWebhookRegistry(t, map[string]engine.Webhook{"backend": hook})
+	webhook, _ := reg.GetActionFunc("_webhook")
+
+	tests := []struct {
+		name   string
+		params []string
+	}{
+		{"no webhook", nil},
+		{"too many params", []string{"backend", "", "sync", "x"}},
+		{"unknown webhook", []string{"audit"}},
+		{"unknown mode", []string{"backend", "", "later"}},
+		{"invalid body", []string{"backend", `{"text":`}},
+	}
+	for _, tt := range tests {
+		if err := webhook(cargo, tt.params...); err == nil {
+			t.Errorf("%s: expected an error", tt.name)
+		}
+	}
+	expectNoWebhookRequest(t, requests, "expected a rejected webhook not to be sent")
+}
+
+func mustResolver(t *testing.T, reg *engine.Registry, name string) engine.ResolverFunc {
+	t.Helper()
+	resolve, ok := reg.GetParamResolver(name)
+	if !ok {
+		t.Fatalf("expected {$%s} to resolve", name)
+	}
+	return resolve
+}
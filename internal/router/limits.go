@@ -0,0 +1,67 @@
+package router
+
+import (
+	"errors"
+	"fmt"
+)
+
+// metric names for JSON complexity violations detected by the router.
+const (
+	MetricJSONTooDeep     = "router.limit.json_depth"
+	MetricJSONTooManyKeys = "router.limit.json_keys"
+)
+
+// MessageLimits bounds the structural complexity of inbound JSON, checked
+// before the message is unmarshalled. A zero value disables a limit.
+type MessageLimits struct {
+	MaxDepth int
+	MaxKeys  int
+}
+
+var (
+	errJSONTooDeep     = errors.New("json nesting too deep")
+	errJSONTooManyKeys = errors.New("json has too many keys")
+)
+
+// checkJSONComplexity scans msg once without allocating, counting nesting depth
+// and object keys. It does not validate the JSON; json.Unmarshal does that.
+func checkJSONComplexity(msg []byte, limits MessageLimits) error {
+	if limits.MaxDepth <= 0 && limits.MaxKeys <= 0 {
+		return nil
+	}
+
+	depth, keys := 0, 0
+	inString, escaped := false, false
+	for _, b := range msg {
+		if inString {
+			switch {
+			case escaped:
+				escaped = false
+			case b == '\\':
+				escaped = true
+			case b == '"':
+				inString = false
+			}
+			continue
+		}
+
+		switch b {
+		case '"':
+			inString = true
+		case '{', '[':
+			depth++
+			if limits.MaxDepth > 0 && depth > limits.MaxDepth {
+				return fmt.Errorf("%w: exceeds %d levels", errJSONTooDeep, limits.MaxDepth)
+			}
+		case '}', ']':
+			depth--
+		case ':':
+			// outside of strings, every colon terminates an object key.
+			keys++
+			if limits.MaxKeys > 0 && keys > limits.MaxKeys {
+				return fmt.Errorf("%w: exceeds %d keys", errJSONTooManyKeys, limits.MaxKeys)
+			}
+		}
+	}
+	return nil
+}
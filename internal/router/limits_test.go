@@ -0,0 +1,38 @@
+package router
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestCheckJSONComplexity(t *testing.T) {
+	limits := MessageLimits{MaxDepth: 3, MaxKeys: 4}
+
+	tests := []struct {
+		name string
+		msg  string
+		want error
+	}{
+		{"flat message", `{"event":"a","target":"b","payload":{}}`, nil},
+		{"at depth limit", `{"payload":{"a":[1]}}`, nil},
+		{"too deep", `{"payload":{"a":[[1]]}}`, errJSONTooDeep},
+		{"too many keys", `{"a":1,"b":2,"c":3,"d":4,"e":5}`, errJSONTooManyKeys},
+		{"brackets inside strings ignored", `{"a":"[[[[{{{{:::"}`, nil},
+		{"escaped quote inside string", `{"a":"\"[[[[:::"}`, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkJSONComplexity([]byte(tt.msg), limits)
+			if !errors.Is(err, tt.want) {
+				t.Errorf("checkJSONComplexity(%s) = %v, want %v", tt.msg, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckJSONComplexity_Disabled(t *testing.T) {
+	if err := checkJSONComplexity([]byte(`[[[[[[[[[[]]]]]]]]]]`), MessageLimits{}); err != nil {
+		t.Errorf("expected no error with limits disabled, got %v", err)
+	}
+}
@@ -6,4 +6,6 @@ type ClientMessage struct {
 	Target  string          `json:"target"`
 	Event   string          `json:"event"`
 	Payload json.RawMessage `json:"payload"`
+	// optional; replies to the message, such as _proxy's, carry it as replyTo.
+	ID string `json:"id,omitempty"`
 }
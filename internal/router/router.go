@@ -6,12 +6,15 @@ import (
 	"errors"
 	"fmt"
 	"log/slog"
+	"net/url"
 	"regexp"
 	"strings"
 
 	"github.com/a-essam23/go-dispatch/internal/engine"
+	"github.com/a-essam23/go-dispatch/pkg/metrics"
 	"github.com/a-essam23/go-dispatch/pkg/pipeline"
 	"github.com/a-essam23/go-dispatch/pkg/state"
+	"github.com/a-essam23/go-dispatch/pkg/transport"
 	"github.com/google/uuid"
 	"github.com/tidwall/gjson"
 )
@@ -23,23 +26,37 @@ type EventRouter struct {
 	stateManager state.Manager
 	pipelines    map[string]*pipeline.CompiledPipeline
 	engine       *engine.Registry
+	limits       MessageLimits
+	metrics      *metrics.Registry
 }
 
-func NewEventRouter(logger *slog.Logger, stateManager state.Manager, pipelines map[string]*pipeline.CompiledPipeline, reg *engine.Registry) *EventRouter {
+func NewEventRouter(logger *slog.Logger, stateManager state.Manager, pipelines map[string]*pipeline.CompiledPipeline, reg *engine.Registry, limits MessageLimits, metricsReg *metrics.Registry) *EventRouter {
 	return &EventRouter{
 		logger:       logger.With(slog.String("component", "event_router")),
 		stateManager: stateManager,
 		pipelines:    pipelines,
 		engine:       reg,
+		limits:       limits,
+		metrics:      metricsReg,
 	}
 }
 func (r *EventRouter) HandleMessage(ctx context.Context, connID uuid.UUID, msg []byte) {
+	if err := checkJSONComplexity(msg, r.limits); err != nil {
+		r.rejectMessage(connID, err)
+		return
+	}
+
 	var clientMsg ClientMessage
 	if err := json.Unmarshal(msg, &clientMsg); err != nil {
 		r.logger.Warn("Failed to unmarshal client message", slog.Any("connID", connID), slog.Any("error", err))
 		return
 	}
 
+	// application-level keepalives only need to reach the read pump.
+	if clientMsg.Event == transport.HeartbeatEvent {
+		return
+	}
+
 	if clientMsg.Target == "" {
 		r.logger.Warn("Client message missing required 'target' field", "connID", connID)
 		return
@@ -52,142 +69,175 @@ func (r *EventRouter) HandleMessage(ctx context.Context, connID uuid.UUID, msg [
 		r.logger.Warn("Recieved unknown event", slog.Any("event", clientMsg.Event), slog.Any("connID", connID))
 		return
 	}
+	if pipe.Origin == pipeline.OriginSystem {
+		r.logger.Warn("Client sent a system event", slog.Any("event", clientMsg.Event), slog.Any("connID", connID))
+		return
+	}
 
 	originConn, found := r.stateManager.GetConnection(connID)
 	if !found || originConn.User == nil {
 		r.logger.Error("CRITICAL: State for originating connection/user not found.", "connID", connID)
 		return
 	}
-	var targetObj interface{}
-
-	if strings.HasPrefix(clientMsg.Target, "user:") {
-		targetUser, found := r.stateManager.FindUser(strings.TrimPrefix(clientMsg.Target, "user:"))
-		if found {
-			targetObj = targetUser
-		}
-	} else {
-		targetRoom, found := r.stateManager.FindRoom(clientMsg.Target)
-		if found {
-			targetObj = targetRoom
-		}
-	}
-	// now that we have the correct state objects, we can build the Cargo
 	pctx := &pipeline.Cargo{
-		Logger:       r.logger.With("component", "pipeline"),
+		Logger:       r.logger.With("component", "pipeline", "userID", originConn.User.ID),
 		Ctx:          ctx,
 		EventName:    clientMsg.Event,
+		RequestID:    clientMsg.ID,
 		User:         originConn.User,
 		Connection:   originConn,
 		StateManager: r.stateManager,
 		Payload:      clientMsg.Payload,
 		TargetID:     clientMsg.Target,
-		TargetObject: targetObj,
+		TargetObject: r.findTarget(clientMsg.Target),
 	}
-	r.logger.Debug("Executing modifier pipeline", "event", clientMsg.Event, "userID", pctx.User.ID)
-	for _, modStep := range pipe.Modifiers {
-		resolvedParams, err := r.resolveParams(pctx, modStep.Params)
-		if err != nil {
-			r.logger.Error("Failed to resolve params for modifier, halting pipeline", "event", clientMsg.Event, "error", err)
-			// TODO: Send error response to client
-			return
-		}
+	// why it halted is logged by executePipeline.
+	_ = r.executePipeline(pctx, pipe)
+}
 
-		if err := modStep.Function(pctx, resolvedParams...); err != nil {
-			// A modifier failed validation. Log and halt everything.
-			r.logger.Warn("Modifier check failed, pipeline halted", "event", clientMsg.Event, "userID", pctx.User.ID, "error", err)
-			// TODO: Send error response to client
-			return
-		}
+// rejectMessage counts a complexity violation and closes the offending connection.
+func (r *EventRouter) rejectMessage(connID uuid.UUID, err error) {
+	switch {
+	case errors.Is(err, errJSONTooDeep):
+		r.metrics.Counter(MetricJSONTooDeep).Inc()
+	case errors.Is(err, errJSONTooManyKeys):
+		r.metrics.Counter(MetricJSONTooManyKeys).Inc()
 	}
+	r.logger.Warn("Client message rejected by complexity limits", slog.Any("connID", connID), slog.Any("error", err))
 
-	r.logger.Debug("Executing action pipeline", slog.Any("event", clientMsg.Event), slog.Any("userID", pctx.User.ID))
-	for _, anStep := range pipe.Actions {
-		resolvedParams, err := r.resolveParams(pctx, anStep.Params)
-		if err != nil {
-			r.logger.Error("Failed to resolve params, halting pipeline", "event", clientMsg.Event, "error", err)
-			break
-		}
+	conn, found := r.stateManager.GetConnection(connID)
+	if !found {
+		return
+	}
+	conn.Transport.Close(transport.PolicyViolation("%v", err))
+}
 
-		if err := anStep.Function(pctx, resolvedParams...); err != nil {
-			r.logger.Error("Pipeline execution halted", "event", clientMsg.Event, "error", err)
-			break
+// findTarget returns the user ("user:<id>") or room a target names, or nil.
+func (r *EventRouter) findTarget(target string) any {
+	if strings.HasPrefix(target, "user:") {
+		if user, found := r.stateManager.FindUser(strings.TrimPrefix(target, "user:")); found {
+			return user
 		}
+		return nil
+	}
+	if room, found := r.stateManager.FindRoom(target); found {
+		return room
 	}
+	return nil
 }
 
-// constructs the Cargo object for a given message.
-func (r *EventRouter) buildPipelineCargo(ctx context.Context, connID uuid.UUID, clientMsg *ClientMessage) (*pipeline.Cargo, error) {
-	originConn, found := r.stateManager.GetConnection(connID)
-	if !found || originConn.User == nil {
-		return nil, errors.New("state for originating connection/user not found")
+// Run executes the pipeline of an invocation with the system origin, such as a
+// scheduled job or an admin publish. An invocation with a user runs as them,
+// never with a connection, and only a pipeline clients may trigger; it is
+// dropped once they are gone rather than run as the server. The pipeline is
+// looked up by event when it runs.
+func (r *EventRouter) Run(inv engine.Invocation) error {
+	pipe, ok := r.pipelines[inv.Event]
+	if !ok {
+		r.logger.Warn("Received unknown event", "event", inv.Event)
+		return fmt.Errorf("%w '%s'", ErrUnknownEvent, inv.Event)
 	}
-
-	var targetObj any
-	if strings.HasPrefix(clientMsg.Target, "user:") {
-		targetUser, found := r.stateManager.FindUser(strings.TrimPrefix(clientMsg.Target, "user:"))
-		if found {
-			targetObj = targetUser
+	pctx := &pipeline.Cargo{
+		Origin:       pipeline.OriginSystem,
+		Logger:       r.logger.With("component", "pipeline", "origin", "invocation"),
+		Ctx:          context.Background(),
+		EventName:    inv.Event,
+		StateManager: r.stateManager,
+		Payload:      inv.Payload,
+		TargetID:     inv.Target,
+		TargetObject: r.findTarget(inv.Target),
+	}
+	if inv.UserID != "" {
+		if pipe.Origin == pipeline.OriginSystem {
+			return fmt.Errorf("%w: '%s' run for user '%s'", ErrSystemEventForUser, inv.Event, inv.UserID)
 		}
-	} else {
-		targetRoom, found := r.stateManager.FindRoom(clientMsg.Target)
-		r.logger.Info("targetroom", targetRoom, found)
-		if found {
-			targetObj = targetRoom
+		user, found := r.stateManager.FindUser(inv.UserID)
+		if !found {
+			return fmt.Errorf("%w '%s'; dropping '%s'", ErrUnknownUser, inv.UserID, inv.Event)
 		}
+		pctx.User = user
+		pctx.Logger = pctx.Logger.With("userID", user.ID)
 	}
-
-	return &pipeline.Cargo{
-		Logger:       r.logger.With("component", "pipeline", "userID", originConn.User.ID),
-		Ctx:          ctx,
-		EventName:    clientMsg.Event,
-		User:         originConn.User,
-		Connection:   originConn,
-		StateManager: r.stateManager,
-		Payload:      clientMsg.Payload,
-		TargetID:     clientMsg.Target,
-		TargetObject: targetObj,
-	}, nil
+	return r.executePipeline(pctx, pipe)
 }
 
-// runs the full modifier and action chain for a given context.
-func (r *EventRouter) executePipeline(pctx *pipeline.Cargo) {
-	pipe, ok := r.pipelines[pctx.EventName]
+var (
+	// ErrUnknownEvent is returned when running an event without a pipeline.
+	ErrUnknownEvent = errors.New("unknown event")
+	// ErrNotSystemEvent is returned when publishing an event clients trigger.
+	ErrNotSystemEvent = errors.New("event does not have origin 'system'")
+	// ErrSystemEventForUser is returned when running a system event as a user.
+	ErrSystemEventForUser = errors.New("event has origin 'system'")
+	// ErrUnknownUser is returned when running as a user the server never saw.
+	ErrUnknownUser = errors.New("unknown user")
+)
+
+// Publish runs the pipeline of a system event on behalf of the server, with no
+// user or connection, and returns why it halted, if it did.
+func (r *EventRouter) Publish(event, target string, payload json.RawMessage) error {
+	pipe, ok := r.pipelines[event]
 	if !ok {
-		r.logger.Warn("Received unknown event", "event", pctx.EventName)
-		return
+		return fmt.Errorf("%w '%s'", ErrUnknownEvent, event)
+	}
+	if pipe.Origin != pipeline.OriginSystem {
+		return fmt.Errorf("%w: '%s'", ErrNotSystemEvent, event)
 	}
+	return r.Run(engine.Invocation{Event: event, Target: target, Payload: payload})
+}
 
+// runs the full modifier and action chain of pipe for a given context,
+// returning why it halted, if it did. A panic in a step is returned rather
+// than taking down the read pump or the server.
+func (r *EventRouter) executePipeline(pctx *pipeline.Cargo, pipe *pipeline.CompiledPipeline) (err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			pctx.Logger.Error("Pipeline panicked", "event", pctx.EventName, "panic", p)
+			err = fmt.Errorf("pipeline '%s' panicked: %v", pctx.EventName, p)
+		}
+	}()
 	// --- MODIFIER EXECUTION LOOP ---
 	for _, modStep := range pipe.Modifiers {
-		resolvedParams, err := r.resolveParams(pctx, modStep.Params)
+		resolvedParams, err := r.resolveParams(pctx, modStep.Params, nil)
 		if err != nil {
 			pctx.Logger.Error("Failed to resolve params for modifier, halting pipeline", "event", pctx.EventName, "error", err)
-			return
+			return err
 		}
 		if err := modStep.Function(pctx, resolvedParams...); err != nil {
 			pctx.Logger.Warn("Modifier check failed, pipeline halted", "event", pctx.EventName, "error", err)
-			return
+			return err
 		}
 	}
 
 	// --- ACTION EXECUTION LOOP ---
 	for _, actionStep := range pipe.Actions {
-		resolvedParams, err := r.resolveParams(pctx, actionStep.Params)
+		resolvedParams, err := r.resolveParams(pctx, actionStep.Params, actionStep.Encodings)
 		if err != nil {
 			pctx.Logger.Error("Failed to resolve params for action, halting pipeline", "event", pctx.EventName, "error", err)
-			return
+			return err
 		}
 		if err := actionStep.Function(pctx, resolvedParams...); err != nil {
 			pctx.Logger.Error("Action execution failed, pipeline halted", "event", pctx.EventName, "error", err)
-			return
+			return err
 		}
 	}
+	return nil
 }
 
-func (r *EventRouter) resolveParams(pctx *pipeline.Cargo, templates []string) ([]string, error) {
+// resolves every param of a step, encoding the values resolved into those in
+// encodings.
+func (r *EventRouter) resolveParams(pctx *pipeline.Cargo, templates []string, encodings map[int]pipeline.Encoding) ([]string, error) {
 	resolved := make([]string, len(templates))
 
 	for i, tpl := range templates {
+		if enc := encodings[i]; enc != pipeline.EncodeNone {
+			interpolated, err := r.resolveEncoded(pctx, tpl, enc)
+			if err != nil {
+				return nil, err
+			}
+			resolved[i] = interpolated
+			continue
+		}
+
 		var resolveErr error
 		interpolated := templateRegex.ReplaceAllStringFunc(tpl, func(match string) string {
 			if resolveErr != nil {
@@ -195,42 +245,7 @@ func (r *EventRouter) resolveParams(pctx *pipeline.Cargo, templates []string) ([
 			}
 
 			submatches := templateRegex.FindStringSubmatch(match)
-			prefix := submatches[1]
-			path := submatches[2]
-			var replacement string
-			var err error
-
-			switch prefix {
-			case ".": // {.payload.path}
-				if path == "payload" {
-					replacement = string(pctx.Payload)
-				} else {
-					subPath := strings.TrimPrefix(path, "payload.")
-					value := gjson.Get(string(pctx.Payload), subPath)
-					if !value.Exists() {
-						err = fmt.Errorf("path '%.*s' not found in payload", 40, subPath)
-					}
-					replacement = value.String()
-				}
-			case "$": // {$param.var}
-				var resolver engine.ResolverFunc
-				var ok bool
-
-				// if strings.HasPrefix(path, "token.") {
-				// 	claimKey := strings.TrimPrefix(path, "token.")
-				// 	resolver = engine.GetTokenClaimResolver(claimKey)
-				// } else {
-				resolver, ok = r.engine.GetParamResolver(path)
-				if !ok {
-					// This should be caught by the compiler, but we check again for safety.
-					err = fmt.Errorf("unrecognized context variable '%s'", path)
-				}
-				// }
-				if err == nil {
-					replacement, err = resolver(pctx)
-				}
-			}
-
+			replacement, _, err := r.resolveVar(pctx, submatches[1], submatches[2])
 			if err != nil {
 				resolveErr = err
 				return ""
@@ -245,3 +260,86 @@ func (r *EventRouter) resolveParams(pctx *pipeline.Cargo, templates []string) ([
 	}
 	return resolved, nil
 }
+
+// resolveEncoded resolves a param whose values are encoded rather than pasted
+// in, so none can change the param's structure. In a JSON template, such as
+// the body of _webhook, values inside a JSON string are escaped, and elsewhere
+// a payload path gives its JSON value and a context variable a JSON string. In
+// a URL path, such as that of _proxy, values are escaped as a path segment, or
+// as a query value after a '?'.
+func (r *EventRouter) resolveEncoded(pctx *pipeline.Cargo, tpl string, enc pipeline.Encoding) (string, error) {
+	var b strings.Builder
+	inString, escaped, inQuery, last := false, false, false, 0
+	for _, m := range templateRegex.FindAllStringSubmatchIndex(tpl, -1) {
+		for _, c := range []byte(tpl[last:m[0]]) {
+			switch {
+			case escaped:
+				escaped = false
+			case inString && c == '\\':
+				escaped = true
+			case c == '"':
+				inString = !inString
+			case c == '?':
+				inQuery = true
+			}
+		}
+		b.WriteString(tpl[last:m[0]])
+
+		text, raw, err := r.resolveVar(pctx, tpl[m[2]:m[3]], tpl[m[4]:m[5]])
+		if err != nil {
+			return "", err
+		}
+		switch {
+		case enc == pipeline.EncodePath && inQuery:
+			b.WriteString(url.QueryEscape(text))
+		case enc == pipeline.EncodePath:
+			b.WriteString(url.PathEscape(text))
+		case inString:
+			quoted, _ := json.Marshal(text)
+			b.Write(quoted[1 : len(quoted)-1])
+		default:
+			b.WriteString(raw)
+		}
+		last = m[1]
+	}
+	b.WriteString(tpl[last:])
+	return b.String(), nil
+}
+
+// resolveVar resolves one placeholder, {.payload.path} or {$param.var}, as
+// text and as JSON.
+func (r *EventRouter) resolveVar(pctx *pipeline.Cargo, prefix, path string) (text, raw string, err error) {
+	switch prefix {
+	case ".": // {.payload.path}
+		if path == "payload" {
+			if len(pctx.Payload) == 0 {
+				return "", "null", nil
+			}
+			return string(pctx.Payload), string(pctx.Payload), nil
+		}
+		subPath := strings.TrimPrefix(path, "payload.")
+		value := gjson.Get(string(pctx.Payload), subPath)
+		if !value.Exists() {
+			return "", "", fmt.Errorf("path '%.*s' not found in payload", 40, subPath)
+		}
+		return value.String(), value.Raw, nil
+	case "$": // {$param.var}
+		// if strings.HasPrefix(path, "token.") {
+		// 	claimKey := strings.TrimPrefix(path, "token.")
+		// 	resolver = engine.GetTokenClaimResolver(claimKey)
+		// } else {
+		resolver, ok := r.engine.GetParamResolver(path)
+		if !ok {
+			// This should be caught by the compiler, but we check again for safety.
+			return "", "", fmt.Errorf("unrecognized context variable '%s'", path)
+		}
+		// }
+		text, err = resolver(pctx)
+		if err != nil {
+			return "", "", err
+		}
+		quoted, _ := json.Marshal(text)
+		return text, string(quoted), nil
+	}
+	return "", "", fmt.Errorf("unrecognized placeholder '%s%s'", prefix, path)
+}
@@ -0,0 +1,244 @@
+package router
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/a-essam23/go-dispatch/internal/engine"
+	"github.com/a-essam23/go-dispatch/pkg/config"
+	"github.com/a-essam23/go-dispatch/pkg/pipeline"
+	"github.com/a-essam23/go-dispatch/pkg/state"
+	"github.com/a-essam23/go-dispatch/pkg/state/statemanager"
+	"github.com/a-essam23/go-dispatch/pkg/transport/transporttest"
+)
+
+const hostileText = `hi", "admin": true, "x": "`
+
+func TestJSONTemplatesEncodeResolvedValues(t *testing.T) {
+	reg := engine.New(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	reg.RegisterCore(&engine.RegisterCoreOptions{})
+	r := &EventRouter{engine: reg}
+	pctx := &pipeline.Cargo{
+		User:    &state.User{ID: `bob", "admin": true, "x": "`},
+		Payload: json.RawMessage(`{"text":` + mustMarshal(t, hostileText) + `,"count":3,"tags":["a","b"]}`),
+	}
+
+	tests := []struct {
+		name string
+		tpl  string
+		want map[string]any
+	}{
+		{"inside a string", `{"text": "{.payload.text}"}`, map[string]any{"text": hostileText}},
+		{"part of a string", `{"text": "said \"{.payload.text}\" {.payload.count} times"}`, map[string]any{"text": `said "` + hostileText + `" 3 times`}},
+		{"a string value", `{"text": {.payload.text}}`, map[string]any{"text": hostileText}},
+		{"other values", `{"count": {.payload.count}, "tags": {.payload.tags}}`, map[string]any{"count": 3.0, "tags": []any{"a", "b"}}},
+		{"the whole payload", `{"p": {.payload}}`, map[string]any{"p": map[string]any{"text": hostileText, "count": 3.0, "tags": []any{"a", "b"}}}},
+		{"a context variable", `{"user": "{$user.id}", "again": {$user.id}}`, map[string]any{"user": pctx.User.ID, "again": pctx.User.ID}},
+	}
+	for _, tt := range tests {
+		resolved, err := r.resolveParams(pctx, []string{tt.tpl}, map[int]pipeline.Encoding{0: pipeline.EncodeJSON})
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		var got map[string]any
+		if err := json.Unmarshal([]byte(resolved[0]), &got); err != nil {
+			t.Errorf("%s: resolved to invalid JSON %s: %v", tt.name, resolved[0], err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: resolved to %v, want %v", tt.name, got, tt.want)
+		}
+	}
+
+	// params that are not JSON templates are still pasted as they are.
+	resolved, _ := r.resolveParams(pctx, []string{`{"text": "{.payload.text}"}`}, nil)
+	if want := `{"text": "` + hostileText + `"}`; resolved[0] != want {
+		t.Errorf("a plain param resolved to %s, want %s", resolved[0], want)
+	}
+}
+
+func TestPathTemplatesEscapeResolvedValues(t *testing.T) {
+	reg := engine.New(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	reg.RegisterCore(&engine.RegisterCoreOptions{})
+	r := &EventRouter{engine: reg}
+	pctx := &pipeline.Cargo{
+		User:    &state.User{ID: "../admin?all=1#x"},
+		Payload: json.RawMessage(`{"name":"a/b c","q":"x&admin=1#y"}`),
+	}
+
+	tests := []struct {
+		tpl, want string
+	}{
+		{"/users/{.payload.name}", "/users/a%2Fb%20c"},
+		{"/users/{$user.id}/profile", "/users/..%2Fadmin%3Fall=1%23x/profile"},
+		{"/search?q={.payload.q}&user={$user.id}", "/search?q=x%26admin%3D1%23y&user=..%2Fadmin%3Fall%3D1%23x"},
+	}
+	for _, tt := range tests {
+		resolved, err := r.resolveParams(pctx, []string{tt.tpl}, map[int]pipeline.Encoding{0: pipeline.EncodePath})
+		if err != nil {
+			t.Errorf("%s: %v", tt.tpl, err)
+		} else if resolved[0] != tt.want {
+			t.Errorf("%s resolved to %s, want %s", tt.tpl, resolved[0], tt.want)
+		}
+	}
+}
+
+func TestWebhookBodiesCannotBeInjected(t *testing.T) {
+	bodies := make(chan string, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		bodies <- string(body)
+	}))
+	defer srv.Close()
+
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	reg := engine.New(logger)
+	reg.RegisterCore(&engine.RegisterCoreOptions{Webhooks: map[string]engine.Webhook{"audit": {URL: srv.URL, Timeout: time.Second}}})
+	cfg := &config.Config{Events: map[string]config.EventConfig{
+		"report": {Actions: []config.VarConfig{{Name: "_webhook", Params: []string{"audit", `{"reason": "{.payload.reason}", "admin": false}`, "sync"}}}},
+	}}
+	if err := config.CompilePipelines(cfg, reg); err != nil {
+		t.Fatalf("CompilePipelines failed: %v", err)
+	}
+	sm := statemanager.NewInMemoryManager(logger)
+	r := NewEventRouter(logger, sm, cfg.Pipelines, reg, MessageLimits{}, nil)
+	conn := transporttest.NewConn()
+	sm.RegisterConnection(conn, "127.0.0.1")
+	sm.AssociateUser(conn.ID(), "alice", 0)
+
+	msg := `{"event":"report","target":"lobby","payload":{"reason":` + mustMarshal(t, `spam", "admin": true, "x": "`) + `}}`
+	r.HandleMessage(context.Background(), conn.ID(), []byte(msg))
+	var got map[string]any
+	if err := json.Unmarshal([]byte(<-bodies), &got); err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]any{"reason": `spam", "admin": true, "x": "`, "admin": false}; !reflect.DeepEqual(got, want) {
+		t.Errorf("the webhook was sent %v, want %v", got, want)
+	}
+}
+
+func TestScheduledPayloadsCannotBeInjected(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	reg := engine.New(logger)
+	reg.RegisterCore(&engine.RegisterCoreOptions{})
+	defer reg.Scheduler().Stop()
+	cfg := &config.Config{Events: map[string]config.EventConfig{
+		"remind_me": {Actions: []config.VarConfig{{Name: "_schedule", Params: []string{"reminder", "1h", `{"text": "{.payload.text}"}`, "user:{$user.id}"}}}},
+		"reminder":  {Actions: []config.VarConfig{{Name: "_log"}}},
+	}}
+	if err := config.CompilePipelines(cfg, reg); err != nil {
+		t.Fatalf("CompilePipelines failed: %v", err)
+	}
+	sm := statemanager.NewInMemoryManager(logger)
+	r := NewEventRouter(logger, sm, cfg.Pipelines, reg, MessageLimits{}, nil)
+	conn := transporttest.NewConn()
+	sm.RegisterConnection(conn, "127.0.0.1")
+	sm.AssociateUser(conn.ID(), "alice", 0)
+
+	text := `call "mom", "admin": true, "x": "`
+	r.HandleMessage(context.Background(), conn.ID(), []byte(`{"event":"remind_me","target":"self","payload":{"text":`+mustMarshal(t, text)+`}}`))
+	jobs := reg.Scheduler().Jobs()
+	if len(jobs) != 1 {
+		t.Fatalf("expected the reminder to be scheduled, got %v", jobs)
+	}
+	var got map[string]any
+	if err := json.Unmarshal(jobs[0].Payload, &got); err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]any{"text": text}; !reflect.DeepEqual(got, want) {
+		t.Errorf("the reminder was scheduled with %v, want %v", got, want)
+	}
+}
+
+func TestProxyHeadersCannotBeInjected(t *testing.T) {
+	headers := make(chan http.Header, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		headers <- r.Header
+		io.WriteString(w, `{}`)
+	}))
+	defer srv.Close()
+
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	reg := engine.New(logger)
+	reg.RegisterCore(&engine.RegisterCoreOptions{Upstreams: map[string]engine.Upstream{
+		"api": {URL: srv.URL, Secret: "s3cret", Timeout: time.Second, MaxConcurrent: 1, FailureThreshold: 5, Cooldown: time.Minute},
+	}})
+	cfg := &config.Config{Events: map[string]config.EventConfig{
+		"get_profile": {Actions: []config.VarConfig{{Name: "_proxy", Params: []string{"api", "GET", "/profile", "", "", `{"X-User-Name": "{.payload.name}"}`}}}},
+	}}
+	if err := config.CompilePipelines(cfg, reg); err != nil {
+		t.Fatalf("CompilePipelines failed: %v", err)
+	}
+	sm := statemanager.NewInMemoryManager(logger)
+	r := NewEventRouter(logger, sm, cfg.Pipelines, reg, MessageLimits{}, nil)
+	conn := transporttest.NewConn()
+	sm.RegisterConnection(conn, "127.0.0.1")
+	sm.AssociateUser(conn.ID(), "alice", 0)
+
+	name := `Alice", "X-Dispatch-Signature": "sha256=forged`
+	r.HandleMessage(context.Background(), conn.ID(), []byte(`{"event":"get_profile","target":"self","payload":{"name":`+mustMarshal(t, name)+`}}`))
+	select {
+	case got := <-headers:
+		if got.Get("X-User-Name") != name {
+			t.Errorf("X-User-Name is %q, want %q", got.Get("X-User-Name"), name)
+		}
+		if sig := got.Get(engine.WebhookSignatureHeader); sig == "sha256=forged" || len(got.Values(engine.WebhookSignatureHeader)) != 1 {
+			t.Errorf("the signature was overwritten: %q", got.Values(engine.WebhookSignatureHeader))
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the request was not sent")
+	}
+}
+
+func TestPanickingPipelinesAreRecovered(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	reg := engine.New(logger)
+	reg.RegisterCore(&engine.RegisterCoreOptions{})
+	reg.RegisterAction("boom", func(*pipeline.Cargo, ...string) error { panic("boom") })
+	ran := make(chan string, 2)
+	reg.RegisterAction("record", func(pctx *pipeline.Cargo, _ ...string) error {
+		ran <- pctx.EventName
+		return nil
+	})
+	cfg := &config.Config{Events: map[string]config.EventConfig{
+		"explode": {Actions: []config.VarConfig{{Name: "boom"}, {Name: "record"}}},
+		"ping":    {Actions: []config.VarConfig{{Name: "record"}}},
+	}}
+	if err := config.CompilePipelines(cfg, reg); err != nil {
+		t.Fatalf("CompilePipelines failed: %v", err)
+	}
+	sm := statemanager.NewInMemoryManager(logger)
+	r := NewEventRouter(logger, sm, cfg.Pipelines, reg, MessageLimits{}, nil)
+	conn := transporttest.NewConn()
+	sm.RegisterConnection(conn, "127.0.0.1")
+	sm.AssociateUser(conn.ID(), "alice", 0)
+
+	r.HandleMessage(context.Background(), conn.ID(), []byte(`{"event":"explode","target":"lobby"}`))
+	r.HandleMessage(context.Background(), conn.ID(), []byte(`{"event":"ping","target":"lobby"}`))
+	if got := <-ran; got != "ping" {
+		t.Errorf("the steps after a panic ran: %s", got)
+	}
+	if err := r.Run(engine.Invocation{Event: "explode", Target: "lobby", UserID: "alice"}); err == nil {
+		t.Error("a panicking invocation returned no error")
+	}
+	if len(ran) != 0 {
+		t.Errorf("the steps after a panic ran: %s", <-ran)
+	}
+}
+
+func mustMarshal(t *testing.T, v any) string {
+	t.Helper()
+	b, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
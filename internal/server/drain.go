@@ -0,0 +1,132 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/a-essam23/go-dispatch/pkg/transport"
+)
+
+// DrainingEvent is the reserved event every client receives when the server
+// starts draining, ahead of its connection being closed.
+const DrainingEvent = "server_draining"
+
+var ErrAlreadyDraining = errors.New("server is already draining")
+
+type drainingPayload struct {
+	// ReconnectDelayMs is how long the client should wait before reconnecting.
+	ReconnectDelayMs int64 `json:"reconnectDelayMs"`
+	// CloseInMs is when the server will close this connection.
+	CloseInMs int64 `json:"closeInMs"`
+}
+
+type drainStatus struct {
+	Draining    bool `json:"draining"`
+	Connections int  `json:"connections"`
+}
+
+// Draining reports whether the server has stopped accepting connections.
+func (a *App) Draining() bool {
+	return a.draining.Load()
+}
+
+// Drain stops accepting new connections, tells every client to reconnect
+// elsewhere and closes the connections spread evenly over the drain window, so
+// they do not all reconnect at the same moment. It returns once every
+// connection is closed; if ctx ends first, the rest are closed at once.
+func (a *App) Drain(ctx context.Context) error {
+	if !a.draining.CompareAndSwap(false, true) {
+		return ErrAlreadyDraining
+	}
+	defer close(a.drained)
+
+	conns := a.activeConnections()
+	window := a.config.Server.Drain.Window
+	a.logger.Info("Draining connections", slog.Int("count", len(conns)), slog.Duration("window", window))
+
+	// the first close is one slot in, giving the notice time to reach the client.
+	offsets := make([]time.Duration, len(conns))
+	for i, conn := range conns {
+		offsets[i] = window * time.Duration(i+1) / time.Duration(len(conns))
+		a.notifyDraining(conn, offsets[i])
+	}
+
+	start := time.Now()
+	reason := transport.GoingAway("server draining")
+	for i, conn := range conns {
+		if wait := time.Until(start.Add(offsets[i])); wait > 0 {
+			timer := time.NewTimer(wait)
+			select {
+			case <-timer.C:
+			case <-ctx.Done():
+				timer.Stop()
+				for _, rest := range conns[i:] {
+					rest.Close(reason)
+				}
+				return ctx.Err()
+			}
+		}
+		conn.Close(reason)
+	}
+	a.logger.Info("Drain complete")
+	return nil
+}
+
+func (a *App) notifyDraining(conn transport.Conn, closeIn time.Duration) {
+	payload, _ := json.Marshal(drainingPayload{
+		ReconnectDelayMs: a.config.Server.Drain.ReconnectDelay.Milliseconds(),
+		CloseInMs:        closeIn.Milliseconds(),
+	})
+	msg, _ := json.Marshal(struct {
+		Event   string          `json:"event"`
+		Payload json.RawMessage `json:"payload"`
+	}{DrainingEvent, payload})
+
+	wire, err := conn.Codec().Encode(msg)
+	if err != nil {
+		a.logger.Error("Failed to encode drain notice", slog.String("connID", conn.ID().String()), slog.Any("error", err))
+		return
+	}
+	conn.SendPriority(wire, transport.PrioritySystem)
+}
+
+// returns every registered connection.
+func (a *App) activeConnections() []transport.Conn {
+	users, err := a.stateManager.GetAllUsers()
+	if err != nil {
+		a.logger.Error("Failed to list users", slog.Any("error", err))
+		return nil
+	}
+	var conns []transport.Conn
+	for _, user := range users {
+		for _, conn := range user.Connections {
+			conns = append(conns, conn.Transport)
+		}
+	}
+	return conns
+}
+
+// GET reports the drain status; POST starts draining in the background.
+func (a *App) adminDrainHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, drainStatus{Draining: a.Draining(), Connections: len(a.activeConnections())})
+	case http.MethodPost:
+		if a.Draining() {
+			http.Error(w, ErrAlreadyDraining.Error(), http.StatusConflict)
+			return
+		}
+		go func() {
+			if err := a.Drain(context.WithoutCancel(a.ctx)); err != nil && !errors.Is(err, ErrAlreadyDraining) {
+				a.logger.Error("Drain failed", slog.Any("error", err))
+			}
+		}()
+		writeJSON(w, http.StatusAccepted, drainStatus{Draining: true, Connections: len(a.activeConnections())})
+	default:
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+	}
+}
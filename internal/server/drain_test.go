@@ -0,0 +1,72 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/a-essam23/go-dispatch/internal/engine"
+	"github.com/a-essam23/go-dispatch/pkg/config"
+	"github.com/a-essam23/go-dispatch/pkg/transport/transporttest"
+	"github.com/coder/websocket"
+)
+
+func TestDrainNotifiesThenClosesWithGoingAway(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	cfg := &config.Config{}
+	cfg.Server.Drain = config.DrainConfig{Window: 30 * time.Millisecond, ReconnectDelay: 2 * time.Second}
+	app := NewApp(logger, context.Background(), cfg, engine.New(logger))
+
+	conns := make([]*transporttest.Conn, 3)
+	for i := range conns {
+		conns[i] = transporttest.NewConn()
+		if _, err := app.stateManager.RegisterConnection(conns[i], "127.0.0.1"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := app.stateManager.AssociateUser(conns[i].ID(), "alice", 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	start := time.Now()
+	if err := app.Drain(context.Background()); err != nil {
+		t.Fatalf("Drain failed: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < cfg.Server.Drain.Window {
+		t.Errorf("closes were not spread over the window: drained in %v", elapsed)
+	}
+	if !app.Draining() {
+		t.Error("server does not report draining")
+	}
+
+	for i, conn := range conns {
+		sent := conn.Sent()
+		if len(sent) != 1 {
+			t.Fatalf("conn %d: expected one drain notice, got %d messages", i, len(sent))
+		}
+		var notice struct {
+			Event   string          `json:"event"`
+			Payload drainingPayload `json:"payload"`
+		}
+		if err := json.Unmarshal(sent[0], &notice); err != nil {
+			t.Fatal(err)
+		}
+		if notice.Event != DrainingEvent || notice.Payload.ReconnectDelayMs != 2000 {
+			t.Errorf("conn %d: unexpected notice %s", i, sent[0])
+		}
+
+		closed, err := conn.Closed()
+		var closeErr websocket.CloseError
+		if !closed || !errors.As(err, &closeErr) || closeErr.Code != websocket.StatusGoingAway {
+			t.Errorf("conn %d: expected close with going away, got closed=%v err=%v", i, closed, err)
+		}
+	}
+
+	if err := app.Drain(context.Background()); !errors.Is(err, ErrAlreadyDraining) {
+		t.Errorf("expected ErrAlreadyDraining, got %v", err)
+	}
+}
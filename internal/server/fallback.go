@@ -0,0 +1,261 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/a-essam23/go-dispatch/internal/server/middleware"
+	"github.com/a-essam23/go-dispatch/pkg/transport"
+	"github.com/google/uuid"
+)
+
+/*
+ * HTTP fallback transports for networks that block WebSockets.
+ *
+ *   GET    /sse            open an SSE stream (downstream)
+ *   POST   /poll/open      open a long-poll session
+ *   GET    /poll?conn=id   wait for queued messages (JSON array)
+ *   DELETE /poll?conn=id   close a long-poll session
+ *   POST   /send?conn=id   send one client message (upstream, both kinds)
+ *
+ * Both kinds register a transport.HTTPConnection, so they join rooms and
+ * receive notifications exactly like WebSocket connections.
+ */
+
+type connectedPayload struct {
+	ConnID string `json:"connId"`
+}
+
+// opens an HTTP connection and returns it along with the ID it is registered
+// under, which clients pass back as ?conn= (a session ID when sessions are enabled).
+func (a *App) newHTTPConnection(r *http.Request, kind string) (*transport.HTTPConnection, uuid.UUID, *slog.Logger, error) {
+	reqMeta, _ := middleware.ReqMetadataFrom(r.Context())
+	connLogger := a.logger.With(
+		slog.String("remoteAddr", reqMeta.IP),
+		slog.String("userID", reqMeta.UserID),
+	)
+
+	cfg := transport.HTTPConnectionConfig{
+		MaxMessagesPerSecond: a.config.Transport.MaxMessagesPerSecond,
+	}
+	if kind == transport.KindLongPoll {
+		cfg.IdleTimeout = a.config.Transport.Fallback.IdleTimeout
+	}
+	conn := transport.NewHTTPConnection(r.Context(), &a.wg, kind, cfg, nil, nil, a.logger)
+	conn.SetMetrics(a.metrics)
+	conn.SetPeer(reqMeta.IP, r.UserAgent())
+	// Run before attach so a failed attach can Close the connection cleanly.
+	conn.Run()
+	registered, err := a.connect(conn, r, reqMeta, connLogger)
+	if err != nil {
+		return nil, uuid.Nil, nil, err
+	}
+	connLogger.Info("User connection fully established", slog.String("transport", kind))
+	return conn, registered.ID(), connLogger, nil
+}
+
+func (a *App) sseHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming Unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	conn, connID, connLogger, err := a.newHTTPConnection(r, transport.KindSSE)
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	// the stream is the connection: once the request ends, so does the connection.
+	defer conn.Close(errors.New("sse stream ended"))
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	hello, _ := json.Marshal(connectedPayload{ConnID: connID.String()})
+	if err := writeSSE(w, "connected", hello); err != nil {
+		return
+	}
+	flusher.Flush()
+
+	// comment lines keep proxies from timing out an idle stream and reveal
+	// dead clients through failed writes.
+	keepalive := a.config.Transport.PingInterval
+	if keepalive <= 0 {
+		keepalive = 30 * time.Second
+	}
+	for {
+		waitCtx, cancel := context.WithTimeout(r.Context(), keepalive)
+		msg, err := conn.Next(waitCtx)
+		cancel()
+
+		switch {
+		case err == nil:
+			err = writeSSE(w, "", msg)
+		case errors.Is(err, context.DeadlineExceeded) && r.Context().Err() == nil:
+			_, err = io.WriteString(w, ": keepalive\n\n")
+		default:
+			return
+		}
+		if err != nil {
+			connLogger.Debug("SSE write failed", slog.Any("error", err))
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+// writes one SSE event. Multi-line data is split across data fields, which
+// the client joins back with newlines.
+func writeSSE(w io.Writer, event string, data []byte) error {
+	var buf bytes.Buffer
+	if event != "" {
+		fmt.Fprintf(&buf, "event: %s\n", event)
+	}
+	for _, line := range bytes.Split(data, []byte("\n")) {
+		buf.WriteString("data: ")
+		buf.Write(line)
+		buf.WriteByte('\n')
+	}
+	buf.WriteByte('\n')
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+func (a *App) pollOpenHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	_, connID, _, err := a.newHTTPConnection(r, transport.KindLongPoll)
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, connectedPayload{ConnID: connID.String()})
+}
+
+func (a *App) pollHandler(w http.ResponseWriter, r *http.Request) {
+	registered, conn, ok := a.httpSession(w, r, transport.KindLongPoll)
+	if !ok {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		batch := conn.Poll(r.Context(), a.config.Transport.Fallback.PollWait)
+		msgs := make([]json.RawMessage, len(batch))
+		for i, msg := range batch {
+			msgs[i] = msg
+		}
+		writeJSON(w, http.StatusOK, msgs)
+	case http.MethodDelete:
+		// close what is registered so a wrapping session ends too.
+		registered.Close(errors.New("long-poll session closed by client"))
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (a *App) sendHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	_, conn, ok := a.httpSession(w, r, "")
+	if !ok {
+		return
+	}
+
+	body := r.Body
+	if limit := a.config.Transport.MaxMessageSize; limit > 0 {
+		body = http.MaxBytesReader(w, r.Body, limit)
+	}
+	msg, err := io.ReadAll(body)
+	if err != nil {
+		var tooBig *http.MaxBytesError
+		if errors.As(err, &tooBig) {
+			a.metrics.Counter(transport.MetricMessageTooBig).Inc()
+			http.Error(w, "Message Too Big", http.StatusRequestEntityTooLarge)
+			return
+		}
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+	// fallback transports always speak JSON.
+	if !json.Valid(msg) {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+	if err := conn.Deliver(msg); err != nil {
+		switch {
+		case errors.Is(err, transport.ErrClosed):
+			http.Error(w, "Connection Closed", http.StatusGone)
+		case errors.Is(err, transport.ErrRateExceeded):
+			http.Error(w, "Too Many Requests", http.StatusTooManyRequests)
+		default:
+			http.Error(w, "Bad Request", http.StatusBadRequest)
+		}
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// resolves the ?conn= session of an HTTP fallback request, ensuring it belongs
+// to the authenticated user. It returns the registered connection and the HTTP
+// transport currently serving it. An empty kind accepts any HTTP transport.
+func (a *App) httpSession(w http.ResponseWriter, r *http.Request, kind string) (transport.Conn, *transport.HTTPConnection, bool) {
+	reqMeta, _ := middleware.ReqMetadataFrom(r.Context())
+
+	connID, err := uuid.Parse(r.URL.Query().Get("conn"))
+	if err != nil {
+		http.Error(w, "Invalid Connection ID", http.StatusBadRequest)
+		return nil, nil, false
+	}
+	stateConn, found := a.stateManager.GetConnection(connID)
+	if !found {
+		http.Error(w, "Connection Not Found", http.StatusNotFound)
+		return nil, nil, false
+	}
+	if stateConn.User == nil || stateConn.User.ID != reqMeta.UserID {
+		a.logger.Warn("User attempted to use another user's connection", slog.String("userID", reqMeta.UserID), slog.String("connID", connID.String()))
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return nil, nil, false
+	}
+	current := stateConn.Transport
+	if session, isSession := current.(*transport.Session); isSession {
+		current = session.Current()
+		if current == nil {
+			// detached, awaiting a resume over a new connection.
+			http.Error(w, "Connection Closed", http.StatusGone)
+			return nil, nil, false
+		}
+	}
+	conn, ok := current.(*transport.HTTPConnection)
+	if !ok || (kind != "" && conn.Kind() != kind) {
+		http.Error(w, "Connection Does Not Support This Operation", http.StatusBadRequest)
+		return nil, nil, false
+	}
+	return stateConn.Transport, conn, true
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
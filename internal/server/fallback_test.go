@@ -0,0 +1,232 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/a-essam23/go-dispatch/internal/engine"
+	"github.com/a-essam23/go-dispatch/internal/server/middleware"
+	"github.com/a-essam23/go-dispatch/pkg/config"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+)
+
+const testJWTSecret = "fallback-test-secret"
+
+// starts an app with the fallback transports and an "echo" event answering
+// the sender, adjusting the config with tweak before the app is built.
+func newFallbackServer(t *testing.T, tweak func(*config.Config)) (*App, *httptest.Server) {
+	t.Helper()
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	eng := engine.New(logger)
+	eng.RegisterCore(&engine.RegisterCoreOptions{})
+	cfg := &config.Config{
+		Events: map[string]config.EventConfig{
+			"echo": {Actions: []config.VarConfig{{Name: "_notify_origin", Params: []string{"echo", "{.payload}"}}}},
+		},
+	}
+	cfg.Server.Auth.JWTSecret = testJWTSecret
+	cfg.Transport.Fallback = config.FallbackConfig{Enabled: true, PollWait: time.Second, IdleTimeout: time.Minute}
+	if tweak != nil {
+		tweak(cfg)
+	}
+	if err := config.CompilePipelines(cfg, eng); err != nil {
+		t.Fatalf("CompilePipelines failed: %v", err)
+	}
+	app := NewApp(logger, context.Background(), cfg, eng)
+	srv := httptest.NewServer(app.http.Handler)
+	t.Cleanup(func() {
+		srv.Close()
+		eng.Scheduler().Stop()
+	})
+	return app, srv
+}
+
+// sends an authenticated request as alice.
+func doAs(t *testing.T, method, url, body string) *http.Response {
+	t.Helper()
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, middleware.AppClaims{
+		RegisteredClaims: jwt.RegisteredClaims{Subject: "alice"},
+	}).SignedString([]byte(testJWTSecret))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.AddCookie(&http.Cookie{Name: "session-token", Value: token})
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("%s %s failed: %v", method, url, err)
+	}
+	return resp
+}
+
+func openPoll(t *testing.T, srv *httptest.Server) string {
+	t.Helper()
+	resp := doAs(t, http.MethodPost, srv.URL+"/poll/open", "")
+	defer resp.Body.Close()
+	var hello connectedPayload
+	if resp.StatusCode != http.StatusOK || json.NewDecoder(resp.Body).Decode(&hello) != nil {
+		t.Fatalf("opening a long-poll session answered %d", resp.StatusCode)
+	}
+	return hello.ConnID
+}
+
+func poll(t *testing.T, srv *httptest.Server, connID string) (int, []json.RawMessage) {
+	t.Helper()
+	resp := doAs(t, http.MethodGet, srv.URL+"/poll?conn="+connID, "")
+	defer resp.Body.Close()
+	var msgs []json.RawMessage
+	if resp.StatusCode == http.StatusOK {
+		if err := json.NewDecoder(resp.Body).Decode(&msgs); err != nil {
+			t.Fatalf("invalid poll response: %v", err)
+		}
+	}
+	return resp.StatusCode, msgs
+}
+
+func send(t *testing.T, srv *httptest.Server, connID, body string) int {
+	t.Helper()
+	resp := doAs(t, http.MethodPost, srv.URL+"/send?conn="+connID, body)
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestSSEStreamsQueuedMessages(t *testing.T) {
+	app, srv := newFallbackServer(t, nil)
+
+	resp := doAs(t, http.MethodGet, srv.URL+"/sse", "")
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("expected an event stream, got %q", ct)
+	}
+	events := bufio.NewReader(resp.Body)
+	// reads one event, returning its name and data.
+	next := func() (string, string) {
+		var name, data string
+		for {
+			line, err := events.ReadString('\n')
+			if err != nil {
+				t.Fatalf("stream ended: %v", err)
+			}
+			switch line = strings.TrimSuffix(line, "\n"); {
+			case line == "":
+				return name, data
+			case strings.HasPrefix(line, "event: "):
+				name = strings.TrimPrefix(line, "event: ")
+			case strings.HasPrefix(line, "data: "):
+				data += strings.TrimPrefix(line, "data: ")
+			}
+		}
+	}
+
+	name, data := next()
+	var hello connectedPayload
+	if name != "connected" || json.Unmarshal([]byte(data), &hello) != nil {
+		t.Fatalf("expected a connected event first, got %q %q", name, data)
+	}
+	conn, found := app.stateManager.GetConnection(uuid.MustParse(hello.ConnID))
+	if !found {
+		t.Fatal("the stream's connection is not registered")
+	}
+
+	conn.Transport.Send([]byte(`{"event":"note","payload":1}`))
+	if name, data := next(); name != "" || data != `{"event":"note","payload":1}` {
+		t.Errorf("expected the queued message, got %q %q", name, data)
+	}
+	if code := send(t, srv, hello.ConnID, `{"event":"echo","target":"lobby","payload":{"n":2}}`); code != http.StatusAccepted {
+		t.Fatalf("expected 202 sending over the stream's connection, got %d", code)
+	}
+	if _, data := next(); data != `{"event":"echo","payload":{"n":2}}` {
+		t.Errorf("expected the echo, got %q", data)
+	}
+}
+
+func TestPollWaitsThenReturnsQueuedMessages(t *testing.T) {
+	_, srv := newFallbackServer(t, func(cfg *config.Config) {
+		cfg.Transport.Fallback.PollWait = 30 * time.Millisecond
+	})
+	connID := openPoll(t, srv)
+
+	start := time.Now()
+	code, msgs := poll(t, srv, connID)
+	if code != http.StatusOK || len(msgs) != 0 {
+		t.Fatalf("expected an empty poll, got %d %s", code, msgs)
+	}
+	if waited := time.Since(start); waited < 30*time.Millisecond {
+		t.Errorf("poll returned after %s, before pollWait", waited)
+	}
+
+	for i := range 2 {
+		if code := send(t, srv, connID, `{"event":"echo","target":"lobby","payload":`+string(rune('1'+i))+`}`); code != http.StatusAccepted {
+			t.Fatalf("expected 202, got %d", code)
+		}
+	}
+	code, msgs = poll(t, srv, connID)
+	if code != http.StatusOK || len(msgs) != 2 || string(msgs[1]) != `{"event":"echo","payload":2}` {
+		t.Errorf("expected both echoes in one poll, got %d %s", code, msgs)
+	}
+}
+
+func TestPollSessionsCloseWhenIdle(t *testing.T) {
+	_, srv := newFallbackServer(t, func(cfg *config.Config) {
+		cfg.Transport.Fallback.IdleTimeout = 30 * time.Millisecond
+	})
+	connID := openPoll(t, srv)
+
+	time.Sleep(100 * time.Millisecond)
+	if code, _ := poll(t, srv, connID); code != http.StatusNotFound {
+		t.Errorf("expected an idle session to be gone, got %d", code)
+	}
+}
+
+func TestSendRejectsBadInputAndExcessRates(t *testing.T) {
+	_, srv := newFallbackServer(t, func(cfg *config.Config) {
+		cfg.Transport.MaxMessageSize = 64
+		cfg.Transport.MaxMessagesPerSecond = 1
+	})
+	connID := openPoll(t, srv)
+
+	if code := send(t, srv, connID, `{"event":`); code != http.StatusBadRequest {
+		t.Errorf("expected 400 for a body that is not JSON, got %d", code)
+	}
+	if code := send(t, srv, connID, `{"event":"echo","payload":"`+strings.Repeat("x", 64)+`"}`); code != http.StatusRequestEntityTooLarge {
+		t.Errorf("expected 413 for an oversized message, got %d", code)
+	}
+	if code := send(t, srv, "not-a-uuid", `{}`); code != http.StatusBadRequest {
+		t.Errorf("expected 400 for a malformed connection ID, got %d", code)
+	}
+	if code := send(t, srv, uuid.NewString(), `{}`); code != http.StatusNotFound {
+		t.Errorf("expected 404 for an unknown connection, got %d", code)
+	}
+	if code := send(t, srv, connID, `{"event":"echo"}`); code != http.StatusAccepted {
+		t.Fatalf("expected 202, got %d", code)
+	}
+	if code := send(t, srv, connID, `{"event":"echo"}`); code != http.StatusTooManyRequests {
+		t.Errorf("expected 429 over the rate limit, got %d", code)
+	}
+}
+
+func TestSendToADetachedSessionIsGone(t *testing.T) {
+	_, srv := newFallbackServer(t, func(cfg *config.Config) {
+		cfg.Transport.Session = config.SessionConfig{Enabled: true, ReplayBuffer: 8, GracePeriod: time.Minute}
+		cfg.Transport.Fallback.IdleTimeout = 30 * time.Millisecond
+	})
+	connID := openPoll(t, srv)
+
+	// the idle long-poll closes, leaving its session registered for a resume.
+	time.Sleep(100 * time.Millisecond)
+	if code := send(t, srv, connID, `{"event":"echo"}`); code != http.StatusGone {
+		t.Errorf("expected 410 sending to a detached session, got %d", code)
+	}
+}
@@ -0,0 +1,21 @@
+package server
+
+import (
+	"net/http"
+
+	"github.com/a-essam23/go-dispatch/pkg/state"
+)
+
+type invitesResponse struct {
+	Invites []state.Invite `json:"invites"`
+}
+
+// GET lists the pending invites and join requests, of every room or only of
+// the one named by the "room" query parameter.
+func (a *App) adminInvitesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, http.StatusOK, invitesResponse{Invites: a.stateManager.ListInvites(r.URL.Query().Get("room"))})
+}
@@ -0,0 +1,46 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/a-essam23/go-dispatch/internal/engine"
+	"github.com/a-essam23/go-dispatch/pkg/config"
+	"github.com/a-essam23/go-dispatch/pkg/state"
+	"github.com/a-essam23/go-dispatch/pkg/transport/transporttest"
+)
+
+func TestAdminListsPendingInvites(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	app := NewApp(logger, context.Background(), &config.Config{}, engine.New(logger))
+
+	conn := transporttest.NewConn()
+	app.stateManager.RegisterConnection(conn, "127.0.0.1")
+	app.stateManager.AssociateUser(conn.ID(), "alice", 0)
+	for _, roomID := range []string{"a", "b"} {
+		app.stateManager.Join("alice", roomID, nil)
+		app.stateManager.PutInvite(state.Invite{Kind: state.InviteKindInvite, Room: roomID, UserID: "bob", By: "alice", ExpiresAt: time.Now().Add(time.Hour)})
+	}
+
+	rec := httptest.NewRecorder()
+	app.adminInvitesHandler(rec, httptest.NewRequest(http.MethodGet, "/admin/invites?room=b", nil))
+	var body invitesResponse
+	if err := json.NewDecoder(rec.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Code != http.StatusOK || len(body.Invites) != 1 || body.Invites[0].Room != "b" {
+		t.Errorf("expected room b's invite, got %d %+v", rec.Code, body)
+	}
+
+	rec = httptest.NewRecorder()
+	app.adminInvitesHandler(rec, httptest.NewRequest(http.MethodPost, "/admin/invites", nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("expected POST to be refused, got %d", rec.Code)
+	}
+}
@@ -0,0 +1,23 @@
+package middleware
+
+import (
+	"crypto/subtle"
+	"log/slog"
+	"net/http"
+	"strings"
+)
+
+// NewAdminAuth guards the admin API with a static bearer token.
+func NewAdminAuth(logger *slog.Logger, token string) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			presented, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if !ok || subtle.ConstantTimeCompare([]byte(presented), []byte(token)) != 1 {
+				logger.Warn("Rejected admin request", slog.String("path", r.URL.Path), slog.String("remoteAddr", r.RemoteAddr))
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
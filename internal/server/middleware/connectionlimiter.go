@@ -10,10 +10,16 @@ import (
 type UserConnectionCounter func(userID string) (int, error)
 type UserConnectionCycler func(userID string)
 
+// UserConnectionExempter reports whether a request replaces one of the user's
+// existing connections (e.g. a session resume) and so must not count against
+// the limit. It may be nil.
+type UserConnectionExempter func(r *http.Request, userID string) bool
+
 func NewConnectionLimiter(
 	logger *slog.Logger,
 	counter UserConnectionCounter,
 	cycler UserConnectionCycler,
+	exempt UserConnectionExempter,
 	config config.ConnectionLimitConfig,
 ) Middleware {
 	return func(next http.Handler) http.Handler {
@@ -36,6 +42,11 @@ func NewConnectionLimiter(
 				return
 			}
 
+			if exempt != nil && exempt(r, reqMeta.UserID) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
 			count, err := counter(reqMeta.UserID)
 			if err != nil {
 				logger.Error("Connection limiter failed to get connection count", slog.Any("error", err))
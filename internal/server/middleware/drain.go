@@ -0,0 +1,23 @@
+package middleware
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// NewDrainGuard rejects new connections while the server is draining, pointing
+// clients at another instance via 503 and Retry-After.
+func NewDrainGuard(draining func() bool, retryAfter time.Duration) Middleware {
+	seconds := strconv.Itoa(int(max(retryAfter.Round(time.Second), time.Second) / time.Second))
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if draining() {
+				w.Header().Set("Retry-After", seconds)
+				http.Error(w, "Server Draining", http.StatusServiceUnavailable)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,50 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/a-essam23/go-dispatch/internal/router"
+)
+
+type publishRequest struct {
+	Event   string          `json:"event"`
+	Target  string          `json:"target"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+type publishResponse struct {
+	Event string `json:"event"`
+	Error string `json:"error,omitempty"`
+}
+
+// POST runs the pipeline of a system event, as a schedule would, and waits for
+// it to finish.
+func (a *App) adminPublishHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	body := r.Body
+	if limit := a.config.Transport.MaxMessageSize; limit > 0 {
+		body = http.MaxBytesReader(w, r.Body, limit)
+	}
+	var req publishRequest
+	if err := json.NewDecoder(body).Decode(&req); err != nil || req.Event == "" || req.Target == "" {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+
+	err := a.eventRouter.Publish(req.Event, req.Target, req.Payload)
+	switch {
+	case err == nil:
+		writeJSON(w, http.StatusOK, publishResponse{Event: req.Event})
+	case errors.Is(err, router.ErrUnknownEvent):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, router.ErrNotSystemEvent):
+		http.Error(w, err.Error(), http.StatusForbidden)
+	default:
+		writeJSON(w, http.StatusUnprocessableEntity, publishResponse{Event: req.Event, Error: err.Error()})
+	}
+}
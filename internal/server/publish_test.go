@@ -0,0 +1,78 @@
+package server
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/a-essam23/go-dispatch/internal/engine"
+	"github.com/a-essam23/go-dispatch/pkg/config"
+	"github.com/a-essam23/go-dispatch/pkg/transport/transporttest"
+)
+
+func TestPublishRunsOnlySystemPipelines(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	eng := engine.New(logger)
+	eng.RegisterCore(&engine.RegisterCoreOptions{})
+	cfg := &config.Config{
+		Events: map[string]config.EventConfig{
+			"announce": {Origin: "system", Actions: []config.VarConfig{{Name: "_notify_room", Params: []string{"announce", "{.payload}"}}}},
+			"message":  {Actions: []config.VarConfig{{Name: "_notify_room", Params: []string{"message", "{.payload}"}}}},
+		},
+	}
+	if err := config.CompilePipelines(cfg, eng); err != nil {
+		t.Fatalf("CompilePipelines failed: %v", err)
+	}
+	app := NewApp(logger, context.Background(), cfg, eng)
+	defer eng.Scheduler().Stop()
+
+	conn := transporttest.NewConn()
+	app.stateManager.RegisterConnection(conn, "127.0.0.1")
+	app.stateManager.AssociateUser(conn.ID(), "alice", 0)
+	app.stateManager.Join("alice", "lobby", nil)
+
+	publish := func(body string) int {
+		rec := httptest.NewRecorder()
+		app.adminPublishHandler(rec, httptest.NewRequest(http.MethodPost, "/admin/publish", strings.NewReader(body)))
+		return rec.Code
+	}
+	if code := publish(`{"event":"announce","target":"lobby","payload":{"text":"hi"}}`); code != http.StatusOK {
+		t.Fatalf("expected 200 publishing a system event, got %d", code)
+	}
+	if sent := conn.Sent(); len(sent) != 1 || string(sent[0]) != `{"event":"announce","payload":{"text":"hi"}}` {
+		t.Errorf("expected the announcement in the lobby, got %q", sent)
+	}
+	if code := publish(`{"event":"message","target":"lobby"}`); code != http.StatusForbidden {
+		t.Errorf("expected 403 publishing a client event, got %d", code)
+	}
+	if code := publish(`{"event":"missing","target":"lobby"}`); code != http.StatusNotFound {
+		t.Errorf("expected 404 publishing an unknown event, got %d", code)
+	}
+}
+
+func TestSystemPipelinesRejectUserBoundSteps(t *testing.T) {
+	eng := engine.New(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	eng.RegisterCore(&engine.RegisterCoreOptions{})
+	for name, event := range map[string]config.EventConfig{
+		"action":   {Origin: "system", Actions: []config.VarConfig{{Name: "_notify_origin", Params: []string{"x", "{}"}}}},
+		"modifier": {Origin: "system", Modifiers: []config.VarConfig{{Name: "rate_limit", Params: []string{"1", "1s"}}}},
+		"param":    {Origin: "system", Actions: []config.VarConfig{{Name: "_notify_room", Params: []string{"x", "{$user.id}"}}}},
+	} {
+		cfg := &config.Config{Events: map[string]config.EventConfig{"tick": event}}
+		if err := config.CompilePipelines(cfg, eng); err == nil {
+			t.Errorf("%s: expected a system pipeline needing a user to be rejected", name)
+		}
+	}
+
+	cfg := &config.Config{
+		Events:    map[string]config.EventConfig{"tick": {Actions: []config.VarConfig{{Name: "_log"}}}},
+		Schedules: []config.ScheduleConfig{{Name: "ticker", Cron: "@every 1m", Event: "tick", Target: "lobby"}},
+	}
+	if err := config.CompilePipelines(cfg, eng); err == nil {
+		t.Error("expected a schedule of a client event to be rejected")
+	}
+}
@@ -0,0 +1,22 @@
+package server
+
+import (
+	"net/http"
+
+	"github.com/a-essam23/go-dispatch/internal/engine"
+)
+
+type schedulesResponse struct {
+	Jobs []engine.ScheduledJob `json:"jobs"`
+	Cron []engine.CronSchedule `json:"cron"`
+}
+
+// GET lists the pending jobs of _schedule and the configured cron schedules.
+func (a *App) adminSchedulesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	scheduler := a.engine.Scheduler()
+	writeJSON(w, http.StatusOK, schedulesResponse{Jobs: scheduler.Jobs(), Cron: scheduler.CronSchedules()})
+}
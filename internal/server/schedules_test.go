@@ -0,0 +1,140 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/a-essam23/go-dispatch/internal/engine"
+	"github.com/a-essam23/go-dispatch/internal/router"
+	"github.com/a-essam23/go-dispatch/pkg/config"
+	"github.com/a-essam23/go-dispatch/pkg/transport/transporttest"
+)
+
+func TestCronSchedulesRunPipelinesAndAreListed(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	eng := engine.New(logger)
+	eng.RegisterCore(&engine.RegisterCoreOptions{})
+	cfg := &config.Config{
+		Events: map[string]config.EventConfig{
+			"room_stats": {Origin: "system", Actions: []config.VarConfig{{Name: "_notify_room", Params: []string{"stats", "{.payload}"}}}},
+		},
+		Schedules: []config.ScheduleConfig{{Name: "lobby-stats", Cron: "@every 20ms", Event: "room_stats", Target: "lobby", Payload: `{"members":1}`}},
+	}
+	if err := config.CompilePipelines(cfg, eng); err != nil {
+		t.Fatalf("CompilePipelines failed: %v", err)
+	}
+	app := NewApp(logger, context.Background(), cfg, eng)
+	defer eng.Scheduler().Stop()
+
+	conn := transporttest.NewConn()
+	app.stateManager.RegisterConnection(conn, "127.0.0.1")
+	app.stateManager.AssociateUser(conn.ID(), "alice", 0)
+	app.stateManager.Join("alice", "lobby", nil)
+
+	deadline := time.Now().Add(time.Second)
+	for len(conn.Sent()) == 0 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if sent := conn.Sent(); len(sent) == 0 || string(sent[0]) != `{"event":"stats","payload":{"members":1}}` {
+		t.Fatalf("expected the scheduled stats in the lobby, got %q", sent)
+	}
+
+	rec := httptest.NewRecorder()
+	app.adminSchedulesHandler(rec, httptest.NewRequest(http.MethodGet, "/admin/schedules", nil))
+	var body schedulesResponse
+	if err := json.NewDecoder(rec.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Code != http.StatusOK || len(body.Cron) != 1 || body.Cron[0].Name != "lobby-stats" || body.Cron[0].Next.IsZero() {
+		t.Errorf("expected the lobby-stats schedule, got %d %+v", rec.Code, body)
+	}
+}
+
+func TestScheduledEventsAreCheckedWhenCompiled(t *testing.T) {
+	schedule := func(event string) []config.VarConfig {
+		return []config.VarConfig{{Name: "_schedule", Params: []string{event, "5m"}}}
+	}
+	tests := []struct {
+		name    string
+		origin  string
+		event   string
+		wantErr bool
+	}{
+		{"client event", "", "reminder", false},
+		{"unknown event", "", "remindr", true},
+		{"system event from a client", "", "room_stats", true},
+		{"system event from the server", "system", "room_stats", false},
+		{"templated event", "", "{.payload.event}", false},
+	}
+	for _, tt := range tests {
+		eng := engine.New(slog.New(slog.NewTextHandler(io.Discard, nil)))
+		eng.RegisterCore(&engine.RegisterCoreOptions{})
+		cfg := &config.Config{Events: map[string]config.EventConfig{
+			"reminder":   {Actions: []config.VarConfig{{Name: "_log", Params: []string{"reminder"}}}},
+			"room_stats": {Origin: "system", Actions: []config.VarConfig{{Name: "_log", Params: []string{"stats"}}}},
+			"later":      {Origin: tt.origin, Actions: schedule(tt.event)},
+		}}
+		if err := config.CompilePipelines(cfg, eng); (err != nil) != tt.wantErr {
+			t.Errorf("%s: CompilePipelines returned %v, want an error: %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestScheduledJobsRunAsTheirUserOnly(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	eng := engine.New(logger)
+	eng.RegisterCore(&engine.RegisterCoreOptions{})
+	cfg := &config.Config{Events: map[string]config.EventConfig{
+		"later":    {Actions: []config.VarConfig{{Name: "_schedule", Params: []string{"{.payload.event}", "20ms", "{}", "lobby"}}}},
+		"announce": {Actions: []config.VarConfig{{Name: "_broadcast", Params: []string{"announcement", "{}"}}}},
+		"shout":    {Actions: []config.VarConfig{{Name: "_notify_room", Params: []string{"shout", "{}"}}}},
+		"stats":    {Origin: "system", Actions: []config.VarConfig{{Name: "_notify_room", Params: []string{"stats", "{}"}}}},
+	}}
+	if err := config.CompilePipelines(cfg, eng); err != nil {
+		t.Fatalf("CompilePipelines failed: %v", err)
+	}
+	app := NewApp(logger, context.Background(), cfg, eng)
+	defer eng.Scheduler().Stop()
+
+	alice, bob := transporttest.NewConn(), transporttest.NewConn()
+	app.stateManager.RegisterConnection(alice, "127.0.0.1")
+	app.stateManager.AssociateUser(alice.ID(), "alice", 0)
+	app.stateManager.RegisterConnection(bob, "127.0.0.1")
+	app.stateManager.AssociateUser(bob.ID(), "bob", 0)
+	app.stateManager.Join("alice", "lobby", nil)
+	app.stateManager.Join("bob", "lobby", nil)
+
+	// alice schedules a broadcast she may not send, a system event and a
+	// notify she may send, then goes offline before they run.
+	for _, event := range []string{"announce", "stats", "shout"} {
+		app.eventRouter.HandleMessage(context.Background(), alice.ID(), []byte(`{"event":"later","target":"lobby","payload":{"event":"`+event+`"}}`))
+	}
+	app.stateManager.DeregisterConnection(alice.ID())
+	bob.Reset() // alice's presence
+
+	deadline := time.Now().Add(time.Second)
+	for len(eng.Scheduler().Jobs()) > 0 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	time.Sleep(20 * time.Millisecond)
+	if sent := bob.Sent(); len(sent) != 1 || string(sent[0]) != `{"event":"shout","payload":{}}` {
+		t.Errorf("expected only alice's shout to reach bob, got %q", sent)
+	}
+
+	if err := app.eventRouter.Run(engine.Invocation{Event: "shout", Target: "lobby", UserID: "ghost"}); !errors.Is(err, router.ErrUnknownUser) {
+		t.Errorf("running as an unknown user returned %v, want ErrUnknownUser", err)
+	}
+	if err := app.eventRouter.Run(engine.Invocation{Event: "stats", Target: "lobby", UserID: "bob"}); !errors.Is(err, router.ErrSystemEventForUser) {
+		t.Errorf("running a system event as a user returned %v, want ErrSystemEventForUser", err)
+	}
+	if sent := bob.Sent(); len(sent) != 1 {
+		t.Errorf("a refused invocation was sent: %q", sent)
+	}
+}
@@ -6,13 +6,17 @@ import (
 	"log/slog"
 	"net"
 	"net/http"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/a-essam23/go-dispatch/internal/engine"
 	"github.com/a-essam23/go-dispatch/internal/router"
 	"github.com/a-essam23/go-dispatch/internal/server/middleware"
+	"github.com/a-essam23/go-dispatch/pkg/codec"
 	"github.com/a-essam23/go-dispatch/pkg/config"
+	"github.com/a-essam23/go-dispatch/pkg/metrics"
 	"github.com/a-essam23/go-dispatch/pkg/state"
 	"github.com/a-essam23/go-dispatch/pkg/state/statemanager"
 	"github.com/a-essam23/go-dispatch/pkg/transport"
@@ -25,24 +29,49 @@ type App struct {
 	logger       *slog.Logger
 	stateManager state.Manager
 	eventRouter  *router.EventRouter
+	engine       *engine.Registry
 	wg           sync.WaitGroup
 	http         *http.Server
 	config       *config.Config
+	metrics      *metrics.Registry
+	sessions     *transport.SessionStore // nil when sessions are disabled
+
+	draining atomic.Bool
+	drained  chan struct{} // closed once a drain completes
 
 	ctx context.Context
 }
 
 func NewApp(logger *slog.Logger, rootContx context.Context, cfg *config.Config, eng *engine.Registry) *App {
 	stateManager := statemanager.NewInMemoryManager(logger)
-	eventRouter := router.NewEventRouter(logger, stateManager, cfg.Pipelines, eng)
+	stateManager.SetPresenceDebounce(cfg.Presence.OfflineDebounce)
+	stateManager.SetRoomClasses(cfg.RoomClasses)
+	stateManager.SetRoomStateLimit(cfg.RoomState.MaxSize)
+	stateManager.SetPresenceHandler(engine.NewPresenceBroadcaster(logger, stateManager))
+	metricsReg := metrics.New()
+	eventRouter := router.NewEventRouter(logger, stateManager, cfg.Pipelines, eng, router.MessageLimits{
+		MaxDepth: cfg.Transport.MaxJSONDepth,
+		MaxKeys:  cfg.Transport.MaxJSONKeys,
+	}, metricsReg)
+	eng.Scheduler().SetRunner(eventRouter.Run)
+	eng.Scheduler().SetCronSchedules(cfg.CronSchedules)
 
 	app := &App{
 		logger:       logger,
 		stateManager: stateManager,
 		eventRouter:  eventRouter,
+		engine:       eng,
 		config:       cfg,
+		metrics:      metricsReg,
+		drained:      make(chan struct{}),
 		ctx:          rootContx,
 	}
+	if cfg.Transport.Session.Enabled {
+		app.sessions = transport.NewSessionStore(transport.SessionConfig{
+			ReplayBuffer: cfg.Transport.Session.ReplayBuffer,
+			GracePeriod:  cfg.Transport.Session.GracePeriod,
+		}, logger)
+	}
 	mux := http.NewServeMux()
 	upgradeHandler := http.HandlerFunc(app.upgradeHandler)
 	connCounter := middleware.UserConnectionCounter(stateManager.GetUserConnectionCount)
@@ -61,21 +90,53 @@ func NewApp(logger *slog.Logger, rootContx context.Context, cfg *config.Config,
 		AllowCredentials: true,
 	})
 
-	handler := middleware.Chain(upgradeHandler,
-		middleware.RequestMetadataMiddleware(),
-		middleware.NewRequestLogger(app.logger),
-		middleware.NewAuthMiddleware(logger, app.config.Server.Auth.JWTSecret, permCompiler),
-		middleware.NewConnectionLimiter(
-			logger,
-			connCounter,
-			connCycler,
-			app.config.Server.ConnectionLimit,
+	// endpoints that open a new connection pass the full chain, including the
+	// connection limiter. They are closed while draining.
+	opening := func(h http.HandlerFunc) http.Handler {
+		return c.Handler(middleware.Chain(h,
+			middleware.NewDrainGuard(app.Draining, app.config.Server.Drain.ReconnectDelay),
+			middleware.RequestMetadataMiddleware(),
+			middleware.NewRequestLogger(app.logger),
+			middleware.NewAuthMiddleware(logger, app.config.Server.Auth.JWTSecret, permCompiler),
+			middleware.NewConnectionLimiter(
+				logger,
+				connCounter,
+				connCycler,
+				app.resumesSession,
+				app.config.Server.ConnectionLimit,
+			)))
+	}
+	// endpoints acting on an existing connection only need authentication.
+	authenticated := func(h http.HandlerFunc) http.Handler {
+		return c.Handler(middleware.Chain(h,
+			middleware.RequestMetadataMiddleware(),
+			middleware.NewRequestLogger(app.logger),
+			middleware.NewAuthMiddleware(logger, app.config.Server.Auth.JWTSecret, permCompiler),
 		))
+	}
 
-	mux.Handle("/ws", c.Handler(handler))
+	mux.Handle("/ws", opening(upgradeHandler))
+	if cfg.Transport.Fallback.Enabled {
+		mux.Handle("/sse", opening(app.sseHandler))
+		mux.Handle("/poll/open", opening(app.pollOpenHandler))
+		mux.Handle("/poll", authenticated(app.pollHandler))
+		mux.Handle("/send", authenticated(app.sendHandler))
+	}
+	mux.Handle("/metrics", metricsReg.Handler())
+	if token := cfg.Server.Admin.Token; token != "" {
+		admin := func(h http.HandlerFunc) http.Handler {
+			return middleware.Chain(h, middleware.NewAdminAuth(logger, token))
+		}
+		mux.Handle("/admin/drain", admin(app.adminDrainHandler))
+		mux.Handle("/admin/invites", admin(app.adminInvitesHandler))
+		mux.Handle("/admin/schedules", admin(app.adminSchedulesHandler))
+		mux.Handle("/admin/publish", admin(app.adminPublishHandler))
+	}
 
+	// connections must outlive the root context so Shutdown can drain them;
+	// they are closed explicitly instead.
 	app.http = &http.Server{Addr: app.config.Server.Address, Handler: mux, BaseContext: func(l net.Listener) context.Context {
-		return app.ctx
+		return context.WithoutCancel(app.ctx)
 	}}
 
 	return app
@@ -100,9 +161,7 @@ func (a *App) upgradeHandler(w http.ResponseWriter, r *http.Request) {
 		slog.String("userID", reqMeta.UserID),
 	)
 
-	wsConn, err := websocket.Accept(w, r, &websocket.AcceptOptions{
-		InsecureSkipVerify: true,
-	})
+	wsConn, err := websocket.Accept(w, r, a.acceptOptions(r.URL.Path))
 	if err != nil {
 		a.logger.Error("Failed to accept websocket connection", slog.Any("error", err))
 		return
@@ -112,23 +171,87 @@ func (a *App) upgradeHandler(w http.ResponseWriter, r *http.Request) {
 		r.Context(),
 		&a.wg,
 		wsConn,
-		transport.ConnectionConfig(a.config.Transport),
+		connectionConfig(a.config.Transport),
 		nil,
 		nil,
 		a.logger,
 	)
+	conn.SetMetrics(a.metrics)
+	conn.SetPeer(reqMeta.IP, r.UserAgent())
+	// the negotiated subprotocol selects the wire format; clients that offer
+	// none of ours fall back to JSON.
+	if cd, ok := codec.Lookup(wsConn.Subprotocol()); ok {
+		conn.SetCodec(cd)
+	}
+	if _, err := a.connect(conn, r, reqMeta, connLogger); err != nil {
+		return
+	}
+
+	connLogger.Info("User connection fully established", slog.Any("userID", reqMeta.UserID))
+	conn.Run()
+	<-conn.Done()
+}
+
+// connects a freshly opened transport. With sessions enabled it is wrapped in a
+// new session, or attached to the session the client asked to resume. Returns
+// the connection as registered in state.
+func (a *App) connect(raw transport.Attachable, r *http.Request, reqMeta *middleware.RequestMetadata, connLogger *slog.Logger) (transport.Conn, error) {
+	if a.sessions == nil {
+		return raw, a.attach(raw, reqMeta, connLogger)
+	}
+
+	if sessionID, lastSeq, ok := resumeParams(r); ok {
+		session, err := a.sessions.Resume(sessionID, reqMeta.UserID, raw, lastSeq)
+		if err == nil {
+			// the session is still registered; state and rooms are untouched.
+			return session, nil
+		}
+		connLogger.Info("Could not resume session, starting a new one", slog.String("sessionID", sessionID.String()), slog.Any("error", err))
+	}
+
+	session := a.sessions.Create(reqMeta.UserID, raw)
+	return session, a.attach(session, reqMeta, connLogger)
+}
+
+// reads the ?session=<id>&lastSeq=<n> parameters of a resuming client.
+func resumeParams(r *http.Request) (uuid.UUID, uint64, bool) {
+	q := r.URL.Query()
+	sessionID, err := uuid.Parse(q.Get("session"))
+	if err != nil {
+		return uuid.Nil, 0, false
+	}
+	lastSeq, err := strconv.ParseUint(q.Get("lastSeq"), 10, 64)
+	if err != nil {
+		return uuid.Nil, 0, false
+	}
+	return sessionID, lastSeq, true
+}
+
+// a resuming client replaces its own detached connection, so it is exempt
+// from the per-user connection limit.
+func (a *App) resumesSession(r *http.Request, userID string) bool {
+	if a.sessions == nil {
+		return false
+	}
+	sessionID, _, ok := resumeParams(r)
+	return ok && a.sessions.Resumable(sessionID, userID)
+}
+
+// registers conn for the authenticated user and routes its messages. On
+// failure the connection is closed and the error returned.
+func (a *App) attach(conn transport.Attachable, reqMeta *middleware.RequestMetadata, connLogger *slog.Logger) error {
 	// register new connection
 	stateConn, err := a.stateManager.RegisterConnection(conn, reqMeta.IP)
 	if err != nil {
 		connLogger.Error("Failed to register connection state", slog.Any("error", err))
 		conn.Close(err)
-		return
+		return err
 	}
 	// associate the authenticated user with the registered connection.
 	if _, err := a.stateManager.AssociateUser(stateConn.ID, reqMeta.UserID, reqMeta.GlobalPermissions); err != nil {
 		connLogger.Error("Failed to associate user with connection", slog.Any("error", err))
 		conn.Close(err)
-		return
+		return err
 	}
 	conn.SetOnMessageHandler(a.eventRouter.HandleMessage)
 	conn.SetOnCloseHandler(func(id uuid.UUID, err error) {
@@ -136,37 +259,81 @@ func (a *App) upgradeHandler(w http.ResponseWriter, r *http.Request) {
 		if dErr := a.stateManager.DeregisterConnection(id); dErr != nil {
 			connLogger.Error("Failed to deregister connection from state", slog.Any("error", dErr))
 		}
+		if count, _ := a.stateManager.GetUserConnectionCount(reqMeta.UserID); count == 0 {
+			a.engine.HandleDisconnect(connLogger, a.stateManager, reqMeta.UserID)
+		}
 	})
+	return nil
+}
 
-	connLogger.Info("User connection fully established", slog.Any("userID", reqMeta.UserID))
-	conn.Run()
-	<-conn.Done()
+// builds the websocket handshake options for the endpoint at path, applying any
+// endpoint-specific compression settings over the transport defaults.
+func (a *App) acceptOptions(path string) *websocket.AcceptOptions {
+	compression := a.config.Transport.Compression
+	if override, ok := a.config.Transport.EndpointCompression[path]; ok {
+		compression = override
+	}
+	// modes are validated when the config is loaded.
+	mode, _ := transport.ParseCompressionMode(compression.Mode)
+
+	return &websocket.AcceptOptions{
+		InsecureSkipVerify:   true,
+		Subprotocols:         a.config.Transport.Codecs,
+		CompressionMode:      mode,
+		CompressionThreshold: compression.MinSize,
+	}
 }
 
-// graceful shutdown sequence.
+// maps the transport section of the config onto the per-connection settings.
+func connectionConfig(cfg config.TransportConfig) transport.ConnectionConfig {
+	return transport.ConnectionConfig{
+		ReadTimeout:          cfg.ReadTimeout,
+		WriteTimeout:         cfg.WriteTimeout,
+		PingInterval:         cfg.PingInterval,
+		PongTimeout:          cfg.PongTimeout,
+		HeartbeatInterval:    cfg.HeartbeatInterval,
+		MaxMessageSize:       cfg.MaxMessageSize,
+		MaxMessagesPerSecond: cfg.MaxMessagesPerSecond,
+	}
+}
+
+// graceful shutdown sequence: drain connections, then stop the HTTP server.
 func (a *App) Shutdown() error {
 	a.logger.Info("Shutting down server...")
+	// no scheduled pipeline starts once shutdown begins.
+	a.engine.Scheduler().Stop()
+	drainCtx, cancelDrain := context.WithTimeout(context.Background(), a.config.Server.Drain.Window+5*time.Second)
+	defer cancelDrain()
+	if err := a.Drain(drainCtx); errors.Is(err, ErrAlreadyDraining) {
+		// a drain started through the admin API; let it finish.
+		select {
+		case <-a.drained:
+		case <-drainCtx.Done():
+		}
+	} else if err != nil {
+		a.logger.Warn("Drain did not finish in time", slog.Any("error", err))
+	}
+
 	shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 	if err := a.http.Shutdown(shutdownCtx); err != nil {
 		return err
 	}
 
-	// close all active WebSocket connections.
-	a.logger.Info("Closing all active connections...")
-	allUsers, err := a.stateManager.GetAllUsers()
-	if err != nil {
-		a.logger.Error(err.Error())
-		return err
-	}
-	for _, user := range allUsers {
-		for _, conn := range user.Connections {
-			conn.Transport.Close(errors.New("graceful shutdown"))
-		}
+	// close connections that were mid-handshake when the drain began.
+	for _, conn := range a.activeConnections() {
+		conn.Close(transport.GoingAway("graceful shutdown"))
 	}
 
 	// wait for all connection goroutines to finish their cleanup.
 	a.wg.Wait()
+
+	// no pipeline runs anymore; let the webhooks they sent finish.
+	webhookCtx, cancelWebhooks := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancelWebhooks()
+	if err := a.engine.Close(webhookCtx); err != nil {
+		a.logger.Warn("Webhook deliveries did not finish in time", slog.Any("error", err))
+	}
 	a.logger.Info("Server shut down gracefully.")
 	return nil
 }
@@ -0,0 +1,58 @@
+package codec
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"reflect"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+// CBOR encodes messages as CBOR (RFC 8949) binary frames.
+var CBOR Codec = newCBORCodec()
+
+type cborCodec struct {
+	dec cbor.DecMode
+}
+
+func newCBORCodec() cborCodec {
+	// decode maps with string keys so the result can be marshalled back to JSON.
+	dec, err := cbor.DecOptions{DefaultMapType: reflect.TypeOf(map[string]any(nil))}.DecMode()
+	if err != nil {
+		panic("invalid cbor decode options: " + err.Error())
+	}
+	return cborCodec{dec: dec}
+}
+
+func (cborCodec) Name() string { return "cbor" }
+func (cborCodec) Binary() bool { return true }
+
+func (cborCodec) Encode(doc []byte) ([]byte, error) {
+	v, err := decodeJSON(doc)
+	if err != nil {
+		return nil, err
+	}
+	return cbor.Marshal(v)
+}
+
+func (c cborCodec) Decode(data []byte) ([]byte, error) {
+	var v any
+	if err := c.dec.Unmarshal(data, &v); err != nil {
+		return nil, fmt.Errorf("invalid cbor message: %w", err)
+	}
+	return json.Marshal(v)
+}
+
+func (c cborCodec) SetSeq(msg []byte, seq uint64) ([]byte, error) {
+	// envelopes are small maps: bump the inline map (0xa0-0xb7) length and
+	// append the new key/value pair.
+	if len(msg) == 0 || msg[0] < 0xa0 || msg[0] >= 0xb7 {
+		return setSeqViaJSON(c, msg, seq)
+	}
+	out := make([]byte, 0, len(msg)+13)
+	out = append(out, msg[0]+1)
+	out = append(out, msg[1:]...)
+	out = append(out, 0x63, 's', 'e', 'q', 0x1b) // text "seq", uint64
+	return binary.BigEndian.AppendUint64(out, seq), nil
+}
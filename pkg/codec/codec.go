@@ -0,0 +1,86 @@
+package codec
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+)
+
+/*
+ * Everything above the transport works with JSON documents (payload templates,
+ * gjson lookups, json.RawMessage). A Codec only translates between its wire
+ * format and that canonical JSON form, so the rest of the engine is unaware of
+ * which format a client negotiated.
+ */
+
+type Codec interface {
+	// Name is the websocket subprotocol a client offers to select this codec.
+	Name() string
+	// Binary reports whether messages are sent as binary rather than text frames.
+	Binary() bool
+	// Encode converts a JSON document into the codec's wire format.
+	Encode(doc []byte) ([]byte, error)
+	// Decode converts a message in the codec's wire format into a JSON document.
+	Decode(data []byte) ([]byte, error)
+	// SetSeq adds a top-level "seq" field to an encoded envelope. Codecs patch
+	// the encoded bytes where they can, so payloads are not re-encoded per connection.
+	SetSeq(msg []byte, seq uint64) ([]byte, error)
+}
+
+var builtIn = map[string]Codec{
+	JSON.Name():        JSON,
+	MessagePack.Name(): MessagePack,
+	CBOR.Name():        CBOR,
+}
+
+// Lookup returns the built-in codec registered under name.
+func Lookup(name string) (Codec, bool) {
+	c, ok := builtIn[name]
+	return c, ok
+}
+
+// setSeqViaJSON is the slow path of SetSeq for envelopes that cannot be
+// patched in place: decode, add the field, encode again.
+func setSeqViaJSON(c Codec, msg []byte, seq uint64) ([]byte, error) {
+	doc, err := c.Decode(msg)
+	if err != nil {
+		return nil, err
+	}
+	doc, err = JSON.SetSeq(doc, seq)
+	if err != nil {
+		return nil, err
+	}
+	return c.Encode(doc)
+}
+
+// decodeJSON parses a JSON document into generic Go values, keeping integers
+// as int64 so they survive the round-trip into binary formats unchanged.
+func decodeJSON(doc []byte) (any, error) {
+	dec := json.NewDecoder(bytes.NewReader(doc))
+	dec.UseNumber()
+	var v any
+	if err := dec.Decode(&v); err != nil {
+		return nil, fmt.Errorf("invalid json document: %w", err)
+	}
+	return normalizeNumbers(v), nil
+}
+
+func normalizeNumbers(v any) any {
+	switch t := v.(type) {
+	case json.Number:
+		if i, err := t.Int64(); err == nil {
+			return i
+		}
+		f, _ := t.Float64()
+		return f
+	case map[string]any:
+		for k, e := range t {
+			t[k] = normalizeNumbers(e)
+		}
+	case []any:
+		for i, e := range t {
+			t[i] = normalizeNumbers(e)
+		}
+	}
+	return v
+}
@@ -0,0 +1,92 @@
+package codec_test
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/a-essam23/go-dispatch/pkg/codec"
+)
+
+func TestCodecRoundTrip(t *testing.T) {
+	doc := []byte(`{"event":"new_message","payload":{"count":42,"ratio":0.5,"tags":["a","b"],"nested":{"ok":true,"none":null}}}`)
+
+	for _, name := range []string{"json", "msgpack", "cbor"} {
+		t.Run(name, func(t *testing.T) {
+			cd, ok := codec.Lookup(name)
+			if !ok {
+				t.Fatalf("codec %q is not registered", name)
+			}
+
+			wire, err := cd.Encode(doc)
+			if err != nil {
+				t.Fatalf("Encode failed: %v", err)
+			}
+			back, err := cd.Decode(wire)
+			if err != nil {
+				t.Fatalf("Decode failed: %v", err)
+			}
+
+			var want, got any
+			json.Unmarshal(doc, &want)
+			if err := json.Unmarshal(back, &got); err != nil {
+				t.Fatalf("Decode produced invalid JSON: %v", err)
+			}
+			if !reflect.DeepEqual(want, got) {
+				t.Errorf("round trip mismatch:\nwant %s\ngot  %s", doc, back)
+			}
+		})
+	}
+}
+
+func TestCodecDecodeRejectsGarbage(t *testing.T) {
+	for _, cd := range []codec.Codec{codec.MessagePack, codec.CBOR} {
+		if _, err := cd.Decode([]byte{0xc1}); err == nil {
+			t.Errorf("%s: expected error decoding invalid data", cd.Name())
+		}
+	}
+}
+
+func TestCodecSetSeq(t *testing.T) {
+	doc := []byte(`{"event":"new_message","payload":{"text":"hi"}}`)
+
+	for _, name := range []string{"json", "msgpack", "cbor"} {
+		t.Run(name, func(t *testing.T) {
+			cd, _ := codec.Lookup(name)
+			wire, err := cd.Encode(doc)
+			if err != nil {
+				t.Fatalf("Encode failed: %v", err)
+			}
+			stamped, err := cd.SetSeq(wire, 1<<40)
+			if err != nil {
+				t.Fatalf("SetSeq failed: %v", err)
+			}
+			back, err := cd.Decode(stamped)
+			if err != nil {
+				t.Fatalf("Decode of stamped message failed: %v", err)
+			}
+
+			var got struct {
+				Seq     uint64         `json:"seq"`
+				Event   string         `json:"event"`
+				Payload map[string]any `json:"payload"`
+			}
+			if err := json.Unmarshal(back, &got); err != nil {
+				t.Fatalf("invalid JSON after SetSeq: %v (%s)", err, back)
+			}
+			if got.Seq != 1<<40 || got.Event != "new_message" || got.Payload["text"] != "hi" {
+				t.Errorf("unexpected stamped envelope: %s", back)
+			}
+		})
+	}
+}
+
+func TestJSONSetSeqEmptyObject(t *testing.T) {
+	out, err := codec.JSON.SetSeq([]byte(`{}`), 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != `{"seq":7}` {
+		t.Errorf("got %s", out)
+	}
+}
@@ -0,0 +1,34 @@
+package codec
+
+import (
+	"bytes"
+	"errors"
+	"strconv"
+)
+
+// JSON is the default codec. Messages already are JSON, so it passes them through.
+var JSON Codec = jsonCodec{}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Name() string { return "json" }
+func (jsonCodec) Binary() bool { return false }
+
+func (jsonCodec) Encode(doc []byte) ([]byte, error)  { return doc, nil }
+func (jsonCodec) Decode(data []byte) ([]byte, error) { return data, nil }
+
+func (jsonCodec) SetSeq(msg []byte, seq uint64) ([]byte, error) {
+	body := bytes.TrimLeft(msg, " \t\r\n")
+	if len(body) == 0 || body[0] != '{' {
+		return nil, errors.New("json envelope is not an object")
+	}
+	body = body[1:]
+
+	out := make([]byte, 0, len(msg)+24)
+	out = append(out, `{"seq":`...)
+	out = strconv.AppendUint(out, seq, 10)
+	if rest := bytes.TrimLeft(body, " \t\r\n"); len(rest) == 0 || rest[0] != '}' {
+		out = append(out, ',')
+	}
+	return append(out, body...), nil
+}
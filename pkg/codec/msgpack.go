@@ -0,0 +1,46 @@
+package codec
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// MessagePack encodes messages as MessagePack binary frames.
+var MessagePack Codec = msgpackCodec{}
+
+type msgpackCodec struct{}
+
+func (msgpackCodec) Name() string { return "msgpack" }
+func (msgpackCodec) Binary() bool { return true }
+
+func (msgpackCodec) Encode(doc []byte) ([]byte, error) {
+	v, err := decodeJSON(doc)
+	if err != nil {
+		return nil, err
+	}
+	return msgpack.Marshal(v)
+}
+
+func (msgpackCodec) Decode(data []byte) ([]byte, error) {
+	var v any
+	if err := msgpack.Unmarshal(data, &v); err != nil {
+		return nil, fmt.Errorf("invalid msgpack message: %w", err)
+	}
+	return json.Marshal(v)
+}
+
+func (c msgpackCodec) SetSeq(msg []byte, seq uint64) ([]byte, error) {
+	// envelopes are small maps: bump the fixmap (0x80-0x8f) length and
+	// append the new key/value pair.
+	if len(msg) == 0 || msg[0] < 0x80 || msg[0] >= 0x8f {
+		return setSeqViaJSON(c, msg, seq)
+	}
+	out := make([]byte, 0, len(msg)+13)
+	out = append(out, msg[0]+1)
+	out = append(out, msg[1:]...)
+	out = append(out, 0xa3, 's', 'e', 'q', 0xcf) // fixstr "seq", uint64
+	return binary.BigEndian.AppendUint64(out, seq), nil
+}
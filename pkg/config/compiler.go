@@ -1,11 +1,13 @@
 package config
 
 import (
+	"encoding/json"
 	"fmt"
 	"regexp"
 	"strings"
 
 	"github.com/a-essam23/go-dispatch/internal/engine"
+	"github.com/a-essam23/go-dispatch/pkg/cron"
 	"github.com/a-essam23/go-dispatch/pkg/pipeline"
 )
 
@@ -16,7 +18,17 @@ func CompilePipelines(cfg *Config, e *engine.Registry) error {
 	cfg.Pipelines = make(map[string]*pipeline.CompiledPipeline)
 
 	for eventName, eventCfg := range cfg.Events {
+		origin, err := parseOrigin(eventCfg.Origin)
+		if err != nil {
+			return fmt.Errorf("event '%s': %w", eventName, err)
+		}
+		if origin == pipeline.OriginSystem {
+			if err := validateSystemPipeline(eventCfg, e); err != nil {
+				return fmt.Errorf("system event '%s': %w", eventName, err)
+			}
+		}
 		compiledPipe := &pipeline.CompiledPipeline{
+			Origin:    origin,
 			Modifiers: make([]pipeline.ModifierStep, 0, len(eventCfg.Modifiers)),
 			Actions:   make([]pipeline.Step, 0, len(eventCfg.Actions)),
 		}
@@ -46,15 +58,134 @@ func CompilePipelines(cfg *Config, e *engine.Registry) error {
 				return fmt.Errorf("invalid params for action '%s' in event '%s': %w", actionCfg.Name, eventName, err)
 			}
 			step := pipeline.Step{
-				Function: fn,
-				Params:   actionCfg.Params,
+				Function:  fn,
+				Params:    actionCfg.Params,
+				Encodings: e.ActionParamEncodings(actionCfg.Name),
 			}
 			compiledPipe.Actions = append(compiledPipe.Actions, step)
 		}
 
 		cfg.Pipelines[eventName] = compiledPipe
 	}
+	// _schedule names events, so it is checked once every pipeline is known.
+	for eventName, eventCfg := range cfg.Events {
+		if err := validateScheduledEvents(eventCfg, cfg.Pipelines[eventName].Origin, cfg.Pipelines); err != nil {
+			return fmt.Errorf("event '%s': %w", eventName, err)
+		}
+	}
 	cfg.Events = nil
+
+	// schedules name events, so they come after the pipelines.
+	schedules, err := compileSchedules(cfg.Schedules, cfg.Pipelines)
+	if err != nil {
+		return err
+	}
+	cfg.CronSchedules = schedules
+	cfg.Schedules = nil
+	return nil
+}
+
+func compileSchedules(schedules []ScheduleConfig, pipelines map[string]*pipeline.CompiledPipeline) ([]engine.CronSchedule, error) {
+	compiled := make([]engine.CronSchedule, 0, len(schedules))
+	names := make(map[string]bool, len(schedules))
+	for i, sc := range schedules {
+		if sc.Name == "" {
+			return nil, fmt.Errorf("schedules[%d]: name is required", i)
+		}
+		if names[sc.Name] {
+			return nil, fmt.Errorf("schedule '%s' is defined more than once", sc.Name)
+		}
+		names[sc.Name] = true
+		pipe, ok := pipelines[sc.Event]
+		if !ok {
+			return nil, fmt.Errorf("schedule '%s': unknown event '%s'", sc.Name, sc.Event)
+		}
+		if pipe.Origin != pipeline.OriginSystem {
+			return nil, fmt.Errorf("schedule '%s': event '%s' must have origin 'system'", sc.Name, sc.Event)
+		}
+		schedule, err := cron.Parse(sc.Cron)
+		if err != nil {
+			return nil, fmt.Errorf("schedule '%s': %w", sc.Name, err)
+		}
+		payload := sc.Payload
+		if payload == "" {
+			payload = "{}"
+		}
+		if !json.Valid([]byte(payload)) {
+			return nil, fmt.Errorf("schedule '%s': payload is not valid JSON", sc.Name)
+		}
+		compiled = append(compiled, engine.CronSchedule{
+			Name:       sc.Name,
+			Spec:       sc.Cron,
+			Schedule:   schedule,
+			Invocation: engine.Invocation{Event: sc.Event, Target: sc.Target, Payload: json.RawMessage(payload)},
+		})
+	}
+	return compiled, nil
+}
+
+// validateScheduledEvents rejects _schedule steps naming, without templating,
+// an event that does not exist, or a system event from a client event: such
+// a job would run a pipeline its user may not trigger.
+func validateScheduledEvents(eventCfg EventConfig, origin pipeline.Origin, pipelines map[string]*pipeline.CompiledPipeline) error {
+	for _, actionCfg := range eventCfg.Actions {
+		if actionCfg.Name != "_schedule" || len(actionCfg.Params) == 0 || strings.Contains(actionCfg.Params[0], "{") {
+			continue
+		}
+		scheduled := actionCfg.Params[0]
+		pipe, ok := pipelines[scheduled]
+		if !ok {
+			return fmt.Errorf("_schedule: unknown event '%s'", scheduled)
+		}
+		if origin == pipeline.OriginClient && pipe.Origin == pipeline.OriginSystem {
+			return fmt.Errorf("_schedule: client event cannot schedule system event '%s'", scheduled)
+		}
+	}
+	return nil
+}
+
+func parseOrigin(s string) (pipeline.Origin, error) {
+	switch s {
+	case "", "client":
+		return pipeline.OriginClient, nil
+	case "system":
+		return pipeline.OriginSystem, nil
+	default:
+		return 0, fmt.Errorf("unknown origin '%s' (want client or system)", s)
+	}
+}
+
+// validateSystemPipeline rejects the steps and context variables of an event
+// that cannot run without a user or connection, or that read a client token.
+func validateSystemPipeline(eventCfg EventConfig, e *engine.Registry) error {
+	for _, modCfg := range eventCfg.Modifiers {
+		if e.ModifierNeedsUser(modCfg.Name) {
+			return fmt.Errorf("modifier '%s' requires a user", modCfg.Name)
+		}
+		if err := validateSystemParams(modCfg.Params, e); err != nil {
+			return fmt.Errorf("modifier '%s': %w", modCfg.Name, err)
+		}
+	}
+	for _, actionCfg := range eventCfg.Actions {
+		if e.ActionNeedsUser(actionCfg.Name) {
+			return fmt.Errorf("action '%s' requires a user", actionCfg.Name)
+		}
+		if err := validateSystemParams(actionCfg.Params, e); err != nil {
+			return fmt.Errorf("action '%s': %w", actionCfg.Name, err)
+		}
+	}
+	return nil
+}
+
+func validateSystemParams(params []string, e *engine.Registry) error {
+	for _, p := range params {
+		for _, match := range contextVarRegex.FindAllStringSubmatch(p, -1) {
+			varName := match[1]
+			if strings.HasPrefix(varName, "token.") || e.ParamNeedsUser(varName) {
+				return fmt.Errorf("context variable '{$%s}' requires a user", varName)
+			}
+		}
+	}
 	return nil
 }
 
@@ -1,9 +1,20 @@
 package config
 
 import (
+	"errors"
+	"fmt"
 	"log/slog"
+	"maps"
+	"net/url"
+	"os"
+	"slices"
 	"strings"
+	"time"
 
+	"github.com/a-essam23/go-dispatch/internal/engine"
+	"github.com/a-essam23/go-dispatch/pkg/codec"
+	"github.com/a-essam23/go-dispatch/pkg/state"
+	"github.com/a-essam23/go-dispatch/pkg/transport"
 	"github.com/joho/godotenv"
 	"github.com/spf13/viper"
 )
@@ -20,7 +31,32 @@ func Load(logger *slog.Logger, fileName string) (*Config, error) {
 	v.SetDefault("server.address", ":8080")
 	v.SetDefault("server.auth.jwtSecret", "default-secret-key-change-me")
 	v.SetDefault("server.ratelimit.maxConnsPerIP", 5)
+	v.SetDefault("server.admin.token", "")
+	v.SetDefault("server.drain.window", "10s")
+	v.SetDefault("server.drain.reconnectDelay", "2s")
 	v.SetDefault("transport.readTimeout", "60s")
+	v.SetDefault("transport.writeTimeout", "10s")
+	v.SetDefault("transport.pingInterval", "30s")
+	v.SetDefault("transport.pongTimeout", "10s")
+	v.SetDefault("transport.heartbeatInterval", "0s")
+	v.SetDefault("transport.maxMessageSize", 32768)
+	v.SetDefault("transport.maxMessagesPerSecond", 50)
+	v.SetDefault("transport.maxJsonDepth", 16)
+	v.SetDefault("transport.maxJsonKeys", 256)
+	v.SetDefault("transport.compression.mode", "disabled")
+	v.SetDefault("transport.codecs", []string{"json", "msgpack", "cbor"})
+	v.SetDefault("transport.session.enabled", false)
+	v.SetDefault("transport.session.replayBuffer", 256)
+	v.SetDefault("transport.session.gracePeriod", "30s")
+	v.SetDefault("transport.fallback.enabled", false)
+	v.SetDefault("transport.fallback.pollWait", "25s")
+	v.SetDefault("transport.fallback.idleTimeout", "60s")
+	v.SetDefault("presence.offlineDebounce", "5s")
+	v.SetDefault("broadcast.permission", "broadcast")
+	v.SetDefault("broadcast.batchSize", 256)
+	v.SetDefault("receipts.retention", "24h")
+	v.SetDefault("scheduler.maxJobsPerUser", 100)
+	v.SetDefault("roomState.maxSize", 65536)
 
 	// 2. Set config file details
 	v.SetConfigName(fileName)
@@ -53,6 +89,21 @@ func Load(logger *slog.Logger, fileName string) (*Config, error) {
 		return nil, err
 	}
 
+	if _, err := transport.ParseCompressionMode(cfg.Transport.Compression.Mode); err != nil {
+		return nil, fmt.Errorf("transport.compression: %w", err)
+	}
+	for path, c := range cfg.Transport.EndpointCompression {
+		if _, err := transport.ParseCompressionMode(c.Mode); err != nil {
+			return nil, fmt.Errorf("transport.endpointCompression '%s': %w", path, err)
+		}
+	}
+
+	for _, name := range cfg.Transport.Codecs {
+		if _, ok := codec.Lookup(name); !ok {
+			return nil, fmt.Errorf("transport.codecs: unknown codec '%s'", name)
+		}
+	}
+
 	for _, name := range cfg.Permissions {
 		if err := RegisterPermission(name); err != nil {
 			return nil, err
@@ -60,5 +111,207 @@ func Load(logger *slog.Logger, fileName string) (*Config, error) {
 	}
 	logger.Info("Permission registry loaded", slog.Any("total_permissions", len(GetAllRegistered())))
 
+	// room classes may name permissions, so they come after the registry.
+	if cfg.RoomClasses, err = compileRoomClasses(cfg.Rooms); err != nil {
+		return nil, err
+	}
+	cfg.Rooms = nil
+
+	if cfg.Receipts.Retention <= 0 {
+		return nil, fmt.Errorf("receipts.retention must be positive")
+	}
+	if cfg.Scheduler.MaxJobsPerUser <= 0 {
+		return nil, fmt.Errorf("scheduler.maxJobsPerUser must be positive")
+	}
+	if cfg.RoomState.MaxSize < 0 {
+		return nil, fmt.Errorf("roomState.maxSize must not be negative")
+	}
+	if cfg.Broadcast.BatchSize <= 0 {
+		return nil, fmt.Errorf("broadcast.batchSize must be positive")
+	}
+	if cfg.Broadcast.Required, err = CompilePermissions([]string{cfg.Broadcast.Permission}); err != nil {
+		return nil, fmt.Errorf("broadcast.permission: %w", err)
+	}
+	if cfg.WebhookEndpoints, err = compileWebhooks(cfg.Webhooks); err != nil {
+		return nil, err
+	}
+	cfg.Webhooks = nil
+	if cfg.AuthorizerEndpoints, err = compileAuthorizers(cfg.Authorizers); err != nil {
+		return nil, err
+	}
+	cfg.Authorizers = nil
+	if cfg.UpstreamEndpoints, err = compileUpstreams(cfg.Upstreams); err != nil {
+		return nil, err
+	}
+	cfg.Upstreams = nil
+	if cfg.CompiledScripts, err = compileScripts(cfg.Scripts); err != nil {
+		return nil, err
+	}
+	cfg.Scripts = nil
+
 	return &cfg, nil
 }
+
+func compileRoomClasses(rooms []RoomClassConfig) ([]state.RoomClass, error) {
+	classes := make([]state.RoomClass, 0, len(rooms))
+	for i, rc := range rooms {
+		if rc.Pattern == "" {
+			return nil, fmt.Errorf("rooms[%d]: pattern is required", i)
+		}
+		name := rc.Name
+		if name == "" {
+			name = rc.Pattern
+		}
+		policy, err := state.ParseJoinPolicy(rc.Join)
+		if err != nil {
+			return nil, fmt.Errorf("room class '%s': %w", name, err)
+		}
+		if rc.MaxMembers < 0 || rc.IdleTTL < 0 {
+			return nil, fmt.Errorf("room class '%s': maxMembers and idleTTL cannot be negative", name)
+		}
+		class := state.RoomClass{
+			Name:       name,
+			Pattern:    rc.Pattern,
+			MaxMembers: rc.MaxMembers,
+			Join:       policy,
+			Persist:    rc.Persist,
+			IdleTTL:    rc.IdleTTL,
+		}
+		switch {
+		case policy == state.JoinPermissionRequired && rc.Permission == "":
+			return nil, fmt.Errorf("room class '%s': join policy 'permission-required' needs a permission", name)
+		case policy != state.JoinPermissionRequired && policy != state.JoinInviteOnly && rc.Permission != "":
+			return nil, fmt.Errorf("room class '%s': permission is only used by the 'permission-required' and 'invite-only' join policies", name)
+		case rc.Permission != "":
+			if class.Permission, err = CompilePermissions([]string{rc.Permission}); err != nil {
+				return nil, fmt.Errorf("room class '%s': %w", name, err)
+			}
+		}
+		if rc.IdleTTL > 0 && !rc.Persist {
+			return nil, fmt.Errorf("room class '%s': idleTTL only applies to rooms that persist", name)
+		}
+		classes = append(classes, class)
+	}
+	return classes, nil
+}
+
+func validateEndpointURL(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return errors.New("url must be an absolute http(s) URL")
+	}
+	return nil
+}
+
+func compileWebhooks(webhooks map[string]WebhookConfig) (map[string]engine.Webhook, error) {
+	compiled := make(map[string]engine.Webhook, len(webhooks))
+	for name, wc := range webhooks {
+		if err := validateEndpointURL(wc.URL); err != nil {
+			return nil, fmt.Errorf("webhooks '%s': %w", name, err)
+		}
+		hook := engine.Webhook{URL: wc.URL, Secret: wc.Secret, Timeout: wc.Timeout, Retries: 3, Backoff: wc.Backoff, MaxInFlight: wc.MaxInFlight}
+		if wc.Retries != nil {
+			hook.Retries = *wc.Retries
+		}
+		if hook.Timeout == 0 {
+			hook.Timeout = 5 * time.Second
+		}
+		if hook.Backoff == 0 {
+			hook.Backoff = 500 * time.Millisecond
+		}
+		if hook.MaxInFlight == 0 {
+			hook.MaxInFlight = 64
+		}
+		if hook.Timeout < 0 || hook.Backoff < 0 || hook.Retries < 0 || hook.MaxInFlight < 0 {
+			return nil, fmt.Errorf("webhooks '%s': timeout, retries, backoff and maxInFlight must not be negative", name)
+		}
+		compiled[name] = hook
+	}
+	return compiled, nil
+}
+
+func compileAuthorizers(authorizers map[string]AuthorizerConfig) (map[string]engine.Authorizer, error) {
+	compiled := make(map[string]engine.Authorizer, len(authorizers))
+	for name, ac := range authorizers {
+		if err := validateEndpointURL(ac.URL); err != nil {
+			return nil, fmt.Errorf("authorizers '%s': %w", name, err)
+		}
+		a := engine.Authorizer{URL: ac.URL, Secret: ac.Secret, Timeout: ac.Timeout, TTL: ac.TTL, FailOpen: ac.FailOpen}
+		if a.Timeout == 0 {
+			a.Timeout = 2 * time.Second
+		}
+		if a.TTL == 0 {
+			a.TTL = 30 * time.Second
+		}
+		if a.Timeout < 0 || a.TTL < 0 {
+			return nil, fmt.Errorf("authorizers '%s': timeout and ttl must not be negative", name)
+		}
+		compiled[name] = a
+	}
+	return compiled, nil
+}
+
+func compileUpstreams(upstreams map[string]UpstreamConfig) (map[string]engine.Upstream, error) {
+	compiled := make(map[string]engine.Upstream, len(upstreams))
+	for name, uc := range upstreams {
+		if err := validateEndpointURL(uc.URL); err != nil {
+			return nil, fmt.Errorf("upstreams '%s': %w", name, err)
+		}
+		u := engine.Upstream{
+			URL:              uc.URL,
+			Secret:           uc.Secret,
+			Timeout:          uc.Timeout,
+			MaxConcurrent:    uc.MaxConcurrent,
+			FailureThreshold: uc.Breaker.Failures,
+			Cooldown:         uc.Breaker.Cooldown,
+		}
+		if u.Timeout == 0 {
+			u.Timeout = 5 * time.Second
+		}
+		if u.MaxConcurrent == 0 {
+			u.MaxConcurrent = 64
+		}
+		if u.FailureThreshold == 0 {
+			u.FailureThreshold = 5
+		}
+		if u.Cooldown == 0 {
+			u.Cooldown = 30 * time.Second
+		}
+		if u.Timeout < 0 || u.MaxConcurrent < 0 || u.FailureThreshold < 0 || u.Cooldown < 0 {
+			return nil, fmt.Errorf("upstreams '%s': timeout, maxConcurrent and breaker settings must not be negative", name)
+		}
+		compiled[name] = u
+	}
+	return compiled, nil
+}
+
+func compileScripts(scripts map[string]ScriptConfig) ([]*engine.Script, error) {
+	names := slices.Sorted(maps.Keys(scripts))
+	compiled := make([]*engine.Script, 0, len(scripts))
+	for _, name := range names {
+		sc := scripts[name]
+		source := sc.Source
+		switch {
+		case sc.File != "" && sc.Source != "":
+			return nil, fmt.Errorf("scripts '%s': set either source or file, not both", name)
+		case sc.File != "":
+			data, err := os.ReadFile(sc.File)
+			if err != nil {
+				return nil, fmt.Errorf("scripts '%s': %w", name, err)
+			}
+			source = string(data)
+		case sc.Source == "":
+			return nil, fmt.Errorf("scripts '%s': source or file is required", name)
+		}
+		timeout := sc.Timeout
+		if timeout == 0 {
+			timeout = 100 * time.Millisecond
+		}
+		script, err := engine.CompileScript(name, engine.ScriptKind(sc.Kind), source, timeout)
+		if err != nil {
+			return nil, fmt.Errorf("scripts '%s': %w", name, err)
+		}
+		compiled = append(compiled, script)
+	}
+	return compiled, nil
+}
@@ -3,23 +3,65 @@ package config
 import (
 	"time"
 
+	"github.com/a-essam23/go-dispatch/internal/engine"
 	"github.com/a-essam23/go-dispatch/pkg/pipeline"
+	"github.com/a-essam23/go-dispatch/pkg/state"
 )
 
 type Config struct {
 	Server    ServerConfig
 	Transport TransportConfig
+	Presence  PresenceConfig
+	Broadcast BroadcastConfig
+	Receipts  ReceiptsConfig
+	Scheduler SchedulerConfig
+	RoomState RoomStateConfig `mapstructure:"roomState"`
+	// raw room classes from YAML, in matching order (only used when loading)
+	Rooms []RoomClassConfig `mapstructure:"rooms"`
+	// validated room classes (populated by the loader)
+	RoomClasses []state.RoomClass `mapstructure:"-"`
 	// raw representation from YAML (only used when loading)
 	Events map[string]EventConfig `mapstructure:"events"`
 	// compiled, ready-to-execute action pipelines (populated by the compiler)
 	Pipelines   map[string]*pipeline.CompiledPipeline `mapstructure:"-"`
 	Permissions []string                              `mapstructure:"permissions"`
+	// raw cron schedules from YAML (only used when compiling)
+	Schedules []ScheduleConfig `mapstructure:"schedules"`
+	// validated cron schedules (populated by the compiler)
+	CronSchedules []engine.CronSchedule `mapstructure:"-"`
+	// raw webhook endpoints from YAML, by name (only used when loading)
+	Webhooks map[string]WebhookConfig `mapstructure:"webhooks"`
+	// validated webhook endpoints (populated by the loader)
+	WebhookEndpoints map[string]engine.Webhook `mapstructure:"-"`
+	// raw authorize endpoints from YAML, by name (only used when loading)
+	Authorizers map[string]AuthorizerConfig `mapstructure:"authorizers"`
+	// validated authorize endpoints (populated by the loader)
+	AuthorizerEndpoints map[string]engine.Authorizer `mapstructure:"-"`
+	// raw _proxy backends from YAML, by name (only used when loading)
+	Upstreams map[string]UpstreamConfig `mapstructure:"upstreams"`
+	// validated _proxy backends (populated by the loader)
+	UpstreamEndpoints map[string]engine.Upstream `mapstructure:"-"`
+	// raw script actions and modifiers from YAML, by name (only used when loading)
+	Scripts map[string]ScriptConfig `mapstructure:"scripts"`
+	// compiled scripts, sorted by name (populated by the loader)
+	CompiledScripts []*engine.Script `mapstructure:"-"`
 }
 
 type ServerConfig struct {
 	Address         string
 	Auth            AuthConfig
 	ConnectionLimit ConnectionLimitConfig `mapstructure:"connectionLimit"`
+	Admin           AdminConfig           `mapstructure:"admin"`
+	Drain           DrainConfig           `mapstructure:"drain"`
+}
+
+type AdminConfig struct {
+	Token string `mapstructure:"token"` // bearer token for the admin API; empty disables it
+}
+
+type DrainConfig struct {
+	Window         time.Duration `mapstructure:"window"`         // connection closes are spread over this long
+	ReconnectDelay time.Duration `mapstructure:"reconnectDelay"` // suggested to clients before they reconnect elsewhere
 }
 
 type AuthConfig struct {
@@ -32,10 +74,137 @@ type ConnectionLimitConfig struct {
 }
 
 type TransportConfig struct {
-	ReadTimeout time.Duration `mapstructure:"readTimeout"`
+	ReadTimeout       time.Duration `mapstructure:"readTimeout"`
+	WriteTimeout      time.Duration `mapstructure:"writeTimeout"`
+	PingInterval      time.Duration `mapstructure:"pingInterval"`
+	PongTimeout       time.Duration `mapstructure:"pongTimeout"`
+	HeartbeatInterval time.Duration `mapstructure:"heartbeatInterval"`
+
+	MaxMessageSize       int64 `mapstructure:"maxMessageSize"`
+	MaxMessagesPerSecond int   `mapstructure:"maxMessagesPerSecond"`
+	MaxJSONDepth         int   `mapstructure:"maxJsonDepth"`
+	MaxJSONKeys          int   `mapstructure:"maxJsonKeys"`
+
+	// wire formats offered to clients as websocket subprotocols, in order of
+	// preference. Clients that offer none of them get JSON.
+	Codecs []string `mapstructure:"codecs"`
+
+	// default permessage-deflate settings for every websocket endpoint.
+	Compression CompressionConfig `mapstructure:"compression"`
+	// per-endpoint overrides, keyed by URL path (e.g. "/ws").
+	EndpointCompression map[string]CompressionConfig `mapstructure:"endpointCompression"`
+
+	// resumable sessions with sequenced, replayable outbound messages.
+	Session SessionConfig `mapstructure:"session"`
+
+	// HTTP transports for clients that cannot use WebSockets.
+	Fallback FallbackConfig `mapstructure:"fallback"`
+}
+
+type SessionConfig struct {
+	Enabled      bool          `mapstructure:"enabled"`
+	ReplayBuffer int           `mapstructure:"replayBuffer"` // recent outbound messages kept per session
+	GracePeriod  time.Duration `mapstructure:"gracePeriod"`  // how long a dropped session waits to be resumed
+}
+
+type FallbackConfig struct {
+	Enabled     bool          `mapstructure:"enabled"`
+	PollWait    time.Duration `mapstructure:"pollWait"`    // how long a long-poll request waits for messages
+	IdleTimeout time.Duration `mapstructure:"idleTimeout"` // long-poll sessions without a poll for this long are closed
+}
+
+type CompressionConfig struct {
+	Mode    string `mapstructure:"mode"`    // "disabled", "context_takeover" or "no_context_takeover"
+	MinSize int    `mapstructure:"minSize"` // messages smaller than this (bytes) are sent uncompressed
+}
+
+type PresenceConfig struct {
+	// how long a user whose last connection closed stays online, so quick
+	// reconnects do not flap their presence. "0s" marks them offline at once.
+	OfflineDebounce time.Duration `mapstructure:"offlineDebounce"`
+}
+
+type BroadcastConfig struct {
+	Permission string `mapstructure:"permission"` // the global permission _broadcast requires
+	BatchSize  int    `mapstructure:"batchSize"`  // users sent to per hold of the user lock
+	// the compiled permission (populated by the loader)
+	Required state.Permission `mapstructure:"-"`
+}
+
+type ReceiptsConfig struct {
+	// how long the receipts of a tracked message are kept, unless the receipts
+	// modifier says otherwise.
+	Retention time.Duration `mapstructure:"retention"`
+}
+
+type RoomStateConfig struct {
+	// the largest a room's state document may grow, in bytes; 0 lifts the limit.
+	MaxSize int `mapstructure:"maxSize"`
+}
+
+type SchedulerConfig struct {
+	// how many _schedule jobs a user may have pending at once.
+	MaxJobsPerUser int `mapstructure:"maxJobsPerUser"`
+}
+
+type WebhookConfig struct {
+	URL     string        `mapstructure:"url"`
+	Secret  string        `mapstructure:"secret"`  // signs requests when set
+	Timeout time.Duration `mapstructure:"timeout"` // per attempt; defaults to 5s
+	Retries *int          `mapstructure:"retries"` // attempts after the first; defaults to 3
+	Backoff time.Duration `mapstructure:"backoff"` // before the first retry, then doubled; defaults to 500ms
+	// asynchronous deliveries in flight at once; defaults to 64
+	MaxInFlight int `mapstructure:"maxInFlight"`
+}
+
+type AuthorizerConfig struct {
+	URL      string        `mapstructure:"url"`
+	Secret   string        `mapstructure:"secret"`   // signs requests when set
+	Timeout  time.Duration `mapstructure:"timeout"`  // defaults to 2s
+	TTL      time.Duration `mapstructure:"ttl"`      // how long decisions are cached; defaults to 30s
+	FailOpen bool          `mapstructure:"failOpen"` // allow events when the endpoint fails
+}
+
+type UpstreamConfig struct {
+	URL           string        `mapstructure:"url"`           // request paths are appended to it
+	Secret        string        `mapstructure:"secret"`        // signs requests when set
+	Timeout       time.Duration `mapstructure:"timeout"`       // defaults to 5s
+	MaxConcurrent int           `mapstructure:"maxConcurrent"` // requests in flight at once; defaults to 64
+	Breaker       BreakerConfig `mapstructure:"breaker"`
+}
+
+type BreakerConfig struct {
+	Failures int           `mapstructure:"failures"` // consecutive failures that open the circuit; defaults to 5
+	Cooldown time.Duration `mapstructure:"cooldown"` // how long it stays open; defaults to 30s
+}
+
+type ScriptConfig struct {
+	Kind    string        `mapstructure:"kind"`    // "action" or "modifier"
+	Source  string        `mapstructure:"source"`  // the Lua source, or
+	File    string        `mapstructure:"file"`    // a file holding it
+	Timeout time.Duration `mapstructure:"timeout"` // per run; defaults to 100ms
+}
+
+type RoomClassConfig struct {
+	Name       string        `mapstructure:"name"`       // defaults to the pattern
+	Pattern    string        `mapstructure:"pattern"`    // room IDs the class applies to, e.g. "dm:*"
+	MaxMembers int           `mapstructure:"maxMembers"` // 0 means unlimited
+	Join       string        `mapstructure:"join"`       // "open", "invite-only", "token-required" or "permission-required"
+	Permission string        `mapstructure:"permission"` // the permission "permission-required" asks for, or "invite-only" asks of a room's creator
+	Persist    bool          `mapstructure:"persist"`    // keep the room once its last member leaves
+	IdleTTL    time.Duration `mapstructure:"idleTTL"`    // how long a persisted room may stay empty; "0s" keeps it
+}
+
+type ScheduleConfig struct {
+	Name    string `mapstructure:"name"`
+	Cron    string `mapstructure:"cron"`    // e.g. "*/5 * * * *", "@hourly" or "@every 30s"
+	Event   string `mapstructure:"event"`   // the event whose pipeline runs
+	Target  string `mapstructure:"target"`  // the event's target
+	Payload string `mapstructure:"payload"` // the event's payload, as JSON
 }
 
 type EventConfig struct {
+	Origin    string      `mapstructure:"origin"` // "client" (the default) or "system"
 	Actions   []VarConfig `mapstructure:"actions"`
 	Modifiers []VarConfig `mapstructure:"modifiers"`
 }
@@ -0,0 +1,162 @@
+// Package cron parses cron expressions and computes when they next fire.
+package cron
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Schedule reports the next activation strictly after a given time, or the
+// zero time if there is none.
+type Schedule interface {
+	Next(after time.Time) time.Time
+}
+
+var descriptors = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+// Parse accepts a standard five field expression (minute, hour, day of month,
+// month, day of week), one of the descriptors @yearly, @monthly, @weekly,
+// @daily or @hourly, or "@every <duration>". Fields take '*', numbers, ranges
+// ("1-5"), steps ("*/15", "0-30/10") and comma separated lists of those; days
+// of the week run from 0 (Sunday) to 6, with 7 also meaning Sunday.
+func Parse(spec string) (Schedule, error) {
+	spec = strings.TrimSpace(spec)
+	if rest, ok := strings.CutPrefix(spec, "@every "); ok {
+		d, err := time.ParseDuration(strings.TrimSpace(rest))
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("invalid interval in '%s'", spec)
+		}
+		return every(d), nil
+	}
+	if expanded, ok := descriptors[spec]; ok {
+		spec = expanded
+	}
+
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("cron expression '%s' must have 5 fields", spec)
+	}
+	var s fieldSchedule
+	var err error
+	if s.minute, err = parseField(fields[0], 0, 59); err != nil {
+		return nil, fmt.Errorf("minute: %w", err)
+	}
+	if s.hour, err = parseField(fields[1], 0, 23); err != nil {
+		return nil, fmt.Errorf("hour: %w", err)
+	}
+	if s.dom, err = parseField(fields[2], 1, 31); err != nil {
+		return nil, fmt.Errorf("day of month: %w", err)
+	}
+	if s.month, err = parseField(fields[3], 1, 12); err != nil {
+		return nil, fmt.Errorf("month: %w", err)
+	}
+	if s.dow, err = parseField(fields[4], 0, 7); err != nil {
+		return nil, fmt.Errorf("day of week: %w", err)
+	}
+	if s.dow&(1<<7) != 0 {
+		s.dow |= 1
+	}
+	// as in standard cron, a field starting with '*', such as "*/2", leaves
+	// the day to the other field.
+	s.domAny = strings.HasPrefix(fields[2], "*")
+	s.dowAny = strings.HasPrefix(fields[4], "*")
+	return &s, nil
+}
+
+// parseField returns the bit set of the values a field allows.
+func parseField(field string, min, max int) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		rng, stepStr, hasStep := strings.Cut(part, "/")
+		step := 1
+		if hasStep {
+			var err error
+			if step, err = strconv.Atoi(stepStr); err != nil || step <= 0 {
+				return 0, fmt.Errorf("invalid step in '%s'", part)
+			}
+		}
+		lo, hi := min, max
+		switch {
+		case rng == "*":
+		case strings.Contains(rng, "-"):
+			l, h, _ := strings.Cut(rng, "-")
+			var err1, err2 error
+			lo, err1 = strconv.Atoi(l)
+			hi, err2 = strconv.Atoi(h)
+			if err1 != nil || err2 != nil {
+				return 0, fmt.Errorf("invalid range '%s'", rng)
+			}
+		default:
+			n, err := strconv.Atoi(rng)
+			if err != nil {
+				return 0, fmt.Errorf("invalid value '%s'", rng)
+			}
+			lo, hi = n, n
+			if hasStep {
+				hi = max
+			}
+		}
+		if lo < min || hi > max || lo > hi {
+			return 0, fmt.Errorf("'%s' is out of range %d-%d", part, min, max)
+		}
+		for v := lo; v <= hi; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+	return bits, nil
+}
+
+type fieldSchedule struct {
+	minute, hour, dom, month, dow uint64
+	// with both day fields restricted, a day matching either one fires.
+	domAny, dowAny bool
+}
+
+// Next walks forward a month, a day, an hour or a minute at a time, whichever
+// field fails first. Activations are in after's location.
+func (s *fieldSchedule) Next(after time.Time) time.Time {
+	loc := after.Location()
+	t := time.Date(after.Year(), after.Month(), after.Day(), after.Hour(), after.Minute(), 0, 0, loc).Add(time.Minute)
+	// a schedule that never fires, such as February 30th, gives up after five years.
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		switch {
+		case s.month&(1<<uint(t.Month())) == 0:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, loc)
+		case !s.dayMatches(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, loc)
+		case s.hour&(1<<uint(t.Hour())) == 0:
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, loc)
+		case s.minute&(1<<uint(t.Minute())) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+func (s *fieldSchedule) dayMatches(t time.Time) bool {
+	dom := s.dom&(1<<uint(t.Day())) != 0
+	dow := s.dow&(1<<uint(t.Weekday())) != 0
+	if s.domAny || s.dowAny {
+		return dom && dow
+	}
+	return dom || dow
+}
+
+type every time.Duration
+
+func (e every) Next(after time.Time) time.Time {
+	return after.Add(time.Duration(e))
+}
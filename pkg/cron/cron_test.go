@@ -0,0 +1,46 @@
+package cron_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/a-essam23/go-dispatch/pkg/cron"
+)
+
+func TestNext(t *testing.T) {
+	from := time.Date(2025, time.January, 31, 10, 7, 30, 0, time.UTC) // a Friday
+	tests := []struct {
+		spec string
+		want time.Time
+	}{
+		{"* * * * *", time.Date(2025, 1, 31, 10, 8, 0, 0, time.UTC)},
+		{"*/15 * * * *", time.Date(2025, 1, 31, 10, 15, 0, 0, time.UTC)},
+		{"0 9 * * 1-5", time.Date(2025, 2, 3, 9, 0, 0, 0, time.UTC)},
+		{"30 8,20 * * *", time.Date(2025, 1, 31, 20, 30, 0, 0, time.UTC)},
+		{"0 0 29 2 *", time.Date(2028, 2, 29, 0, 0, 0, 0, time.UTC)},
+		{"0 12 1 * 0", time.Date(2025, 2, 1, 12, 0, 0, 0, time.UTC)}, // the 1st, or a Sunday
+		{"0 0 */2 * 1", time.Date(2025, 2, 3, 0, 0, 0, 0, time.UTC)}, // an odd day that is a Monday
+		{"0 0 * * 7", time.Date(2025, 2, 2, 0, 0, 0, 0, time.UTC)},
+		{"@hourly", time.Date(2025, 1, 31, 11, 0, 0, 0, time.UTC)},
+		{"@every 90s", from.Add(90 * time.Second)},
+		{"0 0 30 2 *", time.Time{}},
+	}
+	for _, tt := range tests {
+		s, err := cron.Parse(tt.spec)
+		if err != nil {
+			t.Errorf("Parse(%q) failed: %v", tt.spec, err)
+			continue
+		}
+		if got := s.Next(from); !got.Equal(tt.want) {
+			t.Errorf("Parse(%q).Next = %v, want %v", tt.spec, got, tt.want)
+		}
+	}
+}
+
+func TestParseRejectsInvalidExpressions(t *testing.T) {
+	for _, spec := range []string{"", "* * * *", "60 * * * *", "* 24 * * *", "* * 0 * *", "*/0 * * * *", "5-1 * * * *", "@every -1s", "@sometimes"} {
+		if _, err := cron.Parse(spec); err == nil {
+			t.Errorf("Parse(%q) should fail", spec)
+		}
+	}
+}
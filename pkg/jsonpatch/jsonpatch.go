@@ -0,0 +1,346 @@
+// Package jsonpatch applies RFC 6902 JSON Patch documents, addressing values
+// with RFC 6901 JSON Pointers.
+package jsonpatch
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Operation is a single step of a patch.
+type Operation struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path"`
+	From  string          `json:"from,omitempty"`
+	Value json.RawMessage `json:"value,omitempty"`
+}
+
+// Patch is an ordered list of operations, applied all or nothing.
+type Patch []Operation
+
+// Decode parses and validates a patch document.
+func Decode(data []byte) (Patch, error) {
+	var patch Patch
+	if err := json.Unmarshal(data, &patch); err != nil {
+		return nil, fmt.Errorf("invalid json patch: %w", err)
+	}
+	for i, op := range patch {
+		if err := op.validate(); err != nil {
+			return nil, fmt.Errorf("invalid json patch operation %d: %w", i, err)
+		}
+	}
+	return patch, nil
+}
+
+func (op Operation) validate() error {
+	if _, err := parsePointer(op.Path); err != nil {
+		return err
+	}
+	switch op.Op {
+	case "add", "replace", "test":
+		if op.Value == nil {
+			return fmt.Errorf("'%s' requires a value", op.Op)
+		}
+	case "remove":
+	case "move", "copy":
+		if _, err := parsePointer(op.From); err != nil {
+			return fmt.Errorf("invalid from: %w", err)
+		}
+	default:
+		return fmt.Errorf("unknown op '%s'", op.Op)
+	}
+	return nil
+}
+
+// Apply applies the patch to the JSON document and returns the result. If any
+// operation fails, including a failed test, the whole patch fails.
+func (p Patch) Apply(document []byte) ([]byte, error) {
+	doc, err := decodeValue(document)
+	if err != nil {
+		return nil, fmt.Errorf("invalid json document: %w", err)
+	}
+	for i, op := range p {
+		if doc, err = op.apply(doc); err != nil {
+			return nil, fmt.Errorf("operation %d (%s %s): %w", i, op.Op, op.Path, err)
+		}
+	}
+	return json.Marshal(doc)
+}
+
+func (op Operation) apply(doc any) (any, error) {
+	path, err := parsePointer(op.Path)
+	if err != nil {
+		return nil, err
+	}
+	switch op.Op {
+	case "add", "replace", "test":
+		value, err := decodeValue(op.Value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value: %w", err)
+		}
+		switch op.Op {
+		case "add":
+			return add(doc, path, value)
+		case "replace":
+			return replace(doc, path, value)
+		}
+		current, err := get(doc, path)
+		if err != nil {
+			return nil, err
+		}
+		if !equal(current, value) {
+			return nil, errors.New("test failed")
+		}
+		return doc, nil
+	case "remove":
+		doc, _, err = remove(doc, path)
+		return doc, err
+	case "move", "copy":
+		from, err := parsePointer(op.From)
+		if err != nil {
+			return nil, err
+		}
+		if op.Op == "copy" {
+			value, err := get(doc, from)
+			if err != nil {
+				return nil, err
+			}
+			return add(doc, path, deepCopy(value))
+		}
+		if op.From == op.Path {
+			return doc, nil
+		}
+		if strings.HasPrefix(op.Path, op.From+"/") {
+			return nil, errors.New("cannot move a value into one of its children")
+		}
+		doc, value, err := remove(doc, from)
+		if err != nil {
+			return nil, err
+		}
+		return add(doc, path, value)
+	default:
+		return nil, fmt.Errorf("unknown op '%s'", op.Op)
+	}
+}
+
+var unescape = strings.NewReplacer("~1", "/", "~0", "~")
+
+// parsePointer splits an RFC 6901 pointer into its unescaped reference tokens.
+// The empty pointer refers to the whole document.
+func parsePointer(pointer string) ([]string, error) {
+	if pointer == "" {
+		return nil, nil
+	}
+	if pointer[0] != '/' {
+		return nil, fmt.Errorf("json pointer '%s' must start with '/'", pointer)
+	}
+	tokens := strings.Split(pointer[1:], "/")
+	for i, token := range tokens {
+		tokens[i] = unescape.Replace(token)
+	}
+	return tokens, nil
+}
+
+func get(doc any, path []string) (any, error) {
+	for _, token := range path {
+		switch node := doc.(type) {
+		case map[string]any:
+			value, ok := node[token]
+			if !ok {
+				return nil, fmt.Errorf("member '%s' not found", token)
+			}
+			doc = value
+		case []any:
+			i, err := index(token, len(node)-1)
+			if err != nil {
+				return nil, err
+			}
+			doc = node[i]
+		default:
+			return nil, fmt.Errorf("cannot reference '%s' in a scalar", token)
+		}
+	}
+	return doc, nil
+}
+
+// update replaces the container holding the last token of path with what fn
+// returns, and gives back the new document. Arrays may change length, so every
+// container on the way is stored again in its parent.
+func update(doc any, path []string, fn func(container any, token string) (any, error)) (any, error) {
+	if len(path) == 1 {
+		return fn(doc, path[0])
+	}
+	child, err := get(doc, path[:1])
+	if err != nil {
+		return nil, err
+	}
+	if child, err = update(child, path[1:], fn); err != nil {
+		return nil, err
+	}
+	switch node := doc.(type) {
+	case map[string]any:
+		node[path[0]] = child
+	case []any:
+		i, _ := index(path[0], len(node)-1)
+		node[i] = child
+	}
+	return doc, nil
+}
+
+func add(doc any, path []string, value any) (any, error) {
+	if len(path) == 0 {
+		return value, nil
+	}
+	return update(doc, path, func(container any, token string) (any, error) {
+		switch node := container.(type) {
+		case map[string]any:
+			node[token] = value
+			return node, nil
+		case []any:
+			i := len(node)
+			if token != "-" {
+				var err error
+				if i, err = index(token, len(node)); err != nil {
+					return nil, err
+				}
+			}
+			node = append(node, nil)
+			copy(node[i+1:], node[i:])
+			node[i] = value
+			return node, nil
+		default:
+			return nil, fmt.Errorf("cannot add '%s' to a scalar", token)
+		}
+	})
+}
+
+func replace(doc any, path []string, value any) (any, error) {
+	if len(path) == 0 {
+		return value, nil
+	}
+	if _, err := get(doc, path); err != nil {
+		return nil, err
+	}
+	return update(doc, path, func(container any, token string) (any, error) {
+		switch node := container.(type) {
+		case map[string]any:
+			node[token] = value
+		case []any:
+			i, _ := index(token, len(node)-1)
+			node[i] = value
+		}
+		return container, nil
+	})
+}
+
+// remove deletes the value at path and returns it along with the new document.
+func remove(doc any, path []string) (any, any, error) {
+	if len(path) == 0 {
+		return nil, nil, errors.New("cannot remove the whole document")
+	}
+	removed, err := get(doc, path)
+	if err != nil {
+		return nil, nil, err
+	}
+	doc, err = update(doc, path, func(container any, token string) (any, error) {
+		switch node := container.(type) {
+		case map[string]any:
+			delete(node, token)
+			return node, nil
+		case []any:
+			i, _ := index(token, len(node)-1)
+			return append(node[:i], node[i+1:]...), nil
+		}
+		return container, nil
+	})
+	return doc, removed, err
+}
+
+// index parses an array index token, which must not exceed last.
+func index(token string, last int) (int, error) {
+	if token == "" || (len(token) > 1 && token[0] == '0') || strings.Trim(token, "0123456789") != "" {
+		return 0, fmt.Errorf("invalid array index '%s'", token)
+	}
+	i, err := strconv.Atoi(token)
+	if err != nil {
+		return 0, fmt.Errorf("invalid array index '%s'", token)
+	}
+	if i > last {
+		return 0, fmt.Errorf("array index %d out of bounds", i)
+	}
+	return i, nil
+}
+
+// numbers are kept as json.Number so large integers survive a round trip.
+func decodeValue(data []byte) (any, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var value any
+	if err := dec.Decode(&value); err != nil {
+		return nil, err
+	}
+	if dec.More() {
+		return nil, errors.New("unexpected data after the value")
+	}
+	return value, nil
+}
+
+func equal(a, b any) bool {
+	switch a := a.(type) {
+	case map[string]any:
+		b, ok := b.(map[string]any)
+		if !ok || len(a) != len(b) {
+			return false
+		}
+		for k, v := range a {
+			if w, ok := b[k]; !ok || !equal(v, w) {
+				return false
+			}
+		}
+		return true
+	case []any:
+		b, ok := b.([]any)
+		if !ok || len(a) != len(b) {
+			return false
+		}
+		for i := range a {
+			if !equal(a[i], b[i]) {
+				return false
+			}
+		}
+		return true
+	case json.Number:
+		b, ok := b.(json.Number)
+		if !ok {
+			return false
+		}
+		x, errA := a.Float64()
+		y, errB := b.Float64()
+		return errA == nil && errB == nil && x == y
+	default:
+		return a == b
+	}
+}
+
+func deepCopy(value any) any {
+	switch v := value.(type) {
+	case map[string]any:
+		out := make(map[string]any, len(v))
+		for k, e := range v {
+			out[k] = deepCopy(e)
+		}
+		return out
+	case []any:
+		out := make([]any, len(v))
+		for i, e := range v {
+			out[i] = deepCopy(e)
+		}
+		return out
+	default:
+		return v
+	}
+}
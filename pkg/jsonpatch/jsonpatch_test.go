@@ -0,0 +1,77 @@
+package jsonpatch_test
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/a-essam23/go-dispatch/pkg/jsonpatch"
+)
+
+func TestApply(t *testing.T) {
+	tests := []struct {
+		name  string
+		doc   string
+		patch string
+		want  string // empty if the patch must fail
+	}{
+		{"add member", `{"foo":"bar"}`, `[{"op":"add","path":"/baz","value":"qux"}]`, `{"foo":"bar","baz":"qux"}`},
+		{"add array element", `{"foo":["bar","baz"]}`, `[{"op":"add","path":"/foo/1","value":"qux"}]`, `{"foo":["bar","qux","baz"]}`},
+		{"append", `{"foo":[1]}`, `[{"op":"add","path":"/foo/-","value":2}]`, `{"foo":[1,2]}`},
+		{"remove", `{"baz":"qux","foo":"bar"}`, `[{"op":"remove","path":"/baz"}]`, `{"foo":"bar"}`},
+		{"remove array element", `{"foo":["bar","qux","baz"]}`, `[{"op":"remove","path":"/foo/1"}]`, `{"foo":["bar","baz"]}`},
+		{"replace", `{"baz":"qux","foo":"bar"}`, `[{"op":"replace","path":"/baz","value":"boo"}]`, `{"baz":"boo","foo":"bar"}`},
+		{"move", `{"foo":{"bar":"baz","waldo":"fred"},"qux":{"corge":"grault"}}`, `[{"op":"move","from":"/foo/waldo","path":"/qux/thud"}]`, `{"foo":{"bar":"baz"},"qux":{"corge":"grault","thud":"fred"}}`},
+		{"move array element", `{"foo":["all","grass","cows","eat"]}`, `[{"op":"move","from":"/foo/1","path":"/foo/3"}]`, `{"foo":["all","cows","eat","grass"]}`},
+		{"copy", `{"a":{"b":1}}`, `[{"op":"copy","from":"/a","path":"/c"},{"op":"replace","path":"/c/b","value":2}]`, `{"a":{"b":1},"c":{"b":2}}`},
+		{"test passes", `{"n":1,"l":[1,"x"]}`, `[{"op":"test","path":"/n","value":1.0},{"op":"test","path":"/l","value":[1,"x"]}]`, `{"n":1,"l":[1,"x"]}`},
+		{"escaped pointer", `{"a/b":1,"m~n":2}`, `[{"op":"replace","path":"/a~1b","value":3},{"op":"remove","path":"/m~0n"}]`, `{"a/b":3}`},
+		{"replace root", `{"a":1}`, `[{"op":"replace","path":"","value":[1]}]`, `[1]`},
+		{"large integer survives", `{"id":9007199254740993}`, `[{"op":"add","path":"/x","value":true}]`, `{"id":9007199254740993,"x":true}`},
+		{"failed test aborts", `{"a":1}`, `[{"op":"add","path":"/b","value":2},{"op":"test","path":"/a","value":2}]`, ""},
+		{"remove missing", `{"a":1}`, `[{"op":"remove","path":"/b"}]`, ""},
+		{"replace missing", `{"a":1}`, `[{"op":"replace","path":"/b","value":1}]`, ""},
+		{"index out of bounds", `{"a":[1]}`, `[{"op":"add","path":"/a/2","value":1}]`, ""},
+		{"leading zero index", `{"a":[1,2]}`, `[{"op":"remove","path":"/a/01"}]`, ""},
+		{"missing parent", `{}`, `[{"op":"add","path":"/a/b","value":1}]`, ""},
+		{"move into child", `{"a":{"b":{}}}`, `[{"op":"move","from":"/a","path":"/a/b/c"}]`, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			patch, err := jsonpatch.Decode([]byte(tt.patch))
+			if err != nil {
+				t.Fatalf("Decode failed: %v", err)
+			}
+			got, err := patch.Apply([]byte(tt.doc))
+			if tt.want == "" {
+				if err == nil {
+					t.Fatalf("expected the patch to fail, got %s", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Apply failed: %v", err)
+			}
+			var want, have any
+			json.Unmarshal([]byte(tt.want), &want)
+			json.Unmarshal(got, &have)
+			if !reflect.DeepEqual(want, have) || (tt.name == "large integer survives" && string(got) != tt.want) {
+				t.Errorf("want %s, got %s", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestDecodeRejectsInvalidOperations(t *testing.T) {
+	for _, patch := range []string{
+		`{"op":"add"}`,
+		`[{"op":"frobnicate","path":"/a"}]`,
+		`[{"op":"add","path":"/a"}]`,
+		`[{"op":"remove","path":"a"}]`,
+		`[{"op":"move","path":"/a","from":"b"}]`,
+	} {
+		if _, err := jsonpatch.Decode([]byte(patch)); err == nil {
+			t.Errorf("expected %s to be rejected", patch)
+		}
+	}
+}
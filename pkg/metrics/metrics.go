@@ -0,0 +1,86 @@
+package metrics
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"sync/atomic"
+)
+
+// Counter is a monotonically increasing value. A nil Counter is a no-op,
+// so components can count unconditionally even when metrics are not wired.
+type Counter struct {
+	v atomic.Int64
+}
+
+func (c *Counter) Inc() {
+	c.Add(1)
+}
+
+func (c *Counter) Add(n int64) {
+	if c == nil {
+		return
+	}
+	c.v.Add(n)
+}
+
+func (c *Counter) Value() int64 {
+	if c == nil {
+		return 0
+	}
+	return c.v.Load()
+}
+
+// Registry holds named counters. It is safe for concurrent use.
+type Registry struct {
+	counters map[string]*Counter
+	mu       sync.RWMutex
+}
+
+func New() *Registry {
+	return &Registry{
+		counters: make(map[string]*Counter),
+	}
+}
+
+// Counter returns the counter registered under name, creating it on first use.
+// Calling it on a nil Registry returns a nil (no-op) Counter.
+func (r *Registry) Counter(name string) *Counter {
+	if r == nil {
+		return nil
+	}
+	r.mu.RLock()
+	c, ok := r.counters[name]
+	r.mu.RUnlock()
+	if ok {
+		return c
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if c, ok = r.counters[name]; !ok {
+		c = &Counter{}
+		r.counters[name] = c
+	}
+	return c
+}
+
+// Snapshot returns a copy of all counter values, keyed by name.
+func (r *Registry) Snapshot() map[string]int64 {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	snap := make(map[string]int64, len(r.counters))
+	for name, c := range r.counters {
+		snap[name] = c.Value()
+	}
+	return snap
+}
+
+// Handler serves the current snapshot as JSON.
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(r.Snapshot())
+	})
+}
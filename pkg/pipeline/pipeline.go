@@ -4,6 +4,7 @@ import (
 	"context"
 	"encoding/json"
 	"log/slog"
+	"time"
 
 	"github.com/a-essam23/go-dispatch/pkg/state"
 	"github.com/golang-jwt/jwt/v5"
@@ -14,7 +15,39 @@ import (
  * from the actual router
  */
 
+// Origin is what triggers a pipeline.
+type Origin int
+
+const (
+	// a client message, from a user's connection.
+	OriginClient Origin = iota
+	// the server itself: schedules and the admin API. There is no connection,
+	// and a user only if the run was scheduled by one.
+	OriginSystem
+)
+
+func (o Origin) String() string {
+	if o == OriginSystem {
+		return "system"
+	}
+	return "client"
+}
+
+// Encoding is how values resolved into a param's template are encoded.
+type Encoding int
+
+const (
+	// pasted in as they are.
+	EncodeNone Encoding = iota
+	// a JSON template: values are JSON-encoded, so they cannot add fields.
+	EncodeJSON
+	// a URL path: values are escaped as a path segment, or as a query value
+	// after a '?', so they cannot add segments, query params or a fragment.
+	EncodePath
+)
+
 type Cargo struct {
+	Origin       Origin
 	Logger       *slog.Logger
 	Ctx          context.Context
 	User         *state.User
@@ -22,11 +55,34 @@ type Cargo struct {
 	StateManager state.Manager
 	Payload      json.RawMessage
 	EventName    string
+	// the client's optional correlation id for the message, echoed in replies.
+	RequestID string
 
 	TargetObject any
 	TargetID     string
 
 	TokenClaims jwt.MapClaims
+
+	// set by the coalesce modifier; nil sends every notification as is.
+	Coalesce *Coalescing
+	// set by the receipts modifier; nil sends notifications untracked.
+	Receipts *ReceiptTracking
+	// the JSON response of the last synchronous _webhook, read by {$webhook.*}.
+	Webhook json.RawMessage
+}
+
+// Coalescing makes notifications keep only the latest undelivered value per
+// key (event name, target room and Key) in each connection's outbound queue.
+type Coalescing struct {
+	Key string
+	// Throttle, when positive, flushes a key to a room at most once per interval.
+	Throttle time.Duration
+}
+
+// ReceiptTracking gives notifications a message ID and keeps their delivery
+// and read receipts for Retention.
+type ReceiptTracking struct {
+	Retention time.Duration
 }
 
 type ActionFunc func(pctx *Cargo, params ...string) error
@@ -36,6 +92,9 @@ type ModifierFunc func(pctx *Cargo, params ...string) error
 type Step struct {
 	Function ActionFunc
 	Params   []string // Raw template strings from YAML
+	// how values resolved into params are encoded, by index; EncodeNone for
+	// params not in it.
+	Encodings map[int]Encoding
 }
 
 type ModifierStep struct {
@@ -44,6 +103,8 @@ type ModifierStep struct {
 }
 
 type CompiledPipeline struct {
+	// OriginSystem pipelines cannot be triggered by clients.
+	Origin    Origin
 	Modifiers []ModifierStep
 	Actions   []Step
 }
@@ -1,13 +1,16 @@
 package state
 
 import (
+	"time"
+
+	"github.com/a-essam23/go-dispatch/pkg/jsonpatch"
 	"github.com/a-essam23/go-dispatch/pkg/transport"
 	"github.com/google/uuid"
 )
 
 type Manager interface {
 	// --- Connection Lifecycle ---
-	RegisterConnection(conn *transport.Connection, ipAddr string) (*Connection, error)
+	RegisterConnection(conn transport.Conn, ipAddr string) (*Connection, error)
 	DeregisterConnection(connID uuid.UUID) error
 	GetConnection(connID uuid.UUID) (*Connection, bool)
 	FindOldestUserConnection(userID string) (*Connection, bool)
@@ -16,17 +19,72 @@ type Manager interface {
 	// links a connection to a user, creating the user if they don't exist.
 	AssociateUser(connID uuid.UUID, userID string, globalPerms Permission) (*User, error)
 	FindUser(userID string) (*User, bool)
-	GetUserConnections(userID string) ([]*transport.Connection, error)
+	GetUserConnections(userID string) ([]transport.Conn, error)
 	GetUserConnectionCount(userID string) (int, error)
 	GetAllUsers() ([]*User, error)
+	// calls fn with every user that has a connection, in batches of at most
+	// batchSize, holding no lock while fn runs. Users connecting meanwhile may
+	// be missed.
+	ForEachConnectedUser(batchSize int, fn func(batch []ConnectedUser))
+	// lists the IDs of the rooms the user is a member of.
+	GetUserRooms(userID string) ([]string, error)
+
+	// --- Presence ---
+	GetPresence(userID string) (Presence, bool)
+	// sets a connected user's status (online or away) and status text.
+	SetPresence(userID string, status PresenceStatus, text string) (Presence, error)
+	// registers the handler told about every presence change.
+	SetPresenceHandler(handler PresenceHandler)
 
 	// --- Room & Membership Management ---
-	// adds a user to a room, creating the room if it doesn't exist.
-	Join(userID, roomID string, grants *Grant) (*Grant, error)
+	// adds a user to a room, creating the room if it doesn't exist. The join must
+	// satisfy the room's class; auth holds what the join presents, if anything.
+	Join(userID, roomID string, auth *JoinAuth) (*Grant, error)
 	Leave(userID, roomID string) error
 	GetRoomMembers(roomID string) ([]*User, error)
 	FindRoom(roomID string) (*Room, bool)
 
+	// --- Room Hierarchy ---
+	// resolves a room pattern (see IsRoomPattern) to the IDs of the existing
+	// rooms it matches, sorted.
+	MatchRooms(pattern string) []string
+	// subscribes a user to the notifications of every room matching pattern,
+	// including rooms created later.
+	Subscribe(userID, pattern string) error
+	Unsubscribe(userID, pattern string) error
+	GetSubscriptions(userID string) []string
+	// lists the users subscribed to a pattern that roomID matches.
+	GetSubscribers(roomID string) []string
+	// reports whether the user is a member of an existing room, or could join
+	// it on their own: without a token or invite, and regardless of its member limit.
+	CanJoin(userID, roomID string) bool
+
+	// --- Room State ---
+	GetRoomState(roomID string) (RoomState, error)
+	// applies a JSON patch to the room's {"meta": ..., "data": ...} document, all
+	// or nothing, and returns the new state. If expected is not nil, the room
+	// must still be at that version.
+	PatchRoomState(roomID string, patch jsonpatch.Patch, expected *uint64) (RoomState, error)
+
+	// --- Invitations ---
+	// records a pending invite or join request to an existing room, replacing
+	// the pending one of the same kind for the same user and room.
+	PutInvite(invite Invite) error
+	// returns the pending invite of kind for userID to roomID, unless it expired.
+	GetInvite(kind InviteKind, roomID, userID string) (Invite, bool)
+	DeleteInvite(kind InviteKind, roomID, userID string)
+	// lists the pending invites and join requests of roomID, or of every room
+	// if roomID is empty.
+	ListInvites(roomID string) []Invite
+
+	// --- Receipts ---
+	// starts tracking the receipts of a sent message until it expires.
+	TrackMessage(receipt Receipt) error
+	// records that a recipient got the message, or read it, which implies they
+	// got it. It returns the updated receipt and whether anything changed.
+	AckMessage(messageID, userID string, status ReceiptStatus, at time.Time) (Receipt, bool, error)
+	GetReceipt(messageID string) (Receipt, bool)
+
 	// --- Permission Management ---
 	SetPermissions(userID, roomID string, perms Permission) error
 	UpdatePermissions(userID, roomID string, add, remove Permission) error
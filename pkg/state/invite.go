@@ -0,0 +1,25 @@
+package state
+
+import "time"
+
+type InviteKind string
+
+const (
+	// a room moderator invites a user.
+	InviteKindInvite InviteKind = "invite"
+	// a user asks the room's moderators to let them in.
+	InviteKindRequest InviteKind = "request"
+)
+
+// a pending invite, or join request, for one user to one room. Accepting an
+// invite, or approving a request, joins the user with Permissions.
+type Invite struct {
+	Kind        InviteKind `json:"kind"`
+	Room        string     `json:"room"`
+	UserID      string     `json:"userId"` // who would join
+	By          string     `json:"by"`     // who invited them, or the requester
+	Permissions Permission `json:"permissions,omitempty"`
+	Message     string     `json:"message,omitempty"`
+	CreatedAt   time.Time  `json:"createdAt"`
+	ExpiresAt   time.Time  `json:"expiresAt"`
+}
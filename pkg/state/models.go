@@ -1,6 +1,8 @@
 package state
 
 import (
+	"encoding/json"
+	"errors"
 	"time"
 
 	"github.com/a-essam23/go-dispatch/pkg/transport"
@@ -11,8 +13,8 @@ import (
 type Connection struct {
 	ID        uuid.UUID
 	IPAddress string
-	Transport *transport.Connection // The actual connection for sending messages
-	User      *User                 // Pointer to the owning user (nil until associated)
+	Transport transport.Conn // The actual connection for sending messages (WebSocket, SSE or long-poll)
+	User      *User          // Pointer to the owning user (nil until associated)
 	CreatedAt time.Time
 }
 
@@ -22,14 +24,69 @@ type User struct {
 	Connections       map[uuid.UUID]*Connection // All active connections for this user
 	Grants            map[string]*Grant         // This user's permissions in various rooms, keyed by RoomID
 	GlobalPermissions Permission
+	Presence          Presence
 }
 
+// a snapshot of a user and their open connections.
+type ConnectedUser struct {
+	ID                string
+	GlobalPermissions Permission
+	Conns             []transport.Conn
+}
+
+type PresenceStatus string
+
+const (
+	PresenceOnline  PresenceStatus = "online"
+	PresenceAway    PresenceStatus = "away"
+	PresenceOffline PresenceStatus = "offline"
+)
+
+// a user's presence. Online and offline follow the user's connections; away
+// and the status text are set by the user.
+type Presence struct {
+	Status   PresenceStatus `json:"status"`
+	Text     string         `json:"text,omitempty"`
+	LastSeen time.Time      `json:"lastSeen"` // when the user's last connection closed
+}
+
+// called after a user's presence changes, outside of any state lock.
+type PresenceHandler func(userID string, presence Presence)
+
 // canonical representation of a communication channel.
 type Room struct {
 	ID      string
 	Members map[string]*User // All users who are members of this room, keyed by UserID
+	Meta    RoomMeta
+	Data    json.RawMessage // The shared key-value document, always a JSON object
+	Version uint64          // Bumped by every change to Meta or Data
+}
+
+// a room's attributes. Owner and CreatedAt are set when the room is created and
+// are read-only.
+type RoomMeta struct {
+	Title     string          `json:"title"`
+	Topic     string          `json:"topic"`
+	Owner     string          `json:"owner"`
+	CreatedAt time.Time       `json:"createdAt"`
+	Custom    json.RawMessage `json:"custom"` // A JSON object for application attributes
 }
 
+// a snapshot of a room's attributes and shared document.
+type RoomState struct {
+	Room    string          `json:"room"`
+	Version uint64          `json:"version"`
+	Meta    RoomMeta        `json:"meta"`
+	Data    json.RawMessage `json:"data"`
+}
+
+var (
+	// returned when a room state change expects a version the room is no longer at.
+	ErrRoomVersionConflict = errors.New("room state version conflict")
+	// returned when a room state change would grow the document past its limit.
+	ErrRoomStateTooLarge = errors.New("room state is too large")
+)
+
 // represents the relationship between a User and a Room, holding the permissions.
 type Grant struct {
 	// User        *User
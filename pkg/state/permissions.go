@@ -4,9 +4,17 @@ package state
 type Permission uint64
 
 // our builtin permissions
-const ()
+const (
+	// may invite users to a room and answer its join requests.
+	PermModerate Permission = 1 << 0
+	// may send to every connected user.
+	PermBroadcast Permission = 1 << 1
+)
 
-var BuiltInPerms = map[string]Permission{}
+var BuiltInPerms = map[string]Permission{
+	"moderate":  PermModerate,
+	"broadcast": PermBroadcast,
+}
 
 func (p Permission) Has(flag Permission) bool {
 	return p&flag == flag
@@ -0,0 +1,35 @@
+package state
+
+import (
+	"errors"
+	"time"
+)
+
+type ReceiptStatus string
+
+const (
+	// the message reached one of the recipient's connections.
+	ReceiptDelivered ReceiptStatus = "delivered"
+	// the recipient read the message, which implies it was delivered.
+	ReceiptRead ReceiptStatus = "read"
+)
+
+// the delivery and read receipts of a tracked message, aggregated per
+// recipient and kept until ExpiresAt.
+type Receipt struct {
+	MessageID  string               `json:"id"`
+	Event      string               `json:"event"`
+	Sender     string               `json:"sender"`
+	Recipients []string             `json:"recipients"` // sorted user IDs, the sender excluded
+	Delivered  map[string]time.Time `json:"delivered"`
+	Read       map[string]time.Time `json:"read"`
+	SentAt     time.Time            `json:"sentAt"`
+	ExpiresAt  time.Time            `json:"expiresAt"`
+}
+
+var (
+	// returned when acknowledging a message that is not tracked, or no longer.
+	ErrReceiptNotFound = errors.New("message receipts not found")
+	// returned when a user acknowledges a message that was not sent to them.
+	ErrNotRecipient = errors.New("user is not a recipient of the message")
+)
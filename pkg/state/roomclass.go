@@ -0,0 +1,84 @@
+package state
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// who may join the rooms of a class.
+type JoinPolicy string
+
+const (
+	// anyone may join.
+	JoinOpen JoinPolicy = "open"
+	// only users invited to the room, and its owner: the user whose join created
+	// it, which takes an invite or the class's create permission.
+	JoinInviteOnly JoinPolicy = "invite-only"
+	// only joins authorized by a token for the room, validated by the secure modifier.
+	JoinTokenRequired JoinPolicy = "token-required"
+	// only users holding the class's global permission.
+	JoinPermissionRequired JoinPolicy = "permission-required"
+)
+
+func ParseJoinPolicy(s string) (JoinPolicy, error) {
+	switch p := JoinPolicy(s); p {
+	case "":
+		return JoinOpen, nil
+	case JoinOpen, JoinInviteOnly, JoinTokenRequired, JoinPermissionRequired:
+		return p, nil
+	default:
+		return "", fmt.Errorf("unknown join policy '%s' (want open, invite-only, token-required or permission-required)", s)
+	}
+}
+
+// the policy shared by every room whose ID matches Pattern. In a pattern, '*'
+// matches any run of characters, e.g. "dm:*" or "game:*:lobby".
+type RoomClass struct {
+	Name       string
+	Pattern    string
+	MaxMembers int // 0 means unlimited
+	Join       JoinPolicy
+	// required by JoinPermissionRequired, and to create a JoinInviteOnly room
+	// without an invite; see CreatePermission.
+	Permission Permission
+	// keep the room, and its state, once its last member leaves.
+	Persist bool
+	// how long a persisted room may stay empty before it is removed; 0 keeps it.
+	IdleTTL time.Duration
+}
+
+// the class of rooms that match no configured class.
+var DefaultRoomClass = RoomClass{Name: "default", Pattern: "*", Join: JoinOpen}
+
+func (c *RoomClass) Matches(roomID string) bool {
+	return GlobMatch(c.Pattern, roomID)
+}
+
+// CreatePermission is the global permission needed to create an invite-only
+// room of the class without an invite: its Permission, or PermModerate when
+// it has none.
+func (c *RoomClass) CreatePermission() Permission {
+	if c.Permission == 0 {
+		return PermModerate
+	}
+	return c.Permission
+}
+
+// what a join presents beyond the user's own permissions. A nil *JoinAuth
+// presents nothing.
+type JoinAuth struct {
+	// a token validated by the secure modifier authorizes joining this room.
+	Token bool
+	// an accepted invite, or approved join request, for this user and room. It
+	// overrides the join policy, though not the member limit, and its
+	// permissions are granted to the user in the room.
+	Invite *Invite
+}
+
+var (
+	// returned when joining a room that has reached its class's member limit.
+	ErrRoomFull = errors.New("room is full")
+	// returned when a join does not satisfy the room's join policy.
+	ErrJoinDenied = errors.New("join denied")
+)
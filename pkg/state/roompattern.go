@@ -0,0 +1,58 @@
+package state
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// RoomSeparator separates the levels of hierarchical room IDs, as in
+// "org:42/team:7/channel:3".
+const RoomSeparator = "/"
+
+// GlobMatch reports whether s matches pattern, where '*' matches any run of
+// characters, including none.
+func GlobMatch(pattern, s string) bool {
+	parts := strings.Split(pattern, "*")
+	if len(parts) == 1 {
+		return s == pattern
+	}
+	if !strings.HasPrefix(s, parts[0]) {
+		return false
+	}
+	rest := s[len(parts[0]):]
+	last := parts[len(parts)-1]
+	for _, part := range parts[1 : len(parts)-1] {
+		i := strings.Index(rest, part)
+		if i < 0 {
+			return false
+		}
+		rest = rest[i+len(part):]
+	}
+	return len(rest) >= len(last) && strings.HasSuffix(rest, last)
+}
+
+// IsRoomPattern reports whether target names a set of rooms rather than one.
+// In a room pattern, a "**" level matches any number of levels, including
+// none, and '*' within a level matches any run of characters in that level:
+// "org:42/**" is org:42 and every room below it, "org:42/team:*" its teams.
+func IsRoomPattern(target string) bool {
+	return strings.Contains(target, "*")
+}
+
+// ValidateRoomPattern checks that a room ID or pattern has no empty levels,
+// and that "**" only appears as a whole level.
+func ValidateRoomPattern(pattern string) error {
+	if pattern == "" {
+		return errors.New("room pattern cannot be empty")
+	}
+	for _, level := range strings.Split(pattern, RoomSeparator) {
+		if level == "" {
+			return fmt.Errorf("room pattern '%s' has an empty level", pattern)
+		}
+		if level != "**" && strings.Contains(level, "**") {
+			return fmt.Errorf("room pattern '%s': '**' must be a whole level", pattern)
+		}
+	}
+	return nil
+}
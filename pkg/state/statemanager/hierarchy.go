@@ -0,0 +1,92 @@
+package statemanager
+
+import (
+	"errors"
+	"slices"
+
+	"github.com/a-essam23/go-dispatch/pkg/state"
+)
+
+func (m *InMemoryManager) MatchRooms(pattern string) []string {
+	m.roomMu.RLock()
+	defer m.roomMu.RUnlock()
+	return sortedKeys(m.roomIndex.match(pattern))
+}
+
+func (m *InMemoryManager) Subscribe(userID, pattern string) error {
+	if err := state.ValidateRoomPattern(pattern); err != nil {
+		return err
+	}
+	if _, ok := m.FindUser(userID); !ok {
+		return errors.New("user not found")
+	}
+
+	m.subMu.Lock()
+	defer m.subMu.Unlock()
+	patterns, ok := m.userSubs[userID]
+	if !ok {
+		patterns = make(map[string]struct{})
+		m.userSubs[userID] = patterns
+	}
+	patterns[pattern] = struct{}{}
+	m.subs.insert(pattern, userID)
+	m.logger.Debug("User subscribed", "userID", userID, "pattern", pattern)
+	return nil
+}
+
+func (m *InMemoryManager) Unsubscribe(userID, pattern string) error {
+	m.subMu.Lock()
+	defer m.subMu.Unlock()
+	if _, ok := m.userSubs[userID][pattern]; !ok {
+		return errors.New("not subscribed to this pattern")
+	}
+	delete(m.userSubs[userID], pattern)
+	if len(m.userSubs[userID]) == 0 {
+		delete(m.userSubs, userID)
+	}
+	m.subs.remove(pattern, userID)
+	return nil
+}
+
+func (m *InMemoryManager) GetSubscriptions(userID string) []string {
+	m.subMu.RLock()
+	defer m.subMu.RUnlock()
+	return sortedKeys(m.userSubs[userID])
+}
+
+func (m *InMemoryManager) GetSubscribers(roomID string) []string {
+	m.subMu.RLock()
+	defer m.subMu.RUnlock()
+	return sortedKeys(m.subs.matchPatterns(roomID))
+}
+
+func (m *InMemoryManager) CanJoin(userID, roomID string) bool {
+	m.userMu.RLock()
+	defer m.userMu.RUnlock()
+	m.roomMu.RLock()
+	defer m.roomMu.RUnlock()
+
+	user, ok := m.users[userID]
+	if !ok {
+		return false
+	}
+	if _, member := user.Grants[roomID]; member {
+		return true
+	}
+	room, ok := m.rooms[roomID]
+	if !ok {
+		return false
+	}
+	class := *m.classFor(roomID)
+	class.MaxMembers = 0
+	return checkJoin(&class, user, roomID, room, nil) == nil
+}
+
+func sortedKeys(set map[string]struct{}) []string {
+	keys := make([]string, 0, len(set))
+	for key := range set {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	return keys
+}
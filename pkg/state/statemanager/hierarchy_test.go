@@ -0,0 +1,79 @@
+package statemanager_test
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/a-essam23/go-dispatch/pkg/state"
+)
+
+func TestMatchRoomsResolvesHierarchicalPatterns(t *testing.T) {
+	m := newTestManager()
+	connectUsers(t, m, 0, "alice")
+	for _, roomID := range []string{"org:42", "org:42/team:7", "org:42/team:7/channel:3", "org:42/team:8/channel:1", "org:43/team:7", "lobby"} {
+		if _, err := m.Join("alice", roomID, nil); err != nil {
+			t.Fatalf("Join %s failed: %v", roomID, err)
+		}
+	}
+	if _, err := m.Join("alice", "org:*", nil); err == nil {
+		t.Error("a room ID with a wildcard was accepted")
+	}
+
+	tests := map[string][]string{
+		"org:42/**":             {"org:42", "org:42/team:7", "org:42/team:7/channel:3", "org:42/team:8/channel:1"},
+		"org:42/*":              {"org:42/team:7"},
+		"org:*/team:7":          {"org:42/team:7", "org:43/team:7"},
+		"**/channel:*":          {"org:42/team:7/channel:3", "org:42/team:8/channel:1"},
+		"org:42/**/channel:1":   {"org:42/team:8/channel:1"},
+		"org:42/team:7":         {"org:42/team:7"},
+		"org:44/**":             {},
+		"lob*":                  {"lobby"},
+		"org:42/team:7/channel": {},
+	}
+	for pattern, want := range tests {
+		if got := m.MatchRooms(pattern); !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: want %v, got %v", pattern, want, got)
+		}
+	}
+
+	m.Leave("alice", "org:42/team:7/channel:3")
+	if got := m.MatchRooms("org:42/team:7/**"); !reflect.DeepEqual(got, []string{"org:42/team:7"}) {
+		t.Errorf("a removed room is still indexed: %v", got)
+	}
+}
+
+func TestSubscriptionsMatchRoomsAndRespectJoinPolicies(t *testing.T) {
+	m := newTestManager()
+	m.SetRoomClasses([]state.RoomClass{{Name: "private", Pattern: "org:42/private*", Join: state.JoinInviteOnly}})
+	connectUsers(t, m, state.PermModerate, "alice")
+	connectUsers(t, m, 0, "bob", "carol")
+	m.Join("alice", "org:42/team:7", nil)
+	m.Join("alice", "org:42/private", nil)
+
+	for userID, pattern := range map[string]string{"bob": "org:42/**", "carol": "org:*/team:7"} {
+		if err := m.Subscribe(userID, pattern); err != nil {
+			t.Fatalf("Subscribe failed: %v", err)
+		}
+	}
+	if err := m.Subscribe("bob", "org:42/**x"); err == nil {
+		t.Error("a malformed pattern was accepted")
+	}
+
+	if got := m.GetSubscribers("org:42/team:7"); !reflect.DeepEqual(got, []string{"bob", "carol"}) {
+		t.Errorf("unexpected subscribers %v", got)
+	}
+	if got := m.GetSubscribers("org:42"); !reflect.DeepEqual(got, []string{"bob"}) {
+		t.Errorf("'**' should match the root of the subtree, got %v", got)
+	}
+	if !m.CanJoin("bob", "org:42/team:7") || m.CanJoin("bob", "org:42/private") || !m.CanJoin("alice", "org:42/private") {
+		t.Error("CanJoin does not follow the join policies")
+	}
+
+	m.Unsubscribe("bob", "org:42/**")
+	if got := m.GetSubscribers("org:42/team:7"); !reflect.DeepEqual(got, []string{"carol"}) {
+		t.Errorf("unsubscribing left %v", got)
+	}
+	if got := m.GetSubscriptions("bob"); len(got) != 0 {
+		t.Errorf("bob still has subscriptions %v", got)
+	}
+}
@@ -20,18 +20,63 @@ type InMemoryManager struct {
 	userMu sync.RWMutex
 	roomMu sync.RWMutex
 
+	// room classes, the idle expiry timers of empty rooms and the index of room
+	// IDs, guarded by roomMu.
+	roomClasses []state.RoomClass
+	roomTimers  map[string]*time.Timer
+	roomIndex   *roomTrie
+	// the largest a room's state document may grow, in bytes; 0 if unlimited.
+	roomStateLimit int
+
+	// room pattern subscriptions, indexed by pattern and by user.
+	subs     *roomTrie
+	userSubs map[string]map[string]struct{}
+	subMu    sync.RWMutex
+
 	mods   map[string]map[string]map[string]*state.ModifierState
 	modsMu sync.Mutex
 
+	invites  map[inviteKey]state.Invite
+	inviteMu sync.Mutex
+
+	receipts      map[string]*state.Receipt
+	receiptExpiry receiptExpiry
+	receiptMu     sync.Mutex
+
+	// presence, guarded by userMu.
+	presenceDebounce time.Duration
+	presenceHandler  state.PresenceHandler
+	offlineTimers    map[string]*time.Timer
+
 	logger *slog.Logger
 }
 
+// DefaultRoomStateLimit is the largest a room's state document may grow, in
+// bytes, unless SetRoomStateLimit says otherwise.
+const DefaultRoomStateLimit = 64 << 10
+
+// DefaultPresenceDebounce is how long a user without connections stays online,
+// so a quick reconnect (e.g. a page reload) does not flap their presence.
+const DefaultPresenceDebounce = 5 * time.Second
+
 func NewInMemoryManager(logger *slog.Logger) *InMemoryManager {
 	return &InMemoryManager{
-		conns:  make(map[uuid.UUID]*state.Connection),
-		users:  make(map[string]*state.User),
-		rooms:  make(map[string]*state.Room),
-		mods:   make(map[string]map[string]map[string]*state.ModifierState),
+		conns: make(map[uuid.UUID]*state.Connection),
+		users: make(map[string]*state.User),
+		rooms: make(map[string]*state.Room),
+		mods:  make(map[string]map[string]map[string]*state.ModifierState),
+
+		roomTimers:     make(map[string]*time.Timer),
+		roomIndex:      newRoomTrie(),
+		roomStateLimit: DefaultRoomStateLimit,
+		subs:           newRoomTrie(),
+		userSubs:       make(map[string]map[string]struct{}),
+		invites:        make(map[inviteKey]state.Invite),
+		receipts:       make(map[string]*state.Receipt),
+
+		presenceDebounce: DefaultPresenceDebounce,
+		offlineTimers:    make(map[string]*time.Timer),
+
 		logger: logger.With(slog.String("component", "state_manager_inmemory")),
 	}
 }
@@ -39,7 +84,7 @@ func NewInMemoryManager(logger *slog.Logger) *InMemoryManager {
 // compile-time check to ensure InMemoryManager implements Manager.
 var _ state.Manager = (*InMemoryManager)(nil)
 
-func (m *InMemoryManager) RegisterConnection(conn *transport.Connection, ipAddr string) (*state.Connection, error) {
+func (m *InMemoryManager) RegisterConnection(conn transport.Conn, ipAddr string) (*state.Connection, error) {
 	m.connMu.Lock()
 	defer m.connMu.Unlock()
 
@@ -73,11 +118,19 @@ func (m *InMemoryManager) DeregisterConnection(connID uuid.UUID) error {
 	// detach conn from user
 	if conn.User != nil {
 		m.userMu.Lock()
-		defer m.userMu.Unlock()
-
 		user := conn.User
 		delete(user.Connections, connID)
 		m.logger.Debug("Detached connection from user", slog.Any("connID", connID.String()), slog.Any("userID", user.ID))
+
+		var notify func()
+		if len(user.Connections) == 0 {
+			user.Presence.LastSeen = time.Now()
+			notify = m.scheduleOffline(user)
+		}
+		m.userMu.Unlock()
+		if notify != nil {
+			notify()
+		}
 	}
 	m.logger.Debug("Connection deregistered", "connID", connID.String())
 	return nil
@@ -130,6 +183,14 @@ func (m *InMemoryManager) FindOldestUserConnection(userID string) (*state.Connec
 // --- User Management ---
 
 func (m *InMemoryManager) AssociateUser(connID uuid.UUID, userID string, globalPerms state.Permission) (*state.User, error) {
+	// deferred first so it runs after the locks below are released.
+	var notify func()
+	defer func() {
+		if notify != nil {
+			notify()
+		}
+	}()
+
 	m.connMu.Lock()
 	defer m.connMu.Unlock()
 	m.userMu.Lock()
@@ -155,6 +216,9 @@ func (m *InMemoryManager) AssociateUser(connID uuid.UUID, userID string, globalP
 	user.GlobalPermissions = globalPerms
 	conn.User = user
 	user.Connections[connID] = conn
+	if len(user.Connections) == 1 {
+		notify = m.cameOnline(user)
+	}
 
 	m.logger.Debug("Associated connection with user", slog.Any("connID", connID.String()), slog.Any("userID", userID))
 	return user, nil
@@ -167,7 +231,7 @@ func (m *InMemoryManager) FindUser(userID string) (*state.User, bool) {
 	return user, ok
 }
 
-func (m *InMemoryManager) GetUserConnections(userID string) ([]*transport.Connection, error) {
+func (m *InMemoryManager) GetUserConnections(userID string) ([]transport.Conn, error) {
 	m.userMu.RLock()
 	defer m.userMu.RUnlock()
 
@@ -176,13 +240,28 @@ func (m *InMemoryManager) GetUserConnections(userID string) ([]*transport.Connec
 		return nil, errors.New("user not found")
 	}
 
-	conns := make([]*transport.Connection, 0, len(user.Connections))
+	conns := make([]transport.Conn, 0, len(user.Connections))
 	for _, c := range user.Connections {
 		conns = append(conns, c.Transport)
 	}
 	return conns, nil
 }
 
+func (m *InMemoryManager) GetUserRooms(userID string) ([]string, error) {
+	m.userMu.RLock()
+	defer m.userMu.RUnlock()
+
+	user, ok := m.users[userID]
+	if !ok {
+		return nil, errors.New("user not found")
+	}
+	rooms := make([]string, 0, len(user.Grants))
+	for roomID := range user.Grants {
+		rooms = append(rooms, roomID)
+	}
+	return rooms, nil
+}
+
 func (m *InMemoryManager) GetAllUsers() ([]*state.User, error) {
 	m.userMu.RLock()
 	defer m.userMu.RUnlock()
@@ -196,9 +275,41 @@ func (m *InMemoryManager) GetAllUsers() ([]*state.User, error) {
 	return users, nil
 }
 
+func (m *InMemoryManager) ForEachConnectedUser(batchSize int, fn func(batch []state.ConnectedUser)) {
+	if batchSize <= 0 {
+		batchSize = 1
+	}
+	m.userMu.RLock()
+	ids := make([]string, 0, len(m.users))
+	for id := range m.users {
+		ids = append(ids, id)
+	}
+	m.userMu.RUnlock()
+
+	for start := 0; start < len(ids); start += batchSize {
+		batch := make([]state.ConnectedUser, 0, batchSize)
+		m.userMu.RLock()
+		for _, id := range ids[start:min(start+batchSize, len(ids))] {
+			user, ok := m.users[id]
+			if !ok || len(user.Connections) == 0 {
+				continue
+			}
+			cu := state.ConnectedUser{ID: id, GlobalPermissions: user.GlobalPermissions, Conns: make([]transport.Conn, 0, len(user.Connections))}
+			for _, conn := range user.Connections {
+				cu.Conns = append(cu.Conns, conn.Transport)
+			}
+			batch = append(batch, cu)
+		}
+		m.userMu.RUnlock()
+		if len(batch) > 0 {
+			fn(batch)
+		}
+	}
+}
+
 // --- Room & Membership Management ---
 
-func (m *InMemoryManager) Join(userID, roomID string, grants *state.Grant) (*state.Grant, error) {
+func (m *InMemoryManager) Join(userID, roomID string, auth *state.JoinAuth) (*state.Grant, error) {
 	// Lock users and rooms to ensure atomic joining.
 	m.userMu.Lock()
 	defer m.userMu.Unlock()
@@ -209,28 +320,35 @@ func (m *InMemoryManager) Join(userID, roomID string, grants *state.Grant) (*sta
 	if !ok {
 		return nil, errors.New("cannot join room: user not found")
 	}
+	if state.IsRoomPattern(roomID) {
+		return nil, errors.New("cannot join room: room IDs cannot contain '*'")
+	}
 
 	// If the user is already in the room, just return the existing grant.
 	if grant, exists := user.Grants[roomID]; exists {
 		return grant, nil
 	}
 
-	// Find or create the room.
+	// Enforce the room's class before finding or creating the room.
 	room, exists := m.rooms[roomID]
+	if err := checkJoin(m.classFor(roomID), user, roomID, room, auth); err != nil {
+		return nil, err
+	}
 	if !exists {
-		room = &state.Room{
-			ID:      roomID,
-			Members: make(map[string]*state.User),
-		}
+		room = newRoom(roomID, userID)
 		m.rooms[roomID] = room
+		m.roomIndex.insert(roomID, roomID)
 	}
+	m.cancelExpiry(roomID)
 
-	//TODO assign grants if attached.
 	grant := &state.Grant{
 		// User: user,
 		Room:        room,
 		Permissions: 0,
 	}
+	if auth != nil && auth.Invite != nil {
+		grant.Permissions = auth.Invite.Permissions
+	}
 
 	// Link all three canonical objects together.
 	user.Grants[roomID] = grant
@@ -268,10 +386,9 @@ func (m *InMemoryManager) Leave(userID string, roomID string) error {
 	delete(user.Grants, roomID)
 	delete(room.Members, userID)
 
-	// For memory hygiene, remove the room if it's now empty.
+	// For memory hygiene, remove the room if it's now empty, unless its class keeps it.
 	if len(room.Members) == 0 {
-		delete(m.rooms, roomID)
-		m.logger.Debug("Removed empty room", "roomID", roomID)
+		m.roomEmptied(room)
 	}
 
 	m.logger.Debug("User left room", "userID", userID, "roomID", roomID)
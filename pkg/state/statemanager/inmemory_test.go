@@ -1,7 +1,6 @@
 package statemanager_test
 
 import (
-	"context"
 	"log/slog"
 	"os"
 	"strconv"
@@ -11,7 +10,7 @@ import (
 
 	"github.com/a-essam23/go-dispatch/pkg/state"
 	"github.com/a-essam23/go-dispatch/pkg/state/statemanager"
-	"github.com/a-essam23/go-dispatch/pkg/transport"
+	"github.com/a-essam23/go-dispatch/pkg/transport/transporttest"
 )
 
 // --- Test Suite Setup ---
@@ -26,13 +25,8 @@ func newTestManager() *statemanager.InMemoryManager {
 	return statemanager.NewInMemoryManager(newTestLogger())
 }
 
-// CORRECTED HELPER FUNCTION
-func newTransportConn() *transport.Connection {
-	// We must provide a valid logger and waitgroup to the constructor.
-	// Since we don't use the actual conn or context, they can be nil.
-	logger := newTestLogger()
-	var wg sync.WaitGroup
-	return transport.NewConnection(context.Background(), &wg, nil, transport.ConnectionConfig{}, nil, nil, logger)
+func newTransportConn() *transporttest.Conn {
+	return transporttest.NewConn()
 }
 
 // --- Connection and User Management Tests ---
@@ -133,6 +127,36 @@ func TestFindOldestUserConnection(t *testing.T) {
 	}
 }
 
+func TestForEachConnectedUserBatches(t *testing.T) {
+	m := newTestManager()
+	for i := 0; i < 5; i++ {
+		conn := newTransportConn()
+		m.RegisterConnection(conn, "127.0.0.1")
+		m.AssociateUser(conn.ID(), "user-"+strconv.Itoa(i), 0)
+	}
+	// a user whose only connection closed is not connected.
+	gone := newTransportConn()
+	m.RegisterConnection(gone, "127.0.0.1")
+	m.AssociateUser(gone.ID(), "gone", 0)
+	m.DeregisterConnection(gone.ID())
+
+	seen := make(map[string]int)
+	m.ForEachConnectedUser(2, func(batch []state.ConnectedUser) {
+		if len(batch) > 2 {
+			t.Errorf("Expected batches of at most 2 users, got %d", len(batch))
+		}
+		for _, u := range batch {
+			seen[u.ID] += len(u.Conns)
+		}
+	})
+	if len(seen) != 5 {
+		t.Errorf("Expected 5 connected users, got %d: %v", len(seen), seen)
+	}
+	if _, ok := seen["gone"]; ok {
+		t.Error("A user without connections should be skipped")
+	}
+}
+
 // --- Room Management Tests ---
 
 func TestRoomMembership(t *testing.T) {
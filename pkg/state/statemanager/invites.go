@@ -0,0 +1,85 @@
+package statemanager
+
+import (
+	"errors"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/a-essam23/go-dispatch/pkg/state"
+)
+
+type inviteKey struct {
+	kind   state.InviteKind
+	roomID string
+	userID string
+}
+
+func (m *InMemoryManager) PutInvite(invite state.Invite) error {
+	if !invite.ExpiresAt.After(time.Now()) {
+		return errors.New("invite has already expired")
+	}
+	if _, ok := m.FindRoom(invite.Room); !ok {
+		return errors.New("room not found")
+	}
+
+	m.inviteMu.Lock()
+	defer m.inviteMu.Unlock()
+	// expired invites are only ever dropped lazily.
+	m.pruneInvites(time.Now())
+	m.invites[inviteKey{invite.Kind, invite.Room, invite.UserID}] = invite
+	m.logger.Debug("Invite recorded", "kind", invite.Kind, "roomID", invite.Room, "userID", invite.UserID)
+	return nil
+}
+
+func (m *InMemoryManager) GetInvite(kind state.InviteKind, roomID, userID string) (state.Invite, bool) {
+	m.inviteMu.Lock()
+	defer m.inviteMu.Unlock()
+
+	key := inviteKey{kind, roomID, userID}
+	invite, ok := m.invites[key]
+	if !ok {
+		return state.Invite{}, false
+	}
+	if !invite.ExpiresAt.After(time.Now()) {
+		delete(m.invites, key)
+		return state.Invite{}, false
+	}
+	return invite, true
+}
+
+func (m *InMemoryManager) DeleteInvite(kind state.InviteKind, roomID, userID string) {
+	m.inviteMu.Lock()
+	delete(m.invites, inviteKey{kind, roomID, userID})
+	m.inviteMu.Unlock()
+}
+
+// ListInvites returns the oldest first.
+func (m *InMemoryManager) ListInvites(roomID string) []state.Invite {
+	m.inviteMu.Lock()
+	defer m.inviteMu.Unlock()
+
+	m.pruneInvites(time.Now())
+	invites := make([]state.Invite, 0)
+	for _, invite := range m.invites {
+		if roomID == "" || invite.Room == roomID {
+			invites = append(invites, invite)
+		}
+	}
+	slices.SortFunc(invites, func(a, b state.Invite) int {
+		if c := a.CreatedAt.Compare(b.CreatedAt); c != 0 {
+			return c
+		}
+		return strings.Compare(a.UserID, b.UserID)
+	})
+	return invites
+}
+
+// pruneInvites drops every invite expired by now. Must be called with inviteMu held.
+func (m *InMemoryManager) pruneInvites(now time.Time) {
+	for key, invite := range m.invites {
+		if !invite.ExpiresAt.After(now) {
+			delete(m.invites, key)
+		}
+	}
+}
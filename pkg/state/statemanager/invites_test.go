@@ -0,0 +1,74 @@
+package statemanager_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/a-essam23/go-dispatch/pkg/state"
+)
+
+func TestInvitesExpireAndAreListed(t *testing.T) {
+	m := newTestManager()
+	connectUsers(t, m, 0, "alice")
+	m.Join("alice", "lobby", nil)
+
+	now := time.Now()
+	invite := state.Invite{Kind: state.InviteKindInvite, Room: "lobby", UserID: "bob", By: "alice", CreatedAt: now, ExpiresAt: now.Add(time.Hour)}
+	if err := m.PutInvite(invite); err != nil {
+		t.Fatalf("PutInvite failed: %v", err)
+	}
+	short := state.Invite{Kind: state.InviteKindRequest, Room: "lobby", UserID: "carol", By: "carol", CreatedAt: now.Add(time.Millisecond), ExpiresAt: now.Add(30 * time.Millisecond)}
+	if err := m.PutInvite(short); err != nil {
+		t.Fatalf("PutInvite failed: %v", err)
+	}
+	if err := m.PutInvite(state.Invite{Kind: state.InviteKindInvite, Room: "nowhere", UserID: "bob", ExpiresAt: now.Add(time.Hour)}); err == nil {
+		t.Error("an invite to a room that does not exist was recorded")
+	}
+
+	if got, ok := m.GetInvite(state.InviteKindInvite, "lobby", "bob"); !ok || got.By != "alice" {
+		t.Errorf("expected bob's invite, got %+v, %v", got, ok)
+	}
+	if _, ok := m.GetInvite(state.InviteKindRequest, "lobby", "bob"); ok {
+		t.Error("an invite was returned as a join request")
+	}
+	if got := m.ListInvites(""); len(got) != 2 || got[0].UserID != "bob" || got[1].UserID != "carol" {
+		t.Errorf("expected both invites oldest first, got %+v", got)
+	}
+
+	time.Sleep(40 * time.Millisecond)
+	if _, ok := m.GetInvite(state.InviteKindRequest, "lobby", "carol"); ok {
+		t.Error("an expired join request was returned")
+	}
+	if got := m.ListInvites("lobby"); len(got) != 1 {
+		t.Errorf("expected the expired request to be dropped, got %+v", got)
+	}
+	m.DeleteInvite(state.InviteKindInvite, "lobby", "bob")
+	if got := m.ListInvites(""); len(got) != 0 {
+		t.Errorf("expected no invites left, got %+v", got)
+	}
+}
+
+func TestInviteOverridesJoinPolicyAndGrantsPermissions(t *testing.T) {
+	m := newTestManager()
+	m.SetRoomClasses([]state.RoomClass{{Name: "private", Pattern: "private:*", MaxMembers: 2, Join: state.JoinInviteOnly}})
+	connectUsers(t, m, state.PermModerate, "alice")
+	connectUsers(t, m, 0, "bob", "carol")
+	m.Join("alice", "private:1", nil)
+
+	invite := &state.Invite{Kind: state.InviteKindInvite, Room: "private:1", UserID: "bob", Permissions: state.PermModerate}
+	if _, err := m.Join("carol", "private:1", &state.JoinAuth{Invite: invite}); !errors.Is(err, state.ErrJoinDenied) {
+		t.Errorf("expected bob's invite not to let carol in, got %v", err)
+	}
+	grant, err := m.Join("bob", "private:1", &state.JoinAuth{Invite: invite})
+	if err != nil {
+		t.Fatalf("expected the invite to let bob in, got %v", err)
+	}
+	if !grant.Permissions.Has(state.PermModerate) {
+		t.Error("the invite's permissions were not granted")
+	}
+	carolInvite := &state.Invite{Kind: state.InviteKindInvite, Room: "private:1", UserID: "carol"}
+	if _, err := m.Join("carol", "private:1", &state.JoinAuth{Invite: carolInvite}); !errors.Is(err, state.ErrRoomFull) {
+		t.Errorf("expected an invite not to override the member limit, got %v", err)
+	}
+}
@@ -0,0 +1,128 @@
+package statemanager
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/a-essam23/go-dispatch/pkg/state"
+)
+
+// SetPresenceDebounce sets how long a user stays online after their last
+// connection closes. Zero marks them offline at once.
+func (m *InMemoryManager) SetPresenceDebounce(d time.Duration) {
+	m.userMu.Lock()
+	m.presenceDebounce = d
+	m.userMu.Unlock()
+}
+
+func (m *InMemoryManager) SetPresenceHandler(handler state.PresenceHandler) {
+	m.userMu.Lock()
+	m.presenceHandler = handler
+	m.userMu.Unlock()
+}
+
+func (m *InMemoryManager) GetPresence(userID string) (state.Presence, bool) {
+	m.userMu.RLock()
+	defer m.userMu.RUnlock()
+	user, ok := m.users[userID]
+	if !ok {
+		return state.Presence{}, false
+	}
+	return user.Presence, true
+}
+
+func (m *InMemoryManager) SetPresence(userID string, status state.PresenceStatus, text string) (state.Presence, error) {
+	if status != state.PresenceOnline && status != state.PresenceAway {
+		return state.Presence{}, fmt.Errorf("cannot set presence to '%s': only online and away can be set", status)
+	}
+
+	m.userMu.Lock()
+	user, ok := m.users[userID]
+	if !ok {
+		m.userMu.Unlock()
+		return state.Presence{}, errors.New("user not found")
+	}
+	if len(user.Connections) == 0 {
+		m.userMu.Unlock()
+		return state.Presence{}, errors.New("cannot set presence of a user without connections")
+	}
+	if user.Presence.Status == status && user.Presence.Text == text {
+		p := user.Presence
+		m.userMu.Unlock()
+		return p, nil
+	}
+	user.Presence.Status = status
+	user.Presence.Text = text
+	notify := m.presenceChanged(user)
+	p := user.Presence
+	m.userMu.Unlock()
+
+	notify()
+	return p, nil
+}
+
+// cameOnline handles a user's first connection. A pending offline transition
+// is cancelled, so a quick reconnect goes unnoticed. Must be called with
+// userMu held; the returned func, if any, must be called after it is released.
+func (m *InMemoryManager) cameOnline(user *state.User) func() {
+	if timer, pending := m.offlineTimers[user.ID]; pending {
+		timer.Stop()
+		delete(m.offlineTimers, user.ID)
+		return nil
+	}
+	if user.Presence.Status == state.PresenceOnline || user.Presence.Status == state.PresenceAway {
+		return nil
+	}
+	user.Presence.Status = state.PresenceOnline
+	user.Presence.Text = ""
+	return m.presenceChanged(user)
+}
+
+// scheduleOffline handles a user's last connection closing: after the
+// debounce, if they have not reconnected, they go offline. Must be called with
+// userMu held; the returned func, if any, must be called after it is released.
+func (m *InMemoryManager) scheduleOffline(user *state.User) func() {
+	if m.presenceDebounce <= 0 {
+		return m.wentOffline(user)
+	}
+	if timer, pending := m.offlineTimers[user.ID]; pending {
+		timer.Stop()
+	}
+	m.offlineTimers[user.ID] = time.AfterFunc(m.presenceDebounce, func() {
+		m.userMu.Lock()
+		delete(m.offlineTimers, user.ID)
+		var notify func()
+		if len(user.Connections) == 0 {
+			notify = m.wentOffline(user)
+		}
+		m.userMu.Unlock()
+		if notify != nil {
+			notify()
+		}
+	})
+	return nil
+}
+
+// Must be called with userMu held.
+func (m *InMemoryManager) wentOffline(user *state.User) func() {
+	if user.Presence.Status == state.PresenceOffline {
+		return nil
+	}
+	user.Presence.Status = state.PresenceOffline
+	user.Presence.Text = ""
+	return m.presenceChanged(user)
+}
+
+// presenceChanged captures the change for the presence handler. Must be
+// called with userMu held; the returned func must be called after it is released.
+func (m *InMemoryManager) presenceChanged(user *state.User) func() {
+	handler, userID, p := m.presenceHandler, user.ID, user.Presence
+	m.logger.Debug("Presence changed", slog.String("userID", userID), slog.String("status", string(p.Status)))
+	return func() {
+		if handler != nil {
+			handler(userID, p)
+		}
+	}
+}
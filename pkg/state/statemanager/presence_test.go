@@ -0,0 +1,87 @@
+package statemanager_test
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/a-essam23/go-dispatch/pkg/state"
+)
+
+type presenceRecorder struct {
+	mu      sync.Mutex
+	changes []state.PresenceStatus
+}
+
+func (r *presenceRecorder) handle(_ string, p state.Presence) {
+	r.mu.Lock()
+	r.changes = append(r.changes, p.Status)
+	r.mu.Unlock()
+}
+
+func (r *presenceRecorder) get() []state.PresenceStatus {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]state.PresenceStatus(nil), r.changes...)
+}
+
+func TestPresenceFollowsConnectionsWithDebounce(t *testing.T) {
+	m := newTestManager()
+	m.SetPresenceDebounce(30 * time.Millisecond)
+	rec := &presenceRecorder{}
+	m.SetPresenceHandler(rec.handle)
+
+	conn := newTransportConn()
+	m.RegisterConnection(conn, "1.1.1.1")
+	m.AssociateUser(conn.ID(), "user-1", 0)
+	if p, _ := m.GetPresence("user-1"); p.Status != state.PresenceOnline {
+		t.Fatalf("expected online after connecting, got %q", p.Status)
+	}
+
+	// a quick reconnect goes unnoticed.
+	m.DeregisterConnection(conn.ID())
+	reconnect := newTransportConn()
+	m.RegisterConnection(reconnect, "1.1.1.1")
+	m.AssociateUser(reconnect.ID(), "user-1", 0)
+	time.Sleep(60 * time.Millisecond)
+	if got := rec.get(); len(got) != 1 {
+		t.Fatalf("expected a single online change across a quick reconnect, got %v", got)
+	}
+
+	m.DeregisterConnection(reconnect.ID())
+	time.Sleep(60 * time.Millisecond)
+	p, _ := m.GetPresence("user-1")
+	if p.Status != state.PresenceOffline || p.LastSeen.IsZero() {
+		t.Errorf("expected offline with a last-seen time, got %+v", p)
+	}
+	if got := rec.get(); len(got) != 2 || got[1] != state.PresenceOffline {
+		t.Errorf("expected online then offline, got %v", got)
+	}
+}
+
+func TestSetPresence(t *testing.T) {
+	m := newTestManager()
+	rec := &presenceRecorder{}
+	m.SetPresenceHandler(rec.handle)
+
+	conn := newTransportConn()
+	m.RegisterConnection(conn, "1.1.1.1")
+	m.AssociateUser(conn.ID(), "user-1", 0)
+
+	p, err := m.SetPresence("user-1", state.PresenceAway, "lunch")
+	if err != nil || p.Status != state.PresenceAway || p.Text != "lunch" {
+		t.Fatalf("SetPresence failed: %+v, %v", p, err)
+	}
+	// an unchanged presence is not reported again.
+	m.SetPresence("user-1", state.PresenceAway, "lunch")
+	if got := rec.get(); len(got) != 2 {
+		t.Errorf("expected online then away, got %v", got)
+	}
+
+	if _, err := m.SetPresence("user-1", state.PresenceOffline, ""); err == nil {
+		t.Error("expected offline to be rejected as it follows connections")
+	}
+	if _, err := m.SetPresence("nobody", state.PresenceAway, ""); err == nil {
+		t.Error("expected an unknown user to be rejected")
+	}
+}
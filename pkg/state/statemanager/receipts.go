@@ -0,0 +1,109 @@
+package statemanager
+
+import (
+	"container/heap"
+	"errors"
+	"maps"
+	"slices"
+	"time"
+
+	"github.com/a-essam23/go-dispatch/pkg/state"
+)
+
+// receiptExpiry orders tracked messages by when their receipts expire, so
+// pruning only looks at the ones that did.
+type receiptExpiry []*state.Receipt
+
+func (q receiptExpiry) Len() int           { return len(q) }
+func (q receiptExpiry) Less(i, j int) bool { return q[i].ExpiresAt.Before(q[j].ExpiresAt) }
+func (q receiptExpiry) Swap(i, j int)      { q[i], q[j] = q[j], q[i] }
+func (q *receiptExpiry) Push(x any)        { *q = append(*q, x.(*state.Receipt)) }
+func (q *receiptExpiry) Pop() any {
+	old := *q
+	r := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return r
+}
+
+func (m *InMemoryManager) TrackMessage(receipt state.Receipt) error {
+	if receipt.MessageID == "" {
+		return errors.New("message ID cannot be empty")
+	}
+	if !receipt.ExpiresAt.After(time.Now()) {
+		return errors.New("receipt has already expired")
+	}
+	r := cloneReceipt(receipt)
+	slices.Sort(r.Recipients)
+
+	m.receiptMu.Lock()
+	defer m.receiptMu.Unlock()
+	m.pruneReceipts(time.Now())
+	if _, exists := m.receipts[r.MessageID]; exists {
+		return errors.New("message is already tracked")
+	}
+	m.receipts[r.MessageID] = &r
+	heap.Push(&m.receiptExpiry, &r)
+	return nil
+}
+
+func (m *InMemoryManager) AckMessage(messageID, userID string, status state.ReceiptStatus, at time.Time) (state.Receipt, bool, error) {
+	if status != state.ReceiptDelivered && status != state.ReceiptRead {
+		return state.Receipt{}, false, errors.New("unknown receipt status '" + string(status) + "'")
+	}
+	m.receiptMu.Lock()
+	defer m.receiptMu.Unlock()
+	m.pruneReceipts(time.Now())
+
+	r, ok := m.receipts[messageID]
+	if !ok {
+		return state.Receipt{}, false, state.ErrReceiptNotFound
+	}
+	if _, found := slices.BinarySearch(r.Recipients, userID); !found {
+		return state.Receipt{}, false, state.ErrNotRecipient
+	}
+	changed := false
+	if _, done := r.Delivered[userID]; !done {
+		r.Delivered[userID] = at
+		changed = true
+	}
+	if _, done := r.Read[userID]; status == state.ReceiptRead && !done {
+		r.Read[userID] = at
+		changed = true
+	}
+	return cloneReceipt(*r), changed, nil
+}
+
+func (m *InMemoryManager) GetReceipt(messageID string) (state.Receipt, bool) {
+	m.receiptMu.Lock()
+	defer m.receiptMu.Unlock()
+	m.pruneReceipts(time.Now())
+
+	r, ok := m.receipts[messageID]
+	if !ok {
+		return state.Receipt{}, false
+	}
+	return cloneReceipt(*r), true
+}
+
+// pruneReceipts drops the receipts expired by now. Must be called with
+// receiptMu held.
+func (m *InMemoryManager) pruneReceipts(now time.Time) {
+	for len(m.receiptExpiry) > 0 && !m.receiptExpiry[0].ExpiresAt.After(now) {
+		r := heap.Pop(&m.receiptExpiry).(*state.Receipt)
+		delete(m.receipts, r.MessageID)
+	}
+}
+
+// cloneReceipt copies r so callers never share its maps or slices.
+func cloneReceipt(r state.Receipt) state.Receipt {
+	r.Recipients = slices.Clone(r.Recipients)
+	r.Delivered = maps.Clone(r.Delivered)
+	r.Read = maps.Clone(r.Read)
+	if r.Delivered == nil {
+		r.Delivered = make(map[string]time.Time)
+	}
+	if r.Read == nil {
+		r.Read = make(map[string]time.Time)
+	}
+	return r
+}
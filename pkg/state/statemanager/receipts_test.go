@@ -0,0 +1,47 @@
+package statemanager_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/a-essam23/go-dispatch/pkg/state"
+)
+
+func TestReceiptsAggregateAndExpire(t *testing.T) {
+	m := newTestManager()
+	now := time.Now()
+	receipt := state.Receipt{MessageID: "m1", Event: "new_message", Sender: "alice", Recipients: []string{"carol", "bob"}, SentAt: now, ExpiresAt: now.Add(30 * time.Millisecond)}
+	if err := m.TrackMessage(receipt); err != nil {
+		t.Fatalf("TrackMessage failed: %v", err)
+	}
+	if err := m.TrackMessage(receipt); err == nil {
+		t.Error("a message was tracked twice")
+	}
+
+	if _, _, err := m.AckMessage("m1", "dave", state.ReceiptDelivered, now); !errors.Is(err, state.ErrNotRecipient) {
+		t.Errorf("expected ErrNotRecipient, got %v", err)
+	}
+	got, changed, err := m.AckMessage("m1", "bob", state.ReceiptRead, now)
+	if err != nil || !changed {
+		t.Fatalf("AckMessage = %v, %v", changed, err)
+	}
+	if len(got.Delivered) != 1 || len(got.Read) != 1 {
+		t.Errorf("reading should imply delivery, got %+v", got)
+	}
+	if _, changed, _ := m.AckMessage("m1", "bob", state.ReceiptDelivered, now); changed {
+		t.Error("acknowledging delivery after reading should change nothing")
+	}
+	got.Read["carol"] = now
+	if stored, _ := m.GetReceipt("m1"); len(stored.Read) != 1 {
+		t.Error("a returned receipt shares its maps with the stored one")
+	}
+
+	time.Sleep(40 * time.Millisecond)
+	if _, _, err := m.AckMessage("m1", "carol", state.ReceiptDelivered, time.Now()); !errors.Is(err, state.ErrReceiptNotFound) {
+		t.Errorf("expected ErrReceiptNotFound once the retention passed, got %v", err)
+	}
+	if _, ok := m.GetReceipt("m1"); ok {
+		t.Error("an expired receipt is still returned")
+	}
+}
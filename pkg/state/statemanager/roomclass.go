@@ -0,0 +1,105 @@
+package statemanager
+
+import (
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/a-essam23/go-dispatch/pkg/state"
+)
+
+// SetRoomClasses sets the classes rooms are matched against, in order: a room
+// belongs to the first class whose pattern matches its ID, or to
+// state.DefaultRoomClass. It applies to joins and leaves from then on.
+func (m *InMemoryManager) SetRoomClasses(classes []state.RoomClass) {
+	m.roomMu.Lock()
+	m.roomClasses = classes
+	m.roomMu.Unlock()
+}
+
+// classFor returns the class of roomID. Must be called with roomMu held.
+func (m *InMemoryManager) classFor(roomID string) *state.RoomClass {
+	for i := range m.roomClasses {
+		if m.roomClasses[i].Matches(roomID) {
+			return &m.roomClasses[i]
+		}
+	}
+	return &state.DefaultRoomClass
+}
+
+// checkJoin enforces the class of the room on a user joining it. room is nil
+// if the join would create it. Must be called with userMu and roomMu held.
+func checkJoin(class *state.RoomClass, user *state.User, roomID string, room *state.Room, auth *state.JoinAuth) error {
+	if room != nil && class.MaxMembers > 0 && len(room.Members) >= class.MaxMembers {
+		return fmt.Errorf("%w: room '%s' of class '%s' allows at most %d members", state.ErrRoomFull, roomID, class.Name, class.MaxMembers)
+	}
+	if auth != nil && auth.Invite != nil {
+		if auth.Invite.Room != roomID || auth.Invite.UserID != user.ID {
+			return fmt.Errorf("%w: the invite is for user '%s' to room '%s'", state.ErrJoinDenied, auth.Invite.UserID, auth.Invite.Room)
+		}
+		return nil
+	}
+	switch class.Join {
+	case state.JoinInviteOnly:
+		if room == nil {
+			// so nobody can claim the room before the users it is meant for.
+			if !user.GlobalPermissions.Has(class.CreatePermission()) {
+				return fmt.Errorf("%w: creating room '%s' of class '%s' requires an invite or a permission user '%s' does not have", state.ErrJoinDenied, roomID, class.Name, user.ID)
+			}
+			return nil
+		}
+		// whoever creates the room owns it, and may always come back.
+		if room.Meta.Owner != user.ID {
+			return fmt.Errorf("%w: room '%s' of class '%s' is invite-only", state.ErrJoinDenied, roomID, class.Name)
+		}
+	case state.JoinTokenRequired:
+		if auth == nil || !auth.Token {
+			return fmt.Errorf("%w: room '%s' of class '%s' requires a token for the room", state.ErrJoinDenied, roomID, class.Name)
+		}
+	case state.JoinPermissionRequired:
+		if !user.GlobalPermissions.Has(class.Permission) {
+			return fmt.Errorf("%w: room '%s' of class '%s' requires a permission user '%s' does not have", state.ErrJoinDenied, roomID, class.Name, user.ID)
+		}
+	}
+	return nil
+}
+
+// roomEmptied decides the fate of a room whose last member left. Must be
+// called with roomMu held.
+func (m *InMemoryManager) roomEmptied(room *state.Room) {
+	class := m.classFor(room.ID)
+	if !class.Persist {
+		delete(m.rooms, room.ID)
+		m.roomIndex.remove(room.ID, room.ID)
+		m.logger.Debug("Removed empty room", "roomID", room.ID)
+		return
+	}
+	if class.IdleTTL > 0 {
+		m.roomTimers[room.ID] = time.AfterFunc(class.IdleTTL, func() {
+			m.expireRoom(room)
+		})
+	}
+}
+
+// expireRoom removes a persisted room that stayed empty for its idle TTL.
+func (m *InMemoryManager) expireRoom(room *state.Room) {
+	m.roomMu.Lock()
+	defer m.roomMu.Unlock()
+	// a join in the meantime may have kept or replaced the room.
+	if m.rooms[room.ID] != room || len(room.Members) > 0 {
+		return
+	}
+	delete(m.rooms, room.ID)
+	delete(m.roomTimers, room.ID)
+	m.roomIndex.remove(room.ID, room.ID)
+	m.logger.Debug("Removed idle room", slog.String("roomID", room.ID))
+}
+
+// cancelExpiry keeps an empty persisted room that is being joined again. Must
+// be called with roomMu held.
+func (m *InMemoryManager) cancelExpiry(roomID string) {
+	if timer, ok := m.roomTimers[roomID]; ok {
+		timer.Stop()
+		delete(m.roomTimers, roomID)
+	}
+}
@@ -0,0 +1,109 @@
+package statemanager_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/a-essam23/go-dispatch/pkg/state"
+	"github.com/a-essam23/go-dispatch/pkg/state/statemanager"
+)
+
+// connects each user once, with the given global permissions.
+func connectUsers(t *testing.T, m *statemanager.InMemoryManager, perms state.Permission, userIDs ...string) {
+	t.Helper()
+	for _, userID := range userIDs {
+		conn := newTransportConn()
+		m.RegisterConnection(conn, "1.1.1.1")
+		if _, err := m.AssociateUser(conn.ID(), userID, perms); err != nil {
+			t.Fatalf("AssociateUser failed: %v", err)
+		}
+	}
+}
+
+func TestRoomClassesEnforceJoins(t *testing.T) {
+	m := newTestManager()
+	const moderate state.Permission = 1 << 5
+	m.SetRoomClasses([]state.RoomClass{
+		{Name: "dm", Pattern: "dm:*", MaxMembers: 2, Join: state.JoinOpen},
+		{Name: "private", Pattern: "private:*", Join: state.JoinInviteOnly},
+		{Name: "team", Pattern: "team:*", Join: state.JoinInviteOnly, Permission: moderate},
+		{Name: "paid", Pattern: "paid:*", Join: state.JoinTokenRequired},
+		{Name: "staff", Pattern: "staff:*:room", Join: state.JoinPermissionRequired, Permission: moderate},
+	})
+	connectUsers(t, m, 0, "alice", "bob", "carol")
+	connectUsers(t, m, moderate, "mod")
+	connectUsers(t, m, state.PermModerate, "owner")
+	carolInvite := &state.Invite{Kind: state.InviteKindInvite, Room: "private:y", UserID: "carol"}
+
+	tests := []struct {
+		name   string
+		userID string
+		roomID string
+		auth   *state.JoinAuth
+		want   error
+	}{
+		{"first dm member", "alice", "dm:1", nil, nil},
+		{"second dm member", "bob", "dm:1", nil, nil},
+		{"dm is full", "carol", "dm:1", nil, state.ErrRoomFull},
+		{"rejoining is not blocked", "alice", "dm:1", nil, nil},
+		{"creating invite-only room without permission", "alice", "private:x", nil, state.ErrJoinDenied},
+		{"creator of invite-only room", "owner", "private:x", nil, nil},
+		{"stranger to invite-only room", "bob", "private:x", nil, state.ErrJoinDenied},
+		{"creating invite-only room with an invite", "carol", "private:y", &state.JoinAuth{Invite: carolInvite}, nil},
+		{"default create permission is not the class's", "owner", "team:1", nil, state.ErrJoinDenied},
+		{"class's create permission", "mod", "team:1", nil, nil},
+		{"no token", "alice", "paid:1", nil, state.ErrJoinDenied},
+		{"token for another room", "alice", "paid:1", &state.JoinAuth{}, state.ErrJoinDenied},
+		{"token", "alice", "paid:1", &state.JoinAuth{Token: true}, nil},
+		{"missing permission", "alice", "staff:a:room", nil, state.ErrJoinDenied},
+		{"permission", "mod", "staff:a:room", nil, nil},
+		{"unmatched room is open", "carol", "staff:a:hall", nil, nil},
+	}
+	for _, tt := range tests {
+		_, err := m.Join(tt.userID, tt.roomID, tt.auth)
+		if tt.want == nil && err != nil {
+			t.Errorf("%s: unexpected error: %v", tt.name, err)
+		}
+		if tt.want != nil && !errors.Is(err, tt.want) {
+			t.Errorf("%s: expected %v, got %v", tt.name, tt.want, err)
+		}
+	}
+}
+
+func TestPersistedRoomsExpireWhenIdle(t *testing.T) {
+	m := newTestManager()
+	m.SetRoomClasses([]state.RoomClass{
+		{Name: "game", Pattern: "game:*", Join: state.JoinOpen, Persist: true, IdleTTL: 40 * time.Millisecond},
+		{Name: "hall", Pattern: "hall:*", Join: state.JoinOpen, Persist: true},
+	})
+	connectUsers(t, m, 0, "alice")
+
+	for _, roomID := range []string{"game:1", "hall:1", "chat"} {
+		m.Join("alice", roomID, nil)
+		m.Leave("alice", roomID)
+	}
+	if _, ok := m.FindRoom("chat"); ok {
+		t.Error("a room without a persistent class was kept once empty")
+	}
+	if _, ok := m.FindRoom("game:1"); !ok {
+		t.Fatal("a persistent room was removed once empty")
+	}
+
+	// coming back within the TTL keeps the room.
+	time.Sleep(20 * time.Millisecond)
+	m.Join("alice", "game:1", nil)
+	time.Sleep(40 * time.Millisecond)
+	if _, ok := m.FindRoom("game:1"); !ok {
+		t.Fatal("an occupied room expired")
+	}
+
+	m.Leave("alice", "game:1")
+	time.Sleep(80 * time.Millisecond)
+	if _, ok := m.FindRoom("game:1"); ok {
+		t.Error("an idle persistent room did not expire")
+	}
+	if _, ok := m.FindRoom("hall:1"); !ok {
+		t.Error("a persistent room without an idle TTL expired")
+	}
+}
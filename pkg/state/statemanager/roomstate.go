@@ -0,0 +1,118 @@
+package statemanager
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/a-essam23/go-dispatch/pkg/jsonpatch"
+	"github.com/a-essam23/go-dispatch/pkg/state"
+)
+
+var emptyObject = json.RawMessage(`{}`)
+
+// roomDocument is what room state patches apply to.
+type roomDocument struct {
+	Meta state.RoomMeta  `json:"meta"`
+	Data json.RawMessage `json:"data"`
+}
+
+// newRoom creates an empty room owned by the user who caused its creation.
+func newRoom(roomID, owner string) *state.Room {
+	return &state.Room{
+		ID:      roomID,
+		Members: make(map[string]*state.User),
+		Meta: state.RoomMeta{
+			Owner:     owner,
+			CreatedAt: time.Now(),
+			Custom:    emptyObject,
+		},
+		Data: emptyObject,
+	}
+}
+
+func roomState(room *state.Room) state.RoomState {
+	return state.RoomState{Room: room.ID, Version: room.Version, Meta: room.Meta, Data: room.Data}
+}
+
+// SetRoomStateLimit sets the largest a room's state document, meta and data
+// together, may grow in bytes. Zero lifts the limit.
+func (m *InMemoryManager) SetRoomStateLimit(limit int) {
+	m.roomMu.Lock()
+	m.roomStateLimit = limit
+	m.roomMu.Unlock()
+}
+
+func (m *InMemoryManager) GetRoomState(roomID string) (state.RoomState, error) {
+	m.roomMu.RLock()
+	defer m.roomMu.RUnlock()
+
+	room, ok := m.rooms[roomID]
+	if !ok {
+		return state.RoomState{}, errors.New("room not found")
+	}
+	return roomState(room), nil
+}
+
+func (m *InMemoryManager) PatchRoomState(roomID string, patch jsonpatch.Patch, expected *uint64) (state.RoomState, error) {
+	m.roomMu.Lock()
+	defer m.roomMu.Unlock()
+
+	room, ok := m.rooms[roomID]
+	if !ok {
+		return state.RoomState{}, errors.New("room not found")
+	}
+	if expected != nil && *expected != room.Version {
+		return state.RoomState{}, fmt.Errorf("%w: room '%s' is at version %d", state.ErrRoomVersionConflict, roomID, room.Version)
+	}
+
+	doc, err := json.Marshal(roomDocument{Meta: room.Meta, Data: room.Data})
+	if err != nil {
+		return state.RoomState{}, err
+	}
+	patched, err := patch.Apply(doc)
+	if err != nil {
+		return state.RoomState{}, err
+	}
+	// every patch marshals the whole document, so its size is bounded.
+	if m.roomStateLimit > 0 && len(patched) > m.roomStateLimit {
+		return state.RoomState{}, fmt.Errorf("%w: room '%s' would take %d bytes, over the limit of %d", state.ErrRoomStateTooLarge, roomID, len(patched), m.roomStateLimit)
+	}
+	next, err := decodeRoomDocument(patched)
+	if err != nil {
+		return state.RoomState{}, fmt.Errorf("invalid room state: %w", err)
+	}
+	if next.Meta.Owner != room.Meta.Owner || !next.Meta.CreatedAt.Equal(room.Meta.CreatedAt) {
+		return state.RoomState{}, errors.New("invalid room state: meta owner and createdAt are read-only")
+	}
+
+	room.Meta = next.Meta
+	room.Data = next.Data
+	room.Version++
+	m.logger.Debug("Room state patched", "roomID", roomID, "version", room.Version)
+	return roomState(room), nil
+}
+
+// decodeRoomDocument checks that a patched document still has the shape of a
+// roomDocument.
+func decodeRoomDocument(data []byte) (roomDocument, error) {
+	var doc roomDocument
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&doc); err != nil {
+		return doc, err
+	}
+	if !isObject(doc.Data) {
+		return doc, errors.New("data must be an object")
+	}
+	if !isObject(doc.Meta.Custom) {
+		return doc, errors.New("meta custom must be an object")
+	}
+	return doc, nil
+}
+
+func isObject(raw json.RawMessage) bool {
+	return len(raw) > 0 && raw[0] == '{'
+}
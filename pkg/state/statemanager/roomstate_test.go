@@ -0,0 +1,88 @@
+package statemanager_test
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/a-essam23/go-dispatch/pkg/jsonpatch"
+	"github.com/a-essam23/go-dispatch/pkg/state"
+)
+
+func mustPatch(t *testing.T, doc string) jsonpatch.Patch {
+	t.Helper()
+	patch, err := jsonpatch.Decode([]byte(doc))
+	if err != nil {
+		t.Fatalf("Decode failed: %v", err)
+	}
+	return patch
+}
+
+func TestRoomStatePatching(t *testing.T) {
+	m := newTestManager()
+	conn := newTransportConn()
+	m.RegisterConnection(conn, "1.1.1.1")
+	m.AssociateUser(conn.ID(), "owner", 0)
+	m.Join("owner", "lobby", nil)
+
+	initial, err := m.GetRoomState("lobby")
+	if err != nil {
+		t.Fatalf("GetRoomState failed: %v", err)
+	}
+	if initial.Version != 0 || initial.Meta.Owner != "owner" || initial.Meta.CreatedAt.IsZero() || string(initial.Data) != "{}" {
+		t.Fatalf("unexpected initial state %+v", initial)
+	}
+
+	got, err := m.PatchRoomState("lobby", mustPatch(t, `[{"op":"replace","path":"/meta/title","value":"Lobby"},{"op":"add","path":"/data/score","value":1}]`), nil)
+	if err != nil {
+		t.Fatalf("PatchRoomState failed: %v", err)
+	}
+	if got.Version != 1 || got.Meta.Title != "Lobby" || string(got.Data) != `{"score":1}` {
+		t.Fatalf("unexpected state after patch %+v", got)
+	}
+
+	stale := uint64(0)
+	if _, err := m.PatchRoomState("lobby", mustPatch(t, `[{"op":"remove","path":"/data/score"}]`), &stale); !errors.Is(err, state.ErrRoomVersionConflict) {
+		t.Errorf("expected a version conflict, got %v", err)
+	}
+
+	for name, doc := range map[string]string{
+		"owner is read-only":    `[{"op":"replace","path":"/meta/owner","value":"mallory"}]`,
+		"data must be object":   `[{"op":"replace","path":"/data","value":[]}]`,
+		"no unknown members":    `[{"op":"add","path":"/extra","value":1}]`,
+		"failed test aborts":    `[{"op":"add","path":"/data/x","value":1},{"op":"test","path":"/data/score","value":2}]`,
+		"custom must be object": `[{"op":"replace","path":"/meta/custom","value":"x"}]`,
+	} {
+		if _, err := m.PatchRoomState("lobby", mustPatch(t, doc), nil); err == nil {
+			t.Errorf("%s: expected the patch to be rejected", name)
+		}
+	}
+	if after, _ := m.GetRoomState("lobby"); after.Version != 1 || string(after.Data) != `{"score":1}` {
+		t.Errorf("rejected patches changed the state: %+v", after)
+	}
+}
+
+func TestRoomStatePatchesAreLimitedInSize(t *testing.T) {
+	m := newTestManager()
+	conn := newTransportConn()
+	m.RegisterConnection(conn, "1.1.1.1")
+	m.AssociateUser(conn.ID(), "owner", 0)
+	m.Join("owner", "lobby", nil)
+	m.SetRoomStateLimit(256)
+
+	if _, err := m.PatchRoomState("lobby", mustPatch(t, `[{"op":"add","path":"/data/note","value":"short"}]`), nil); err != nil {
+		t.Fatalf("a patch within the limit failed: %v", err)
+	}
+	big := strings.Repeat("x", 256)
+	if _, err := m.PatchRoomState("lobby", mustPatch(t, `[{"op":"add","path":"/data/note","value":"`+big+`"}]`), nil); !errors.Is(err, state.ErrRoomStateTooLarge) {
+		t.Errorf("expected a patch past the limit to be rejected, got %v", err)
+	}
+	if after, _ := m.GetRoomState("lobby"); after.Version != 1 || string(after.Data) != `{"note":"short"}` {
+		t.Errorf("a rejected patch changed the state: %+v", after)
+	}
+
+	m.SetRoomStateLimit(0)
+	if _, err := m.PatchRoomState("lobby", mustPatch(t, `[{"op":"add","path":"/data/note","value":"`+big+`"}]`), nil); err != nil {
+		t.Errorf("expected no limit once lifted, got %v", err)
+	}
+}
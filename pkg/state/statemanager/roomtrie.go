@@ -0,0 +1,124 @@
+package statemanager
+
+import (
+	"strings"
+
+	"github.com/a-essam23/go-dispatch/pkg/state"
+)
+
+// roomTrie indexes room IDs, or room patterns, level by level. Levels holding
+// a '*' are kept apart from literal ones, so matching a room ID against stored
+// patterns only visits the wildcards and the one literal level that can match.
+type roomTrie struct {
+	literal map[string]*roomTrie
+	wild    map[string]*roomTrie
+	values  map[string]struct{} // what is stored under the exact path to this node
+}
+
+func newRoomTrie() *roomTrie {
+	return &roomTrie{}
+}
+
+func (t *roomTrie) insert(key, value string) {
+	node := t
+	for _, level := range strings.Split(key, state.RoomSeparator) {
+		children := &node.literal
+		if strings.Contains(level, "*") {
+			children = &node.wild
+		}
+		if *children == nil {
+			*children = make(map[string]*roomTrie)
+		}
+		child, ok := (*children)[level]
+		if !ok {
+			child = newRoomTrie()
+			(*children)[level] = child
+		}
+		node = child
+	}
+	if node.values == nil {
+		node.values = make(map[string]struct{})
+	}
+	node.values[value] = struct{}{}
+}
+
+func (t *roomTrie) remove(key, value string) {
+	t.removeLevels(strings.Split(key, state.RoomSeparator), value)
+}
+
+// removeLevels reports whether t is left empty, so its parent can drop it.
+func (t *roomTrie) removeLevels(levels []string, value string) bool {
+	if len(levels) == 0 {
+		delete(t.values, value)
+	} else {
+		children := t.literal
+		if strings.Contains(levels[0], "*") {
+			children = t.wild
+		}
+		if child, ok := children[levels[0]]; ok && child.removeLevels(levels[1:], value) {
+			delete(children, levels[0])
+		}
+	}
+	return len(t.values) == 0 && len(t.literal) == 0 && len(t.wild) == 0
+}
+
+// match returns the values stored under the room IDs that pattern matches.
+func (t *roomTrie) match(pattern string) map[string]struct{} {
+	out := make(map[string]struct{})
+	t.collect(strings.Split(pattern, state.RoomSeparator), out)
+	return out
+}
+
+func (t *roomTrie) collect(levels []string, out map[string]struct{}) {
+	if len(levels) == 0 {
+		for value := range t.values {
+			out[value] = struct{}{}
+		}
+		return
+	}
+	level, rest := levels[0], levels[1:]
+	switch {
+	case level == "**":
+		t.collect(rest, out)
+		for _, child := range t.literal {
+			child.collect(levels, out)
+		}
+	case strings.Contains(level, "*"):
+		for name, child := range t.literal {
+			if state.GlobMatch(level, name) {
+				child.collect(rest, out)
+			}
+		}
+	default:
+		if child, ok := t.literal[level]; ok {
+			child.collect(rest, out)
+		}
+	}
+}
+
+// matchPatterns returns the values stored under the patterns roomID matches.
+func (t *roomTrie) matchPatterns(roomID string) map[string]struct{} {
+	out := make(map[string]struct{})
+	t.collectPatterns(strings.Split(roomID, state.RoomSeparator), out)
+	return out
+}
+
+func (t *roomTrie) collectPatterns(levels []string, out map[string]struct{}) {
+	if len(levels) == 0 {
+		for value := range t.values {
+			out[value] = struct{}{}
+		}
+	} else if child, ok := t.literal[levels[0]]; ok {
+		child.collectPatterns(levels[1:], out)
+	}
+	for name, child := range t.wild {
+		switch {
+		case name == "**":
+			for i := 0; i <= len(levels); i++ {
+				child.collectPatterns(levels[i:], out)
+			}
+		case len(levels) > 0 && state.GlobMatch(name, levels[0]):
+			child.collectPatterns(levels[1:], out)
+		}
+	}
+}
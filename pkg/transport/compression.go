@@ -0,0 +1,29 @@
+package transport
+
+import (
+	"fmt"
+
+	"github.com/coder/websocket"
+)
+
+// compression mode names as they appear in configuration.
+const (
+	CompressionDisabled          = "disabled"
+	CompressionContextTakeover   = "context_takeover"
+	CompressionNoContextTakeover = "no_context_takeover"
+)
+
+// ParseCompressionMode maps a configured permessage-deflate mode onto the
+// websocket library's mode. An empty string means disabled.
+func ParseCompressionMode(mode string) (websocket.CompressionMode, error) {
+	switch mode {
+	case "", CompressionDisabled:
+		return websocket.CompressionDisabled, nil
+	case CompressionContextTakeover:
+		return websocket.CompressionContextTakeover, nil
+	case CompressionNoContextTakeover:
+		return websocket.CompressionNoContextTakeover, nil
+	default:
+		return 0, fmt.Errorf("unknown compression mode '%s'", mode)
+	}
+}
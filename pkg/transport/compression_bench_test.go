@@ -0,0 +1,147 @@
+package transport_test
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/a-essam23/go-dispatch/pkg/transport"
+	"github.com/coder/websocket"
+)
+
+// countingListener counts every byte the server writes to its sockets, which
+// is the bandwidth a fan-out costs on the wire after compression.
+type countingListener struct {
+	net.Listener
+	written *atomic.Int64
+}
+
+func (l countingListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return countingConn{Conn: c, written: l.written}, nil
+}
+
+type countingConn struct {
+	net.Conn
+	written *atomic.Int64
+}
+
+func (c countingConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.written.Add(int64(n))
+	return n, err
+}
+
+// a typical chat room broadcast: repetitive keys, short values.
+func roomBroadcast(i int) []byte {
+	return fmt.Appendf(nil,
+		`{"event":"new_message","payload":{"room":"org:42/team:7/channel:3","user":{"id":"user-%d","name":"Test User %d","avatar":"https://cdn.example.com/avatars/user-%d.png"},"message":"%s","sentAt":"2025-01-01T12:00:00Z"}}`,
+		i%50, i%50, i%50, strings.Repeat("hello everyone, ", 1+i%8))
+}
+
+func benchmarkFanOut(b *testing.B, mode string, members int) {
+	compression, err := transport.ParseCompressionMode(mode)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	messages := make([][]byte, 64)
+	threshold := 0
+	for i := range messages {
+		messages[i] = roomBroadcast(i)
+		if threshold == 0 || len(messages[i]) < threshold {
+			threshold = len(messages[i])
+		}
+	}
+
+	var written atomic.Int64
+	serverConns := make(chan *websocket.Conn, members)
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// compress every message; the library's default thresholds would skip
+		// most of them without context takeover.
+		c, err := websocket.Accept(w, r, &websocket.AcceptOptions{CompressionMode: compression, CompressionThreshold: threshold})
+		if err != nil {
+			b.Error(err)
+			return
+		}
+		serverConns <- c
+		<-r.Context().Done()
+	}))
+	srv.Listener = countingListener{Listener: srv.Listener, written: &written}
+	srv.Start()
+	defer srv.Close()
+
+	ctx := context.Background()
+	var readers sync.WaitGroup
+	conns := make([]*websocket.Conn, 0, members)
+	for range members {
+		client, _, err := websocket.Dial(ctx, "ws"+strings.TrimPrefix(srv.URL, "http"), &websocket.DialOptions{CompressionMode: compression})
+		if err != nil {
+			b.Fatal(err)
+		}
+		defer client.CloseNow()
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+			for {
+				if _, _, err := client.Read(ctx); err != nil {
+					return
+				}
+			}
+		}()
+		conns = append(conns, <-serverConns)
+	}
+
+	var raw int64
+	written.Store(0)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		msg := messages[i%len(messages)]
+		for _, c := range conns {
+			if err := c.Write(ctx, websocket.MessageText, msg); err != nil {
+				b.Fatal(err)
+			}
+			raw += int64(len(msg))
+		}
+	}
+	b.StopTimer()
+
+	ratio := float64(written.Load()) / float64(raw)
+	b.ReportMetric(float64(written.Load())/float64(b.N*members), "wire-B/msg")
+	b.ReportMetric(ratio, "ratio")
+	if compression != websocket.CompressionDisabled && ratio >= 1 {
+		b.Errorf("%s sent frames uncompressed (ratio %.2f)", mode, ratio)
+	}
+
+	for _, c := range conns {
+		c.CloseNow()
+	}
+	readers.Wait()
+}
+
+// BenchmarkFanOutCompression compares bandwidth (wire-B/msg, ratio) and CPU
+// (ns/op) of each compression mode when broadcasting to a room.
+func BenchmarkFanOutCompression(b *testing.B) {
+	modes := []string{
+		transport.CompressionDisabled,
+		transport.CompressionNoContextTakeover,
+		transport.CompressionContextTakeover,
+	}
+	for _, members := range []int{1, 25} {
+		for _, mode := range modes {
+			b.Run(fmt.Sprintf("%s/members=%d", mode, members), func(b *testing.B) {
+				benchmarkFanOut(b, mode, members)
+			})
+		}
+	}
+}
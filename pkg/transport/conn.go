@@ -0,0 +1,58 @@
+package transport
+
+import (
+	"time"
+
+	"github.com/a-essam23/go-dispatch/pkg/codec"
+	"github.com/google/uuid"
+)
+
+// kinds of transport, as reported in Metadata.
+const (
+	KindWebSocket = "websocket"
+	KindSSE       = "sse"
+	KindLongPoll  = "longpoll"
+)
+
+// Metadata describes where a connection comes from. It is informational only;
+// nothing in the dispatch path depends on it.
+type Metadata struct {
+	Kind        string
+	RemoteAddr  string
+	UserAgent   string
+	ConnectedAt time.Time
+}
+
+// Conn is what the layers above need from a client connection, regardless of
+// whether it is a WebSocket, an SSE stream or a long-poll session.
+type Conn interface {
+	ID() uuid.UUID
+	// Send queues a message already encoded with Codec. It is safe for concurrent use.
+	Send(message []byte)
+	// SendPriority is Send in the given outbound lane.
+	SendPriority(message []byte, priority Priority)
+	// SendCoalesced is SendPriority, except that the message replaces any
+	// message queued with the same key that has not been delivered yet. An
+	// empty key makes it SendPriority.
+	SendCoalesced(message []byte, priority Priority, key string)
+	Close(err error)
+	// Done is closed once the connection is fully terminated.
+	Done() <-chan struct{}
+	Codec() codec.Codec
+	Metadata() Metadata
+}
+
+// Attachable is a Conn whose handlers can be set after construction, which is
+// how the server and sessions wire a transport up.
+type Attachable interface {
+	Conn
+	SetOnMessageHandler(handler MessageHandler)
+	SetOnCloseHandler(handler OnCloseHandler)
+}
+
+// compile-time checks that every transport satisfies Attachable.
+var (
+	_ Attachable = (*Connection)(nil)
+	_ Attachable = (*HTTPConnection)(nil)
+	_ Attachable = (*Session)(nil)
+)
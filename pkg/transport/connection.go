@@ -2,11 +2,15 @@ package transport
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"io"
 	"log/slog"
 	"sync"
 	"time"
 
+	"github.com/a-essam23/go-dispatch/pkg/codec"
+	"github.com/a-essam23/go-dispatch/pkg/metrics"
 	"github.com/coder/websocket"
 	"github.com/google/uuid"
 )
@@ -17,14 +21,35 @@ type MessageHandler func(ctx context.Context, connId uuid.UUID, msg []byte)
 type OnCloseHandler func(connId uuid.UUID, err error)
 type ConnectionConfig struct {
 	ReadTimeout time.Duration
+	// WriteTimeout bounds a single frame write. Zero disables the deadline.
+	WriteTimeout time.Duration
+	// PingInterval is how often a websocket ping is sent. Zero disables pings.
+	PingInterval time.Duration
+	// PongTimeout is how long to wait for the pong before the connection is considered dead.
+	PongTimeout time.Duration
+	// HeartbeatInterval is how often an application-level heartbeat event is sent,
+	// for clients behind proxies that swallow control frames. Zero disables it.
+	HeartbeatInterval time.Duration
+	// MaxMessageSize is the largest inbound message, in bytes. Zero keeps the
+	// websocket library default (32KiB).
+	MaxMessageSize int64
+	// MaxMessagesPerSecond caps inbound messages per connection. Zero disables the limit.
+	MaxMessagesPerSecond int
 }
 
+// HeartbeatEvent is the reserved event name used for application-level heartbeats.
+const HeartbeatEvent = "_heartbeat"
+
+var ErrPongTimeout = errors.New("websocket ping timed out waiting for pong")
+
 // Connection represents a single, thread-safe WebSocket connection.
 type Connection struct {
 	id     uuid.UUID
+	meta   Metadata
 	conn   *websocket.Conn
 	config ConnectionConfig
-	send   chan []byte
+	codec  codec.Codec
+	out    *outbox
 
 	onMessage MessageHandler
 	onClose   OnCloseHandler
@@ -35,7 +60,8 @@ type Connection struct {
 	closeOnce sync.Once
 	cancel    context.CancelFunc
 
-	logger *slog.Logger
+	logger  *slog.Logger
+	metrics *metrics.Registry
 }
 
 func NewConnection(parentCtx context.Context, wg *sync.WaitGroup, conn *websocket.Conn, config ConnectionConfig, onMessage MessageHandler, onClose OnCloseHandler, logger *slog.Logger) *Connection {
@@ -45,11 +71,13 @@ func NewConnection(parentCtx context.Context, wg *sync.WaitGroup, conn *websocke
 
 	return &Connection{
 		id:        id,
+		meta:      Metadata{Kind: KindWebSocket, ConnectedAt: time.Now()},
 		conn:      conn,
 		logger:    connLogger,
 		config:    config,
+		codec:     codec.JSON,
 		onMessage: onMessage,
-		send:      make(chan []byte, 256), // Buffered channel
+		out:       newOutbox(256),
 		done:      make(chan struct{}),
 		ctx:       connCtx,
 		cancel:    cancel,
@@ -60,8 +88,14 @@ func NewConnection(parentCtx context.Context, wg *sync.WaitGroup, conn *websocke
 
 func (c *Connection) Run() {
 	c.wg.Add(1)
+	if c.config.MaxMessageSize > 0 {
+		c.conn.SetReadLimit(c.config.MaxMessageSize)
+	}
 	go c.readPump()
 	go c.writePump()
+	if c.config.PingInterval > 0 {
+		go c.pingPump()
+	}
 
 	c.logger.Info("connection established")
 }
@@ -73,6 +107,11 @@ func (c *Connection) readPump() {
 		c.Close(readErr)
 	}()
 
+	var limiter *messageRateLimiter
+	if c.config.MaxMessagesPerSecond > 0 {
+		limiter = newMessageRateLimiter(c.config.MaxMessagesPerSecond)
+	}
+
 	for {
 		readCtx, cancelRead := context.WithTimeout(c.ctx, c.config.ReadTimeout)
 		defer cancelRead()
@@ -88,6 +127,11 @@ func (c *Connection) readPump() {
 		}
 		// Pass a connection-scoped context to the handler.
 		// Read the full message. Use io.ReadAll for safety.
+		if c.config.MaxMessageSize > 0 {
+			// read one byte past the limit so oversized messages are detected here
+			// rather than by the websocket library, which would close silently.
+			r = io.LimitReader(r, c.config.MaxMessageSize+1)
+		}
 		message, err := io.ReadAll(r)
 		if err != nil {
 			c.logger.Error("Connection readpump failed for some reason")
@@ -95,11 +139,27 @@ func (c *Connection) readPump() {
 
 			return
 		}
+		if c.config.MaxMessageSize > 0 && int64(len(message)) > c.config.MaxMessageSize {
+			c.metrics.Counter(MetricMessageTooBig).Inc()
+			readErr = CloseError(websocket.StatusMessageTooBig, "message exceeds %d bytes", c.config.MaxMessageSize)
+			return
+		}
+		if limiter != nil && !limiter.allow(time.Now()) {
+			c.metrics.Counter(MetricRateExceeded).Inc()
+			readErr = PolicyViolation("message rate exceeds %d/s", c.config.MaxMessagesPerSecond)
+			return
+		}
+		// everything above the transport speaks JSON.
+		message, err = c.codec.Decode(message)
+		if err != nil {
+			c.logger.Warn("Failed to decode client message", slog.String("codec", c.codec.Name()), slog.Any("error", err))
+			continue
+		}
 		c.onMessage(c.ctx, c.id, message)
 	}
 }
 
-// writePump pumps messages from the send channel to the WebSocket connection.
+// writePump pumps messages from the outbound lanes to the WebSocket connection.
 func (c *Connection) writePump() {
 	var writeErr error
 
@@ -107,15 +167,31 @@ func (c *Connection) writePump() {
 		c.Close(writeErr)
 	}()
 
+	// a nil channel blocks forever, which keeps the heartbeat case inert when disabled.
+	var heartbeat <-chan time.Time
+	if c.config.HeartbeatInterval > 0 {
+		ticker := time.NewTicker(c.config.HeartbeatInterval)
+		defer ticker.Stop()
+		heartbeat = ticker.C
+	}
+
 	for {
+		if message, ok := c.out.pop(); ok {
+			if err := c.write(message); err != nil {
+				writeErr = err
+				return
+			}
+			continue
+		}
 		select {
-		case message, ok := <-c.send:
-			if !ok {
-				// The send channel was closed, signal clean closure.
-				c.conn.Close(websocket.StatusNormalClosure, "")
+		case <-c.out.ready:
+		case t := <-heartbeat:
+			message, err := c.codec.Encode(heartbeatMessage(t))
+			if err != nil {
+				writeErr = err
 				return
 			}
-			if err := c.conn.Write(c.ctx, websocket.MessageText, message); err != nil {
+			if err := c.write(message); err != nil {
 				writeErr = err
 				return
 			}
@@ -126,11 +202,86 @@ func (c *Connection) writePump() {
 	}
 }
 
-// sends a message to the client. It is safe for concurrent use.
+// write sends a single frame, bounded by the configured write timeout.
+func (c *Connection) write(message []byte) error {
+	ctx := c.ctx
+	if c.config.WriteTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(c.ctx, c.config.WriteTimeout)
+		defer cancel()
+	}
+	typ := websocket.MessageText
+	if c.codec.Binary() {
+		typ = websocket.MessageBinary
+	}
+	return c.conn.Write(ctx, typ, message)
+}
+
+// pingPump sends websocket pings at a fixed interval and closes the connection
+// when a pong does not arrive in time. This detects half-open TCP connections
+// long before the read timeout would.
+func (c *Connection) pingPump() {
+	ticker := time.NewTicker(c.config.PingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			pongTimeout := c.config.PongTimeout
+			if pongTimeout <= 0 {
+				pongTimeout = c.config.PingInterval
+			}
+			pingCtx, cancel := context.WithTimeout(c.ctx, pongTimeout)
+			err := c.conn.Ping(pingCtx)
+			cancel()
+			if err != nil {
+				if c.ctx.Err() != nil {
+					return
+				}
+				c.logger.Warn("Keepalive ping failed", slog.Any("error", err))
+				c.Close(fmt.Errorf("%w: %v", ErrPongTimeout, err))
+				return
+			}
+		case <-c.ctx.Done():
+			return
+		}
+	}
+}
+
+func heartbeatMessage(t time.Time) []byte {
+	return fmt.Appendf(nil, `{"event":%q,"payload":{"ts":%d}}`, HeartbeatEvent, t.UnixMilli())
+}
+
+// sends a message to the client in the normal lane. The message must already
+// be encoded with the connection's codec (see Codec). It is safe for concurrent use.
 func (c *Connection) Send(message []byte) {
-	select {
-	case c.send <- message:
-	case <-c.ctx.Done():
+	c.SendPriority(message, PriorityNormal)
+}
+
+// SendPriority queues a message in the given lane. It never blocks: bulk
+// messages are dropped when the client falls behind, and a client too slow to
+// take even normal traffic is disconnected.
+func (c *Connection) SendPriority(message []byte, priority Priority) {
+	c.enqueue(message, priority, "")
+}
+
+// SendCoalesced queues a message that supersedes any undelivered message with
+// the same key, so a slow client only receives the latest value.
+func (c *Connection) SendCoalesced(message []byte, priority Priority, key string) {
+	c.enqueue(message, priority, key)
+}
+
+func (c *Connection) enqueue(message []byte, priority Priority, key string) {
+	switch c.out.push(message, priority, key) {
+	case pushedDroppingBulk, droppedBulk:
+		c.metrics.Counter(MetricBulkDropped).Inc()
+	case coalesced:
+		c.metrics.Counter(MetricCoalesced).Inc()
+	case outboxFull:
+		c.logger.Warn("Outbound buffer full, closing slow connection")
+		// the caller may hold locks the close handlers need.
+		go c.Close(ErrOutboundFull)
+	case outboxClosed:
 		c.logger.Warn("Attempted to send on a closed connection")
 	}
 }
@@ -141,9 +292,22 @@ func (c *Connection) Close(err error) {
 		status := websocket.CloseStatus(err)
 		c.logger.Info("Transport connection closing", slog.Any("reason", err), slog.String("status", status.String()))
 
+		// Close the socket first so the status carried by err (if any) is the
+		// one the client sees, rather than the pumps' normal closure.
+		code, reason := websocket.StatusNormalClosure, ""
+		var closeErr websocket.CloseError
+		if errors.As(err, &closeErr) {
+			code, reason = closeErr.Code, closeErr.Reason
+		}
+		if errors.Is(err, ErrPongTimeout) {
+			// the peer is gone; a close handshake would only wait out its timeout.
+			c.conn.CloseNow()
+		} else {
+			c.conn.Close(code, reason)
+		}
+
 		c.cancel() // Signal goroutines to stop.
-		close(c.send)
-		c.conn.Close(websocket.StatusNormalClosure, "")
+		c.out.close()
 		c.logger.Info("Connection closed")
 		if c.onClose != nil {
 			c.onClose(c.id, err)
@@ -163,6 +327,32 @@ func (c *Connection) ID() uuid.UUID {
 	return c.id
 }
 
+// Codec returns the wire format negotiated for this connection.
+func (c *Connection) Codec() codec.Codec {
+	return c.codec
+}
+
+func (c *Connection) Metadata() Metadata {
+	return c.meta
+}
+
+// SetPeer records the client's address and user agent in the metadata.
+// It must be called before the connection is shared.
+func (c *Connection) SetPeer(remoteAddr, userAgent string) {
+	c.meta.RemoteAddr = remoteAddr
+	c.meta.UserAgent = userAgent
+}
+
+// SetCodec sets the wire format. It must be called before Run.
+func (c *Connection) SetCodec(cd codec.Codec) {
+	c.codec = cd
+}
+
+// SetMetrics attaches a registry used to count limit violations.
+func (c *Connection) SetMetrics(reg *metrics.Registry) {
+	c.metrics = reg
+}
+
 func (c *Connection) SetOnMessageHandler(handler MessageHandler) {
 	c.onMessage = handler
 }
@@ -0,0 +1,138 @@
+package transport_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/a-essam23/go-dispatch/pkg/transport"
+	"github.com/coder/websocket"
+	"github.com/google/uuid"
+)
+
+// serves a single websocket connection with config and returns the dialled
+// client, the server's connection and the error it was closed with.
+func newConnectionPair(t *testing.T, config transport.ConnectionConfig) (*websocket.Conn, *transport.Connection, <-chan error) {
+	t.Helper()
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	closed := make(chan error, 1)
+	accepted := make(chan *transport.Connection, 1)
+	var wg sync.WaitGroup
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := websocket.Accept(w, r, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		conn := transport.NewConnection(context.Background(), &wg, ws, config,
+			func(context.Context, uuid.UUID, []byte) {},
+			func(_ uuid.UUID, err error) { closed <- err },
+			logger)
+		conn.Run()
+		accepted <- conn
+		<-conn.Done()
+	}))
+	t.Cleanup(srv.Close)
+
+	client, _, err := websocket.Dial(context.Background(), "ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	t.Cleanup(func() { client.CloseNow() })
+	return client, <-accepted, closed
+}
+
+func waitClosed(t *testing.T, closed <-chan error, within time.Duration) error {
+	t.Helper()
+	select {
+	case err := <-closed:
+		return err
+	case <-time.After(within):
+		t.Fatalf("connection was not closed within %s", within)
+		return nil
+	}
+}
+
+func TestConnectionClosesWhenPongIsMissing(t *testing.T) {
+	// the client never reads, so it never answers pings.
+	_, _, closed := newConnectionPair(t, transport.ConnectionConfig{
+		ReadTimeout:  time.Minute,
+		PingInterval: 20 * time.Millisecond,
+		PongTimeout:  20 * time.Millisecond,
+	})
+
+	if err := waitClosed(t, closed, 2*time.Second); !errors.Is(err, transport.ErrPongTimeout) {
+		t.Errorf("closed with %v, want ErrPongTimeout", err)
+	}
+}
+
+func TestConnectionStaysOpenWhilePongsArrive(t *testing.T) {
+	client, _, closed := newConnectionPair(t, transport.ConnectionConfig{
+		ReadTimeout:  time.Minute,
+		PingInterval: 10 * time.Millisecond,
+		PongTimeout:  50 * time.Millisecond,
+	})
+	// reading answers pings.
+	ctx, cancel := context.WithTimeout(context.Background(), 150*time.Millisecond)
+	defer cancel()
+	client.Read(ctx)
+
+	select {
+	case err := <-closed:
+		t.Fatalf("connection closed while the client answered pings: %v", err)
+	default:
+	}
+}
+
+func TestConnectionSendsHeartbeatEvents(t *testing.T) {
+	client, _, _ := newConnectionPair(t, transport.ConnectionConfig{
+		ReadTimeout:       time.Minute,
+		HeartbeatInterval: 10 * time.Millisecond,
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	_, data, err := client.Read(ctx)
+	if err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	var msg struct {
+		Event   string `json:"event"`
+		Payload struct {
+			TS int64 `json:"ts"`
+		} `json:"payload"`
+	}
+	if err := json.Unmarshal(data, &msg); err != nil {
+		t.Fatalf("invalid heartbeat %s: %v", data, err)
+	}
+	if msg.Event != transport.HeartbeatEvent || msg.Payload.TS == 0 {
+		t.Errorf("got %s, want a %s event with a timestamp", data, transport.HeartbeatEvent)
+	}
+}
+
+func TestConnectionClosesWhenAWriteExceedsItsDeadline(t *testing.T) {
+	_, conn, closed := newConnectionPair(t, transport.ConnectionConfig{
+		ReadTimeout:  time.Minute,
+		WriteTimeout: 50 * time.Millisecond,
+	})
+
+	// the client never reads, so once the socket buffers fill a write blocks
+	// until its deadline.
+	frame := []byte(`{"event":"big","payload":"` + strings.Repeat("x", 1<<20) + `"}`)
+	for range 64 {
+		conn.Send(frame)
+	}
+
+	// the expired write closes the socket, so the read pump may report the
+	// close first; either way it happens long before the read timeout.
+	waitClosed(t, closed, 5*time.Second)
+}
@@ -0,0 +1,260 @@
+package transport
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/a-essam23/go-dispatch/pkg/codec"
+	"github.com/a-essam23/go-dispatch/pkg/metrics"
+	"github.com/google/uuid"
+)
+
+var (
+	ErrOutboundFull = errors.New("outbound buffer full")
+	ErrIdleTimeout  = errors.New("no poll received within idle timeout")
+	ErrClosed       = errors.New("connection is closed")
+	ErrRateExceeded = errors.New("message rate exceeded")
+)
+
+type HTTPConnectionConfig struct {
+	// IdleTimeout closes the connection when no poll arrives in time. Only
+	// meaningful for long-poll sessions; zero disables it.
+	IdleTimeout time.Duration
+	// MaxMessagesPerSecond caps upstream messages. Zero disables the limit.
+	MaxMessagesPerSecond int
+}
+
+// HTTPConnection is a connection for clients that cannot use WebSockets.
+// Downstream messages are queued and drained by an SSE stream or by long-poll
+// requests; upstream messages arrive as separate HTTP POSTs via Deliver.
+// Messages are always JSON.
+type HTTPConnection struct {
+	id     uuid.UUID
+	meta   Metadata
+	config HTTPConnectionConfig
+	out    *outbox
+
+	onMessage MessageHandler
+	onClose   OnCloseHandler
+
+	idle      *time.Timer
+	limiter   *messageRateLimiter
+	limiterMu sync.Mutex
+
+	done      chan struct{}
+	wg        *sync.WaitGroup
+	ctx       context.Context
+	closeOnce sync.Once
+	cancel    context.CancelFunc
+
+	logger  *slog.Logger
+	metrics *metrics.Registry
+}
+
+func NewHTTPConnection(parentCtx context.Context, wg *sync.WaitGroup, kind string, config HTTPConnectionConfig, onMessage MessageHandler, onClose OnCloseHandler, logger *slog.Logger) *HTTPConnection {
+	id := uuid.New()
+	// the connection outlives the request that opened it, so it must not
+	// inherit the request's cancellation.
+	connCtx, cancel := context.WithCancel(context.WithoutCancel(parentCtx))
+	connLogger := logger.With(slog.String("connID", id.String()), slog.String("transport", kind))
+
+	c := &HTTPConnection{
+		id:        id,
+		meta:      Metadata{Kind: kind, ConnectedAt: time.Now()},
+		config:    config,
+		out:       newOutbox(256),
+		onMessage: onMessage,
+		onClose:   onClose,
+		done:      make(chan struct{}),
+		wg:        wg,
+		ctx:       connCtx,
+		cancel:    cancel,
+		logger:    connLogger,
+	}
+	if config.MaxMessagesPerSecond > 0 {
+		c.limiter = newMessageRateLimiter(config.MaxMessagesPerSecond)
+	}
+	return c
+}
+
+func (c *HTTPConnection) Run() {
+	c.wg.Add(1)
+	if c.config.IdleTimeout > 0 {
+		c.idle = time.AfterFunc(c.config.IdleTimeout, func() {
+			c.Close(ErrIdleTimeout)
+		})
+	}
+	c.logger.Info("connection established")
+}
+
+// Deliver hands an upstream message to the message handler. It returns
+// ErrClosed once the connection is closed, and ErrRateExceeded, closing it,
+// when the client sends too fast.
+func (c *HTTPConnection) Deliver(message []byte) error {
+	if c.ctx.Err() != nil {
+		return ErrClosed
+	}
+	if c.limiter != nil {
+		c.limiterMu.Lock()
+		allowed := c.limiter.allow(time.Now())
+		c.limiterMu.Unlock()
+		if !allowed {
+			c.metrics.Counter(MetricRateExceeded).Inc()
+			err := fmt.Errorf("%w: more than %d/s", ErrRateExceeded, c.config.MaxMessagesPerSecond)
+			c.Close(err)
+			return err
+		}
+	}
+	c.onMessage(c.ctx, c.id, message)
+	return nil
+}
+
+// Next blocks until a message is queued and returns it. It returns ErrClosed
+// once the connection closes, or ctx's error when ctx ends first. It is used
+// by the SSE stream.
+func (c *HTTPConnection) Next(ctx context.Context) ([]byte, error) {
+	for {
+		if msg, ok := c.out.pop(); ok {
+			return msg, nil
+		}
+		select {
+		case <-c.out.ready:
+		case <-c.ctx.Done():
+			return nil, ErrClosed
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// Poll waits up to wait for at least one message, then returns everything
+// queued. An empty result means the wait elapsed. Every poll resets the idle timeout.
+func (c *HTTPConnection) Poll(ctx context.Context, wait time.Duration) [][]byte {
+	c.touch()
+	defer c.touch()
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	for {
+		var batch [][]byte
+		for {
+			msg, ok := c.out.pop()
+			if !ok {
+				break
+			}
+			batch = append(batch, msg)
+		}
+		if len(batch) > 0 {
+			return batch
+		}
+		select {
+		case <-c.out.ready:
+		case <-timer.C:
+			return nil
+		case <-c.ctx.Done():
+			return nil
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+func (c *HTTPConnection) touch() {
+	if c.idle != nil {
+		c.idle.Reset(c.config.IdleTimeout)
+	}
+}
+
+// Send queues a message. Unlike a WebSocket, nothing drains the queue while
+// the client is between requests, so a full queue closes the connection
+// instead of blocking the sender.
+func (c *HTTPConnection) Send(message []byte) {
+	c.SendPriority(message, PriorityNormal)
+}
+
+// SendPriority queues a message in the given lane, which decides both the
+// order messages are flushed in and what a full queue drops first.
+func (c *HTTPConnection) SendPriority(message []byte, priority Priority) {
+	c.enqueue(message, priority, "")
+}
+
+// SendCoalesced queues a message that supersedes any undelivered message with
+// the same key, so a client between polls only receives the latest value.
+func (c *HTTPConnection) SendCoalesced(message []byte, priority Priority, key string) {
+	c.enqueue(message, priority, key)
+}
+
+func (c *HTTPConnection) enqueue(message []byte, priority Priority, key string) {
+	switch c.out.push(message, priority, key) {
+	case pushedDroppingBulk, droppedBulk:
+		c.metrics.Counter(MetricBulkDropped).Inc()
+	case coalesced:
+		c.metrics.Counter(MetricCoalesced).Inc()
+	case outboxFull:
+		c.logger.Warn("Outbound buffer full, closing slow connection")
+		go c.Close(ErrOutboundFull)
+	case outboxClosed:
+		c.logger.Warn("Attempted to send on a closed connection")
+	}
+}
+
+func (c *HTTPConnection) Close(err error) {
+	c.closeOnce.Do(func() {
+		c.logger.Info("Transport connection closing", slog.Any("reason", err))
+		if c.idle != nil {
+			c.idle.Stop()
+		}
+		c.cancel()
+		c.out.close()
+		if c.onClose != nil {
+			c.onClose(c.id, err)
+		}
+		c.wg.Done()
+		close(c.done)
+	})
+}
+
+func (c *HTTPConnection) Done() <-chan struct{} {
+	return c.done
+}
+
+func (c *HTTPConnection) ID() uuid.UUID {
+	return c.id
+}
+
+// Kind reports whether this is an SSE stream or a long-poll session.
+func (c *HTTPConnection) Kind() string {
+	return c.meta.Kind
+}
+
+func (c *HTTPConnection) Metadata() Metadata {
+	return c.meta
+}
+
+// SetPeer records the client's address and user agent in the metadata.
+// It must be called before the connection is shared.
+func (c *HTTPConnection) SetPeer(remoteAddr, userAgent string) {
+	c.meta.RemoteAddr = remoteAddr
+	c.meta.UserAgent = userAgent
+}
+
+func (c *HTTPConnection) Codec() codec.Codec {
+	return codec.JSON
+}
+
+func (c *HTTPConnection) SetMetrics(reg *metrics.Registry) {
+	c.metrics = reg
+}
+
+func (c *HTTPConnection) SetOnMessageHandler(handler MessageHandler) {
+	c.onMessage = handler
+}
+
+func (c *HTTPConnection) SetOnCloseHandler(handler OnCloseHandler) {
+	c.onClose = handler
+}
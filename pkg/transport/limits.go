@@ -0,0 +1,62 @@
+package transport
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/coder/websocket"
+)
+
+// metric names for limit violations detected by the transport.
+const (
+	MetricMessageTooBig = "transport.limit.message_size"
+	MetricRateExceeded  = "transport.limit.message_rate"
+)
+
+// CloseError builds an error that, when passed to Close, closes the
+// connection with the given WebSocket status code and reason.
+func CloseError(code websocket.StatusCode, format string, args ...any) error {
+	return websocket.CloseError{Code: code, Reason: fmt.Sprintf(format, args...)}
+}
+
+// PolicyViolation is a CloseError with StatusPolicyViolation (1008).
+func PolicyViolation(format string, args ...any) error {
+	return CloseError(websocket.StatusPolicyViolation, format, args...)
+}
+
+// GoingAway is a CloseError with StatusGoingAway (1001), used when the server
+// closes connections to shut down or move clients elsewhere.
+func GoingAway(format string, args ...any) error {
+	return CloseError(websocket.StatusGoingAway, format, args...)
+}
+
+// messageRateLimiter is a token bucket allowing `rate` messages per second
+// with a burst of the same size. It is only used from the read pump, so it
+// needs no locking.
+type messageRateLimiter struct {
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newMessageRateLimiter(perSecond int) *messageRateLimiter {
+	return &messageRateLimiter{
+		rate:   float64(perSecond),
+		tokens: float64(perSecond),
+		last:   time.Now(),
+	}
+}
+
+func (l *messageRateLimiter) allow(now time.Time) bool {
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.rate {
+		l.tokens = l.rate
+	}
+	l.last = now
+
+	if l.tokens < 1 {
+		return false
+	}
+	l.tokens--
+	return true
+}
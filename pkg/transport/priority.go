@@ -0,0 +1,224 @@
+package transport
+
+import (
+	"fmt"
+	"slices"
+	"sync"
+)
+
+// Priority is the outbound lane a message is queued in. The zero value is
+// PriorityNormal.
+type Priority int
+
+const (
+	// PriorityNormal is for regular application traffic such as chat messages.
+	PriorityNormal Priority = iota
+	// PrioritySystem is for small control messages (presence, typing, server
+	// notices) that must not wait behind other traffic.
+	PrioritySystem
+	// PriorityBulk is for traffic that may be delayed, or dropped when the
+	// client cannot keep up.
+	PriorityBulk
+
+	numPriorities = 3
+)
+
+// outbound queue metrics.
+const (
+	// MetricBulkDropped counts bulk messages dropped because a client fell behind.
+	MetricBulkDropped = "transport.outbound.bulk_dropped"
+	// MetricCoalesced counts queued messages superseded by a newer value.
+	MetricCoalesced = "transport.outbound.coalesced"
+)
+
+// normalPerBulk is how many normal messages are written for each bulk
+// message while both lanes have messages waiting.
+const normalPerBulk = 4
+
+func (p Priority) String() string {
+	switch p {
+	case PrioritySystem:
+		return "system"
+	case PriorityBulk:
+		return "bulk"
+	default:
+		return "normal"
+	}
+}
+
+// ParsePriority parses "system", "normal" or "bulk". An empty string is normal.
+func ParsePriority(s string) (Priority, error) {
+	switch s {
+	case "", "normal":
+		return PriorityNormal, nil
+	case "system":
+		return PrioritySystem, nil
+	case "bulk":
+		return PriorityBulk, nil
+	default:
+		return PriorityNormal, fmt.Errorf("unknown priority '%s' (want system, normal or bulk)", s)
+	}
+}
+
+// pushResult tells the caller of outbox.push what happened to the message.
+type pushResult int
+
+const (
+	pushed pushResult = iota
+	pushedDroppingBulk
+	droppedBulk
+	coalesced
+	outboxFull
+	outboxClosed
+)
+
+type outboxEntry struct {
+	message  []byte
+	key      string // coalescing key, empty if none
+	priority Priority
+}
+
+// outbox is a bounded, multi-lane outbound queue. System messages always go
+// first; normal and bulk are interleaved normalPerBulk to one. When the queue
+// is full, bulk messages are dropped to make room; a full queue without any
+// bulk to drop means the client is too slow to keep up. System messages do not
+// count against the capacity, so a client busy with normal traffic still gets
+// them, but their lane has a capacity of its own. A message pushed with a key
+// replaces the queued message with the same key, if it is still waiting.
+type outbox struct {
+	mu       sync.Mutex
+	lanes    [numPriorities][]*outboxEntry
+	keyed    map[string]*outboxEntry
+	size     int // normal and bulk messages queued
+	capacity int
+	credits  int // normal messages written since the last bulk one
+	closed   bool
+
+	// ready holds a token whenever the queue may be non-empty.
+	ready chan struct{}
+}
+
+func newOutbox(capacity int) *outbox {
+	return &outbox{
+		capacity: capacity,
+		keyed:    make(map[string]*outboxEntry),
+		ready:    make(chan struct{}, 1),
+	}
+}
+
+func (o *outbox) push(message []byte, priority Priority, key string) pushResult {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.closed {
+		return outboxClosed
+	}
+
+	result := pushed
+	if key != "" {
+		if entry, waiting := o.keyed[key]; waiting {
+			if entry.priority == priority {
+				// it keeps its place in the queue, so a steady stream of
+				// updates cannot postpone delivery forever.
+				entry.message = message
+				return coalesced
+			}
+			// the latest value decides the lane, so it moves to the back of
+			// its new one.
+			o.remove(entry)
+			result = coalesced
+		}
+	}
+
+	switch {
+	case priority == PrioritySystem:
+		// a client that lets this many control messages pile up is stalled.
+		if len(o.lanes[PrioritySystem]) >= o.capacity {
+			return outboxFull
+		}
+	case o.size >= o.capacity:
+		// the oldest bulk message makes room, as it is the most likely stale.
+		switch {
+		case len(o.lanes[PriorityBulk]) > 0:
+			o.take(PriorityBulk)
+			result = pushedDroppingBulk
+		case priority == PriorityBulk:
+			return droppedBulk
+		default:
+			return outboxFull
+		}
+	}
+	entry := &outboxEntry{message: message, key: key, priority: priority}
+	o.lanes[priority] = append(o.lanes[priority], entry)
+	if priority != PrioritySystem {
+		o.size++
+	}
+	if key != "" {
+		o.keyed[key] = entry
+	}
+
+	select {
+	case o.ready <- struct{}{}:
+	default:
+	}
+	return result
+}
+
+// pop returns the next message to write, or false if the queue is empty.
+func (o *outbox) pop() ([]byte, bool) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	var lane Priority
+	switch normal, bulk := len(o.lanes[PriorityNormal]), len(o.lanes[PriorityBulk]); {
+	case len(o.lanes[PrioritySystem]) > 0:
+		lane = PrioritySystem
+	case normal > 0 && (bulk == 0 || o.credits < normalPerBulk):
+		lane = PriorityNormal
+		o.credits++
+	case bulk > 0:
+		lane = PriorityBulk
+		o.credits = 0
+	default:
+		return nil, false
+	}
+	return o.take(lane).message, true
+}
+
+// take removes the oldest entry of lane. Must be called with o.mu held.
+func (o *outbox) take(lane Priority) *outboxEntry {
+	entry := o.lanes[lane][0]
+	o.lanes[lane][0] = nil
+	o.lanes[lane] = o.lanes[lane][1:]
+	o.forget(entry)
+	return entry
+}
+
+// remove removes a queued entry wherever it is in its lane. Must be called
+// with o.mu held.
+func (o *outbox) remove(entry *outboxEntry) {
+	lane := o.lanes[entry.priority]
+	if i := slices.Index(lane, entry); i >= 0 {
+		o.lanes[entry.priority] = slices.Delete(lane, i, i+1)
+		o.forget(entry)
+	}
+}
+
+// forget updates the size and keys for an entry leaving the queue.
+func (o *outbox) forget(entry *outboxEntry) {
+	if entry.priority != PrioritySystem {
+		o.size--
+	}
+	if entry.key != "" {
+		delete(o.keyed, entry.key)
+	}
+}
+
+// close makes further pushes fail. Queued messages are discarded.
+func (o *outbox) close() {
+	o.mu.Lock()
+	o.closed = true
+	o.lanes = [numPriorities][]*outboxEntry{}
+	o.keyed = make(map[string]*outboxEntry)
+	o.size = 0
+	o.mu.Unlock()
+}
@@ -0,0 +1,144 @@
+package transport
+
+import "testing"
+
+func drain(o *outbox) []string {
+	var out []string
+	for {
+		msg, ok := o.pop()
+		if !ok {
+			return out
+		}
+		out = append(out, string(msg))
+	}
+}
+
+func TestOutboxServesSystemFirstAndInterleavesBulk(t *testing.T) {
+	o := newOutbox(64)
+	for range 6 {
+		o.push([]byte("n"), PriorityNormal, "")
+	}
+	o.push([]byte("b1"), PriorityBulk, "")
+	o.push([]byte("b2"), PriorityBulk, "")
+	o.push([]byte("s"), PrioritySystem, "")
+
+	got := drain(o)
+	want := []string{"s", "n", "n", "n", "n", "b1", "n", "n", "b2"}
+	if len(got) != len(want) {
+		t.Fatalf("expected %v, got %v", want, got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("expected %v, got %v", want, got)
+		}
+	}
+}
+
+func TestOutboxDropsBulkWhenFull(t *testing.T) {
+	o := newOutbox(3)
+	o.push([]byte("b1"), PriorityBulk, "")
+	o.push([]byte("b2"), PriorityBulk, "")
+	o.push([]byte("n1"), PriorityNormal, "")
+
+	if r := o.push([]byte("n2"), PriorityNormal, ""); r != pushedDroppingBulk {
+		t.Errorf("expected the oldest bulk message to make room, got %v", r)
+	}
+	if r := o.push([]byte("b3"), PriorityBulk, ""); r != pushedDroppingBulk {
+		t.Errorf("expected the newer bulk message to replace the older, got %v", r)
+	}
+	if r := o.push([]byte("n3"), PriorityNormal, ""); r != pushedDroppingBulk {
+		t.Errorf("expected the last bulk message to make room, got %v", r)
+	}
+	if r := o.push([]byte("b4"), PriorityBulk, ""); r != droppedBulk {
+		t.Errorf("expected bulk to be dropped with no bulk queued, got %v", r)
+	}
+	if r := o.push([]byte("n4"), PriorityNormal, ""); r != outboxFull {
+		t.Errorf("expected a full outbox, got %v", r)
+	}
+	if r := o.push([]byte("s"), PrioritySystem, ""); r != pushed {
+		t.Errorf("system messages must not be refused for a full normal lane, got %v", r)
+	}
+
+	got := drain(o)
+	want := []string{"s", "n1", "n2", "n3"}
+	if len(got) != len(want) {
+		t.Fatalf("expected %v, got %v", want, got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("expected %v, got %v", want, got)
+		}
+	}
+}
+
+func TestOutboxCoalescesUndeliveredMessagesByKey(t *testing.T) {
+	o := newOutbox(8)
+	o.push([]byte("cursor 1"), PriorityNormal, "cursor:alice")
+	o.push([]byte("chat"), PriorityNormal, "")
+	if r := o.push([]byte("cursor 2"), PriorityNormal, "cursor:alice"); r != coalesced {
+		t.Errorf("expected the queued value to be replaced, got %v", r)
+	}
+	o.push([]byte("cursor bob"), PriorityNormal, "cursor:bob")
+
+	got := drain(o)
+	want := []string{"cursor 2", "chat", "cursor bob"}
+	if len(got) != len(want) {
+		t.Fatalf("expected %v, got %v", want, got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("expected %v, got %v", want, got)
+		}
+	}
+
+	// once delivered, a key starts afresh.
+	if r := o.push([]byte("cursor 3"), PriorityNormal, "cursor:alice"); r != pushed {
+		t.Errorf("expected a delivered key to be queued again, got %v", r)
+	}
+}
+
+func TestOutboxCapsTheSystemLane(t *testing.T) {
+	o := newOutbox(2)
+	o.push([]byte("n1"), PriorityNormal, "")
+	o.push([]byte("n2"), PriorityNormal, "")
+	for _, msg := range []string{"s1", "s2"} {
+		if r := o.push([]byte(msg), PrioritySystem, ""); r != pushed {
+			t.Fatalf("expected %s to be queued past the normal capacity, got %v", msg, r)
+		}
+	}
+	if r := o.push([]byte("s3"), PrioritySystem, ""); r != outboxFull {
+		t.Errorf("expected a full system lane to refuse, got %v", r)
+	}
+
+	o.pop()
+	if r := o.push([]byte("s3"), PrioritySystem, ""); r != pushed {
+		t.Errorf("expected room once a system message is written, got %v", r)
+	}
+}
+
+func TestOutboxMovesACoalescedKeyToItsNewLane(t *testing.T) {
+	o := newOutbox(8)
+	o.push([]byte("score 1"), PriorityBulk, "score")
+	o.push([]byte("chat"), PriorityNormal, "")
+	if r := o.push([]byte("score 2"), PrioritySystem, "score"); r != coalesced {
+		t.Errorf("expected the queued value to be replaced, got %v", r)
+	}
+	if r := o.push([]byte("score 3"), PrioritySystem, "score"); r != coalesced {
+		t.Errorf("expected the moved value to coalesce in its new lane, got %v", r)
+	}
+	o.push([]byte("typing"), PrioritySystem, "")
+
+	got := drain(o)
+	want := []string{"score 3", "typing", "chat"}
+	if len(got) != len(want) {
+		t.Fatalf("expected %v, got %v", want, got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("expected %v, got %v", want, got)
+		}
+	}
+	if o.size != 0 {
+		t.Errorf("expected an empty queue, size is %d", o.size)
+	}
+}
@@ -0,0 +1,376 @@
+package transport
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/a-essam23/go-dispatch/pkg/codec"
+	"github.com/google/uuid"
+)
+
+// SessionEvent is the reserved event sent to a client whenever a connection
+// is attached to a session, telling it the session id to resume with.
+const SessionEvent = "_session"
+
+var (
+	ErrSessionNotFound = errors.New("session not found")
+	ErrSessionOwner    = errors.New("session belongs to another user")
+	ErrSessionCodec    = errors.New("session was established with a different codec")
+	ErrReplayGap       = errors.New("missed messages are no longer buffered")
+	ErrSessionExpired  = errors.New("session expired before the client reconnected")
+)
+
+type SessionConfig struct {
+	// ReplayBuffer is how many recent outbound messages are kept for replay.
+	ReplayBuffer int
+	// GracePeriod is how long a session outlives its connection, waiting for
+	// the client to resume. Zero closes the session with its connection.
+	GracePeriod time.Duration
+}
+
+type bufferedMessage struct {
+	seq      uint64
+	msg      []byte
+	priority Priority
+	key      string // coalescing key, empty if none
+}
+
+// Session is a Conn that survives the underlying transport dropping. Every
+// outbound message carries a sequence number and is kept in a short replay
+// buffer; a client reconnecting within the grace period resumes the session
+// and receives what it missed. To the layers above, the session is a single
+// connection with a stable ID for its whole lifetime.
+type Session struct {
+	id    uuid.UUID
+	owner string
+	codec codec.Codec
+	store *SessionStore
+
+	mu     sync.Mutex
+	conn   Attachable // nil while detached
+	meta   Metadata   // of the most recently attached connection
+	seq    uint64
+	buffer []bufferedMessage // ring, oldest first once full
+	head   int
+	grace  *time.Timer
+	closed bool
+
+	onMessage MessageHandler
+	onClose   OnCloseHandler
+
+	done      chan struct{}
+	closeOnce sync.Once
+	logger    *slog.Logger
+}
+
+// SessionStore owns all live sessions so reconnecting clients can find theirs.
+type SessionStore struct {
+	config   SessionConfig
+	sessions map[uuid.UUID]*Session
+	mu       sync.RWMutex
+	logger   *slog.Logger
+}
+
+func NewSessionStore(config SessionConfig, logger *slog.Logger) *SessionStore {
+	return &SessionStore{
+		config:   config,
+		sessions: make(map[uuid.UUID]*Session),
+		logger:   logger.With(slog.String("component", "session_store")),
+	}
+}
+
+// Create starts a new session for owner on top of conn.
+func (st *SessionStore) Create(owner string, conn Attachable) *Session {
+	id := uuid.New()
+	s := &Session{
+		id:     id,
+		owner:  owner,
+		codec:  conn.Codec(),
+		store:  st,
+		buffer: make([]bufferedMessage, 0, st.config.ReplayBuffer),
+		done:   make(chan struct{}),
+		logger: st.logger.With(slog.String("sessionID", id.String())),
+	}
+	st.mu.Lock()
+	st.sessions[id] = s
+	st.mu.Unlock()
+
+	// a fresh session has nothing to replay, so attach cannot fail.
+	s.attach(conn, false, 0)
+	return s
+}
+
+// Resume moves the session id onto conn and replays every buffered message
+// after lastSeq. A session that can no longer be resumed without losing
+// messages is closed, and ErrReplayGap returned so the client starts afresh.
+func (st *SessionStore) Resume(id uuid.UUID, owner string, conn Attachable, lastSeq uint64) (*Session, error) {
+	st.mu.RLock()
+	s, ok := st.sessions[id]
+	st.mu.RUnlock()
+	if !ok {
+		return nil, ErrSessionNotFound
+	}
+	if s.owner != owner {
+		return nil, ErrSessionOwner
+	}
+	if s.codec.Name() != conn.Codec().Name() {
+		return nil, ErrSessionCodec
+	}
+
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil, ErrSessionNotFound
+	}
+	if _, ok := s.since(lastSeq); !ok {
+		s.mu.Unlock()
+		s.Close(ErrReplayGap)
+		return nil, ErrReplayGap
+	}
+	if s.grace != nil {
+		s.grace.Stop()
+		s.grace = nil
+	}
+	// the client may reconnect before the server noticed the old connection
+	// drop; swap first so the old connection's close is not seen as a detach.
+	old := s.conn
+	s.conn = nil
+	s.mu.Unlock()
+	if old != nil {
+		old.Close(errors.New("superseded by resumed connection"))
+	}
+
+	if err := s.attach(conn, true, lastSeq); err != nil {
+		s.Close(err)
+		return nil, err
+	}
+	s.logger.Info("Session resumed", slog.Uint64("lastSeq", lastSeq))
+	return s, nil
+}
+
+// Resumable reports whether owner could resume session id.
+func (st *SessionStore) Resumable(id uuid.UUID, owner string) bool {
+	st.mu.RLock()
+	defer st.mu.RUnlock()
+	s, ok := st.sessions[id]
+	return ok && s.owner == owner
+}
+
+func (st *SessionStore) remove(id uuid.UUID) {
+	st.mu.Lock()
+	delete(st.sessions, id)
+	st.mu.Unlock()
+}
+
+// attach wires conn to the session, greets the client with its session id
+// and, when resuming, replays everything after lastSeq. It holds the lock
+// throughout so no concurrent Send can slip between the replay and live traffic.
+func (s *Session) attach(conn Attachable, resumed bool, lastSeq uint64) error {
+	conn.SetOnMessageHandler(func(ctx context.Context, _ uuid.UUID, msg []byte) {
+		s.mu.Lock()
+		handler := s.onMessage
+		s.mu.Unlock()
+		if handler != nil {
+			handler(ctx, s.id, msg)
+		}
+	})
+	conn.SetOnCloseHandler(func(_ uuid.UUID, err error) {
+		s.detach(conn, err)
+	})
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var missed []bufferedMessage
+	if resumed {
+		var ok bool
+		if missed, ok = s.since(lastSeq); !ok {
+			return ErrReplayGap
+		}
+	}
+	s.conn = conn
+	s.meta = conn.Metadata()
+
+	hello, err := conn.Codec().Encode(sessionMessage(s.id, resumed, s.seq))
+	if err != nil {
+		return fmt.Errorf("failed to encode session message: %w", err)
+	}
+	conn.SendPriority(hello, PrioritySystem)
+	for _, m := range missed {
+		conn.SendCoalesced(m.msg, m.priority, m.key)
+	}
+	return nil
+}
+
+// detach is called when the underlying connection closes. The session stays
+// alive for the grace period so the client can resume it.
+func (s *Session) detach(conn Attachable, err error) {
+	s.mu.Lock()
+	if s.conn != conn || s.closed {
+		// already superseded by a resumed connection, or closing for good.
+		s.mu.Unlock()
+		return
+	}
+	s.conn = nil
+	grace := s.store.config.GracePeriod
+	if grace > 0 {
+		s.grace = time.AfterFunc(grace, func() {
+			s.Close(fmt.Errorf("%w: %v", ErrSessionExpired, err))
+		})
+	}
+	s.mu.Unlock()
+
+	if grace <= 0 {
+		s.Close(err)
+		return
+	}
+	s.logger.Info("Session detached, awaiting resume", slog.Any("reason", err), slog.Duration("grace", grace))
+}
+
+// since returns the buffered messages after lastSeq, or false if some of them
+// have already been evicted. Must be called with s.mu held.
+func (s *Session) since(lastSeq uint64) ([]bufferedMessage, bool) {
+	if lastSeq > s.seq {
+		return nil, false
+	}
+	if lastSeq == s.seq {
+		return nil, true
+	}
+	n := len(s.buffer)
+	if n == 0 || s.ordered(0).seq > lastSeq+1 {
+		return nil, false
+	}
+	missed := make([]bufferedMessage, 0, s.seq-lastSeq)
+	for i := 0; i < n; i++ {
+		if m := s.ordered(i); m.seq > lastSeq {
+			missed = append(missed, m)
+		}
+	}
+	return missed, true
+}
+
+// ordered returns the i-th oldest buffered message.
+func (s *Session) ordered(i int) bufferedMessage {
+	if len(s.buffer) < cap(s.buffer) {
+		return s.buffer[i]
+	}
+	return s.buffer[(s.head+i)%len(s.buffer)]
+}
+
+// Send stamps the message with the next sequence number, buffers it for
+// replay and forwards it to the current connection, if any.
+func (s *Session) Send(message []byte) {
+	s.SendPriority(message, PriorityNormal)
+}
+
+// SendPriority is Send in the given lane. Bulk messages the connection drops
+// leave gaps in the sequence numbers the client sees.
+func (s *Session) SendPriority(message []byte, priority Priority) {
+	s.send(message, priority, "")
+}
+
+// SendCoalesced is Send for a message that supersedes any undelivered message
+// with the same key. Superseded messages leave gaps in the sequence numbers.
+func (s *Session) SendCoalesced(message []byte, priority Priority, key string) {
+	s.send(message, priority, key)
+}
+
+func (s *Session) send(message []byte, priority Priority, key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return
+	}
+
+	s.seq++
+	stamped, err := s.codec.SetSeq(message, s.seq)
+	if err != nil {
+		s.logger.Error("Failed to sequence outbound message", slog.Any("error", err))
+		return
+	}
+	if cap(s.buffer) > 0 {
+		m := bufferedMessage{seq: s.seq, msg: stamped, priority: priority, key: key}
+		if len(s.buffer) < cap(s.buffer) {
+			s.buffer = append(s.buffer, m)
+		} else {
+			s.buffer[s.head] = m
+			s.head = (s.head + 1) % len(s.buffer)
+		}
+	}
+	// sending under the lock keeps sequence numbers in order on the wire.
+	if s.conn != nil {
+		s.conn.SendCoalesced(stamped, priority, key)
+	}
+}
+
+// Close ends the session for good, closing the current connection if any.
+func (s *Session) Close(err error) {
+	s.closeOnce.Do(func() {
+		s.mu.Lock()
+		s.closed = true
+		if s.grace != nil {
+			s.grace.Stop()
+		}
+		conn := s.conn
+		s.conn = nil
+		onClose := s.onClose
+		s.mu.Unlock()
+
+		if conn != nil {
+			conn.Close(err)
+		}
+		s.store.remove(s.id)
+		if onClose != nil {
+			onClose(s.id, err)
+		}
+		close(s.done)
+		s.logger.Info("Session closed", slog.Any("reason", err))
+	})
+}
+
+// Current returns the connection the session is attached to, or nil while detached.
+func (s *Session) Current() Attachable {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.conn
+}
+
+// Metadata describes the connection currently serving the session, or the
+// last one while detached.
+func (s *Session) Metadata() Metadata {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.meta
+}
+
+func (s *Session) Done() <-chan struct{} {
+	return s.done
+}
+
+func (s *Session) ID() uuid.UUID {
+	return s.id
+}
+
+func (s *Session) Codec() codec.Codec {
+	return s.codec
+}
+
+func (s *Session) SetOnMessageHandler(handler MessageHandler) {
+	s.mu.Lock()
+	s.onMessage = handler
+	s.mu.Unlock()
+}
+
+func (s *Session) SetOnCloseHandler(handler OnCloseHandler) {
+	s.mu.Lock()
+	s.onClose = handler
+	s.mu.Unlock()
+}
+
+func sessionMessage(id uuid.UUID, resumed bool, seq uint64) []byte {
+	return fmt.Appendf(nil, `{"event":%q,"payload":{"sessionId":%q,"resumed":%t,"seq":%d}}`, SessionEvent, id.String(), resumed, seq)
+}
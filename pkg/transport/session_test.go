@@ -0,0 +1,120 @@
+package transport_test
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/a-essam23/go-dispatch/pkg/transport"
+	"github.com/a-essam23/go-dispatch/pkg/transport/transporttest"
+	"github.com/google/uuid"
+)
+
+type envelope struct {
+	Seq   uint64 `json:"seq"`
+	Event string `json:"event"`
+}
+
+func envelopes(t *testing.T, c *transporttest.Conn) []envelope {
+	t.Helper()
+	sent := c.Sent()
+	out := make([]envelope, len(sent))
+	for i, msg := range sent {
+		if err := json.Unmarshal(msg, &out[i]); err != nil {
+			t.Fatalf("invalid message %s: %v", msg, err)
+		}
+	}
+	return out
+}
+
+func newTestSessionStore(buffer int, grace time.Duration) *transport.SessionStore {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	return transport.NewSessionStore(transport.SessionConfig{ReplayBuffer: buffer, GracePeriod: grace}, logger)
+}
+
+func TestSessionResumeReplaysMissedMessages(t *testing.T) {
+	store := newTestSessionStore(8, time.Minute)
+	first := transporttest.NewConn()
+	session := store.Create("alice", first)
+
+	session.Send([]byte(`{"event":"a"}`))
+	first.Close(errors.New("network dropped"))
+	session.Send([]byte(`{"event":"b"}`))
+	session.Send([]byte(`{"event":"c"}`))
+
+	second := transporttest.NewConn()
+	second.SetMetadata(transport.Metadata{Kind: transporttest.Kind, RemoteAddr: "10.0.0.2"})
+	resumed, err := store.Resume(session.ID(), "alice", second, 1)
+	if err != nil {
+		t.Fatalf("Resume failed: %v", err)
+	}
+	if resumed.ID() != session.ID() {
+		t.Errorf("resumed session has a different ID")
+	}
+	if resumed.Metadata().RemoteAddr != "10.0.0.2" {
+		t.Errorf("session metadata does not follow the resumed connection")
+	}
+
+	got := envelopes(t, second)
+	if len(got) != 3 || got[0].Event != transport.SessionEvent {
+		t.Fatalf("expected session event then 2 replays, got %+v", got)
+	}
+	if got[1].Seq != 2 || got[1].Event != "b" || got[2].Seq != 3 || got[2].Event != "c" {
+		t.Errorf("unexpected replay: %+v", got[1:])
+	}
+
+	select {
+	case <-session.Done():
+		t.Error("session closed although it was resumed")
+	default:
+	}
+}
+
+func TestSessionResumeRejectsGapAndOtherOwner(t *testing.T) {
+	store := newTestSessionStore(2, time.Minute)
+	session := store.Create("alice", transporttest.NewConn())
+	for range 5 {
+		session.Send([]byte(`{"event":"x"}`))
+	}
+
+	if _, err := store.Resume(session.ID(), "mallory", transporttest.NewConn(), 5); !errors.Is(err, transport.ErrSessionOwner) {
+		t.Errorf("expected ErrSessionOwner, got %v", err)
+	}
+	if _, err := store.Resume(session.ID(), "alice", transporttest.NewConn(), 1); !errors.Is(err, transport.ErrReplayGap) {
+		t.Errorf("expected ErrReplayGap, got %v", err)
+	}
+	select {
+	case <-session.Done():
+	case <-time.After(time.Second):
+		t.Error("session with a replay gap was not closed")
+	}
+}
+
+func TestSessionExpiresAfterGracePeriod(t *testing.T) {
+	store := newTestSessionStore(8, 20*time.Millisecond)
+	conn := transporttest.NewConn()
+	session := store.Create("alice", conn)
+
+	var closeErr error
+	closed := make(chan struct{})
+	session.SetOnCloseHandler(func(_ uuid.UUID, err error) {
+		closeErr = err
+		close(closed)
+	})
+	conn.Close(errors.New("network dropped"))
+
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("session did not expire")
+	}
+	if !errors.Is(closeErr, transport.ErrSessionExpired) {
+		t.Errorf("expected ErrSessionExpired, got %v", closeErr)
+	}
+	if store.Resumable(session.ID(), "alice") {
+		t.Error("expired session is still resumable")
+	}
+}
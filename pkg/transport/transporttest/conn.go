@@ -0,0 +1,176 @@
+// Package transporttest provides an in-memory transport.Conn for tests, so
+// state, actions and sessions can be exercised without real sockets.
+package transporttest
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/a-essam23/go-dispatch/pkg/codec"
+	"github.com/a-essam23/go-dispatch/pkg/transport"
+	"github.com/google/uuid"
+)
+
+// Kind is the Metadata kind reported by fake connections.
+const Kind = "fake"
+
+// Conn is a fake connection that records every message it is sent.
+type Conn struct {
+	id    uuid.UUID
+	meta  transport.Metadata
+	codec codec.Codec
+
+	mu       sync.Mutex
+	sent     [][]byte
+	lanes    []transport.Priority
+	keys     []string
+	closeErr error
+	closed   bool
+
+	onMessage transport.MessageHandler
+	onClose   transport.OnCloseHandler
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+var _ transport.Attachable = (*Conn)(nil)
+
+// NewConn returns an open fake connection speaking JSON.
+func NewConn() *Conn {
+	return &Conn{
+		id:    uuid.New(),
+		meta:  transport.Metadata{Kind: Kind, ConnectedAt: time.Now()},
+		codec: codec.JSON,
+		done:  make(chan struct{}),
+	}
+}
+
+// SetCodec changes the codec the connection reports. It must be called before
+// the connection is shared.
+func (c *Conn) SetCodec(cd codec.Codec) {
+	c.codec = cd
+}
+
+// SetMetadata replaces the metadata the connection reports. It must be called
+// before the connection is shared.
+func (c *Conn) SetMetadata(meta transport.Metadata) {
+	c.meta = meta
+}
+
+func (c *Conn) ID() uuid.UUID {
+	return c.id
+}
+
+func (c *Conn) Codec() codec.Codec {
+	return c.codec
+}
+
+func (c *Conn) Metadata() transport.Metadata {
+	return c.meta
+}
+
+func (c *Conn) Done() <-chan struct{} {
+	return c.done
+}
+
+// Send records the message. Messages sent after Close are dropped, as a real
+// transport would.
+func (c *Conn) Send(message []byte) {
+	c.SendPriority(message, transport.PriorityNormal)
+}
+
+// SendPriority records the message along with its priority.
+func (c *Conn) SendPriority(message []byte, priority transport.Priority) {
+	c.SendCoalesced(message, priority, "")
+}
+
+// SendCoalesced records the message along with its priority and key. Nothing
+// is superseded: every message counts as delivered the moment it is sent.
+func (c *Conn) SendCoalesced(message []byte, priority transport.Priority, key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return
+	}
+	c.sent = append(c.sent, message)
+	c.lanes = append(c.lanes, priority)
+	c.keys = append(c.keys, key)
+}
+
+func (c *Conn) Close(err error) {
+	c.closeOnce.Do(func() {
+		c.mu.Lock()
+		c.closed = true
+		c.closeErr = err
+		onClose := c.onClose
+		c.mu.Unlock()
+
+		if onClose != nil {
+			onClose(c.id, err)
+		}
+		close(c.done)
+	})
+}
+
+// Deliver simulates the client sending message, invoking the message handler.
+func (c *Conn) Deliver(ctx context.Context, message []byte) {
+	c.mu.Lock()
+	handler := c.onMessage
+	c.mu.Unlock()
+	if handler != nil {
+		handler(ctx, c.id, message)
+	}
+}
+
+// Sent returns a copy of every message sent so far, oldest first.
+func (c *Conn) Sent() [][]byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([][]byte(nil), c.sent...)
+}
+
+// Priorities returns the priority of every message sent so far, in the same
+// order as Sent.
+func (c *Conn) Priorities() []transport.Priority {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]transport.Priority(nil), c.lanes...)
+}
+
+// Keys returns the coalescing key of every message sent so far, in the same
+// order as Sent. Messages sent without one have an empty key.
+func (c *Conn) Keys() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]string(nil), c.keys...)
+}
+
+// Reset forgets the messages sent so far.
+func (c *Conn) Reset() {
+	c.mu.Lock()
+	c.sent = nil
+	c.lanes = nil
+	c.keys = nil
+	c.mu.Unlock()
+}
+
+// Closed reports whether the connection was closed, and with which error.
+func (c *Conn) Closed() (bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.closed, c.closeErr
+}
+
+func (c *Conn) SetOnMessageHandler(handler transport.MessageHandler) {
+	c.mu.Lock()
+	c.onMessage = handler
+	c.mu.Unlock()
+}
+
+func (c *Conn) SetOnCloseHandler(handler transport.OnCloseHandler) {
+	c.mu.Lock()
+	c.onClose = handler
+	c.mu.Unlock()
+}